@@ -0,0 +1,113 @@
+package gitpacklib
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// trashCommand is the command an AdminClient runs over SSH to list and
+// restore deleted refs.
+const trashCommand = "gitpacklib-trash"
+
+// gcCommand is the command an AdminClient runs over SSH to collect garbage
+// in a repository.
+const gcCommand = "gitpacklib-gc"
+
+// setupTrashCommand parses a trash command and checks that the client may run
+// it, returning a function that runs it over ch and returns its exit
+// status.
+func (session *ClientSession) setupTrashCommand(ctx context.Context, ch ssh.Channel, execCmd string) (func() uint32, error) {
+	// the repository is quoted like it is for git commands, but does not
+	// contain spaces
+	args := strings.Fields(strings.TrimPrefix(execCmd, trashCommand+" "))
+	if len(args) < 2 {
+		return nil, errors.New("Expected a repository and a subcommand")
+	}
+	repoPath := strings.Trim(args[0], "'")
+
+	admin, ok := session.client.(AdminClient)
+	if !ok || !admin.IsRepositoryAdmin(repoPath) {
+		return nil, errors.New("Client is not an administrator of " + repoPath)
+	}
+
+	store, refs, err := session.openRepository(repoPath)
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case args[1] == "list" && len(args) == 2:
+		return func() uint32 {
+			entries, err := ListTrash(ctx, store)
+			if err != nil {
+				fmt.Fprintln(ch.Stderr(), "Error listing trash:", err.Error())
+				return 1
+			}
+			for _, entry := range entries {
+				fmt.Fprintf(ch, "%s %s %s deleted by %s at %s, expires %s\n",
+					entry.ID, entry.Hash, entry.Name, entry.DeletedBy,
+					entry.DeletedAt.Format(time.RFC3339), entry.ExpiresAt.Format(time.RFC3339))
+			}
+			return 0
+		}, nil
+
+	case args[1] == "restore" && len(args) == 3:
+		return func() uint32 {
+			entry, err := RestoreTrashedRef(ctx, store, refs, args[2], PusherIdentity(session.pubKey))
+			if err != nil {
+				fmt.Fprintln(ch.Stderr(), "Error restoring ref:", err.Error())
+				return 1
+			}
+			fmt.Fprintf(ch, "Restored %s to %s\n", entry.Name, entry.Hash)
+			return 0
+		}, nil
+	}
+
+	return nil, errors.New("Unknown trash subcommand: " + strings.Join(args[1:], " "))
+}
+
+// setupGCCommand parses a gc command and checks that the client may run it,
+// returning a function that collects garbage with the server's GC options,
+// repacking if asked to, and reports what was done over ch.
+func (session *ClientSession) setupGCCommand(ctx context.Context, ch ssh.Channel, execCmd string) (func() uint32, error) {
+	args := strings.Fields(strings.TrimPrefix(execCmd, gcCommand+" "))
+	if len(args) < 1 || len(args) > 2 || len(args) == 2 && args[1] != "--repack" {
+		return nil, errors.New("Expected a repository and optionally --repack")
+	}
+	repoPath := strings.Trim(args[0], "'")
+
+	admin, ok := session.client.(AdminClient)
+	if !ok || !admin.IsRepositoryAdmin(repoPath) {
+		return nil, errors.New("Client is not an administrator of " + repoPath)
+	}
+
+	store, refs, err := session.openRepository(repoPath)
+	if err != nil {
+		return nil, err
+	}
+
+	opts := &GCOptions{}
+	if session.conf.GC != nil {
+		*opts = *session.conf.GC
+	}
+	if len(args) == 2 {
+		opts.Repack = true
+	}
+
+	return func() uint32 {
+		stats, err := NewRepository(store, refs).CollectGarbage(ctx, opts)
+		if err != nil {
+			fmt.Fprintln(ch.Stderr(), "Error collecting garbage:", err.Error())
+			return 1
+		}
+		fmt.Fprintf(ch, "%d reachable objects, %d packed, %d quarantined, %d pruned\n",
+			stats.Reachable, stats.Packed, stats.Quarantined, stats.Pruned)
+		fmt.Fprintf(ch, "Removed %d loose objects and %d packs\n", stats.LooseRemoved, stats.PacksRemoved)
+		return 0
+	}, nil
+}
@@ -0,0 +1,393 @@
+package gitpacklib
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"strings"
+)
+
+// ApplyRequest describes mailbox patches to be committed onto a branch by
+// ApplyPatches.
+type ApplyRequest struct {
+	// Ref is the ref to commit to, such as "refs/heads/main". Symbolic refs
+	// such as HEAD are followed.
+	Ref string
+
+	// Parent is the commit the patches are applied on top of, and the commit
+	// Ref must still point at for it to be updated. If empty, the patches
+	// are applied on whatever Ref points at, or make a root commit if it
+	// does not exist.
+	Parent string
+
+	Patches []*MailPatch
+
+	// Committer of the new commits, which keep the author and message of
+	// each patch. A zero When is filled in with the current time.
+	Committer *Signature
+
+	// Identity is recorded as who updated the ref in its reflog. If empty,
+	// the committer's name and email are used.
+	Identity string
+}
+
+// ApplyPatches applies each of req.Patches in turn, making a commit for each,
+// and moves req.Ref to the last of them, like git am. It returns the shas of
+// the new commits.
+//
+// If a patch does not apply, nothing is changed and the error says which
+// patch failed and why. The ref is updated with a compare-and-swap, as by
+// CreateCommit.
+func (repo *Repository) ApplyPatches(ctx context.Context, req *ApplyRequest) ([]string, error) {
+	if req.Committer == nil {
+		return nil, errors.New("Applied patches need a committer")
+	}
+	if len(req.Patches) == 0 {
+		return nil, errors.New("No patches to apply")
+	}
+
+	ref, err := repo.resolveCommitRef(ctx, req.Ref)
+	if err != nil {
+		return nil, err
+	}
+	parent := req.Parent
+	if parent == "" {
+		parent = ref.Hash
+	}
+
+	head, tree := parent, ""
+	if head != "" {
+		commit, err := repo.ReadCommit(ctx, head)
+		if err != nil {
+			return nil, err
+		}
+		tree = commit.Tree
+	}
+
+	var commits []string
+	for n, patch := range req.Patches {
+		failed := func(err error) error {
+			return errors.New("Patch " + strconv.Itoa(n+1) + " (" + messageSubject(patch.Message) + ") failed: " + err.Error())
+		}
+		if len(patch.Files) == 0 {
+			return nil, failed(errors.New("Patch is empty"))
+		}
+		tree, err = repo.ApplyPatch(ctx, tree, patch.Files)
+		if err != nil {
+			return nil, failed(err)
+		}
+
+		var parents []string
+		if head != "" {
+			parents = []string{head}
+		}
+		head, _, err = repo.writeCommit(ctx, &commitDetails{
+			tree:      tree,
+			parents:   parents,
+			author:    patch.Author,
+			committer: req.Committer,
+			message:   patch.Message,
+		})
+		if err != nil {
+			return nil, failed(err)
+		}
+		commits = append(commits, head)
+	}
+
+	identity := req.Identity
+	if identity == "" {
+		identity = signatureIdentity(req.Committer)
+	}
+	last := req.Patches[len(req.Patches)-1]
+	err = repo.moveRef(ctx, ref.Name, parent, head, identity, "am: "+messageSubject(last.Message))
+	if err != nil {
+		return nil, err
+	}
+	return commits, nil
+}
+
+// ApplyPatch applies patches, such as those parsed by ParsePatch, to the tree
+// with the given sha and stores the result, returning the sha of the new
+// tree. Like git apply, each hunk must match the file exactly, though it may
+// be found away from the lines it names, and if any of them does not the
+// whole patch fails.
+func (repo *Repository) ApplyPatch(ctx context.Context, tree string, patches []*FilePatch) (string, error) {
+	applier := &patchApplier{repo: repo, tree: tree, files: map[string]*patchedFile{}, existed: map[string]bool{}}
+	for _, patch := range patches {
+		if err := applier.apply(ctx, patch); err != nil {
+			return "", err
+		}
+	}
+
+	var changes []FileChange
+	for _, path := range applier.paths {
+		file := applier.files[path]
+		switch {
+		case file == nil:
+			if applier.existed[path] {
+				changes = append(changes, FileChange{Path: path, Delete: true})
+			}
+		case file.mode == ModeSubmodule:
+			sha := strings.TrimSuffix(strings.TrimPrefix(string(file.data), "Subproject commit "), "\n")
+			if !isObjectSha(sha) {
+				return "", errors.New("Invalid submodule commit for " + path)
+			}
+			changes = append(changes, FileChange{Path: path, Hash: sha, Mode: file.mode})
+		default:
+			changes = append(changes, FileChange{Path: path, Data: file.data, Mode: file.mode})
+		}
+	}
+
+	sha, err := repo.editTree(ctx, tree, "", changes)
+	if err != nil {
+		return "", err
+	}
+	if sha == "" {
+		return repo.WriteObject(ctx, &Tree{})
+	}
+	return sha, nil
+}
+
+// patchedFile is the content of a file as patches are applied to it.
+type patchedFile struct {
+	mode uint32
+	data []byte
+}
+
+// patchApplier tracks the files changed by patches, so that later patches
+// see the changes of earlier ones to the same path.
+type patchApplier struct {
+	repo *Repository
+	tree string
+
+	// files holds the current content of each path in paths, or nil if it
+	// does not exist, and existed which of them are in the tree
+	files   map[string]*patchedFile
+	existed map[string]bool
+	paths   []string
+}
+
+// file returns the current content of path, or nil if it does not exist.
+func (applier *patchApplier) file(ctx context.Context, path string) (*patchedFile, error) {
+	if file, ok := applier.files[path]; ok {
+		return file, nil
+	}
+	applier.paths = append(applier.paths, path)
+	applier.files[path] = nil
+	if applier.tree == "" {
+		return nil, nil
+	}
+
+	entry, err := applier.repo.ReadTreeEntry(ctx, applier.tree, path)
+	if err == ErrPathNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if entry.IsTree() {
+		return nil, errors.New("Path " + path + " is a directory")
+	}
+	data, err := applier.repo.readDiffContent(ctx, entry.Hash, entry.Mode)
+	if err != nil {
+		return nil, err
+	}
+
+	mode := entry.Mode
+	if mode == modeGroupWritable {
+		mode = ModeBlob
+	}
+	file := &patchedFile{mode: mode, data: data}
+	applier.files[path] = file
+	applier.existed[path] = true
+	return file, nil
+}
+
+func (applier *patchApplier) apply(ctx context.Context, patch *FilePatch) error {
+	var old *patchedFile
+	if patch.Type != ChangeAdded {
+		var err error
+		old, err = applier.file(ctx, patch.OldPath)
+		if err != nil {
+			return err
+		}
+		if old == nil {
+			return errors.New("Patch does not apply to " + patch.OldPath + ": " + ErrPathNotFound.Error())
+		}
+	}
+	if patch.Type == ChangeAdded || patch.Type == ChangeRenamed && patch.NewPath != patch.OldPath {
+		existing, err := applier.file(ctx, patch.NewPath)
+		if err != nil {
+			return err
+		}
+		if existing != nil {
+			return errors.New("Patch does not apply to " + patch.NewPath + ": it already exists")
+		}
+	}
+
+	var data []byte
+	var mode uint32
+	if old != nil {
+		data, mode = old.data, old.mode
+	}
+
+	var err error
+	if patch.Binary {
+		data, err = applier.applyBinary(ctx, data, patch)
+	} else {
+		data, err = applyHunks(data, patch.Hunks)
+	}
+	if err != nil {
+		return errors.New("Patch does not apply to " + patch.Path() + ": " + err.Error())
+	}
+
+	if patch.Type == ChangeDeleted {
+		if len(data) > 0 {
+			return errors.New("Patch does not apply to " + patch.OldPath + ": it deletes only part of the file")
+		}
+		applier.files[patch.OldPath] = nil
+		return nil
+	}
+
+	if patch.NewMode != 0 {
+		mode = patch.NewMode
+	}
+	if mode == 0 {
+		mode = ModeBlob
+	}
+	if patch.OldPath != "" {
+		applier.files[patch.OldPath] = nil
+	}
+	applier.files[patch.NewPath] = &patchedFile{mode: mode, data: data}
+	return nil
+}
+
+// applyBinary applies a binary patch to data. A patch without its content,
+// which git diff writes unless asked for a binary patch, can only be applied
+// if the patch names the whole sha of an object already in the repository.
+func (applier *patchApplier) applyBinary(ctx context.Context, data []byte, patch *FilePatch) ([]byte, error) {
+	if patch.OldHash != "" && !strings.HasPrefix(HashObject(BlobObject, data), patch.OldHash) {
+		return nil, errors.New("the binary file has changed")
+	}
+
+	var result []byte
+	switch {
+	case patch.binary == nil && patch.Type == ChangeDeleted:
+		return nil, nil
+	case patch.binary == nil:
+		if !isObjectSha(patch.NewHash) {
+			return nil, errors.New("the binary patch has no content")
+		}
+		blob, err := applier.repo.ReadBlob(ctx, patch.NewHash)
+		if err != nil {
+			return nil, errors.New("the binary patch has no content")
+		}
+		return blob.Data, nil
+	case patch.binary.delta:
+		var err error
+		result, err = applyDelta(data, patch.binary.data)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		result = patch.binary.data
+	}
+
+	if patch.NewHash != "" && !strings.HasPrefix(HashObject(BlobObject, result), patch.NewHash) {
+		return nil, errors.New("the binary patch gives the wrong content")
+	}
+	return result, nil
+}
+
+// applyHunks applies hunks to data in turn. Each hunk is looked for where it
+// says it goes, then a line after, a line before, two lines after and so on,
+// as git apply does. A hunk at the start of the file, or without context
+// after it, must match at the start or end of the file.
+func applyHunks(data []byte, hunks []*Hunk) ([]byte, error) {
+	lines := splitLines(data)
+	for n, hunk := range hunks {
+		var preimage, postimage []string
+		for _, line := range hunk.Lines {
+			if line.Op != '+' {
+				preimage = append(preimage, line.Text)
+			}
+			if line.Op != '-' {
+				postimage = append(postimage, line.Text)
+			}
+		}
+
+		matchBeginning := hunk.OldStart <= 1
+		matchEnd := len(hunk.Lines) == 0 || hunk.Lines[len(hunk.Lines)-1].Op != ' '
+		pos := hunk.NewStart - 1
+		if pos < 0 {
+			pos = 0
+		}
+		pos = findHunk(lines, preimage, pos, matchBeginning, matchEnd)
+		if pos < 0 {
+			return nil, errors.New("hunk " + strconv.Itoa(n+1) + " does not match")
+		}
+
+		patched := append([]string{}, lines[:pos]...)
+		patched = append(patched, postimage...)
+		lines = append(patched, lines[pos+len(preimage):]...)
+	}
+	return []byte(strings.Join(lines, "")), nil
+}
+
+// findHunk returns where preimage is found in lines, searching outwards from
+// pos, or -1 if it is not.
+func findHunk(lines []string, preimage []string, pos int, matchBeginning bool, matchEnd bool) int {
+	if len(preimage) > len(lines) {
+		return -1
+	}
+	if pos > len(lines) {
+		pos = len(lines)
+	}
+	if matchBeginning {
+		pos = 0
+	} else if matchEnd {
+		pos = len(lines) - len(preimage)
+	}
+
+	matches := func(at int) bool {
+		if at+len(preimage) > len(lines) {
+			return false
+		}
+		if matchBeginning && at != 0 || matchEnd && at+len(preimage) != len(lines) {
+			return false
+		}
+		if len(preimage) == 0 {
+			return true
+		}
+
+		// git compares the bytes of the lines, so a last line without a
+		// newline matches the start of one with a newline, though the
+		// whole line is replaced
+		last := len(preimage) - 1
+		if !equalStrings(lines[at:at+last], preimage[:last]) {
+			return false
+		}
+		return lines[at+last] == preimage[last] ||
+			!matchEnd && lines[at+last] == preimage[last]+"\n"
+	}
+
+	backwards, forwards := pos, pos
+	if matches(pos) {
+		return pos
+	}
+	for backwards > 0 || forwards < len(lines) {
+		if forwards < len(lines) {
+			forwards++
+			if matches(forwards) {
+				return forwards
+			}
+		}
+		if backwards > 0 {
+			backwards--
+			if matches(backwards) {
+				return backwards
+			}
+		}
+	}
+	return -1
+}
@@ -0,0 +1,75 @@
+package gitpacklib
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestApplyPatchesMatchesGit(t *testing.T) {
+	ctx := context.Background()
+	dir := newGitRepository(t)
+	writeFiles(t, dir, map[string][]byte{
+		"text.txt":    numberedLines(40, nil),
+		"nonl":        []byte("no newline"),
+		"mode.sh":     []byte("echo hi\n"),
+		"deleted.txt": []byte("gone\n"),
+		"movable":     numberedLines(30, nil),
+	})
+	base := gitCommit(t, dir, "base")
+
+	writeFiles(t, dir, map[string][]byte{
+		"text.txt":    numberedLines(40, map[int]string{3: "three", 35: "thirty-five"}),
+		"nonl":        []byte("no newline either"),
+		"deleted.txt": nil,
+		"added/file":  []byte("new\n"),
+	})
+	gitCommit(t, dir, "Change text and files\n\nWith a body.")
+	writeFiles(t, dir, map[string][]byte{
+		"movable": nil,
+		"moved":   numberedLines(30, map[int]string{15: "fifteen"}),
+	})
+	if err := os.Chmod(filepath.Join(dir, "mode.sh"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	gitCommit(t, dir, "Rename and change mode")
+	want := strings.Fields(string(runGit(t, dir, "rev-list", "--reverse", base+"..HEAD")))
+
+	patches, err := ParseMailbox(runGit(t, dir, "format-patch", "-M", "--stdout", base+"..HEAD"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	repo := newTestRepository(t)
+	importGitObjects(t, repo, dir)
+	if err := repo.RefStore().Update(ctx, []*RefUpdate{{Name: "refs/heads/main", NewHash: base}}); err != nil {
+		t.Fatal(err)
+	}
+
+	// with the same committer, the commits are exactly those git made
+	committer := &Signature{Name: "C O Mitter", Email: "committer@example.com", When: time.Unix(1700000000, 0).UTC()}
+	commits, err := repo.ApplyPatches(ctx, &ApplyRequest{Ref: "refs/heads/main", Patches: patches, Committer: committer})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(commits, " ") != strings.Join(want, " ") {
+		t.Errorf("Applied commits are %v, git's are %v", commits, want)
+	}
+	head, err := repo.ResolveRef(ctx, "refs/heads/main")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if head != want[len(want)-1] {
+		t.Errorf("Ref was moved to %s, want %s", head, want[len(want)-1])
+	}
+
+	// applied again the first patch no longer matches, and nothing changes
+	if _, err := repo.ApplyPatches(ctx, &ApplyRequest{Ref: "refs/heads/main", Patches: patches, Committer: committer}); err == nil {
+		t.Error("Patches applied twice")
+	}
+	if after, _ := repo.ResolveRef(ctx, "refs/heads/main"); after != head {
+		t.Errorf("Failed patches moved the ref to %s", after)
+	}
+}
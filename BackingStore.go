@@ -1,9 +1,37 @@
 package gitpacklib
 
+import (
+	"context"
+)
+
+// BackingStore is the storage for a single repository.
+//
+// Lock holds the store exclusively and RLock holds it shared with other
+// readers. LockKey holds a single key exclusively, and is used together with
+// RLock so that, for example, pushes to different refs proceed concurrently
+// while still excluding an operation that holds the whole store. All of them
+// block until the lock is held or ctx is done, in which case ctx.Err() is
+// returned so a disconnected client or server shutdown stops waiting.
+//
+// Get, Set, Delete and List may be called without holding any lock, for
+// example to write content-addressed objects, so Set must replace a value
+// atomically such that a concurrent Get never sees a partial write. The locks
+// guard values that are read, modified and written back, such as refs.
+//
+// Delete does not fail if the key does not exist. List returns the names of
+// all keys starting with prefix, in sorted order.
 type BackingStore interface {
-	Lock()
+	Lock(ctx context.Context) error
 	Unlock()
 
-	Set(name string, value []byte) error
-	Get(name string) ([]byte, error)
+	RLock(ctx context.Context) error
+	RUnlock()
+
+	LockKey(ctx context.Context, name string) error
+	UnlockKey(name string)
+
+	Set(ctx context.Context, name string, value []byte) error
+	Get(ctx context.Context, name string) ([]byte, error)
+	Delete(ctx context.Context, name string) error
+	List(ctx context.Context, prefix string) ([]string, error)
 }
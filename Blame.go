@@ -0,0 +1,255 @@
+package gitpacklib
+
+import (
+	"context"
+	"errors"
+)
+
+type BlameOptions struct {
+	// FollowRenames keeps blaming lines past the commit that renamed the
+	// file, as git blame does.
+	FollowRenames bool
+}
+
+// BlameLine says where a line of a file came from.
+type BlameLine struct {
+	// Line is the 1-based number of the line in the blamed file.
+	Line int
+	Text string
+
+	// Commit is the commit that added the line, and Author its author.
+	// Path and OrigLine are the file and 1-based line number it was added
+	// as, which differ from the blamed file if it has since been renamed
+	// or had lines added above it.
+	Commit   string
+	Author   *Signature
+	Path     string
+	OrigLine int
+}
+
+// blameOrigin is a version of the file, as path in commit, along with the
+// lines of the blamed file that are still thought to come from it.
+type blameOrigin struct {
+	commit  string
+	path    string
+	blob    string
+	when    int64
+	order   int
+	suspect []blameSuspect
+}
+
+// blameSuspect is a line of the blamed file, along with the 0-based number
+// of the line in the version of the file being looked at.
+type blameSuspect struct {
+	final int
+	line  int
+}
+
+// Blame returns, for each line of the file at path in commit, the commit
+// that added it.
+//
+// Starting from commit, lines that a parent has unchanged are passed on to
+// that parent, with the first parent tried first for merges, until each
+// line reaches the commit that changed it. Lines moved within the file or
+// copied from another, which git blame -M and -C look for, are blamed on the
+// commit that moved them.
+func (repo *Repository) Blame(ctx context.Context, commit string, path string, opts *BlameOptions) ([]*BlameLine, error) {
+	followRenames := opts != nil && opts.FollowRenames
+
+	start, err := repo.ReadCommit(ctx, commit)
+	if err != nil {
+		return nil, err
+	}
+	entry, err := repo.ReadTreeEntry(ctx, start.Tree, path)
+	if err != nil {
+		return nil, err
+	}
+	if entry.IsTree() {
+		return nil, errors.New("Can not blame " + path + ": it is a directory")
+	}
+
+	blobLines := map[string][]string{}
+	readLines := func(sha string) ([]string, error) {
+		if lines, ok := blobLines[sha]; ok {
+			return lines, nil
+		}
+		_, data, err := repo.ReadRawObject(ctx, sha)
+		if err != nil {
+			return nil, err
+		}
+		blobLines[sha] = splitLines(data)
+		return blobLines[sha], nil
+	}
+
+	finalLines, err := readLines(entry.Hash)
+	if err != nil {
+		return nil, err
+	}
+	result := make([]*BlameLine, len(finalLines))
+	if len(finalLines) == 0 {
+		return result, nil
+	}
+
+	commits := map[string]*Commit{commit: start}
+	readCommit := func(sha string) (*Commit, error) {
+		if c, ok := commits[sha]; ok {
+			return c, nil
+		}
+		c, err := repo.ReadCommit(ctx, sha)
+		if err == nil {
+			commits[sha] = c
+		}
+		return c, err
+	}
+
+	// origins still to be looked at, keyed by commit and path
+	pending := map[string]*blameOrigin{}
+	order := 0
+	addSuspects := func(commitSha string, path string, blob string, suspects []blameSuspect) error {
+		key := commitSha + "\x00" + path
+		origin := pending[key]
+		if origin == nil {
+			c, err := readCommit(commitSha)
+			if err != nil {
+				return err
+			}
+			order++
+			origin = &blameOrigin{commit: commitSha, path: path, blob: blob, when: c.Committer.When.Unix(), order: order}
+			pending[key] = origin
+		}
+		origin.suspect = append(origin.suspect, suspects...)
+		return nil
+	}
+
+	suspects := make([]blameSuspect, len(finalLines))
+	for i := range suspects {
+		suspects[i] = blameSuspect{i, i}
+	}
+	if err := addSuspects(commit, path, entry.Hash, suspects); err != nil {
+		return nil, err
+	}
+
+	for len(pending) > 0 {
+		// like git, look at the most recently committed version next, so
+		// that lines from every child have arrived before it is split up
+		var origin *blameOrigin
+		var key string
+		for k, o := range pending {
+			if origin == nil || o.when > origin.when || (o.when == origin.when && o.order < origin.order) {
+				origin, key = o, k
+			}
+		}
+		delete(pending, key)
+
+		c, err := readCommit(origin.commit)
+		if err != nil {
+			return nil, err
+		}
+
+		parents := make([]*TreeEntry, len(c.Parents))
+		parentPaths := make([]string, len(c.Parents))
+		for i, parent := range c.Parents {
+			parentPaths[i], parents[i], err = repo.blameParentPath(ctx, c, parent, origin.path, followRenames)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		remaining := origin.suspect
+
+		// a parent with the same content takes the blame for everything
+		for i, parent := range parents {
+			if parent != nil && parent.Hash == origin.blob {
+				if err := addSuspects(c.Parents[i], parentPaths[i], parent.Hash, remaining); err != nil {
+					return nil, err
+				}
+				remaining = nil
+				break
+			}
+		}
+
+		for i, parent := range parents {
+			if len(remaining) == 0 {
+				break
+			}
+			if parent == nil || parent.IsTree() {
+				continue
+			}
+
+			oldLines, err := readLines(parent.Hash)
+			if err != nil {
+				return nil, err
+			}
+			newLines, err := readLines(origin.blob)
+			if err != nil {
+				return nil, err
+			}
+
+			unchanged := make(map[int]int)
+			for _, edit := range diffLines(oldLines, newLines) {
+				if edit.op == diffEqual {
+					unchanged[edit.newLine] = edit.oldLine
+				}
+			}
+
+			var passed, kept []blameSuspect
+			for _, suspect := range remaining {
+				if line, ok := unchanged[suspect.line]; ok {
+					passed = append(passed, blameSuspect{suspect.final, line})
+				} else {
+					kept = append(kept, suspect)
+				}
+			}
+			if len(passed) > 0 {
+				if err := addSuspects(c.Parents[i], parentPaths[i], parent.Hash, passed); err != nil {
+					return nil, err
+				}
+			}
+			remaining = kept
+		}
+
+		for _, suspect := range remaining {
+			result[suspect.final] = &BlameLine{
+				Line:     suspect.final + 1,
+				Text:     finalLines[suspect.final],
+				Commit:   origin.commit,
+				Author:   c.Author,
+				Path:     origin.path,
+				OrigLine: suspect.line + 1,
+			}
+		}
+	}
+
+	return result, nil
+}
+
+// blameParentPath finds the file in parent that path in commit came from,
+// returning a nil entry if there is none.
+func (repo *Repository) blameParentPath(ctx context.Context, commit *Commit, parent string, path string, followRenames bool) (string, *TreeEntry, error) {
+	parentCommit, err := repo.ReadCommit(ctx, parent)
+	if err != nil {
+		return "", nil, err
+	}
+
+	entry, err := repo.ReadTreeEntry(ctx, parentCommit.Tree, path)
+	if err == nil {
+		return path, entry, nil
+	}
+	if err != ErrPathNotFound {
+		return "", nil, err
+	}
+	if !followRenames {
+		return "", nil, nil
+	}
+
+	changes, err := repo.DiffTrees(ctx, parentCommit.Tree, commit.Tree, &DiffOptions{DetectRenames: true})
+	if err != nil {
+		return "", nil, err
+	}
+	for _, change := range changes {
+		if change.Type == ChangeRenamed && change.NewPath == path {
+			return change.OldPath, &TreeEntry{Mode: change.OldMode, Name: change.OldPath, Hash: change.OldHash}, nil
+		}
+	}
+	return "", nil, nil
+}
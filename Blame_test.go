@@ -0,0 +1,111 @@
+package gitpacklib
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// gitBlame runs git blame with args and returns what it says of each line:
+// the commit, the path and line number in that commit, and the author.
+func gitBlame(t *testing.T, dir string, args ...string) []string {
+	var lines []string
+	var current []string
+	author := ""
+	out := string(runGit(t, dir, append([]string{"blame", "--line-porcelain"}, args...)...))
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Fields(line)
+		switch {
+		case strings.HasPrefix(line, "\t"):
+			lines = append(lines, strings.Join(append(current, author), " "))
+		case len(fields) >= 3 && isObjectSha(fields[0]):
+			current = fields[:2]
+		case strings.HasPrefix(line, "author "):
+			author = strings.TrimPrefix(line, "author ")
+		case strings.HasPrefix(line, "filename "):
+			current = []string{current[0], strings.TrimPrefix(line, "filename "), current[1]}
+		}
+	}
+	return lines
+}
+
+func TestBlameMatchesGit(t *testing.T) {
+	ctx := context.Background()
+	dir := newGitRepository(t)
+	now := 1700000000
+	commits := map[string]string{}
+	commit := func(name string, files map[string][]byte) {
+		now += 100
+		writeFiles(t, dir, files)
+		commits[name] = gitCommitAt(t, dir, name, now)
+	}
+	lines := func(replace map[int]string) []byte {
+		return numberedLines(30, replace)
+	}
+
+	commit("c1", map[string][]byte{"src/main.go": lines(nil), "other.txt": []byte("one\ntwo\nthree\n")})
+	commit("c2", map[string][]byte{"src/main.go": lines(map[int]string{3: "c2", 4: "c2"}), "other.txt": []byte("one\n2\nthree\nfour\n")})
+	commit("c3", map[string][]byte{"src/main.go": nil, "lib/core.go": lines(map[int]string{3: "c2", 4: "c2"})})
+	commit("c4", map[string][]byte{"lib/core.go": lines(map[int]string{3: "c2", 4: "c2", 12: "12\nc4 added"})})
+	runGit(t, dir, "checkout", "-q", "-b", "side")
+	commit("side1", map[string][]byte{"lib/core.go": nil, "lib/engine.go": lines(map[int]string{1: "side1", 3: "c2", 4: "c2", 12: "12\nc4 added"})})
+	runGit(t, dir, "checkout", "-q", "main")
+	commit("c5", map[string][]byte{"lib/core.go": lines(map[int]string{3: "c2", 4: "c2", 12: "12\nc4 added", 25: "c5"})})
+	runGit(t, dir, "merge", "-q", "--no-ff", "-m", "merge side", "side")
+	commit("c6", map[string][]byte{"lib/engine.go": lines(map[int]string{1: "side1", 3: "c2", 4: "c2", 7: "c6", 12: "12\nc4 added", 25: "c5"})})
+	head := commits["c6"]
+
+	repo := newTestRepository(t)
+	importGitObjects(t, repo, dir)
+
+	blame := func(commit string, path string, opts *BlameOptions) []string {
+		result, err := repo.Blame(ctx, commit, path, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var lines []string
+		for i, line := range result {
+			if line.Line != i+1 {
+				t.Errorf("Line %d is numbered %d", i+1, line.Line)
+			}
+			lines = append(lines, strings.Join([]string{line.Commit, line.Path, strconv.Itoa(line.OrigLine), line.Author.Name}, " "))
+		}
+		return lines
+	}
+
+	// the history has no lines moved within or copied between files, so git
+	// finds the same with -M and -C
+	for _, test := range []struct {
+		commit string
+		path   string
+	}{
+		{head, "lib/engine.go"},
+		{head, "other.txt"},
+		{commits["c5"], "lib/core.go"},
+		{commits["side1"], "lib/engine.go"},
+	} {
+		got := blame(test.commit, test.path, &BlameOptions{FollowRenames: true})
+		for _, args := range [][]string{nil, {"-M"}, {"-C", "-C"}} {
+			want := gitBlame(t, dir, append(args, test.commit, "--", test.path)...)
+			if strings.Join(got, "\n") != strings.Join(want, "\n") {
+				t.Errorf("Blame of %s with %v is\n%s\nwant\n%s", test.path, args, strings.Join(got, "\n"), strings.Join(want, "\n"))
+			}
+		}
+	}
+
+	// without following renames, lines stop at the commit that renamed them
+	got := blame(commits["c4"], "lib/core.go", nil)
+	want := gitBlame(t, dir, commits["c4"], "--", "lib/core.go")
+	added := 0
+	for i := range want {
+		if strings.HasPrefix(want[i], commits["c4"]) {
+			added++
+		} else {
+			want[i] = strings.Join([]string{commits["c3"], "lib/core.go", strconv.Itoa(i + 1 - added), "A U Thor"}, " ")
+		}
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("Blame without following renames is\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
@@ -0,0 +1,19 @@
+package gitpacklib
+
+// Blob is the content of a file.
+type Blob struct {
+	Data []byte
+}
+
+// ParseBlob wraps the content of a blob object. Any content is a valid blob.
+func ParseBlob(data []byte) (*Blob, error) {
+	return &Blob{data}, nil
+}
+
+func (blob *Blob) Type() string {
+	return BlobObject
+}
+
+func (blob *Blob) Serialize() []byte {
+	return blob.Data
+}
@@ -9,3 +9,20 @@ type Client interface {
 	PublicKeyChosen(key ssh.PublicKey)
 	GetRepositoryBackingStore(repoPath string) (BackingStore, error)
 }
+
+// AdminClient may be implemented by a Client to let some users run
+// administrative commands over SSH, such as listing and restoring deleted
+// refs with "gitpacklib-trash '<repo>' list" and
+// "gitpacklib-trash '<repo>' restore <id>", or collecting garbage with
+// "gitpacklib-gc '<repo>' [--repack]".
+type AdminClient interface {
+	IsRepositoryAdmin(repoPath string) bool
+}
+
+// RefVisibilityClient may be implemented by a Client to decide which refs the
+// authenticated key can see, and so push to. hidden reports whether the
+// server's HideRefs configuration hides the ref, so that a client can, for
+// example, reveal hidden refs to privileged keys only.
+type RefVisibilityClient interface {
+	IsRefVisible(repoPath string, ref string, hidden bool) bool
+}
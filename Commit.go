@@ -0,0 +1,142 @@
+package gitpacklib
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+)
+
+// Commit is a parsed commit object.
+//
+// Headers other than those with fields of their own, such as mergetag, are
+// kept in ExtraHeaders. Serialize writes headers after the committer in the
+// order they were parsed in, so that a parsed commit keeps its sha. Those of
+// a new commit are written in the order git does, with encoding after the
+// committer, then ExtraHeaders, and the signature last.
+type Commit struct {
+	Tree         string
+	Parents      []string
+	Author       *Signature
+	Committer    *Signature
+	Encoding     string
+	GPGSig       string
+	ExtraHeaders []ObjectHeader
+	Message      string
+
+	// keys of the headers after the committer in the order they were parsed,
+	// with those kept in ExtraHeaders left empty
+	order []string
+}
+
+// ParseCommit parses the content of a commit object, failing if required
+// headers are missing, out of order or malformed.
+func ParseCommit(data []byte) (*Commit, error) {
+	headers, message, err := parseObjectHeaders(data)
+	if err != nil {
+		return nil, errors.New("Invalid commit: " + err.Error())
+	}
+
+	commit := &Commit{Message: message}
+
+	// tree, parents, author and committer must come first and in that order
+	i := 0
+	if i >= len(headers) || headers[i].Key != "tree" || !isObjectSha(headers[i].Value) {
+		return nil, errors.New("Invalid commit: missing or invalid tree")
+	}
+	commit.Tree = headers[i].Value
+	i++
+
+	for ; i < len(headers) && headers[i].Key == "parent"; i++ {
+		if !isObjectSha(headers[i].Value) {
+			return nil, errors.New("Invalid commit: invalid parent " + headers[i].Value)
+		}
+		commit.Parents = append(commit.Parents, headers[i].Value)
+	}
+
+	if i >= len(headers) || headers[i].Key != "author" {
+		return nil, errors.New("Invalid commit: missing author")
+	}
+	commit.Author, err = ParseSignature(headers[i].Value)
+	if err != nil {
+		return nil, errors.New("Invalid commit: " + err.Error())
+	}
+	i++
+
+	if i >= len(headers) || headers[i].Key != "committer" {
+		return nil, errors.New("Invalid commit: missing committer")
+	}
+	commit.Committer, err = ParseSignature(headers[i].Value)
+	if err != nil {
+		return nil, errors.New("Invalid commit: " + err.Error())
+	}
+	i++
+
+	for _, header := range headers[i:] {
+		key := header.Key
+		switch {
+		case key == "tree" || key == "parent" || key == "author" || key == "committer":
+			return nil, errors.New("Invalid commit: unexpected " + key + " header")
+		case key == "encoding" && commit.Encoding == "":
+			commit.Encoding = header.Value
+		case key == "gpgsig" && commit.GPGSig == "":
+			commit.GPGSig = header.Value
+		default:
+			commit.ExtraHeaders = append(commit.ExtraHeaders, header)
+			key = ""
+		}
+		commit.order = append(commit.order, key)
+	}
+
+	return commit, nil
+}
+
+// Subject returns the first line of the commit message.
+func (commit *Commit) Subject() string {
+	return messageSubject(commit.Message)
+}
+
+func messageSubject(message string) string {
+	return strings.SplitN(message, "\n", 2)[0]
+}
+
+func (commit *Commit) Type() string {
+	return CommitObject
+}
+
+func (commit *Commit) Serialize() []byte {
+	b := &bytes.Buffer{}
+	writeObjectHeader(b, "tree", commit.Tree)
+	for _, parent := range commit.Parents {
+		writeObjectHeader(b, "parent", parent)
+	}
+	writeObjectHeader(b, "author", commit.Author.String())
+	writeObjectHeader(b, "committer", commit.Committer.String())
+
+	encoding, gpgSig, extra := commit.Encoding, commit.GPGSig, commit.ExtraHeaders
+	for _, key := range commit.order {
+		switch {
+		case key == "encoding" && encoding != "":
+			writeObjectHeader(b, "encoding", encoding)
+			encoding = ""
+		case key == "gpgsig" && gpgSig != "":
+			writeObjectHeader(b, "gpgsig", gpgSig)
+			gpgSig = ""
+		case key == "" && len(extra) > 0:
+			writeObjectHeader(b, extra[0].Key, extra[0].Value)
+			extra = extra[1:]
+		}
+	}
+
+	if encoding != "" {
+		writeObjectHeader(b, "encoding", encoding)
+	}
+	for _, header := range extra {
+		writeObjectHeader(b, header.Key, header.Value)
+	}
+	if gpgSig != "" {
+		writeObjectHeader(b, "gpgsig", gpgSig)
+	}
+	b.WriteByte('\n')
+	b.WriteString(commit.Message)
+	return b.Bytes()
+}
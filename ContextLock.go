@@ -0,0 +1,160 @@
+package gitpacklib
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+type lockTimeoutKey struct{}
+
+// WithLockTimeout returns a context under which RefStore.Update and
+// AppendReflog give up waiting for their locks after timeout, without the
+// writes they make once the locks are held being cut short.
+func WithLockTimeout(ctx context.Context, timeout time.Duration) context.Context {
+	return context.WithValue(ctx, lockTimeoutKey{}, timeout)
+}
+
+// lockWaitContext returns the context to wait for locks under, which is done
+// after any timeout given to WithLockTimeout.
+func lockWaitContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if timeout, ok := ctx.Value(lockTimeoutKey{}).(time.Duration); ok && timeout > 0 {
+		return context.WithTimeout(ctx, timeout)
+	}
+	return context.WithCancel(ctx)
+}
+
+// contextRWMutex is a reader/writer lock whose waits can be abandoned through
+// a context. A waiting writer blocks new readers so that a steady stream of
+// fetches cannot starve a push.
+type contextRWMutex struct {
+	mu             sync.Mutex
+	readers        int
+	writer         bool
+	waitingWriters int
+	changed        chan struct{}
+}
+
+// wait blocks until the lock state changes or ctx is done. l.mu must be held,
+// and is held again on return.
+func (l *contextRWMutex) wait(ctx context.Context) error {
+	if l.changed == nil {
+		l.changed = make(chan struct{})
+	}
+	changed := l.changed
+	l.mu.Unlock()
+
+	var err error
+	select {
+	case <-changed:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	l.mu.Lock()
+	return err
+}
+
+// broadcast wakes all waiters. l.mu must be held.
+func (l *contextRWMutex) broadcast() {
+	if l.changed != nil {
+		close(l.changed)
+		l.changed = nil
+	}
+}
+
+func (l *contextRWMutex) Lock(ctx context.Context) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.waitingWriters++
+	defer func() { l.waitingWriters-- }()
+
+	for l.writer || l.readers > 0 {
+		if err := l.wait(ctx); err != nil {
+			// readers may have been held back by us
+			l.broadcast()
+			return err
+		}
+	}
+	l.writer = true
+	return nil
+}
+
+func (l *contextRWMutex) Unlock() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.writer = false
+	l.broadcast()
+}
+
+func (l *contextRWMutex) RLock(ctx context.Context) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for l.writer || l.waitingWriters > 0 {
+		if err := l.wait(ctx); err != nil {
+			return err
+		}
+	}
+	l.readers++
+	return nil
+}
+
+func (l *contextRWMutex) RUnlock() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.readers--
+	if l.readers == 0 {
+		l.broadcast()
+	}
+}
+
+// lockTable hands out a shared contextRWMutex per name, such as the path of a
+// store, dropping entries once nobody holds or waits on them.
+type lockTable struct {
+	mu    sync.Mutex
+	locks map[string]*lockTableEntry
+}
+
+type lockTableEntry struct {
+	contextRWMutex
+	users int
+}
+
+func (t *lockTable) acquire(name string) *contextRWMutex {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.locks == nil {
+		t.locks = make(map[string]*lockTableEntry)
+	}
+	entry, ok := t.locks[name]
+	if !ok {
+		entry = &lockTableEntry{}
+		t.locks[name] = entry
+	}
+	entry.users++
+	return &entry.contextRWMutex
+}
+
+// lookup returns the lock for a name that the caller has already acquired.
+func (t *lockTable) lookup(name string) *contextRWMutex {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return &t.locks[name].contextRWMutex
+}
+
+func (t *lockTable) release(name string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	entry := t.locks[name]
+	entry.users--
+	if entry.users == 0 {
+		delete(t.locks, name)
+	}
+}
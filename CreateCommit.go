@@ -0,0 +1,355 @@
+package gitpacklib
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+)
+
+var ErrNothingToCommit = errors.New("Nothing to commit, the tree is unchanged")
+
+// FileChange adds, replaces or deletes a single file in a commit made with
+// CreateCommit.
+type FileChange struct {
+	// Path is the file's path from the root of the repository, such as
+	// "docs/README.md". Directories are created and removed as needed.
+	Path string
+
+	// Delete removes the file, or the whole directory, at Path.
+	Delete bool
+
+	// Data is the new content of the file, or the target of a symlink.
+	// Hash may be given instead to use a blob that is already stored, and
+	// is the commit of a ModeSubmodule entry, which need not be stored.
+	Data []byte
+	Hash string
+
+	// Mode is the file's new mode. Zero keeps the mode of the file being
+	// replaced, or uses ModeBlob for a new file.
+	Mode uint32
+}
+
+// CommitRequest describes a commit to be made on a branch by CreateCommit.
+type CommitRequest struct {
+	// Ref is the ref to commit to, such as "refs/heads/main". Symbolic refs
+	// such as HEAD are followed.
+	Ref string
+
+	// Parent is the commit the changes are made on top of, and the commit
+	// Ref must still point at for it to be updated. If empty, the commit is
+	// made on whatever Ref points at, or as a root commit if it does not
+	// exist.
+	Parent string
+
+	Files []FileChange
+
+	// Author of the commit. If Committer is nil, the author is used. A zero
+	// When is filled in with the current time.
+	Author    *Signature
+	Committer *Signature
+	Message   string
+
+	// AllowEmpty allows a commit that changes nothing, which otherwise
+	// fails with ErrNothingToCommit.
+	AllowEmpty bool
+
+	// Identity is recorded as who updated the ref in its reflog. If empty,
+	// the committer's name and email are used.
+	Identity string
+}
+
+// CreateCommit builds the blobs, trees and commit for req, stores them, and
+// moves req.Ref to the new commit, returning its sha.
+//
+// The ref is updated with a compare-and-swap of that ref alone, as for a
+// push, with its reflog entry written while the ref is locked. If the ref
+// moved since Parent was read, the commit is left unreferenced and
+// ErrStaleRef is returned.
+func (repo *Repository) CreateCommit(ctx context.Context, req *CommitRequest) (string, error) {
+	ref, err := repo.resolveCommitRef(ctx, req.Ref)
+	if err != nil {
+		return "", err
+	}
+
+	parent := req.Parent
+	if parent == "" {
+		parent = ref.Hash
+	}
+
+	var parents []string
+	var baseTree string
+	if parent != "" {
+		parentCommit, err := repo.ReadCommit(ctx, parent)
+		if err != nil {
+			return "", err
+		}
+		parents = []string{parent}
+		baseTree = parentCommit.Tree
+	}
+
+	tree, err := repo.editTree(ctx, baseTree, "", req.Files)
+	if err != nil {
+		return "", err
+	}
+	if tree == "" {
+		tree, err = repo.WriteObject(ctx, &Tree{})
+		if err != nil {
+			return "", err
+		}
+	}
+	if tree == baseTree && !req.AllowEmpty {
+		return "", ErrNothingToCommit
+	}
+
+	return repo.commitToRef(ctx, ref.Name, parent, &commitDetails{
+		tree:      tree,
+		parents:   parents,
+		author:    req.Author,
+		committer: req.Committer,
+		message:   req.Message,
+		identity:  req.Identity,
+		action:    "commit",
+	})
+}
+
+// resolveCommitRef resolves the ref a commit is to be made on, which must be
+// under refs/.
+func (repo *Repository) resolveCommitRef(ctx context.Context, name string) (*Ref, error) {
+	ref, err := ResolveRef(ctx, repo.refs, name)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkPushedRefName(ref.Name); err != nil {
+		return nil, err
+	}
+	return ref, nil
+}
+
+// commitDetails describes a commit to be made by commitToRef, and how its
+// ref update is recorded in the reflog.
+type commitDetails struct {
+	tree      string
+	parents   []string
+	author    *Signature
+	committer *Signature
+	message   string
+	identity  string
+	action    string
+}
+
+// commitToRef stores a commit and moves the named ref to it from oldHash,
+// recording the update in the ref's reflog.
+func (repo *Repository) commitToRef(ctx context.Context, name string, oldHash string, details *commitDetails) (string, error) {
+	sha, commit, err := repo.writeCommit(ctx, details)
+	if err != nil {
+		return "", err
+	}
+
+	identity := details.identity
+	if identity == "" {
+		identity = signatureIdentity(commit.Committer)
+	}
+	err = repo.moveRef(ctx, name, oldHash, sha, identity, details.action+": "+commit.Subject())
+	if err != nil {
+		return "", err
+	}
+	return sha, nil
+}
+
+// writeCommit stores the commit described by details, filling in the time of
+// signatures that have none.
+func (repo *Repository) writeCommit(ctx context.Context, details *commitDetails) (string, *Commit, error) {
+	if details.author == nil {
+		return "", nil, errors.New("Commit has no author")
+	}
+
+	now := time.Now()
+	author := signatureAt(details.author, now)
+	committer := author
+	if details.committer != nil {
+		committer = signatureAt(details.committer, now)
+	}
+
+	message := details.message
+	if !strings.HasSuffix(message, "\n") {
+		message += "\n"
+	}
+
+	commit := &Commit{
+		Tree:      details.tree,
+		Parents:   details.parents,
+		Author:    author,
+		Committer: committer,
+		Message:   message,
+	}
+	sha, err := repo.WriteObject(ctx, commit)
+	if err != nil {
+		return "", nil, err
+	}
+	return sha, commit, nil
+}
+
+// moveRef moves the named ref from oldHash to newHash with a
+// compare-and-swap, recording the update in its reflog.
+func (repo *Repository) moveRef(ctx context.Context, name string, oldHash string, newHash string, identity string, message string) error {
+	return repo.refs.Update(ctx, []*RefUpdate{{
+		Name:    name,
+		OldHash: oldHash,
+		NewHash: newHash,
+		Reflog: &ReflogEntry{
+			Identity: identity,
+			Time:     time.Now(),
+			Message:  message,
+		},
+	}})
+}
+
+// signatureIdentity describes who made a signature for reflogs, the same way
+// git does.
+func signatureIdentity(sig *Signature) string {
+	return sig.Name + " <" + sig.Email + ">"
+}
+
+// signatureAt returns sig, with the time filled in if it has none.
+func signatureAt(sig *Signature, now time.Time) *Signature {
+	if !sig.When.IsZero() {
+		return sig
+	}
+	return &Signature{Name: sig.Name, Email: sig.Email, When: now}
+}
+
+// editTree applies files, whose paths are relative to the directory prefix,
+// to the tree with the given sha, storing the trees that change. It returns
+// the sha of the new tree, or the empty string if it is left empty.
+func (repo *Repository) editTree(ctx context.Context, sha string, prefix string, files []FileChange) (string, error) {
+	if len(files) == 0 {
+		return sha, nil
+	}
+
+	tree := &Tree{}
+	if sha != "" {
+		existing, err := repo.ReadTree(ctx, sha)
+		if err != nil {
+			return "", err
+		}
+		tree.Entries = existing.Entries
+	}
+
+	// group the changes by the entry of this tree they fall under
+	var names []string
+	groups := map[string][]FileChange{}
+	for _, file := range files {
+		name := strings.SplitN(strings.TrimPrefix(file.Path, prefix), "/", 2)[0]
+		if err := checkTreeEntryName(name); err != nil {
+			return "", errors.New("Invalid path " + file.Path)
+		}
+		if _, ok := groups[name]; !ok {
+			names = append(names, name)
+		}
+		groups[name] = append(groups[name], file)
+	}
+
+	for _, name := range names {
+		group := groups[name]
+		path := prefix + name
+		entry := tree.Entry(name)
+
+		isFile := false
+		for _, file := range group {
+			if file.Path == path {
+				isFile = true
+			}
+		}
+		if isFile {
+			if len(group) > 1 {
+				return "", errors.New("Conflicting changes to " + path)
+			}
+			if err := repo.editTreeEntry(ctx, tree, entry, name, &group[0]); err != nil {
+				return "", err
+			}
+			continue
+		}
+
+		subtree := ""
+		if entry != nil {
+			if !entry.IsTree() {
+				return "", errors.New("Path " + path + " is not a directory")
+			}
+			subtree = entry.Hash
+		}
+		subtree, err := repo.editTree(ctx, subtree, path+"/", group)
+		if err != nil {
+			return "", err
+		}
+		tree.Entries = removeTreeEntry(tree.Entries, name)
+		if subtree != "" {
+			tree.Entries = append(tree.Entries, TreeEntry{Mode: ModeTree, Name: name, Hash: subtree})
+		}
+	}
+
+	if len(tree.Entries) == 0 {
+		return "", nil
+	}
+	tree.Sort()
+	return repo.WriteObject(ctx, tree)
+}
+
+// editTreeEntry applies a change to the entry called name in tree.
+func (repo *Repository) editTreeEntry(ctx context.Context, tree *Tree, entry *TreeEntry, name string, file *FileChange) error {
+	if file.Delete {
+		if entry == nil {
+			return errors.New("Can not delete " + file.Path + ": " + ErrPathNotFound.Error())
+		}
+		tree.Entries = removeTreeEntry(tree.Entries, name)
+		return nil
+	}
+
+	mode := file.Mode
+	if mode == 0 {
+		mode = ModeBlob
+		if entry != nil && !entry.IsTree() && entry.Mode != modeGroupWritable {
+			mode = entry.Mode
+		}
+	}
+	switch mode {
+	case ModeBlob, ModeExecutable, ModeSymlink, ModeSubmodule:
+	default:
+		return errors.New("Invalid mode for " + file.Path)
+	}
+	if entry != nil && entry.IsTree() {
+		return errors.New("Path " + file.Path + " is a directory")
+	}
+
+	hash := file.Hash
+	if hash == "" {
+		if mode == ModeSubmodule {
+			return errors.New("Submodule " + file.Path + " needs the hash of a commit")
+		}
+		var err error
+		hash, err = repo.WriteObject(ctx, &Blob{Data: file.Data})
+		if err != nil {
+			return err
+		}
+	} else if !isObjectSha(hash) {
+		return errors.New("Invalid hash for " + file.Path)
+	} else if mode != ModeSubmodule {
+		// a submodule's commit lives in another repository
+		if _, err := repo.readObjectOfType(ctx, hash, BlobObject); err != nil {
+			return errors.New("Invalid hash for " + file.Path + ": " + err.Error())
+		}
+	}
+
+	tree.Entries = removeTreeEntry(tree.Entries, name)
+	tree.Entries = append(tree.Entries, TreeEntry{Mode: mode, Name: name, Hash: hash})
+	return nil
+}
+
+func removeTreeEntry(entries []TreeEntry, name string) []TreeEntry {
+	for i := range entries {
+		if entries[i].Name == name {
+			return append(entries[:i], entries[i+1:]...)
+		}
+	}
+	return entries
+}
@@ -0,0 +1,181 @@
+package gitpacklib
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCreateCommitMatchesGit(t *testing.T) {
+	ctx := context.Background()
+	repo := newTestRepository(t)
+	dir := newGitRepository(t)
+	author := &Signature{Name: "A U Thor", Email: "author@example.com", When: time.Unix(1700000000, 0).UTC()}
+
+	for _, step := range []struct {
+		files []FileChange
+		// applies the same change to the git work tree
+		git func()
+	}{
+		{
+			[]FileChange{
+				{Path: "top.txt", Data: []byte("top\n")},
+				{Path: "a/b/c.txt", Data: []byte("c\n")},
+				{Path: "script.sh", Data: []byte("#!/bin/sh\n"), Mode: ModeExecutable},
+				{Path: "link", Data: []byte("top.txt"), Mode: ModeSymlink},
+			},
+			func() {
+				writeFiles(t, dir, map[string][]byte{"top.txt": []byte("top\n"), "a/b/c.txt": []byte("c\n"), "script.sh": []byte("#!/bin/sh\n")})
+				os.Chmod(filepath.Join(dir, "script.sh"), 0755)
+				os.Symlink("top.txt", filepath.Join(dir, "link"))
+			},
+		},
+		{
+			// nested adds, a change keeping the mode, and a mode change
+			[]FileChange{
+				{Path: "a/b/d.txt", Data: []byte("d\n")},
+				{Path: "a/new/deep/e.txt", Data: []byte("e\n")},
+				{Path: "top.txt", Data: []byte("top 2\n")},
+				{Path: "script.sh", Data: []byte("#!/bin/sh\nexit 0\n")},
+				{Path: "a/b/c.txt", Data: []byte("c\n"), Mode: ModeExecutable},
+			},
+			func() {
+				writeFiles(t, dir, map[string][]byte{"a/b/d.txt": []byte("d\n"), "a/new/deep/e.txt": []byte("e\n"), "top.txt": []byte("top 2\n"), "script.sh": []byte("#!/bin/sh\nexit 0\n")})
+				os.Chmod(filepath.Join(dir, "a/b/c.txt"), 0755)
+			},
+		},
+		{
+			// deleting the last file in a directory removes the directory
+			[]FileChange{{Path: "a/new/deep/e.txt", Delete: true}, {Path: "link", Delete: true}},
+			func() {
+				writeFiles(t, dir, map[string][]byte{"a/new/deep/e.txt": nil, "link": nil})
+			},
+		},
+		{
+			// and deleting a whole directory, leaving its parent empty
+			[]FileChange{{Path: "a/b", Delete: true}},
+			func() {
+				os.RemoveAll(filepath.Join(dir, "a"))
+			},
+		},
+	} {
+		sha, err := repo.CreateCommit(ctx, &CommitRequest{Ref: "refs/heads/main", Files: step.files, Author: author, Message: "step"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		commit, err := repo.ReadCommit(ctx, sha)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		step.git()
+		runGit(t, dir, "add", "-A")
+		if want := strings.TrimSpace(string(runGit(t, dir, "write-tree"))); commit.Tree != want {
+			t.Errorf("Commit has tree %s, git wrote %s:\n%s", commit.Tree, want, runGit(t, dir, "ls-files", "-s"))
+		}
+	}
+}
+
+func TestCreateCommitRejectsBadChanges(t *testing.T) {
+	ctx := context.Background()
+	repo := newTestRepository(t)
+	author := &Signature{Name: "A U Thor", Email: "author@example.com"}
+	base, err := repo.CreateCommit(ctx, &CommitRequest{
+		Ref:     "refs/heads/main",
+		Files:   []FileChange{{Path: "file", Data: []byte("file\n")}, {Path: "dir/file", Data: []byte("file\n")}},
+		Author:  author,
+		Message: "base",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		files []FileChange
+		err   string
+	}{
+		{[]FileChange{{Path: "new", Data: []byte("a")}, {Path: "new/file", Data: []byte("b")}}, "Conflicting changes to new"},
+		{[]FileChange{{Path: "x", Data: []byte("a")}, {Path: "x", Delete: true}}, "Conflicting changes to x"},
+		{[]FileChange{{Path: "file/inside", Data: []byte("a")}}, "Path file is not a directory"},
+		{[]FileChange{{Path: "dir", Data: []byte("a")}}, "Path dir is a directory"},
+		{[]FileChange{{Path: "missing", Delete: true}}, "Can not delete missing: " + ErrPathNotFound.Error()},
+		{[]FileChange{{Path: "no/such/file", Delete: true}}, "Can not delete no/such/file: " + ErrPathNotFound.Error()},
+		{[]FileChange{{Path: ".git/config", Data: []byte("a")}}, "Invalid path .git/config"},
+		{[]FileChange{{Path: "dir//file", Data: []byte("a")}}, "Invalid path dir//file"},
+		{[]FileChange{{Path: "../file", Data: []byte("a")}}, "Invalid path ../file"},
+		{[]FileChange{{Path: "file", Data: []byte("a"), Mode: ModeTree}}, "Invalid mode for file"},
+		{[]FileChange{{Path: "sub", Mode: ModeSubmodule}}, "Submodule sub needs the hash of a commit"},
+		{[]FileChange{{Path: "file", Hash: "1234"}}, "Invalid hash for file"},
+		{nil, ErrNothingToCommit.Error()},
+		{[]FileChange{{Path: "file", Data: []byte("file\n")}}, ErrNothingToCommit.Error()},
+	} {
+		_, err := repo.CreateCommit(ctx, &CommitRequest{Ref: "refs/heads/main", Files: test.files, Author: author, Message: "bad"})
+		if err == nil || err.Error() != test.err {
+			t.Errorf("Commit of %+v gave %v, want %q", test.files, err, test.err)
+		}
+	}
+	if sha, err := repo.ResolveRef(ctx, "refs/heads/main"); err != nil || sha != base {
+		t.Errorf("Failed commits moved main to %s: %v", sha, err)
+	}
+
+	if _, err := repo.CreateCommit(ctx, &CommitRequest{Ref: "refs/heads/main", Author: author, Message: "empty", AllowEmpty: true}); err != nil {
+		t.Errorf("Empty commit failed: %v", err)
+	}
+}
+
+func TestCreateCommitUpdatesRef(t *testing.T) {
+	ctx := context.Background()
+	repo := newTestRepository(t)
+	if err := repo.RefStore().Update(ctx, []*RefUpdate{{Name: HeadRef, NewTarget: "refs/heads/main"}}); err != nil {
+		t.Fatal(err)
+	}
+	author := &Signature{Name: "A U Thor", Email: "author@example.com"}
+	commit := func(parent string, content string) (string, error) {
+		return repo.CreateCommit(ctx, &CommitRequest{
+			Ref:      HeadRef,
+			Parent:   parent,
+			Files:    []FileChange{{Path: "file", Data: []byte(content)}},
+			Author:   author,
+			Message:  content,
+			Identity: "tester",
+		})
+	}
+
+	// commits through HEAD go on the branch it points at
+	first, err := commit("", "first")
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := commit(first, "second")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a commit on a parent the branch has moved on from is not referenced
+	stale, err := commit(first, "stale")
+	if err != ErrStaleRef || stale != "" {
+		t.Errorf("Commit on a stale parent gave %s, %v", stale, err)
+	}
+	if sha, err := repo.ResolveRef(ctx, "refs/heads/main"); err != nil || sha != second {
+		t.Errorf("main is at %s, want %s: %v", sha, second, err)
+	}
+	if sha, err := commit(second[:10], "short"); err == nil {
+		t.Errorf("Commit on an abbreviated parent gave %s", sha)
+	}
+
+	entries, err := ReadReflog(ctx, repo.store, "refs/heads/main")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var log []string
+	for _, entry := range entries {
+		log = append(log, entry.OldHash+".."+entry.NewHash+" "+entry.Identity+" "+entry.Message)
+	}
+	want := []string{first + ".." + second + " tester commit: second", ".." + first + " tester commit: first"}
+	if strings.Join(log, "\n") != strings.Join(want, "\n") {
+		t.Errorf("Reflog is\n%s\nwant\n%s", strings.Join(log, "\n"), strings.Join(want, "\n"))
+	}
+}
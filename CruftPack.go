@@ -0,0 +1,73 @@
+package gitpacklib
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"strconv"
+	"time"
+)
+
+// packMtimesMagic starts the mtimes file of a cruft pack, which holds the
+// unreachable objects kept by CollectGarbage along with when each was last
+// found unreachable, in the format of git repack --cruft.
+var packMtimesMagic = []byte{'M', 'T', 'M', 'E'}
+
+// packMtimesVersion is the version of the mtimes files written by
+// writePackMtimes.
+const packMtimesVersion = 1
+
+// writePackMtimes returns the mtimes file of the cruft pack that index is
+// for, giving each object its time in mtimes to the second.
+func writePackMtimes(index *PackIndex, mtimes map[string]time.Time) []byte {
+	data := &bytes.Buffer{}
+	data.Write(packMtimesMagic)
+	binary.Write(data, binary.BigEndian, uint32(packMtimesVersion))
+	binary.Write(data, binary.BigEndian, uint32(sha1HashVersion))
+	for i := 0; i < index.NumObjects(); i++ {
+		mtime := mtimes[hex.EncodeToString(index.sha(i))]
+		binary.Write(data, binary.BigEndian, uint32(mtime.Unix()))
+	}
+
+	checksum, _ := hex.DecodeString(index.PackChecksum())
+	data.Write(checksum)
+	sum := sha1.Sum(data.Bytes())
+	data.Write(sum[:])
+	return data.Bytes()
+}
+
+// readPackMtimes reads the mtimes file of the cruft pack that index is for,
+// returning the time of each object by sha.
+func readPackMtimes(data []byte, index *PackIndex) (map[string]time.Time, error) {
+	if len(data) < 12+2*sha1.Size || !bytes.Equal(data[:4], packMtimesMagic) {
+		return nil, errors.New("Invalid mtimes header")
+	}
+	if version := binary.BigEndian.Uint32(data[4:]); version != packMtimesVersion {
+		return nil, errors.New("Unsupported mtimes version " + strconv.Itoa(int(version)))
+	}
+	if hashVersion := binary.BigEndian.Uint32(data[8:]); hashVersion != sha1HashVersion {
+		return nil, errors.New("Unsupported mtimes hash version " + strconv.Itoa(int(hashVersion)))
+	}
+
+	sum := sha1.Sum(data[:len(data)-sha1.Size])
+	if !bytes.Equal(sum[:], data[len(data)-sha1.Size:]) {
+		return nil, errors.New("Mtimes checksum mismatch")
+	}
+	checksum := data[len(data)-2*sha1.Size : len(data)-sha1.Size]
+	if hex.EncodeToString(checksum) != index.PackChecksum() {
+		return nil, errors.New("Mtimes are for a different pack")
+	}
+
+	table := data[12 : len(data)-2*sha1.Size]
+	if len(table) != index.NumObjects()*4 {
+		return nil, errors.New("Mtimes have the wrong size for their objects")
+	}
+	mtimes := make(map[string]time.Time, index.NumObjects())
+	for i := 0; i < index.NumObjects(); i++ {
+		seconds := binary.BigEndian.Uint32(table[i*4:])
+		mtimes[hex.EncodeToString(index.sha(i))] = time.Unix(int64(seconds), 0)
+	}
+	return mtimes, nil
+}
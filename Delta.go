@@ -0,0 +1,251 @@
+package gitpacklib
+
+import (
+	"errors"
+)
+
+var errInvalidDelta = errors.New("Invalid delta")
+
+// applyDelta rebuilds an object from the base it was deltified against and a
+// delta in git's format, as used in packs and binary patches.
+func applyDelta(base []byte, delta []byte) ([]byte, error) {
+	baseSize, delta, err := deltaHeaderSize(delta)
+	if err != nil {
+		return nil, err
+	}
+	if baseSize != len(base) {
+		return nil, errors.New("Delta base has the wrong size")
+	}
+	resultSize, delta, err := deltaHeaderSize(delta)
+	if err != nil {
+		return nil, err
+	}
+
+	// the size in the header is not trusted until the result reaches it
+	capacity := resultSize
+	if limit := len(base) + 2*len(delta); capacity > limit {
+		capacity = limit
+	}
+	result := make([]byte, 0, capacity)
+	for len(delta) > 0 {
+		op := delta[0]
+		delta = delta[1:]
+
+		if op&0x80 == 0 {
+			// insert the next op bytes of the delta
+			size := int(op)
+			if size == 0 || size > len(delta) || len(result)+size > resultSize {
+				return nil, errInvalidDelta
+			}
+			result = append(result, delta[:size]...)
+			delta = delta[size:]
+			continue
+		}
+
+		// copy from the base, with the bits of op saying which bytes of the
+		// offset and size follow
+		var offset, size int
+		for i := uint(0); i < 7; i++ {
+			if op&(1<<i) == 0 {
+				continue
+			}
+			if len(delta) == 0 {
+				return nil, errInvalidDelta
+			}
+			if i < 4 {
+				offset |= int(delta[0]) << (8 * i)
+			} else {
+				size |= int(delta[0]) << (8 * (i - 4))
+			}
+			delta = delta[1:]
+		}
+		if size == 0 {
+			size = 0x10000
+		}
+		if offset+size > len(base) || len(result)+size > resultSize {
+			return nil, errInvalidDelta
+		}
+		result = append(result, base[offset:offset+size]...)
+	}
+
+	if len(result) != resultSize {
+		return nil, errors.New("Delta result has the wrong size")
+	}
+	return result, nil
+}
+
+// deltaHeaderSize reads one of the sizes at the start of a delta, stored
+// seven bits at a time with the least significant first.
+func deltaHeaderSize(delta []byte) (int, []byte, error) {
+	size := 0
+	for shift := uint(0); ; shift += 7 {
+		if len(delta) == 0 || shift > 56 {
+			return 0, nil, errInvalidDelta
+		}
+		c := delta[0]
+		delta = delta[1:]
+		size |= int(c&0x7f) << shift
+		if c&0x80 == 0 {
+			return size, delta, nil
+		}
+	}
+}
+
+// deltaBlockSize is the length of the runs of the base that a delta index
+// records, and so the shortest copy a delta is made of.
+const deltaBlockSize = 16
+
+// maxDeltaCopy is the most a single copy of a delta takes from the base, as
+// larger copies are not understood by all versions of git.
+const maxDeltaCopy = 0x10000
+
+// maxDeltaInsert is the most a single insert of a delta can hold.
+const maxDeltaInsert = 0x7f
+
+// maxDeltaBucket limits how many places in the base a delta index records
+// for the same block, so that repetitive content stays fast to deltify.
+const maxDeltaBucket = 64
+
+// deltaIndex records where blocks of a base start, so that deltas against it
+// can be made for many targets.
+type deltaIndex struct {
+	base   []byte
+	blocks map[uint64][]int
+}
+
+// blockHashFactor is the multiplier of the rolling hash of blocks.
+const blockHashFactor = 0x100000001b3
+
+func newDeltaIndex(base []byte) *deltaIndex {
+	index := &deltaIndex{base: base, blocks: map[uint64][]int{}}
+	for offset := 0; offset+deltaBlockSize <= len(base); offset += deltaBlockSize {
+		hash := blockHash(base[offset : offset+deltaBlockSize])
+		if len(index.blocks[hash]) < maxDeltaBucket {
+			index.blocks[hash] = append(index.blocks[hash], offset)
+		}
+	}
+	return index
+}
+
+func blockHash(block []byte) uint64 {
+	var hash uint64
+	for _, c := range block {
+		hash = hash*blockHashFactor + uint64(c)
+	}
+	return hash
+}
+
+// createDelta returns a delta that builds target from the base of index, or
+// nil if it would be larger than maxSize.
+func (index *deltaIndex) createDelta(target []byte, maxSize int) []byte {
+	base := index.base
+	delta := appendDeltaSize(nil, len(base))
+	delta = appendDeltaSize(delta, len(target))
+
+	// the factor to take the first byte of a block out of its hash
+	outFactor := uint64(1)
+	for i := 1; i < deltaBlockSize; i++ {
+		outFactor *= blockHashFactor
+	}
+
+	insertStart, pos := 0, 0
+	var hash uint64
+	if len(target) >= deltaBlockSize {
+		hash = blockHash(target[:deltaBlockSize])
+	}
+	for pos+deltaBlockSize <= len(target) {
+		matchOffset, matchSize := 0, 0
+		for _, offset := range index.blocks[hash] {
+			size := 0
+			for offset+size < len(base) && pos+size < len(target) && base[offset+size] == target[pos+size] {
+				size++
+			}
+			if size > matchSize {
+				matchOffset, matchSize = offset, size
+			}
+		}
+
+		if matchSize < deltaBlockSize {
+			if pos+deltaBlockSize < len(target) {
+				hash = (hash-uint64(target[pos])*outFactor)*blockHashFactor + uint64(target[pos+deltaBlockSize])
+			}
+			pos++
+			continue
+		}
+
+		// take what matches before the block out of the pending insert
+		for pos > insertStart && matchOffset > 0 && base[matchOffset-1] == target[pos-1] {
+			pos--
+			matchOffset--
+			matchSize++
+		}
+
+		delta = appendDeltaInsert(delta, target[insertStart:pos])
+		for matchSize > 0 {
+			size := matchSize
+			if size > maxDeltaCopy {
+				size = maxDeltaCopy
+			}
+			delta = appendDeltaCopy(delta, matchOffset, size)
+			matchOffset += size
+			matchSize -= size
+			pos += size
+		}
+		if len(delta) > maxSize {
+			return nil
+		}
+
+		insertStart = pos
+		if pos+deltaBlockSize <= len(target) {
+			hash = blockHash(target[pos : pos+deltaBlockSize])
+		}
+	}
+
+	delta = appendDeltaInsert(delta, target[insertStart:])
+	if len(delta) > maxSize {
+		return nil
+	}
+	return delta
+}
+
+// appendDeltaSize appends one of the sizes at the start of a delta.
+func appendDeltaSize(delta []byte, size int) []byte {
+	for size >= 0x80 {
+		delta = append(delta, byte(size)|0x80)
+		size >>= 7
+	}
+	return append(delta, byte(size))
+}
+
+func appendDeltaInsert(delta []byte, data []byte) []byte {
+	for len(data) > 0 {
+		size := len(data)
+		if size > maxDeltaInsert {
+			size = maxDeltaInsert
+		}
+		delta = append(delta, byte(size))
+		delta = append(delta, data[:size]...)
+		data = data[size:]
+	}
+	return delta
+}
+
+// appendDeltaCopy appends a copy from the base, leaving out the bytes of the
+// offset and size that are zero. A size of maxDeltaCopy is written as zero.
+func appendDeltaCopy(delta []byte, offset int, size int) []byte {
+	op := len(delta)
+	delta = append(delta, 0x80)
+	for i := uint(0); i < 4; i++ {
+		if c := byte(offset >> (8 * i)); c != 0 {
+			delta[op] |= 1 << i
+			delta = append(delta, c)
+		}
+	}
+	for i := uint(0); i < 3; i++ {
+		if c := byte(size >> (8 * i)); c != 0 && size != maxDeltaCopy {
+			delta[op] |= 0x10 << i
+			delta = append(delta, c)
+		}
+	}
+	return delta
+}
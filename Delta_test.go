@@ -0,0 +1,67 @@
+package gitpacklib
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+)
+
+func TestCreateDeltaRoundTrip(t *testing.T) {
+	random := rand.New(rand.NewSource(1))
+	big := make([]byte, 3*maxDeltaCopy)
+	random.Read(big)
+
+	for _, test := range []struct {
+		name         string
+		base, target []byte
+	}{
+		{"unchanged", numberedLines(100, nil), numberedLines(100, nil)},
+		{"edited", numberedLines(100, nil), numberedLines(110, map[int]string{3: "three", 50: "", 90: "ninety"})},
+		{"unrelated", numberedLines(100, nil), bytes.Repeat([]byte("x"), 300)},
+		{"empty target", numberedLines(10, nil), nil},
+		{"long copies", big, append(append([]byte("start"), big[:2*maxDeltaCopy+7]...), "end"...)},
+	} {
+		delta := newDeltaIndex(test.base).createDelta(test.target, len(test.target)+1024)
+		if delta == nil {
+			t.Errorf("%s: no delta", test.name)
+			continue
+		}
+		result, err := applyDelta(test.base, delta)
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+		} else if !bytes.Equal(result, test.target) {
+			t.Errorf("%s: delta does not rebuild the target", test.name)
+		}
+	}
+
+	// a delta bigger than allowed is not made
+	if delta := newDeltaIndex(numberedLines(100, nil)).createDelta(bytes.Repeat([]byte("x"), 300), 100); delta != nil {
+		t.Errorf("Delta of %d bytes made with a limit of 100", len(delta))
+	}
+}
+
+func TestApplyDeltaRejectsInvalidDeltas(t *testing.T) {
+	base := []byte("0123456789abcdef")
+	header := func(baseSize, resultSize int) []byte {
+		return appendDeltaSize(appendDeltaSize(nil, baseSize), resultSize)
+	}
+
+	for _, test := range []struct {
+		name  string
+		delta []byte
+	}{
+		{"wrong base size", appendDeltaCopy(header(15, 4), 0, 4)},
+		{"copy past the base", appendDeltaCopy(header(16, 8), 12, 8)},
+		{"insert past the result", appendDeltaInsert(header(16, 2), []byte("abc"))},
+		{"copy past the result", appendDeltaCopy(header(16, 2), 0, 4)},
+		{"result too short", appendDeltaCopy(header(16, 8), 0, 4)},
+		{"huge result size", appendDeltaCopy(header(16, 1<<40), 0, 4)},
+		{"truncated copy", append(header(16, 4), 0x91)},
+		{"truncated insert", append(header(16, 4), 4, 'a')},
+		{"zero insert", append(header(16, 4), 0)},
+	} {
+		if result, err := applyDelta(base, test.delta); err == nil {
+			t.Errorf("%s: delta applied, giving %q", test.name, result)
+		}
+	}
+}
@@ -1,21 +1,41 @@
 package gitpacklib
 
 import (
+	"context"
 	"encoding/hex"
-	"errors"
 	"io/ioutil"
 	"os"
 	"path"
 	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/nightlyone/lockfile"
 )
 
+// fileStoreLocks and fileKeyLocks coordinate FileBackingStores within this
+// process that share a base path. The lock files on disk only exclude other
+// processes.
+var fileStoreLocks lockTable
+var fileKeyLocks lockTable
+
+// fileStoreReaders counts the readers in this process of each base path,
+// which between them hold the reader file of this process.
+var fileStoreReaders = struct {
+	sync.Mutex
+	counts map[string]int
+}{counts: map[string]int{}}
+
+// FileBackingStore keeps each key in a file under basePath. Across processes
+// a writer holds the lock file and each process with readers holds a reader
+// file, named after its pid, which the writer waits to go away.
 type FileBackingStore struct {
 	basePath string
 	lock     lockfile.Lockfile
-	locked   bool
+	readers  lockfile.Lockfile
 }
 
 func NewFileBackingStore(basePath string) (*FileBackingStore, error) {
@@ -30,8 +50,12 @@ func NewFileBackingStore(basePath string) (*FileBackingStore, error) {
 	if err != nil {
 		return nil, err
 	}
+	readers, err := lockfile.New(absPath + "/rlock-" + strconv.Itoa(os.Getpid()))
+	if err != nil {
+		return nil, err
+	}
 
-	return &FileBackingStore{absPath, lock, false}, nil
+	return &FileBackingStore{absPath, lock, readers}, nil
 }
 
 func (fs *FileBackingStore) keyPath(name string) string {
@@ -45,32 +69,268 @@ func (fs *FileBackingStore) keyPath(name string) string {
 	return path.Join(bucketPath, safeFilename)
 }
 
-func (fs *FileBackingStore) Lock() {
-	for fs.lock.TryLock() != nil {
-		time.Sleep(100 * time.Millisecond)
+// tryLockFile spins on a lock file until it is held or ctx is done.
+func tryLockFile(ctx context.Context, lock lockfile.Lockfile) error {
+	for lock.TryLock() != nil {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+	return nil
+}
+
+// waitForReaders spins until no other process holds a reader file, removing
+// those left behind by processes that have exited.
+func (fs *FileBackingStore) waitForReaders(ctx context.Context) error {
+	for {
+		paths, err := filepath.Glob(filepath.Join(fs.basePath, "rlock-*"))
+		if err != nil {
+			return err
+		}
+		busy := false
+		for _, path := range paths {
+			owner, err := lockfile.Lockfile(path).GetOwner()
+			if err == lockfile.ErrDeadOwner {
+				os.Remove(path)
+			} else if err == nil && owner.Pid != os.Getpid() {
+				busy = true
+			}
+		}
+		if !busy {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(100 * time.Millisecond):
+		}
 	}
-	fs.locked = true
+}
+
+// Lock takes the store exclusively, both against other FileBackingStores in
+// this process and, through the lock file, against other processes. Once
+// the lock file is held no new readers start in other processes, and Lock
+// waits for the ones already reading to finish.
+func (fs *FileBackingStore) Lock(ctx context.Context) error {
+	l := fileStoreLocks.acquire(fs.basePath)
+	if err := l.Lock(ctx); err != nil {
+		fileStoreLocks.release(fs.basePath)
+		return err
+	}
+
+	if err := tryLockFile(ctx, fs.lock); err != nil {
+		l.Unlock()
+		fileStoreLocks.release(fs.basePath)
+		return err
+	}
+	if err := fs.waitForReaders(ctx); err != nil {
+		fs.lock.Unlock()
+		l.Unlock()
+		fileStoreLocks.release(fs.basePath)
+		return err
+	}
+	return nil
 }
 
 func (fs *FileBackingStore) Unlock() {
 	fs.lock.Unlock()
-	fs.locked = false
+	fileStoreLocks.lookup(fs.basePath).Unlock()
+	fileStoreLocks.release(fs.basePath)
+}
+
+// tryLockReaders holds the reader file of this process unless a writer in
+// another process holds the lock file, returning whether it did.
+func (fs *FileBackingStore) tryLockReaders() bool {
+	fileStoreReaders.Lock()
+	defer fileStoreReaders.Unlock()
+
+	if fileStoreReaders.counts[fs.basePath] > 0 {
+		fileStoreReaders.counts[fs.basePath]++
+		return true
+	}
+
+	// the reader file goes first, so that a writer taking the lock file
+	// meanwhile either sees it or is seen by us
+	if fs.readers.TryLock() != nil {
+		return false
+	}
+	if _, err := fs.lock.GetOwner(); err == nil {
+		fs.readers.Unlock()
+		return false
+	}
+	fileStoreReaders.counts[fs.basePath] = 1
+	return true
+}
+
+func (fs *FileBackingStore) unlockReaders() {
+	fileStoreReaders.Lock()
+	defer fileStoreReaders.Unlock()
+
+	fileStoreReaders.counts[fs.basePath]--
+	if fileStoreReaders.counts[fs.basePath] == 0 {
+		delete(fileStoreReaders.counts, fs.basePath)
+		fs.readers.Unlock()
+	}
+}
+
+// RLock takes the store shared with other readers, both in this process and,
+// through the reader file, in other processes, so that a writer in another
+// process never changes the store while it is being read.
+func (fs *FileBackingStore) RLock(ctx context.Context) error {
+	l := fileStoreLocks.acquire(fs.basePath)
+	if err := l.RLock(ctx); err != nil {
+		fileStoreLocks.release(fs.basePath)
+		return err
+	}
+
+	for !fs.tryLockReaders() {
+		select {
+		case <-ctx.Done():
+			l.RUnlock()
+			fileStoreLocks.release(fs.basePath)
+			return ctx.Err()
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+	return nil
+}
+
+func (fs *FileBackingStore) RUnlock() {
+	fs.unlockReaders()
+	fileStoreLocks.lookup(fs.basePath).RUnlock()
+	fileStoreLocks.release(fs.basePath)
+}
+
+// LockKey holds a single key exclusively, using a lock file next to the key
+// to exclude other processes.
+func (fs *FileBackingStore) LockKey(ctx context.Context, name string) error {
+	lock, err := lockfile.New(fs.keyPath(name) + ".lock")
+	if err != nil {
+		return err
+	}
+
+	lockName := fs.basePath + "\x00" + name
+	l := fileKeyLocks.acquire(lockName)
+	if err := l.Lock(ctx); err != nil {
+		fileKeyLocks.release(lockName)
+		return err
+	}
+
+	if err := tryLockFile(ctx, lock); err != nil {
+		l.Unlock()
+		fileKeyLocks.release(lockName)
+		return err
+	}
+	return nil
 }
 
-func (fs *FileBackingStore) Set(name string, value []byte) (err error) {
-	if !fs.locked {
-		return errors.New("Lock must be aquired before calling Set")
+func (fs *FileBackingStore) UnlockKey(name string) {
+	lock, err := lockfile.New(fs.keyPath(name) + ".lock")
+	if err == nil {
+		lock.Unlock()
+	}
+
+	lockName := fs.basePath + "\x00" + name
+	fileKeyLocks.lookup(lockName).Unlock()
+	fileKeyLocks.release(lockName)
+}
+
+func (fs *FileBackingStore) Set(ctx context.Context, name string, value []byte) error {
+	if err := ctx.Err(); err != nil {
+		return err
 	}
 	path := fs.keyPath(name)
-	err = ioutil.WriteFile(path, value, 0644)
+
+	// write to a temporary file and rename it into place, so that concurrent
+	// readers see either the old or the new value and never a partial one
+	tmp, err := ioutil.TempFile(filepath.Dir(path), ".tmp-")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(value)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(tmp.Name(), 0644)
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
 	return err
 }
 
-func (fs *FileBackingStore) Get(name string) ([]byte, error) {
-	if !fs.locked {
-		return nil, errors.New("Lock must be aquired before calling Get")
+func (fs *FileBackingStore) Get(ctx context.Context, name string) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
 	}
 	path := fs.keyPath(name)
 	data, err := ioutil.ReadFile(path)
 	return data, err
 }
+
+func (fs *FileBackingStore) Delete(ctx context.Context, name string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	err := os.Remove(fs.keyPath(name))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+func (fs *FileBackingStore) List(ctx context.Context, prefix string) ([]string, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	// keys are bucketed by the first 10 bytes of their name, so a long enough
+	// prefix narrows the search down to a single bucket
+	hexPrefix := hex.EncodeToString([]byte(prefix))
+	var buckets []string
+	if len(hexPrefix) >= 20 {
+		buckets = []string{hexPrefix[:20]}
+	} else {
+		entries, err := ioutil.ReadDir(fs.basePath)
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range entries {
+			if entry.IsDir() && strings.HasPrefix(entry.Name(), hexPrefix) {
+				buckets = append(buckets, entry.Name())
+			}
+		}
+	}
+
+	var names []string
+	for _, bucket := range buckets {
+		entries, err := ioutil.ReadDir(path.Join(fs.basePath, bucket))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range entries {
+			if !strings.HasPrefix(entry.Name(), hexPrefix) {
+				continue
+			}
+			// skips lock and temporary files, which are never valid hex
+			name, err := hex.DecodeString(entry.Name())
+			if err != nil {
+				continue
+			}
+			names = append(names, string(name))
+		}
+	}
+
+	sort.Strings(names)
+	return names, nil
+}
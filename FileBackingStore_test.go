@@ -0,0 +1,93 @@
+package gitpacklib
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestFileBackingStoreLocksAcrossProcesses(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	store, err := NewFileBackingStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exists := func(name string) bool {
+		_, err := os.Stat(filepath.Join(dir, name))
+		return err == nil
+	}
+	timeout := func() context.Context {
+		ctx, cancel := context.WithTimeout(ctx, 300*time.Millisecond)
+		t.Cleanup(cancel)
+		return ctx
+	}
+
+	// the parent process stands in for another process using the store
+	other := strconv.Itoa(os.Getppid())
+	readers := "rlock-" + strconv.Itoa(os.Getpid())
+
+	// a reader in another process holds off a writer, but not a reader
+	if err := ioutil.WriteFile(filepath.Join(dir, "rlock-"+other), []byte(other+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Lock(timeout()); err == nil {
+		t.Fatal("Store locked while another process reads it")
+	}
+	if exists("lock") {
+		t.Error("Lock file left behind by a lock that timed out")
+	}
+	if err := store.RLock(ctx); err != nil {
+		t.Fatal(err)
+	}
+	store.RUnlock()
+	os.Remove(filepath.Join(dir, "rlock-"+other))
+	if err := store.Lock(ctx); err != nil {
+		t.Fatal(err)
+	}
+	store.Unlock()
+
+	// a writer in another process holds off readers
+	if err := ioutil.WriteFile(filepath.Join(dir, "lock"), []byte(other+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.RLock(timeout()); err == nil {
+		t.Fatal("Store read while another process writes it")
+	}
+	if exists(readers) {
+		t.Error("Reader file left behind by a lock that timed out")
+	}
+	os.Remove(filepath.Join(dir, "lock"))
+
+	// the reader file is held while any reader in this process is
+	if err := store.RLock(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.RLock(ctx); err != nil {
+		t.Fatal(err)
+	}
+	store.RUnlock()
+	if !exists(readers) {
+		t.Error("Reader file removed while a reader remains")
+	}
+	store.RUnlock()
+	if exists(readers) {
+		t.Error("Reader file left behind by the last reader")
+	}
+
+	// the reader file of a process that has exited is ignored
+	if err := ioutil.WriteFile(filepath.Join(dir, "rlock-999999999"), []byte("999999999\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Lock(timeout()); err != nil {
+		t.Fatal(err)
+	}
+	store.Unlock()
+	if names, err := store.List(ctx, ""); err != nil || len(names) != 0 {
+		t.Errorf("Lock files are listed as keys %v: %v", names, err)
+	}
+}
@@ -0,0 +1,741 @@
+package gitpacklib
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"errors"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// DefaultGCGracePeriod is how long CollectGarbage keeps unreachable objects
+// unless configured otherwise, like git's gc.pruneExpire.
+const DefaultGCGracePeriod = 14 * 24 * time.Hour
+
+// The defaults of git gc for how long reflog entries are kept, like
+// gc.reflogExpire and gc.reflogExpireUnreachable.
+const (
+	DefaultReflogExpire            = 90 * 24 * time.Hour
+	DefaultReflogExpireUnreachable = 30 * 24 * time.Hour
+)
+
+// The defaults of git gc --auto for how many loose objects and packs a
+// repository may have before it needs collecting.
+const (
+	DefaultGCAutoLoose = 6700
+	DefaultGCAutoPacks = 50
+)
+
+// gcLockKey is held by CollectGarbage so that only one collection of a
+// repository runs at a time.
+const gcLockKey = "gc"
+
+// GCOptions controls what CollectGarbage does.
+type GCOptions struct {
+	// GracePeriod is how long an object must have been unreachable before
+	// it is deleted. Until then it is kept in a cruft pack, where it can
+	// still be read, so that objects written by a push or other writer that
+	// has yet to update the refs pointing at them are not lost. Zero uses
+	// DefaultGCGracePeriod, and a negative value deletes unreachable objects
+	// at once.
+	GracePeriod time.Duration
+
+	// Repack writes every reachable object into a single new pack with
+	// deltas, replacing the loose objects and the other packs, as git gc
+	// does. Otherwise reachable objects are left where they are, and just
+	// loose objects and packs holding nothing reachable are cleaned up.
+	Repack bool
+
+	// Pack controls how the packs written are compressed.
+	Pack *PackOptions
+
+	// ReflogExpire is how long reflog entries are kept, and so keep the
+	// objects they point at, and ReflogExpireUnreachable how long those whose
+	// commits are no longer in the history of the ref are kept. Zero uses
+	// DefaultReflogExpire and DefaultReflogExpireUnreachable, and a negative
+	// value keeps entries forever. The reflog of a deleted ref is dropped once
+	// the ref is no longer in the trash.
+	ReflogExpire            time.Duration
+	ReflogExpireUnreachable time.Duration
+
+	// AutoLoose and AutoPacks are how many loose objects and packs NeedsGC
+	// allows before a repository needs collecting. Zero uses
+	// DefaultGCAutoLoose and DefaultGCAutoPacks.
+	AutoLoose int
+	AutoPacks int
+}
+
+// GCStats counts what a run of CollectGarbage did.
+type GCStats struct {
+	// Reachable is how many of the objects stored are reachable.
+	Reachable int
+
+	// Packed is how many reachable objects were written to a new pack.
+	Packed int
+
+	// Quarantined is how many unreachable objects were kept in the cruft
+	// pack, and Pruned how many were deleted.
+	Quarantined int
+	Pruned      int
+
+	// LooseRemoved and PacksRemoved are how many loose objects and packs were
+	// deleted, their objects having been packed, quarantined or pruned.
+	LooseRemoved int
+	PacksRemoved int
+}
+
+// CollectGarbage deletes the objects that can no longer be reached from the
+// refs of the repository, their reflogs or the refs in the trash, once they
+// have been unreachable for the grace period, and optionally repacks the
+// objects that can. Expired reflog entries are dropped first.
+//
+// Objects are marked without holding any lock, and only those stored when
+// the collection starts are considered, so pushes carry on meanwhile. The
+// repository is then held exclusively while the refs are read again and
+// marked from, and the objects that were packed elsewhere, quarantined or
+// pruned are deleted. An object that has become reachable since is never
+// pruned, and one that was quarantined can still be read, so a ref pointing
+// at it that is updated afterwards is left intact.
+func (repo *Repository) CollectGarbage(ctx context.Context, opts *GCOptions) (*GCStats, error) {
+	if err := repo.store.LockKey(ctx, gcLockKey); err != nil {
+		return nil, err
+	}
+	defer repo.store.UnlockKey(gcLockKey)
+	return repo.collectGarbage(ctx, opts)
+}
+
+// NeedsGC reports whether the repository has so many loose objects or packs
+// that it is worth collecting, as git gc --auto does. Like git, the number
+// of loose objects is estimated from those whose shas start with 17.
+func (repo *Repository) NeedsGC(ctx context.Context, opts *GCOptions) (bool, error) {
+	if opts == nil {
+		opts = &GCOptions{}
+	}
+	autoLoose := opts.AutoLoose
+	if autoLoose == 0 {
+		autoLoose = DefaultGCAutoLoose
+	}
+	autoPacks := opts.AutoPacks
+	if autoPacks == 0 {
+		autoPacks = DefaultGCAutoPacks
+	}
+
+	loose, err := repo.store.List(ctx, objectKeyPrefix+"17")
+	if err != nil {
+		return false, err
+	}
+	if len(loose)*256 > autoLoose {
+		return true, nil
+	}
+
+	keys, err := repo.store.List(ctx, packKeyPrefix)
+	if err != nil {
+		return false, err
+	}
+	packs := 0
+	for _, key := range keys {
+		if strings.HasSuffix(key, packIndexSuffix) {
+			packs++
+		}
+	}
+	return packs > autoPacks, nil
+}
+
+// collectGarbageIfNeeded collects and repacks the repository if NeedsGC says
+// so once any collection already running has finished, returning nil stats
+// if not. Like git gc --auto it always repacks, as that is what brings the
+// number of loose objects and packs back down.
+func (repo *Repository) collectGarbageIfNeeded(ctx context.Context, opts *GCOptions) (*GCStats, error) {
+	if err := repo.store.LockKey(ctx, gcLockKey); err != nil {
+		return nil, err
+	}
+	defer repo.store.UnlockKey(gcLockKey)
+
+	needed, err := repo.NeedsGC(ctx, opts)
+	if err != nil || !needed {
+		return nil, err
+	}
+	repack := GCOptions{}
+	if opts != nil {
+		repack = *opts
+	}
+	repack.Repack = true
+	return repo.collectGarbage(ctx, &repack)
+}
+
+func (repo *Repository) collectGarbage(ctx context.Context, opts *GCOptions) (*GCStats, error) {
+	if opts == nil {
+		opts = &GCOptions{}
+	}
+	grace := opts.GracePeriod
+	if grace == 0 {
+		grace = DefaultGCGracePeriod
+	}
+
+	gc := &collector{
+		repo:      repo,
+		now:       time.Now(),
+		repack:    opts.Repack,
+		objects:   map[string]*gcObject{},
+		cruft:     map[*storedPack]bool{},
+		reachable: map[string]bool{},
+		stats:     &GCStats{},
+	}
+	if err := PurgeTrash(ctx, repo.store, gc.now); err != nil {
+		return nil, err
+	}
+	if err := gc.expireReflogs(ctx, opts); err != nil {
+		return nil, err
+	}
+	if err := gc.snapshot(ctx); err != nil {
+		return nil, err
+	}
+	roots, err := gc.roots(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if err := gc.mark(ctx, roots, gc.reachable, true); err != nil {
+		return nil, err
+	}
+	if err := gc.plan(ctx, grace); err != nil {
+		return nil, err
+	}
+	if err := gc.writePacks(ctx, opts.Pack); err != nil {
+		return nil, err
+	}
+
+	if err := repo.store.Lock(ctx); err != nil {
+		return nil, err
+	}
+	defer repo.store.Unlock()
+
+	roots, err = gc.roots(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if err := gc.mark(ctx, roots, gc.reachable, true); err != nil {
+		return nil, err
+	}
+	if err := gc.sweep(ctx); err != nil {
+		return nil, err
+	}
+	return gc.stats, nil
+}
+
+// gcObject is where an object stored when a collection starts is found.
+type gcObject struct {
+	loose bool
+	packs []*storedPack
+
+	// mtime is when the object was found unreachable, if it is already in a
+	// cruft pack
+	mtime time.Time
+}
+
+// collector is a single run of CollectGarbage.
+type collector struct {
+	repo   *Repository
+	now    time.Time
+	repack bool
+
+	objects   map[string]*gcObject
+	packs     []*storedPack
+	cruft     map[*storedPack]bool
+	reachable map[string]bool
+
+	// what plan decided to do with the objects that were stored
+	packed       []string
+	quarantined  map[string]time.Time
+	pruned       map[string]bool
+	removedLoose []string
+	removedPacks map[string]bool
+	wrotePacks   bool
+
+	stats *GCStats
+}
+
+// snapshot lists the loose objects and packs in the store, along with when
+// the objects in cruft packs were found unreachable.
+func (gc *collector) snapshot(ctx context.Context) error {
+	store := gc.repo.store
+	keys, err := store.List(ctx, objectKeyPrefix)
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		gc.object(strings.TrimPrefix(key, objectKeyPrefix)).loose = true
+	}
+
+	packs, err := gc.repo.packs.indexedPacks(ctx, store)
+	if err != nil {
+		return err
+	}
+	for _, pack := range packs {
+		var mtimes map[string]time.Time
+		data, err := store.Get(ctx, pack.name+packMtimesSuffix)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		if err == nil {
+			mtimes, err = readPackMtimes(data, pack.index)
+			if err != nil {
+				return errors.New("Error reading " + pack.name + packMtimesSuffix + ": " + err.Error())
+			}
+			gc.cruft[pack] = true
+		}
+
+		gc.packs = append(gc.packs, pack)
+		for i := 0; i < pack.index.NumObjects(); i++ {
+			sha := hex.EncodeToString(pack.index.sha(i))
+			obj := gc.object(sha)
+			obj.packs = append(obj.packs, pack)
+			if mtime, ok := mtimes[sha]; ok && mtime.After(obj.mtime) {
+				obj.mtime = mtime
+			}
+		}
+	}
+	return nil
+}
+
+func (gc *collector) object(sha string) *gcObject {
+	obj := gc.objects[sha]
+	if obj == nil {
+		obj = &gcObject{}
+		gc.objects[sha] = obj
+	}
+	return obj
+}
+
+// roots returns the shas that the refs, the entries of their reflogs and the
+// refs in the trash point at.
+func (gc *collector) roots(ctx context.Context) ([]string, error) {
+	var roots []string
+	refs, err := gc.repo.Refs(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, ref := range refs {
+		if ref.Hash != "" {
+			roots = append(roots, ref.Hash)
+		}
+	}
+
+	keys, err := gc.repo.store.List(ctx, reflogKeyPrefix)
+	if err != nil {
+		return nil, err
+	}
+	for _, key := range keys {
+		entries, err := ReadReflog(ctx, gc.repo.store, strings.TrimPrefix(key, reflogKeyPrefix))
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range entries {
+			for _, sha := range []string{entry.OldHash, entry.NewHash} {
+				if sha != "" && sha != zeroSha {
+					roots = append(roots, sha)
+				}
+			}
+		}
+	}
+
+	trash, err := ListTrash(ctx, gc.repo.store)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range trash {
+		roots = append(roots, entry.Hash)
+	}
+	return roots, nil
+}
+
+// expireReflogs drops the reflog entries that are older than opts allow, and
+// the reflogs of deleted refs that are no longer in the trash.
+func (gc *collector) expireReflogs(ctx context.Context, opts *GCOptions) error {
+	expire := opts.ReflogExpire
+	if expire == 0 {
+		expire = DefaultReflogExpire
+	}
+	expireUnreachable := opts.ReflogExpireUnreachable
+	if expireUnreachable == 0 {
+		expireUnreachable = DefaultReflogExpireUnreachable
+	}
+
+	keys, err := gc.repo.store.List(ctx, reflogKeyPrefix)
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		name := strings.TrimPrefix(key, reflogKeyPrefix)
+		err := rewriteReflog(ctx, gc.repo.store, name, func(entries []*ReflogEntry) ([]*ReflogEntry, error) {
+			return gc.unexpiredEntries(ctx, name, entries, expire, expireUnreachable)
+		})
+		if err != nil {
+			return errors.New("Error expiring reflog of " + name + ": " + err.Error())
+		}
+	}
+	return nil
+}
+
+// unexpiredEntries returns the entries of the reflog of the named ref that
+// are kept, given newest first.
+func (gc *collector) unexpiredEntries(ctx context.Context, name string, entries []*ReflogEntry, expire time.Duration, expireUnreachable time.Duration) ([]*ReflogEntry, error) {
+	tip, err := gc.repo.refs.Get(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	if tip != nil && tip.Target != "" {
+		tip, err = ResolveRef(ctx, gc.repo.refs, name)
+		if err != nil && err != ErrSymbolicRefLoop {
+			return nil, err
+		}
+	}
+	tipHash := ""
+	if tip != nil {
+		tipHash = tip.Hash
+	}
+
+	// a deleted ref is trashed before its deletion is logged, so its reflog
+	// is only dropped once that entry is in and the ref has left the trash
+	if tip == nil && len(entries) > 0 && entries[0].NewHash == "" {
+		trash, err := ListTrash(ctx, gc.repo.store)
+		if err != nil {
+			return nil, err
+		}
+		trashed := false
+		for _, entry := range trash {
+			trashed = trashed || entry.Name == name
+		}
+		if !trashed {
+			return nil, nil
+		}
+	}
+
+	var kept []*ReflogEntry
+	for _, entry := range entries {
+		age := gc.now.Sub(entry.Time)
+		if expire > 0 && age > expire {
+			continue
+		}
+		if expireUnreachable > 0 && age > expireUnreachable {
+			oldReachable, err := gc.inHistory(ctx, entry.OldHash, tipHash)
+			if err != nil {
+				return nil, err
+			}
+			newReachable, err := gc.inHistory(ctx, entry.NewHash, tipHash)
+			if err != nil {
+				return nil, err
+			}
+			if !oldReachable || !newReachable {
+				continue
+			}
+		}
+		kept = append(kept, entry)
+	}
+	return kept, nil
+}
+
+// inHistory reports whether a value a reflog entry gives a ref is in the
+// history of the ref's tip. Like git, no value and objects other than
+// commits count as being in it, and missing objects do not.
+func (gc *collector) inHistory(ctx context.Context, sha string, tip string) (bool, error) {
+	if sha == "" || sha == tip {
+		return true, nil
+	}
+	if tip == "" {
+		return false, nil
+	}
+	for _, object := range []string{sha, tip} {
+		objType, _, err := gc.repo.ReadRawObject(ctx, object)
+		if err == ErrObjectNotFound {
+			return false, nil
+		}
+		if err != nil {
+			return false, err
+		}
+		if objType != CommitObject {
+			return true, nil
+		}
+	}
+	return gc.repo.IsAncestor(ctx, sha, tip)
+}
+
+// mark adds the objects reachable from roots to marked, skipping those that
+// are already reachable. Roots that are missing are skipped, as the old
+// value in a reflog may be, but when strict anything else that is missing
+// fails the collection rather than pruning the objects it would reach.
+func (gc *collector) mark(ctx context.Context, roots []string, marked map[string]bool, strict bool) error {
+	type pending struct {
+		sha  string
+		blob bool
+		root bool
+	}
+	var stack []pending
+	for _, sha := range roots {
+		stack = append(stack, pending{sha: sha, root: true})
+	}
+
+	for len(stack) > 0 {
+		next := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		if marked[next.sha] || gc.reachable[next.sha] {
+			continue
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		// blobs are not read, as nothing is reached from them
+		var objType string
+		var data []byte
+		var err error
+		if next.blob {
+			if gc.objects[next.sha] == nil {
+				var found bool
+				found, err = gc.repo.HasObject(ctx, next.sha)
+				if err == nil && !found {
+					err = ErrObjectNotFound
+				}
+			}
+		} else {
+			objType, data, err = gc.repo.ReadRawObject(ctx, next.sha)
+		}
+		if err == ErrObjectNotFound && (next.root || !strict) {
+			continue
+		}
+		if err == ErrObjectNotFound {
+			return errors.New("Object " + next.sha + " is reachable but missing")
+		}
+		if err != nil {
+			return err
+		}
+		marked[next.sha] = true
+
+		switch objType {
+		case CommitObject:
+			commit, err := ParseCommit(data)
+			if err != nil {
+				return errors.New("Error reading commit " + next.sha + ": " + err.Error())
+			}
+			stack = append(stack, pending{sha: commit.Tree})
+			for _, parent := range commit.Parents {
+				stack = append(stack, pending{sha: parent})
+			}
+		case TreeObject:
+			tree, err := ParseTree(data)
+			if err != nil {
+				return errors.New("Error reading tree " + next.sha + ": " + err.Error())
+			}
+			for _, entry := range tree.Entries {
+				switch entry.Mode {
+				case ModeSubmodule:
+					// the commit is in another repository
+				case ModeTree:
+					stack = append(stack, pending{sha: entry.Hash})
+				default:
+					stack = append(stack, pending{sha: entry.Hash, blob: true})
+				}
+			}
+		case TagObject:
+			tag, err := ParseTag(data)
+			if err != nil {
+				return errors.New("Error reading tag " + next.sha + ": " + err.Error())
+			}
+			stack = append(stack, pending{sha: tag.Object, blob: tag.ObjectType == BlobObject})
+		}
+	}
+	return nil
+}
+
+// plan decides what to do with each object stored. Reachable objects go in
+// a new pack if repacking or if nothing they are stored in is kept.
+// Unreachable ones go in a new cruft pack while they are within the grace
+// period or reachable from one that is, as in git, and are pruned
+// otherwise. When not repacking, unreachable objects in packs that also
+// hold reachable ones are left where they are.
+func (gc *collector) plan(ctx context.Context, grace time.Duration) error {
+	gc.removedPacks = map[string]bool{}
+	for _, pack := range gc.packs {
+		if gc.repack || gc.cruft[pack] || !gc.holdsReachable(pack) {
+			gc.removedPacks[pack.name] = true
+		}
+	}
+
+	cutoff := gc.now.Add(-grace)
+	var recent []string
+	for sha, obj := range gc.objects {
+		if gc.reachable[sha] || gc.kept(sha) {
+			continue
+		}
+		if grace > 0 && (obj.mtime.IsZero() || obj.mtime.After(cutoff)) {
+			recent = append(recent, sha)
+		}
+	}
+	retained := map[string]bool{}
+	if err := gc.mark(ctx, recent, retained, false); err != nil {
+		return err
+	}
+
+	gc.quarantined = map[string]time.Time{}
+	gc.pruned = map[string]bool{}
+	for sha, obj := range gc.objects {
+		switch {
+		case gc.reachable[sha]:
+			gc.stats.Reachable++
+			if !gc.kept(sha) {
+				gc.packed = append(gc.packed, sha)
+			}
+		case gc.kept(sha):
+		case retained[sha]:
+			mtime := obj.mtime
+			if mtime.IsZero() {
+				mtime = gc.now
+			}
+			gc.quarantined[sha] = mtime
+		default:
+			gc.pruned[sha] = true
+		}
+
+		if obj.loose && (gc.repack || !gc.reachable[sha]) {
+			gc.removedLoose = append(gc.removedLoose, sha)
+		}
+	}
+	sort.Strings(gc.packed)
+	return nil
+}
+
+// kept reports whether an object stays where it is, as a reachable loose
+// object or in a pack that is not removed.
+func (gc *collector) kept(sha string) bool {
+	if gc.repack {
+		return false
+	}
+	obj := gc.objects[sha]
+	for _, pack := range obj.packs {
+		if !gc.removedPacks[pack.name] {
+			return true
+		}
+	}
+	return obj.loose && gc.reachable[sha]
+}
+
+func (gc *collector) holdsReachable(pack *storedPack) bool {
+	for i := 0; i < pack.index.NumObjects(); i++ {
+		if gc.reachable[hex.EncodeToString(pack.index.sha(i))] {
+			return true
+		}
+	}
+	return false
+}
+
+// writePacks writes the reachable objects that plan found need packing to a
+// new pack, and the quarantined objects to a new cruft pack.
+func (gc *collector) writePacks(ctx context.Context, opts *PackOptions) error {
+	if len(gc.packed) > 0 {
+		if err := gc.writePack(ctx, gc.packed, opts, nil); err != nil {
+			return err
+		}
+		gc.stats.Packed = len(gc.packed)
+	}
+
+	if len(gc.quarantined) > 0 {
+		var shas []string
+		for sha := range gc.quarantined {
+			shas = append(shas, sha)
+		}
+		sort.Strings(shas)
+		if err := gc.writePack(ctx, shas, opts, gc.quarantined); err != nil {
+			return err
+		}
+		gc.stats.Quarantined = len(shas)
+	}
+	return nil
+}
+
+// writePack stores a pack of objects, which is a cruft pack if mtimes are
+// given for them.
+func (gc *collector) writePack(ctx context.Context, objects []string, opts *PackOptions, mtimes map[string]time.Time) error {
+	pack := &bytes.Buffer{}
+	checksum, entries, err := gc.repo.writePack(ctx, pack, objects, opts)
+	if err != nil {
+		return err
+	}
+	index, reverse, err := indexPack(checksum, entries)
+	if err != nil {
+		return err
+	}
+	var mtimesData []byte
+	if mtimes != nil {
+		mtimesData = writePackMtimes(index, mtimes)
+	}
+	err = savePack(ctx, gc.repo.store, checksum, pack.Bytes(), index, reverse, mtimesData)
+	if err != nil {
+		return errors.New("Error saving pack: " + err.Error())
+	}
+
+	// a pack that is the same as one already stored has just replaced it
+	delete(gc.removedPacks, packKey(checksum, ""))
+	gc.wrotePacks = true
+	return nil
+}
+
+// sweep saves pruned objects that have become reachable since plan as loose
+// objects, then writes a multi-pack index of the packs that are kept and
+// deletes the rest, along with the loose objects that were packed,
+// quarantined or pruned. It runs with the repository held exclusively, after
+// the refs have been marked from again.
+func (gc *collector) sweep(ctx context.Context) error {
+	store := gc.repo.store
+	rescued := map[string]bool{}
+	for sha := range gc.pruned {
+		if !gc.reachable[sha] {
+			continue
+		}
+		objType, data, err := gc.repo.ReadRawObject(ctx, sha)
+		if err != nil {
+			return errors.New("Error reading object " + sha + ": " + err.Error())
+		}
+		if _, err := saveObject(ctx, store, gc.repo.packs, objType, data); err != nil {
+			return errors.New("Error saving object: " + err.Error())
+		}
+		rescued[sha] = true
+		delete(gc.pruned, sha)
+	}
+
+	if gc.wrotePacks || len(gc.removedPacks) > 0 {
+		if err := gc.repo.packs.writeMultiPackIndex(ctx, store, gc.removedPacks); err != nil {
+			return errors.New("Error writing multi-pack index: " + err.Error())
+		}
+	}
+	for name := range gc.removedPacks {
+		if err := removePack(ctx, store, name); err != nil {
+			return err
+		}
+		gc.stats.PacksRemoved++
+	}
+	for _, sha := range gc.removedLoose {
+		if rescued[sha] {
+			continue
+		}
+		if err := store.Delete(ctx, objectKeyPrefix+sha); err != nil {
+			return err
+		}
+		gc.stats.LooseRemoved++
+	}
+
+	keys, err := store.List(ctx, peeledKeyPrefix)
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		if gc.pruned[strings.TrimPrefix(key, peeledKeyPrefix)] {
+			if err := store.Delete(ctx, key); err != nil {
+				return err
+			}
+		}
+	}
+	gc.stats.Pruned = len(gc.pruned)
+	return nil
+}
@@ -0,0 +1,242 @@
+package gitpacklib
+
+import (
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// gcTestRepository makes a git repository with a branch, tags and an
+// unreachable commit, and copies its objects and refs into a repository,
+// some of the objects loose and the rest in a pack. It returns the
+// repository and the git repository, with the objects reachable from the
+// refs and the unreachable commit.
+func gcTestRepository(t *testing.T) (*Repository, string, []string, string) {
+	ctx := context.Background()
+	dir := packTestRepository(t)
+	repo := newTestRepository(t)
+	packPath, indexPath := gitPack(t, dir)
+	storeGitPack(t, repo, packPath, indexPath)
+
+	runGit(t, dir, "checkout", "-q", "-b", "topic")
+	writeFiles(t, dir, map[string][]byte{"topic.txt": []byte("topic\n")})
+	unreachable := gitCommit(t, dir, "topic")
+	runGit(t, dir, "checkout", "-q", "main")
+	runGit(t, dir, "branch", "-q", "-D", "topic")
+	writeFiles(t, dir, map[string][]byte{"big.txt": numberedLines(600, nil)})
+	gitCommit(t, dir, "latest")
+	importGitObjects(t, repo, dir)
+
+	var updates []*RefUpdate
+	for _, line := range strings.Split(strings.TrimSpace(string(runGit(t, dir, "for-each-ref", "--format=%(objectname) %(refname)"))), "\n") {
+		fields := strings.Fields(line)
+		updates = append(updates, &RefUpdate{Name: fields[1], NewHash: fields[0]})
+	}
+	if err := repo.RefStore().Update(ctx, updates); err != nil {
+		t.Fatal(err)
+	}
+
+	var reachable []string
+	for _, line := range strings.Split(strings.TrimSpace(string(runGit(t, dir, "rev-list", "--objects", "--all"))), "\n") {
+		reachable = append(reachable, strings.Fields(line)[0])
+	}
+	return repo, dir, reachable, unreachable
+}
+
+// checkObjects checks that each of the objects can be read and has the right
+// content.
+func checkObjects(t *testing.T, repo *Repository, objects []string) {
+	t.Helper()
+	for _, sha := range objects {
+		objType, data, err := repo.ReadRawObject(context.Background(), sha)
+		if err != nil {
+			t.Errorf("Error reading %s: %v", sha, err)
+		} else if HashObject(objType, data) != sha {
+			t.Errorf("Object %s has the wrong content", sha)
+		}
+	}
+}
+
+func TestCollectGarbageRepacks(t *testing.T) {
+	ctx := context.Background()
+	repo, _, reachable, unreachable := gcTestRepository(t)
+
+	stats, err := repo.CollectGarbage(ctx, &GCOptions{Repack: true, GracePeriod: -1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Reachable != len(reachable) || stats.Packed != len(reachable) {
+		t.Errorf("Collection found %d reachable objects and packed %d, want %d", stats.Reachable, stats.Packed, len(reachable))
+	}
+	if stats.Pruned == 0 || stats.PacksRemoved != 1 {
+		t.Errorf("Collection pruned %d objects and removed %d packs", stats.Pruned, stats.PacksRemoved)
+	}
+
+	// a fresh repository reads every reachable object from the one new pack
+	repo = NewRepository(repo.store, nil)
+	checkObjects(t, repo, reachable)
+	if ok, err := repo.HasObject(ctx, unreachable); ok || err != nil {
+		t.Errorf("Unreachable commit is still stored: %v", err)
+	}
+	loose, err := repo.store.List(ctx, objectKeyPrefix)
+	if err != nil || len(loose) != 0 {
+		t.Errorf("Loose objects %v are left: %v", loose, err)
+	}
+
+	// the packs written are whole and complete as far as git is concerned
+	gitDir := t.TempDir()
+	runGit(t, gitDir, "init", "-q", "--bare")
+	packs, err := repo.store.List(ctx, packKeyPrefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range packs {
+		data, err := repo.store.Get(ctx, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(gitDir, "objects", key), data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	refs, err := repo.Refs(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, ref := range refs {
+		runGit(t, gitDir, "update-ref", ref.Name, ref.Hash)
+	}
+	runGit(t, gitDir, "fsck", "--strict", "--no-dangling")
+}
+
+func TestCollectGarbageQuarantines(t *testing.T) {
+	ctx := context.Background()
+	repo, _, reachable, unreachable := gcTestRepository(t)
+
+	stats, err := repo.CollectGarbage(ctx, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Quarantined == 0 || stats.Pruned != 0 {
+		t.Errorf("Collection quarantined %d objects and pruned %d", stats.Quarantined, stats.Pruned)
+	}
+	repo = NewRepository(repo.store, nil)
+	checkObjects(t, repo, append(reachable, unreachable))
+
+	// once the grace period is over, the quarantined objects go
+	if _, err := repo.CollectGarbage(ctx, &GCOptions{GracePeriod: -1}); err != nil {
+		t.Fatal(err)
+	}
+	repo = NewRepository(repo.store, nil)
+	checkObjects(t, repo, reachable)
+	if ok, err := repo.HasObject(ctx, unreachable); ok || err != nil {
+		t.Errorf("Unreachable commit is still stored: %v", err)
+	}
+}
+
+func TestCollectGarbageExpiresReflogs(t *testing.T) {
+	ctx := context.Background()
+	repo := newTestRepository(t)
+	store := repo.store
+	author := &Signature{Name: "A U Thor", Email: "author@example.com", When: time.Unix(1700000000, 0).UTC()}
+	commit := func(ref string, parent string, content string) string {
+		sha, err := repo.CreateCommit(ctx, &CommitRequest{Ref: ref, Parent: parent, Files: []FileChange{{Path: "file", Data: []byte(content)}}, Author: author, Message: content})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return sha
+	}
+	deleteRef := func(name string, sha string) {
+		if err := repo.refs.Update(ctx, []*RefUpdate{{Name: name, OldHash: sha}}); err != nil {
+			t.Fatal(err)
+		}
+		if err := AppendReflog(ctx, store, name, &ReflogEntry{OldHash: sha, Time: time.Now(), Message: "delete"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// main is reset away from forced, which only its reflog then reaches
+	first := commit("refs/heads/main", "", "first")
+	forced := commit("refs/heads/main", first, "forced")
+	if err := repo.refs.Update(ctx, []*RefUpdate{{Name: "refs/heads/main", OldHash: forced, NewHash: first}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := AppendReflog(ctx, store, "refs/heads/main", &ReflogEntry{OldHash: forced, NewHash: first, Time: time.Now(), Message: "reset"}); err != nil {
+		t.Fatal(err)
+	}
+	second := commit("refs/heads/main", first, "second")
+
+	// a deleted branch, and one that is deleted to the trash
+	gone := commit("refs/heads/gone", "", "gone")
+	deleteRef("refs/heads/gone", gone)
+	trashed := commit("refs/heads/trashed", "", "trashed")
+	if err := TrashRef(ctx, store, "refs/heads/trashed", trashed, "someone", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	deleteRef("refs/heads/trashed", trashed)
+
+	// make the reflog of main old enough for unreachable entries to expire
+	entries, err := ReadReflog(ctx, store, "refs/heads/main")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var log []byte
+	for i := len(entries) - 1; i >= 0; i-- {
+		entries[i].Time = time.Now().Add(-40 * 24 * time.Hour)
+		log = append(log, serializeReflogEntry(entries[i])...)
+	}
+	if err := store.Set(ctx, reflogKeyPrefix+"refs/heads/main", log); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := repo.CollectGarbage(ctx, &GCOptions{GracePeriod: -1}); err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err = ReadReflog(ctx, store, "refs/heads/main")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var kept []string
+	for _, entry := range entries {
+		kept = append(kept, entry.OldHash+".."+entry.NewHash)
+	}
+	want := []string{first + ".." + second, ".." + first}
+	if strings.Join(kept, " ") != strings.Join(want, " ") {
+		t.Errorf("Reflog of main kept %v, want %v", kept, want)
+	}
+	for name, want := range map[string]int{"refs/heads/gone": 0, "refs/heads/trashed": 2} {
+		if entries, err := ReadReflog(ctx, store, name); err != nil || len(entries) != want {
+			t.Errorf("Reflog of %s has %d entries, want %d: %v", name, len(entries), want, err)
+		}
+	}
+
+	for sha, want := range map[string]bool{first: true, second: true, forced: false, gone: false, trashed: true} {
+		if ok, err := repo.HasObject(ctx, sha); ok != want || err != nil {
+			t.Errorf("Commit %s stored is %v, want %v: %v", sha, ok, want, err)
+		}
+	}
+}
+
+func TestCollectGarbageKeepsLegacyTrees(t *testing.T) {
+	ctx := context.Background()
+	dir := newGitRepository(t)
+	blob := gitHashObject(t, dir, BlobObject, []byte("content\n"))
+	sub := gitHashObject(t, dir, TreeObject, treeData(blob, "100644 .git"))
+	tree := gitHashObject(t, dir, TreeObject, treeData(sub, "040000 dir"))
+	commit := strings.TrimSpace(string(runGit(t, dir, "commit-tree", "-m", "legacy", tree)))
+	repo := newTestRepository(t)
+	importGitObjects(t, repo, dir)
+	if err := repo.RefStore().Update(ctx, []*RefUpdate{{Name: "refs/heads/main", NewHash: commit}}); err != nil {
+		t.Fatal(err)
+	}
+
+	// trees older tools wrote are kept and repacked as they are
+	if _, err := repo.CollectGarbage(ctx, &GCOptions{Repack: true, GracePeriod: -1}); err != nil {
+		t.Fatal(err)
+	}
+	checkObjects(t, NewRepository(repo.store, nil), []string{commit, tree, sub, blob})
+}
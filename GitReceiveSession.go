@@ -3,27 +3,98 @@ package gitpacklib
 import (
 	"bufio"
 	"bytes"
-	"compress/zlib"
+	"context"
 	"crypto/sha1"
-	"encoding/binary"
 	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
 	"log"
+	"math"
 	"strconv"
 	"strings"
+	"time"
 )
 
 const RefsKey = "refs"
 
+const zeroSha = "0000000000000000000000000000000000000000"
+
+// DefaultMaxPackSize is the largest pack a push may send if MaxPackSize is
+// not set.
+const DefaultMaxPackSize = 1 << 30
+
+var ErrPackTooLarge = errors.New("Pack exceeds the maximum allowed size")
+
 type GitReceiveSession struct {
 	BackingStore BackingStore
-	refMap       *RefMap
 
-	updatedRefs []string
+	// RefStore holds the refs of the repository. If nil, a LooseRefStore over
+	// BackingStore is used.
+	RefStore RefStore
+
+	// DefaultBranch is the branch HEAD is pointed at if the repository does
+	// not have a HEAD yet. If empty, the package DefaultBranch is used.
+	DefaultBranch string
+
+	// RejectCaseCollisions rejects new refs whose names differ only in case
+	// from an existing ref, which would clash in clones on case-insensitive
+	// filesystems.
+	RejectCaseCollisions bool
+
+	// DenyNonFastForwards rejects updates to branches that are not fast
+	// forwards, so that history can not be rewritten by a force push.
+	DenyNonFastForwards bool
+
+	// Pusher identifies who is pushing in the reflog entries recorded for
+	// each ref updated, such as the PusherIdentity of their key.
+	Pusher string
+
+	// TrashRetention is how long refs deleted by a push are kept in the trash
+	// so that they can be restored. Zero uses DefaultTrashRetention, and a
+	// negative value deletes refs outright.
+	TrashRetention time.Duration
+
+	// HideRefs hides refs from the client, which can neither see nor push to
+	// them, using the same patterns as git's transfer.hideRefs.
+	HideRefs []string
+
+	// RefFilter, if set, decides whether the client can see and push to a
+	// ref, given whether HideRefs hides it.
+	RefFilter func(ref string, hidden bool) bool
+
+	// LockTimeout bounds how long a push waits for the repository lock
+	// before it is rejected. Zero waits until the session's context is done.
+	LockTimeout time.Duration
+
+	// MaxPackSize bounds the size of the pack a push may send, which is held
+	// in memory until it is stored, like git's receive.maxInputSize. Zero
+	// uses DefaultMaxPackSize, and a negative value means no limit.
+	MaxPackSize int64
+
+	// AutoGC, if set, collects garbage and repacks in the background with
+	// these options after a push leaves the repository needing it, as
+	// decided by NeedsGC.
+	AutoGC *GCOptions
+
+	// repo reads objects for the whole session, so that packs are only
+	// read once
+	repo     *Repository
+	commands []*refCommand
+	atomic   bool
+}
+
+// refCommand is a single ref update requested by the client, along with the
+// reason it was rejected, if it was.
+type refCommand struct {
+	oldSha string
+	newSha string
+	ref    string
+
+	// target is the ref actually updated, after following symbolic refs
+	target string
 
-	gitVersion int32
+	err string
 }
 
 func NewGitReceiveSession() *GitReceiveSession {
@@ -31,32 +102,57 @@ func NewGitReceiveSession() *GitReceiveSession {
 	return session
 }
 
-func (session *GitReceiveSession) HandleGitReceivePack(in_ io.Reader, out io.Writer) {
-	session.refMap = NewRefMap()
-
-	session.BackingStore.Lock()
-	defer session.BackingStore.Unlock()
+// HandleGitReceivePack speaks the receive-pack protocol over in and out.
+//
+// The repository is only held shared, and objects from the pack are written
+// without holding any lock since they are content addressed. Just the refs
+// being pushed are locked while they are compared and swapped, so a slow push
+// neither holds up readers of the repository nor pushes to other refs.
+func (session *GitReceiveSession) HandleGitReceivePack(ctx context.Context, in_ io.Reader, out io.Writer) {
+	if session.RefStore == nil {
+		session.RefStore = NewLooseRefStore(session.BackingStore)
+	}
+	session.repo = NewRepository(session.BackingStore, session.RefStore)
 
-	// load the existing refs (if any) from the backing store
-	refMapBytes, err := session.BackingStore.Get(RefsKey)
-	if err == nil {
-		session.refMap.Deserialize(refMapBytes)
+	err := MigrateRefMap(ctx, session.BackingStore, session.RefStore)
+	if err != nil {
+		log.Println("Error migrating refs:", err.Error())
+		writeGitMessage(out, "ERR could not read refs")
+		return
 	}
 
-	capabilitySuffix := "\x00report-status delete-refs agent=gitpacklib/0.0.0"
+	defaultBranch := session.DefaultBranch
+	if defaultBranch == "" {
+		defaultBranch = DefaultBranch
+	}
+	err = ensureHead(ctx, session.RefStore, defaultBranch)
+	if err != nil {
+		log.Println("Error creating HEAD:", err.Error())
+		writeGitMessage(out, "ERR could not read refs")
+		return
+	}
 
-	if session.refMap.Length() == 0 {
-		writeGitMessage(out, "0000000000000000000000000000000000000000 capabilities^{}"+capabilitySuffix)
-	} else {
-		for k, v := range session.refMap.Refs {
-			writeGitMessage(out, v+" "+k+capabilitySuffix)
-			capabilitySuffix = ""
-		}
+	err = session.lock(ctx, session.BackingStore.RLock)
+	if err != nil {
+		log.Println("Error acquiring repository lock:", err.Error())
+		writeGitMessage(out, "ERR "+lockErrorMessage(err))
+		return
 	}
-	terminateGitMessages(out)
+	refs, symrefs, err := readAdvertisedRefs(ctx, session.BackingStore, session.repo.packs, session.RefStore, session.refVisible)
+	session.BackingStore.RUnlock()
+	if err != nil {
+		log.Println("Error loading refs:", err.Error())
+		writeGitMessage(out, "ERR could not read refs")
+		return
+	}
+
+	capabilities := []string{"report-status", "delete-refs", "atomic", "ofs-delta"}
+	capabilities = append(capabilities, symrefs...)
+	capabilities = append(capabilities, "agent=gitpacklib/0.0.0")
+	writeRefAdvertisement(out, refs, capabilities)
 
 	in := bufio.NewReader(in_)
-	pushedRefs := false
+	needPack := false
 
 	for {
 		sizeHex, err := in.Peek(4)
@@ -78,350 +174,480 @@ func (session *GitReceiveSession) HandleGitReceivePack(in_ io.Reader, out io.Wri
 
 		// log.Println("Read", n, err, string(buf))
 
-		// firstly, strip off any capabiltiies (\x00 and thereafter)
-		line := string(buf)
+		// firstly, strip off the length prefix and any capabiltiies (\x00 and thereafter)
+		line := string(buf[4:])
 		caps := strings.Split(line, "\x00")
-		refLine := caps[0]
+		refLine := strings.TrimSuffix(caps[0], "\n")
+		if len(caps) > 1 {
+			for _, capability := range strings.Fields(caps[1]) {
+				if capability == "atomic" {
+					session.atomic = true
+				}
+			}
+		}
 
 		// then work split up the ref details
 		refParts := strings.Split(refLine, " ")
 		if len(refParts) == 3 {
-			//oldSha := refParts[0]
-			newSha := refParts[1]
-			ref := refParts[2]
-
-			session.refMap.Set(ref, newSha)
-			session.updatedRefs = append(session.updatedRefs, ref)
-			pushedRefs = true
+			session.commands = append(session.commands, &refCommand{
+				oldSha: refParts[0],
+				newSha: refParts[1],
+				ref:    refParts[2],
+			})
+			// a push that only deletes refs comes without a pack
+			if refParts[1] != zeroSha {
+				needPack = true
+			}
 		}
 	}
 
 	// now we expect the PACK containing the new data
-	if pushedRefs {
+	if needPack {
 		sizeHex, err := in.Peek(4)
 		if string(sizeHex) != "PACK" {
-			writeGitMessage(out, "unpack invalid header")
+			session.rejectUnpack(out, "invalid header")
 			return
 		}
 
-		err = session.handleGitUnpackStream(in)
+		err = session.handleGitUnpackStream(ctx, in)
 		if err == nil {
 			writeGitMessage(out, "unpack ok")
 		} else {
 			log.Println("Error during unpack:", err.Error())
-			writeGitMessage(out, "unpack "+err.Error())
-			terminateGitMessages(out)
+			session.rejectUnpack(out, err.Error())
 			return
 		}
+	} else if len(session.commands) > 0 {
+		writeGitMessage(out, "unpack ok")
 	}
 
-	// save the refs to the store now that we're done
-	refMapBytes = session.refMap.Serialize()
-	err = session.BackingStore.Set(RefsKey, refMapBytes)
-	globalOk := "ok"
-	if err != nil {
-		globalOk = "ng"
-	}
+	session.checkCommands(ctx)
+	session.updateRefs(ctx)
 
 	// FIXME: check that the commits relating to these refs were correctly added
 	// and that all their trees, blobs, etc were all also valid, and that the old
 	// ref was part of that history (if we care about that ?)
-	for _, ref := range session.updatedRefs {
-		writeGitMessage(out, globalOk+" "+ref)
+	for _, cmd := range session.commands {
+		if cmd.err == "" {
+			writeGitMessage(out, "ok "+cmd.ref)
+		} else {
+			writeGitMessage(out, "ng "+cmd.ref+" "+cmd.err)
+		}
 	}
 
 	terminateGitMessages(out)
-}
 
-func (session *GitReceiveSession) handleGitUnpackStream(rawStream *bufio.Reader) error {
-	stream := NewSHA1Reader(rawStream)
+	if needPack {
+		session.startAutoGC()
+	}
+}
 
-	hdr := make([]byte, 12)
-	_, err := io.ReadFull(stream, hdr)
-	if err != nil {
-		return errors.New("Error reading PACK header: " + err.Error())
+// rejectUnpack reports that the pack could not be unpacked, and so that
+// every ref update failed, as git does.
+func (session *GitReceiveSession) rejectUnpack(out io.Writer, reason string) {
+	writeGitMessage(out, "unpack "+reason)
+	for _, cmd := range session.commands {
+		writeGitMessage(out, "ng "+cmd.ref+" unpacker error")
 	}
+	terminateGitMessages(out)
+}
 
-	if string(hdr[:4]) != "PACK" {
-		return errors.New("Invalid PACK header")
+// startAutoGC collects garbage in the background if AutoGC is set and the
+// repository needs it. The collection outlives the session, so the client is
+// not kept waiting for it.
+func (session *GitReceiveSession) startAutoGC() {
+	if session.AutoGC == nil {
+		return
 	}
+	repo := NewRepository(session.BackingStore, session.RefStore)
+	go func() {
+		stats, err := repo.collectGarbageIfNeeded(context.Background(), session.AutoGC)
+		if err != nil {
+			log.Println("Error collecting garbage:", err.Error())
+		} else if stats != nil {
+			log.Printf("Collected garbage: %d reachable objects, %d packed, %d quarantined, %d pruned\n",
+				stats.Reachable, stats.Packed, stats.Quarantined, stats.Pruned)
+		}
+	}()
+}
 
-	var gitVersion int32
-	var numObjects int32
-	hdrbuf := bytes.NewReader(hdr[4:])
-	err = binary.Read(hdrbuf, binary.BigEndian, &gitVersion)
-	err = binary.Read(hdrbuf, binary.BigEndian, &numObjects)
+// checkCommands resolves the ref each command updates and rejects commands
+// that are not allowed. Ref names must be valid and under refs/, and hidden
+// refs cannot be pushed to. A command naming a symbolic ref updates the ref
+// it points at, as git does, and the branch HEAD points at cannot be deleted.
+func (session *GitReceiveSession) checkCommands(ctx context.Context) {
+	head, err := ResolveRef(ctx, session.RefStore, HeadRef)
 	if err != nil {
-		return errors.New("Error parsing header: " + err.Error())
+		log.Println("Error resolving HEAD:", err.Error())
+		head = &Ref{}
 	}
 
-	session.gitVersion = gitVersion
-	log.Println("Client requested git PACK version", gitVersion)
+	var created []string
+	for _, cmd := range session.commands {
+		if err := checkPushedRefName(cmd.ref); err != nil {
+			cmd.err = err.Error()
+			continue
+		}
+		if !session.refVisible(cmd.ref) {
+			cmd.err = "deny updating a hidden ref"
+			continue
+		}
 
-	// fmt.Println("Num objects:", numObjects)
-	err = session.receivePackObjects(numObjects, stream)
-	if err != nil {
-		return err
-	}
+		if session.RejectCaseCollisions && cmd.oldSha == zeroSha && cmd.newSha != zeroSha {
+			collision, err := findCaseCollision(ctx, session.RefStore, cmd.ref, created)
+			if err != nil {
+				cmd.err = "could not check for case collisions"
+				continue
+			}
+			if collision != "" {
+				cmd.err = "ref name collides with " + collision + " on case-insensitive filesystems"
+				continue
+			}
+			created = append(created, cmd.ref)
+		}
 
-	computedSha := stream.Sum(nil)
-	receivedSha := make([]byte, sha1.Size)
-	_, err = io.ReadFull(stream, receivedSha)
-	if err != nil {
-		return errors.New("Error reading object sha: " + err.Error())
-	}
+		resolved, err := ResolveRef(ctx, session.RefStore, cmd.ref)
+		if err != nil {
+			cmd.err = "could not resolve ref"
+		} else if !session.refVisible(resolved.Name) {
+			cmd.err = "deny updating a hidden ref"
+		} else if cmd.newSha == zeroSha && resolved.Name == head.Name {
+			cmd.err = "deletion of the current branch prohibited"
+		} else {
+			cmd.target = resolved.Name
+		}
 
-	if !bytes.Equal(computedSha[:], receivedSha) {
-		return errors.New(fmt.Sprintf("sha1 sum mismatch: %s != %s!", computedSha, receivedSha))
+		if cmd.err == "" && session.DenyNonFastForwards {
+			cmd.err = session.checkFastForward(ctx, cmd)
+		}
 	}
+}
 
-	// log.Println("Got hash and now done with receiving pack")
+// checkFastForward returns why cmd is rejected as a non-fast-forward update
+// of a branch, or the empty string if it is not.
+func (session *GitReceiveSession) checkFastForward(ctx context.Context, cmd *refCommand) string {
+	if !strings.HasPrefix(cmd.target, "refs/heads/") || cmd.oldSha == zeroSha || cmd.newSha == zeroSha {
+		return ""
+	}
 
-	return nil
+	repo := session.repo
+	fastForward, err := repo.IsAncestor(ctx, cmd.oldSha, cmd.newSha)
+	if err != nil {
+		log.Println("Error checking for fast-forward:", err.Error())
+		return "could not check for fast-forward"
+	}
+	if !fastForward {
+		return "non-fast-forward"
+	}
+	return ""
 }
 
-func (session *GitReceiveSession) receivePackObjects(numObjects int32, stream *HashingReader) error {
-	for i := 0; i < int(numObjects); i++ {
-		c, err := stream.ReadByte()
-		if err != nil {
-			return errors.New("Error reading object: " + err.Error())
-		}
+// refVisible reports whether the client can see and push to the named ref.
+func (session *GitReceiveSession) refVisible(name string) bool {
+	hidden := IsRefHidden(session.HideRefs, name)
+	if session.RefFilter != nil {
+		return session.RefFilter(name, hidden)
+	}
+	return !hidden
+}
 
-		objType := (c >> 4) & 0x7
-		var objLength int64 = int64(c & 0xf)
-		var lenBits uint
-		lenBits = 4
-		for (c & 0x80) != 0 {
-			// log.Println("len=",objLength, "c=",c)
-			c, err = stream.ReadByte()
-			if err != nil {
-				return errors.New("Error reading object: " + err.Error())
+// updateRefs applies the client's commands, checking that each ref still has
+// the value the client based its push on. Each command is its own transaction
+// unless the client asked for an atomic push, in which case nothing is
+// updated if any command was rejected. Commands that cannot be applied are
+// marked with the reason.
+func (session *GitReceiveSession) updateRefs(ctx context.Context) {
+	var transactions [][]*refCommand
+	for _, cmd := range session.commands {
+		if cmd.err != "" {
+			if session.atomic {
+				session.rejectAll("atomic push failed")
+				return
 			}
-
-			objLength |= int64(c&0x7f) << lenBits
-			lenBits += 7
+			continue
 		}
-		// log.Println("len=",objLength, "c=",c)
-
-		// fmt.Printf("Got type=%d len=%d\n", objType, objLength)
-
-		if objType == 6 {
-			return errors.New("base offset deltas not supported")
+		if session.atomic && len(transactions) > 0 {
+			transactions[0] = append(transactions[0], cmd)
+		} else {
+			transactions = append(transactions, []*refCommand{cmd})
 		}
+	}
 
-		var originalSha string
-		if objType == 7 {
-			originalShaBytes := make([]byte, sha1.Size)
-			_, err = io.ReadFull(stream, originalShaBytes)
-			if err != nil {
-				return errors.New("Error reading ID of delta base object: " + err.Error())
+	now := time.Now()
+	for _, transaction := range transactions {
+		updates := make([]*RefUpdate, len(transaction))
+		for i, cmd := range transaction {
+			updates[i] = &RefUpdate{
+				Name:    cmd.target,
+				OldHash: refHash(cmd.oldSha),
+				NewHash: refHash(cmd.newSha),
+				Reflog: &ReflogEntry{
+					Identity: session.Pusher,
+					Time:     now,
+					Message:  "push",
+				},
 			}
-			originalSha = hex.EncodeToString(originalShaBytes)
-		}
-
-		inflated, err := zlib.NewReader(stream)
-		if err != nil {
-			panic(err)
 		}
 
-		obj := make([]byte, objLength)
-		n, err := io.ReadFull(inflated, obj)
-		if err != nil {
-			return errors.New("Error reading object data: " + err.Error())
-		}
-		if int64(n) != objLength {
-			return errors.New("Data truncated!")
-		}
-		// force a read to clean up
-		tmp := make([]byte, 1)
-		n, err = inflated.Read(tmp)
-		if n != 0 || err != io.EOF {
-			return errors.New("Error getting expected EOF and cleanup: " + err.Error())
+		// only the wait for the locks is bounded, so that a slow store is
+		// not cut off part way through writing the refs
+		lockCtx := WithLockTimeout(ctx, session.LockTimeout)
+		err := session.RefStore.Update(lockCtx, updates)
+		if err == nil {
+			session.trashDeletedRefs(lockCtx, updates)
+			continue
 		}
 
-		inflated.Close()
-
-		typeStr := gitTypeToString(objType)
-
-		if objType == 7 {
-			deltaData := obj
-
-			originalType, originalObject, err := session.loadObject(originalSha)
-			if err != nil {
-				return errors.New("Error loading delta base object by SHA: " + err.Error())
+		log.Println("Error updating refs:", err.Error())
+		for i, cmd := range transaction {
+			if updates[i].Err != nil {
+				cmd.err = refUpdateErrorMessage(updates[i].Err)
+			} else {
+				cmd.err = refUpdateErrorMessage(err)
 			}
+		}
+	}
+}
 
-			typeStr = originalType
+// trashDeletedRefs keeps the refs deleted by updates that were applied in
+// the trash. Failing to do so is logged but does not fail the push, since the
+// refs have already been deleted.
+func (session *GitReceiveSession) trashDeletedRefs(ctx context.Context, updates []*RefUpdate) {
+	retention := session.TrashRetention
+	if retention == 0 {
+		retention = DefaultTrashRetention
+	}
+	if retention < 0 {
+		return
+	}
 
-			// perform the actual delta decoding
-			obj, err = session.performDeltaDecode(originalObject, deltaData)
+	for _, update := range updates {
+		if update.NewHash == "" && update.OldHash != "" {
+			err := TrashRef(ctx, session.BackingStore, update.Name, update.OldHash, session.Pusher, retention)
 			if err != nil {
-				return errors.New("Error rewriting object from delta: " + err.Error())
+				log.Println("Error moving", update.Name, "to the trash:", err.Error())
 			}
 		}
+	}
+}
 
-		// fmt.Println("Got", t, ":", obj)
-
-		_, err = session.saveObject(typeStr, obj)
-
-		if err != nil {
-			return errors.New("Error saving object: " + err.Error())
-		} else {
-			// log.Println("SHA saved:", sha)
+// rejectAll marks every command not already rejected with reason.
+func (session *GitReceiveSession) rejectAll(reason string) {
+	for _, cmd := range session.commands {
+		if cmd.err == "" {
+			cmd.err = reason
 		}
 	}
-
-	return nil
 }
 
-func (session *GitReceiveSession) parseMultiByteInt(stream io.ByteReader) (result int, err error) {
-	c, err := stream.ReadByte()
-	if err != nil {
-		return 0, errors.New("Error reading object: " + err.Error())
+// refHash converts a sha from the protocol, where all zeroes means the ref
+// does not exist, to a RefUpdate hash.
+func refHash(sha string) string {
+	if sha == zeroSha {
+		return ""
 	}
+	return sha
+}
 
-	var number int = int(c & 0x7f)
-	var shift uint = 7
-	for (c & 0x80) != 0 {
-		c, err = stream.ReadByte()
-		if err != nil {
-			return 0, errors.New("Error reading object: " + err.Error())
-		}
-
-		number |= int(c&0x7f) << shift
-		shift += 7
+// refUpdateErrorMessage describes why a ref could not be updated in a form
+// suitable for showing to the pushing client.
+func refUpdateErrorMessage(err error) string {
+	switch err {
+	case ErrStaleRef:
+		return "ref was updated by another push"
+	case ErrTransactionAborted:
+		return "atomic push failed"
+	case ErrRefNameConflict:
+		return "ref name conflicts with an existing ref"
+	case context.DeadlineExceeded, context.Canceled:
+		return lockErrorMessage(err)
 	}
+	return "failed to update ref"
+}
 
-	return number, nil
+// lock calls lockFn to acquire the repository lock, giving up after
+// LockTimeout if set.
+func (session *GitReceiveSession) lock(ctx context.Context, lockFn func(context.Context) error) error {
+	if session.LockTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, session.LockTimeout)
+		defer cancel()
+	}
+	return lockFn(ctx)
 }
 
-func (session *GitReceiveSession) performDeltaDecode(base []byte, delta []byte) (computed []byte, err error) {
-	// read the delta header
-	deltaReader := bytes.NewReader(delta)
-	computedObject := &bytes.Buffer{}
+// lockErrorMessage describes a failure to acquire the repository lock in a
+// form suitable for showing to the pushing client.
+func lockErrorMessage(err error) string {
+	switch err {
+	case context.DeadlineExceeded:
+		return "timed out waiting for the repository lock, another push may be in progress"
+	case context.Canceled:
+		return "cancelled while waiting for the repository lock"
+	}
+	return "could not lock repository: " + err.Error()
+}
 
-	baseObjectLength, err := session.parseMultiByteInt(deltaReader)
-	if err != nil {
-		return nil, err
+// handleGitUnpackStream reads the pack the client sends and stores it intact
+// along with an index of it. A thin pack, with deltas against objects that
+// the client knows the repository has, is completed with those objects so
+// that it can be read on its own. The pack is held in memory until it is
+// stored, so one larger than MaxPackSize is rejected as it is read.
+func (session *GitReceiveSession) handleGitUnpackStream(ctx context.Context, rawStream *bufio.Reader) error {
+	maxSize := session.MaxPackSize
+	if maxSize == 0 {
+		maxSize = DefaultMaxPackSize
 	}
-	if baseObjectLength != len(base) {
-		return nil, errors.New(fmt.Sprintf("Base object length mismatch (%d != %d)", baseObjectLength, len(base)))
+	if maxSize < 0 {
+		maxSize = math.MaxInt64
 	}
+	stream := &limitedPackReader{r: rawStream, remaining: maxSize}
 
-	resultObjectLength, err := session.parseMultiByteInt(deltaReader)
+	raw := &bytes.Buffer{}
+	reader, err := newPackReader(stream, raw)
 	if err != nil {
-		return nil, err
+		return stream.check(err)
+	}
+	log.Println("Client requested git PACK version", reader.Version())
+
+	// deltas are resolved against the objects read from the pack so far,
+	// which are read back from the pack as they are needed, or against
+	// objects already in the repository
+	repo := session.repo
+	offsets := map[string]int64{}
+	received := newPackFile(nil, func(sha string) (int64, bool) {
+		offset, ok := offsets[sha]
+		return offset, ok
+	})
+	var thinBases []string
+	loadThinBase := func(sha string) (string, []byte, error) {
+		objType, data, err := repo.ReadRawObject(ctx, sha)
+		if err == nil {
+			thinBases = append(thinBases, sha)
+		}
+		return objType, data, err
+	}
+	received.loadBase = loadThinBase
+	reader.LoadObject = func(ctx context.Context, sha string) (string, []byte, error) {
+		if offset, ok := offsets[sha]; ok {
+			received.data = raw.Bytes()
+			return received.readObject(offset)
+		}
+		return loadThinBase(sha)
 	}
 
-	for deltaReader.Len() > 0 {
-		c, err := deltaReader.ReadByte()
+	var entries []*PackIndexEntry
+	var tags []*PackObject
+	for {
+		obj, err := reader.Next(ctx)
+		if err == io.EOF {
+			break
+		}
 		if err != nil {
-			return nil, errors.New("Error reading delta: " + err.Error())
+			return stream.check(err)
 		}
 
-		if (c & 0x80) == 0 {
-			// insert hunk
-			numBytesToInsert := int64(c & 0x7f)
-			_, err = io.CopyN(computedObject, deltaReader, numBytesToInsert)
-			if err != nil {
-				return nil, err
-			}
-		} else {
-			// copy hunk
-			opcode := c
-
-			var copy_offset int64 = 0
-			var copy_length int64 = 0
-
-			var shift uint64 = 0
-			var i uint64 = 0
-
-			for shift, i = 0, 0; i < 4; i++ {
-				if (opcode & 0x01) != 0 {
-					c, err := deltaReader.ReadByte()
-					if err != nil {
-						return nil, errors.New("Error reading delta: " + err.Error())
-					}
-
-					copy_offset |= int64(c) << shift
-				}
-
-				opcode >>= 1
-				shift += 8
-			}
-
-			var lenBits uint64 = 3
-
-			if session.gitVersion == 2 {
-				lenBits = 2
-			}
-
-			for shift, i = 0, 0; i < lenBits; i++ {
-				if (opcode & 0x01) != 0 {
-					c, err := deltaReader.ReadByte()
-					if err != nil {
-						return nil, errors.New("Error reading delta: " + err.Error())
-					}
-
-					copy_length |= int64(c) << shift
-				}
-
-				opcode >>= 1
-				shift += 8
-			}
-
-			if copy_length == 0 {
-				copy_length = (1 << 16)
-			}
-
-			// fmt.Printf("copy_offset=%d, copy_length=%d, sum=%d len=%d\n", copy_offset, copy_length, copy_offset+copy_length, len(base))
-
-			computedObject.Write(base[copy_offset : copy_offset+copy_length])
+		entries = append(entries, &PackIndexEntry{Hash: obj.Hash, Offset: obj.Offset, CRC32: obj.CRC32})
+		if _, ok := offsets[obj.Hash]; !ok {
+			offsets[obj.Hash] = obj.Offset
 		}
+		if obj.Type == TagObject {
+			tags = append(tags, obj)
+		}
+	}
+	if len(entries) == 0 {
+		return nil
 	}
 
-	b := computedObject.Bytes()
+	pack := raw.Bytes()
+	var missing []string
+	seen := map[string]bool{}
+	for _, sha := range thinBases {
+		if _, ok := offsets[sha]; !ok && !seen[sha] {
+			seen[sha] = true
+			missing = append(missing, sha)
+		}
+	}
+	if len(missing) > 0 {
+		var added []*PackIndexEntry
+		pack, added, err = completeThinPack(ctx, repo, pack, missing)
+		if err != nil {
+			return err
+		}
+		entries = append(entries, added...)
+	}
 
-	if len(b) != resultObjectLength {
-		return nil, errors.New("Computed delta object length mismatch")
+	checksum := hex.EncodeToString(pack[len(pack)-sha1.Size:])
+	index, reverse, err := indexPack(checksum, entries)
+	if err != nil {
+		return err
+	}
+	err = savePack(ctx, session.BackingStore, checksum, pack, index, reverse, nil)
+	if err != nil {
+		return errors.New("Error saving pack: " + err.Error())
 	}
+	session.updateMultiPackIndex(ctx, repo)
 
-	return b, nil
+	// the pack is stored by now, and tags it leaves uncached are peeled when
+	// they are read
+	for _, tag := range tags {
+		if err := cachePeeledTag(ctx, session.BackingStore, session.repo.packs, tag.Hash, tag.Data); err != nil {
+			log.Println("Error caching peeled tag:", err.Error())
+		}
+	}
+	return nil
 }
 
-func (session *GitReceiveSession) saveObject(objType string, data []byte) (sha string, err error) {
-	h := sha1.New()
-	b := new(bytes.Buffer)
-
-	both := io.MultiWriter(h, b)
-	both.Write([]byte(fmt.Sprintf("%s %d", objType, len(data))))
-	both.Write([]byte("\x00"))
-	both.Write(data)
-
-	sha = hex.EncodeToString(h.Sum(nil))
+// limitedPackReader reads a pack, failing with ErrPackTooLarge once more
+// than remaining bytes have been read.
+type limitedPackReader struct {
+	r         io.Reader
+	remaining int64
+	exceeded  bool
+}
 
-	err = session.BackingStore.Set("object/"+sha, b.Bytes())
+func (reader *limitedPackReader) Read(p []byte) (int, error) {
+	if reader.remaining <= 0 {
+		reader.exceeded = true
+		return 0, ErrPackTooLarge
+	}
+	if int64(len(p)) > reader.remaining {
+		p = p[:reader.remaining]
+	}
+	n, err := reader.r.Read(p)
+	reader.remaining -= int64(n)
+	return n, err
+}
 
-	return sha, err
+// check returns ErrPackTooLarge in place of err if reading failed because
+// the pack is too large.
+func (reader *limitedPackReader) check(err error) error {
+	if reader.exceeded {
+		return ErrPackTooLarge
+	}
+	return err
 }
 
-func (session *GitReceiveSession) loadObject(sha string) (objType string, data []byte, err error) {
-	allContent, err := session.BackingStore.Get("object/" + sha)
+// updateMultiPackIndex writes the multi-pack index again once too many packs
+// have been pushed since it was last written. The repository is held shared
+// while it is written, so that it does not race with a repack removing packs.
+// Failing to write it is logged but does not fail the push, since the packs
+// it leaves out are still searched.
+func (session *GitReceiveSession) updateMultiPackIndex(ctx context.Context, repo *Repository) {
+	err := session.lock(ctx, session.BackingStore.RLock)
 	if err != nil {
-		return "", nil, err
+		log.Println("Error acquiring repository lock:", err.Error())
+		return
 	}
+	defer session.BackingStore.RUnlock()
 
-	parts := bytes.SplitN(allContent, []byte{0}, 2)
-	if len(parts) != 2 {
-		return "", nil, errors.New("Expected null byte separating content and header")
+	unindexed, err := repo.packs.numUnindexed(ctx, session.BackingStore)
+	if err == nil && unindexed > maxUnindexedPacks {
+		err = repo.WriteMultiPackIndex(ctx)
+	}
+	if err != nil {
+		log.Println("Error writing multi-pack index:", err.Error())
 	}
-
-	var dataSize int
-	fmt.Sscanf(string(parts[0]), "%s %d", &objType, &dataSize)
-
-	data = parts[1]
-
-	return objType, data, nil
 }
 
 func writeGitMessage(out io.Writer, message string) {
@@ -434,18 +660,3 @@ func writeGitMessage(out io.Writer, message string) {
 func terminateGitMessages(out io.Writer) {
 	out.Write([]byte("0000"))
 }
-
-func gitTypeToString(objType byte) string {
-	switch objType {
-	case 1:
-		return "commit"
-	case 2:
-		return "tree"
-	case 3:
-		return "blob"
-	case 4:
-		return "tag"
-	}
-
-	return "unknown"
-}
@@ -0,0 +1,90 @@
+package gitpacklib
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// receivePack pushes the given commands and pack to session, and returns the
+// status it reports.
+func receivePack(t *testing.T, session *GitReceiveSession, commands []string, pack []byte) []string {
+	in := &bytes.Buffer{}
+	for i, command := range commands {
+		if i == 0 {
+			command += "\x00report-status"
+		}
+		fmt.Fprintf(in, "%04x%s\n", len(command)+5, command)
+	}
+	in.WriteString("0000")
+	in.Write(pack)
+
+	out := &bytes.Buffer{}
+	session.HandleGitReceivePack(context.Background(), in, out)
+
+	// the status follows the ref advertisement and its flush
+	var lines []string
+	flushed := false
+	for data := out.Bytes(); len(data) >= 4; {
+		size, err := strconv.ParseInt(string(data[:4]), 16, 32)
+		if err != nil {
+			t.Fatalf("Bad pkt-line in %q", data)
+		}
+		if size == 0 {
+			flushed = true
+			data = data[4:]
+			continue
+		}
+		if flushed {
+			lines = append(lines, strings.TrimSuffix(string(data[4:size]), "\n"))
+		}
+		data = data[size:]
+	}
+	return lines
+}
+
+func TestReceivePackReportsUnpackErrors(t *testing.T) {
+	ctx := context.Background()
+	dir := packTestRepository(t)
+	packPath, _ := gitPack(t, dir)
+	pack, err := ioutil.ReadFile(packPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	commands := []string{
+		zeroSha + " " + gitRevParse(t, dir, "main") + " refs/heads/main",
+		zeroSha + " " + gitRevParse(t, dir, "v1") + " refs/tags/v1",
+	}
+	rejected := []string{"ng refs/heads/main unpacker error", "ng refs/tags/v1 unpacker error"}
+
+	for _, test := range []struct {
+		pack        []byte
+		maxPackSize int64
+		want        []string
+	}{
+		{pack, int64(len(pack)) - 1, append([]string{"unpack " + ErrPackTooLarge.Error()}, rejected...)},
+		{append([]byte("JUNK"), pack[4:]...), 0, append([]string{"unpack invalid header"}, rejected...)},
+		{pack, int64(len(pack)), []string{"unpack ok", "ok refs/heads/main", "ok refs/tags/v1"}},
+	} {
+		repo := newTestRepository(t)
+		session := NewGitReceiveSession()
+		session.BackingStore = repo.store
+		session.MaxPackSize = test.maxPackSize
+		if got := receivePack(t, session, commands, test.pack); strings.Join(got, "\n") != strings.Join(test.want, "\n") {
+			t.Errorf("Push with a limit of %d reported\n%s\nwant\n%s", test.maxPackSize, strings.Join(got, "\n"), strings.Join(test.want, "\n"))
+		}
+
+		// nothing is stored from a pack that is rejected
+		packs, err := repo.store.List(ctx, "pack/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rejectedPack := test.want[0] != "unpack ok"; rejectedPack != (len(packs) == 0) {
+			t.Errorf("Push with a limit of %d stored %v", test.maxPackSize, packs)
+		}
+	}
+}
@@ -0,0 +1,22 @@
+package gitpacklib
+
+import (
+	"strings"
+)
+
+// IsRefHidden reports whether name is hidden by hideRefs, which follows git's
+// transfer.hideRefs: each entry hides refs named by it or under it as a
+// prefix of whole components, an entry starting with '!' reveals refs that
+// an earlier entry hid, and later entries take precedence.
+func IsRefHidden(hideRefs []string, name string) bool {
+	for i := len(hideRefs) - 1; i >= 0; i-- {
+		pattern := hideRefs[i]
+		reveal := strings.HasPrefix(pattern, "!")
+		pattern = strings.TrimSuffix(strings.TrimPrefix(pattern, "!"), "/")
+
+		if name == pattern || strings.HasPrefix(name, pattern+"/") {
+			return !reveal
+		}
+	}
+	return false
+}
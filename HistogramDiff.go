@@ -0,0 +1,195 @@
+package gitpacklib
+
+// maxHistogramChain is how often a line may occur in the old side before the
+// histogram diff stops using it to line the sides up.
+const maxHistogramChain = 64
+
+// diffLinesHistogram returns an edit script from old to new using git's
+// histogram diff, which git uses when merging. Unlike diffLines, runs of
+// changes are slid as far down as they go rather than placed by indentation,
+// also as git does when merging.
+func diffLinesHistogram(old []string, new []string) []lineEdit {
+	a, b := newDiffSides(old, new)
+	histogramDiff(a, b, 1, len(old), 1, len(new))
+	compactChanges(a, b, false)
+	compactChanges(b, a, false)
+	return editScript(a, b)
+}
+
+// histogramRegion is a run of lines common to both sides. Like the rest of
+// the histogram diff, it counts lines from 1, as xdiff does.
+type histogramRegion struct {
+	begin1, end1 int
+	begin2, end2 int
+}
+
+// histogramDiff marks the changed lines in the count1 lines of a starting at
+// line1 and the count2 lines of b starting at line2. It splits the problem
+// around the longest run of lines that are common to both and rare in a, and
+// falls back to the Myers diff if every common line is too common.
+func histogramDiff(a *diffSide, b *diffSide, line1 int, count1 int, line2 int, count2 int) {
+	for count1 > 0 || count2 > 0 {
+		if count1 == 0 || count2 == 0 {
+			markChanged(a, line1, count1)
+			markChanged(b, line2, count2)
+			return
+		}
+
+		index := newHistogramIndex(a, b, line1, count1)
+		lcs := &histogramRegion{}
+		for ptr := line2; ptr <= line2+count2-1; {
+			ptr = index.tryLCS(lcs, ptr, line1, count1, line2, count2)
+		}
+
+		if index.hasCommon && index.cnt > maxHistogramChain {
+			fallbackDiff(a, b, line1, count1, line2, count2)
+			return
+		}
+		if lcs.begin1 == 0 && lcs.begin2 == 0 {
+			markChanged(a, line1, count1)
+			markChanged(b, line2, count2)
+			return
+		}
+
+		histogramDiff(a, b, line1, lcs.begin1-line1, line2, lcs.begin2-line2)
+		count1 = line1 + count1 - 1 - lcs.end1
+		line1 = lcs.end1 + 1
+		count2 = line2 + count2 - 1 - lcs.end2
+		line2 = lcs.end2 + 1
+	}
+}
+
+func markChanged(side *diffSide, line int, count int) {
+	for i := line - 1; i < line-1+count; i++ {
+		side.changed[i] = true
+	}
+}
+
+// fallbackDiff marks the changed lines of part of the sides with the Myers
+// diff, which is run on that part alone as if it were the whole of both.
+func fallbackDiff(a *diffSide, b *diffSide, line1 int, count1 int, line2 int, count2 int) {
+	part := func(side *diffSide, line int, count int) *diffSide {
+		return &diffSide{
+			ids:     side.ids[line-1 : line-1+count],
+			lines:   side.lines[line-1 : line-1+count],
+			changed: make([]bool, count),
+		}
+	}
+	partA, partB := part(a, line1, count1), part(b, line2, count2)
+	newLineDiffer(partA, partB).compare(0, len(partA.keep), 0, len(partB.keep), false)
+	copy(a.changed[line1-1:], partA.changed)
+	copy(b.changed[line2-1:], partB.changed)
+}
+
+type histogramRecord struct {
+	// ptr is the first occurrence of the line in a, and cnt how many
+	// there are
+	ptr int
+	cnt int
+}
+
+// histogramIndex records where each line occurs in part of a.
+type histogramIndex struct {
+	a, b    *diffSide
+	records map[int]*histogramRecord
+
+	// lineMap and nextPtrs hold the record of each line of a and its next
+	// occurrence, or 0 if it is the last, offset by ptrShift
+	lineMap  []*histogramRecord
+	nextPtrs []int
+	ptrShift int
+
+	// cnt is the fewest occurrences of the lines in the best run found so
+	// far
+	cnt       int
+	hasCommon bool
+}
+
+func newHistogramIndex(a *diffSide, b *diffSide, line1 int, count1 int) *histogramIndex {
+	index := &histogramIndex{
+		a:        a,
+		b:        b,
+		records:  map[int]*histogramRecord{},
+		lineMap:  make([]*histogramRecord, count1),
+		nextPtrs: make([]int, count1),
+		ptrShift: line1,
+		cnt:      maxHistogramChain + 1,
+	}
+
+	for ptr := line1 + count1 - 1; ptr >= line1; ptr-- {
+		id := a.ids[ptr-1]
+		rec, ok := index.records[id]
+		if ok {
+			index.nextPtrs[ptr-line1] = rec.ptr
+			rec.ptr = ptr
+			rec.cnt++
+		} else {
+			rec = &histogramRecord{ptr: ptr, cnt: 1}
+			index.records[id] = rec
+		}
+		index.lineMap[ptr-line1] = rec
+	}
+	return index
+}
+
+func (index *histogramIndex) count(ptr int) int {
+	return index.lineMap[ptr-index.ptrShift].cnt
+}
+
+func (index *histogramIndex) same(ptr1 int, ptr2 int) bool {
+	return index.a.ids[ptr1-1] == index.b.ids[ptr2-1]
+}
+
+// tryLCS looks for the longest common run through line bPtr of b, keeping it
+// in lcs if it is longer or made of rarer lines than the best so far. It
+// returns the next line of b worth trying.
+func (index *histogramIndex) tryLCS(lcs *histogramRegion, bPtr int, line1 int, count1 int, line2 int, count2 int) int {
+	bNext := bPtr + 1
+	rec := index.records[index.b.ids[bPtr-1]]
+	if rec == nil {
+		return bNext
+	}
+	index.hasCommon = true
+	if rec.cnt > index.cnt {
+		return bNext
+	}
+
+	end1, end2 := line1+count1-1, line2+count2-1
+	as := rec.ptr
+	for {
+		np := index.nextPtrs[as-index.ptrShift]
+		bs, ae, be, rc := bPtr, as, bPtr, rec.cnt
+
+		for line1 < as && line2 < bs && index.same(as-1, bs-1) {
+			as--
+			bs--
+			if rc > 1 && index.count(as) < rc {
+				rc = index.count(as)
+			}
+		}
+		for ae < end1 && be < end2 && index.same(ae+1, be+1) {
+			ae++
+			be++
+			if rc > 1 && index.count(ae) < rc {
+				rc = index.count(ae)
+			}
+		}
+
+		if bNext <= be {
+			bNext = be + 1
+		}
+		if lcs.end1-lcs.begin1 < ae-as || rc < index.cnt {
+			*lcs = histogramRegion{begin1: as, end1: ae, begin2: bs, end2: be}
+			index.cnt = rc
+		}
+
+		// carry on from the next occurrence past this run
+		for np != 0 && np <= ae {
+			np = index.nextPtrs[np-index.ptrShift]
+		}
+		if np == 0 {
+			return bNext
+		}
+		as = np
+	}
+}
@@ -0,0 +1,779 @@
+package gitpacklib
+
+import (
+	"bytes"
+)
+
+type diffOp byte
+
+const (
+	diffEqual  diffOp = ' '
+	diffDelete diffOp = '-'
+	diffInsert diffOp = '+'
+)
+
+// lineEdit is one step of turning the old lines into the new ones. oldLine
+// and newLine are the positions in each, which for an insertion or deletion
+// is where the line would be in the side that lacks it.
+type lineEdit struct {
+	op      diffOp
+	oldLine int
+	newLine int
+}
+
+// splitLines splits data after each newline. The last line has no newline if
+// data does not end in one.
+func splitLines(data []byte) []string {
+	var lines []string
+	for len(data) > 0 {
+		n := bytes.IndexByte(data, '\n') + 1
+		if n == 0 {
+			n = len(data)
+		}
+		lines = append(lines, string(data[:n]))
+		data = data[n:]
+	}
+	return lines
+}
+
+// diffLines returns an edit script from old to new, using the same
+// variant of Myers' algorithm as git's xdiff so that the results match git
+// diff. Like git, runs of changes are then slid to where they are easiest to
+// read when there is a choice.
+func diffLines(old []string, new []string) []lineEdit {
+	a, b := newDiffSides(old, new)
+	newLineDiffer(a, b).compare(0, len(a.keep), 0, len(b.keep), false)
+	compactChanges(a, b, true)
+	compactChanges(b, a, true)
+	return editScript(a, b)
+}
+
+// newDiffSides returns the sides for diffing old and new, with each line
+// given an id so that lines are compared by number rather than content.
+func newDiffSides(old []string, new []string) (*diffSide, *diffSide) {
+	ids := map[string]int{}
+	side := func(lines []string) *diffSide {
+		s := &diffSide{
+			ids:     make([]int, len(lines)),
+			lines:   lines,
+			changed: make([]bool, len(lines)),
+		}
+		for i, line := range lines {
+			id, ok := ids[line]
+			if !ok {
+				id = len(ids)
+				ids[line] = id
+			}
+			s.ids[i] = id
+		}
+		return s
+	}
+	return side(old), side(new)
+}
+
+// editScript lists the changes marked in the sides as edits.
+func editScript(a *diffSide, b *diffSide) []lineEdit {
+	var edits []lineEdit
+	i, j := 0, 0
+	for i < len(a.lines) || j < len(b.lines) {
+		switch {
+		case i < len(a.lines) && a.changed[i]:
+			edits = append(edits, lineEdit{diffDelete, i, j})
+			i++
+		case j < len(b.lines) && b.changed[j]:
+			edits = append(edits, lineEdit{diffInsert, i, j})
+			j++
+		default:
+			edits = append(edits, lineEdit{diffEqual, i, j})
+			i++
+			j++
+		}
+	}
+	return edits
+}
+
+// diffSide is one of the two files being compared, with the lines that are
+// not in the other marked as changed.
+type diffSide struct {
+	ids     []int
+	lines   []string
+	changed []bool
+
+	// keep holds the indexes of the lines left for the diff algorithm to
+	// match up, once those that are obviously changed are set aside.
+	keep []int
+}
+
+func (side *diffSide) isChanged(i int) bool {
+	return i >= 0 && i < len(side.changed) && side.changed[i]
+}
+
+// Tuning of the diff algorithm, as in xdiff.
+const (
+	maxCostMin       = 256
+	heuristicMinCost = 256
+	snakeCount       = 20
+	heuristicFactor  = 4
+	maxEqualLimit    = 1024
+	simScanWindow    = 100
+	keepDiscardRun   = 4
+)
+
+type lineDiffer struct {
+	a, b *diffSide
+	// forward and backward hold the furthest reaching paths on each
+	// diagonal, offset so that diagonals can be negative
+	forward, backward []int
+	offset            int
+	maxCost           int
+}
+
+func newLineDiffer(a *diffSide, b *diffSide) *lineDiffer {
+	prepareSides(a, b)
+
+	diagonals := len(a.keep) + len(b.keep) + 3
+	maxCost := bogoSqrt(diagonals)
+	if maxCost < maxCostMin {
+		maxCost = maxCostMin
+	}
+	return &lineDiffer{
+		a:        a,
+		b:        b,
+		forward:  make([]int, diagonals),
+		backward: make([]int, diagonals),
+		offset:   len(b.keep) + 1,
+		maxCost:  maxCost,
+	}
+}
+
+// bogoSqrt is the rough square root xdiff uses to scale its limits.
+func bogoSqrt(n int) int {
+	i := 1
+	for ; n > 0; n >>= 2 {
+		i <<= 1
+	}
+	return i
+}
+
+// prepareSides sets aside the lines of each side that can not be matched
+// with the other: those not in the other at all, and those that are very
+// common in the other but surrounded by lines that are not in it.
+func prepareSides(a *diffSide, b *diffSide) {
+	start := 0
+	for start < len(a.ids) && start < len(b.ids) && a.ids[start] == b.ids[start] {
+		start++
+	}
+	endA, endB := len(a.ids)-1, len(b.ids)-1
+	for endA >= start && endB >= start && a.ids[endA] == b.ids[endB] {
+		endA--
+		endB--
+	}
+
+	count := func(side *diffSide) map[int]int {
+		counts := map[int]int{}
+		for _, id := range side.ids {
+			counts[id]++
+		}
+		return counts
+	}
+	countA, countB := count(a), count(b)
+
+	discard := func(side *diffSide, otherCounts map[int]int, end int) {
+		limit := bogoSqrt(len(side.ids))
+		if limit > maxEqualLimit {
+			limit = maxEqualLimit
+		}
+
+		// 0 for lines with no match, 1 for lines to keep, and 2 for lines
+		// with too many matches
+		match := make([]byte, len(side.ids)+1)
+		for i := start; i <= end; i++ {
+			switch n := otherCounts[side.ids[i]]; {
+			case n == 0:
+				match[i] = 0
+			case n >= limit:
+				match[i] = 2
+			default:
+				match[i] = 1
+			}
+		}
+
+		side.keep = nil
+		for i := start; i <= end; i++ {
+			if match[i] == 1 || (match[i] == 2 && !discardMultimatch(match, i, start, end)) {
+				side.keep = append(side.keep, i)
+			} else {
+				side.changed[i] = true
+			}
+		}
+	}
+	discard(a, countB, endA)
+	discard(b, countA, endB)
+}
+
+// discardMultimatch decides whether line i, which has many matches, should
+// be set aside because it is in the middle of lines with no match.
+func discardMultimatch(match []byte, i int, start int, end int) bool {
+	if i-start > simScanWindow {
+		start = i - simScanWindow
+	}
+	if end-i > simScanWindow {
+		end = i + simScanWindow
+	}
+
+	noMatchBefore, multiBefore := 0, 1
+	for r := 1; i-r >= start; r++ {
+		if match[i-r] == 0 {
+			noMatchBefore++
+		} else if match[i-r] == 2 {
+			multiBefore++
+		} else {
+			break
+		}
+	}
+	if noMatchBefore == 0 {
+		return false
+	}
+
+	noMatchAfter, multiAfter := 0, 1
+	for r := 1; i+r <= end; r++ {
+		if match[i+r] == 0 {
+			noMatchAfter++
+		} else if match[i+r] == 2 {
+			multiAfter++
+		} else {
+			break
+		}
+	}
+	if noMatchAfter == 0 {
+		return false
+	}
+
+	noMatch := noMatchBefore + noMatchAfter
+	multi := multiBefore + multiAfter
+	return multi*keepDiscardRun < multi+noMatch
+}
+
+func (differ *lineDiffer) idA(i int) int { return differ.a.ids[differ.a.keep[i]] }
+func (differ *lineDiffer) idB(i int) int { return differ.b.ids[differ.b.keep[i]] }
+
+// compare marks the lines that differ between the kept lines lo1 to hi1 of
+// a and lo2 to hi2 of b. If needMin is false, heuristics may cut the search
+// for the shortest edit script short.
+func (differ *lineDiffer) compare(lo1, hi1, lo2, hi2 int, needMin bool) {
+	for lo1 < hi1 && lo2 < hi2 && differ.idA(lo1) == differ.idB(lo2) {
+		lo1++
+		lo2++
+	}
+	for lo1 < hi1 && lo2 < hi2 && differ.idA(hi1-1) == differ.idB(hi2-1) {
+		hi1--
+		hi2--
+	}
+
+	if lo1 == hi1 {
+		for ; lo2 < hi2; lo2++ {
+			differ.b.changed[differ.b.keep[lo2]] = true
+		}
+	} else if lo2 == hi2 {
+		for ; lo1 < hi1; lo1++ {
+			differ.a.changed[differ.a.keep[lo1]] = true
+		}
+	} else {
+		split := differ.split(lo1, hi1, lo2, hi2, needMin)
+		differ.compare(lo1, split.i1, lo2, split.i2, split.minLo)
+		differ.compare(split.i1, hi1, split.i2, hi2, split.minHi)
+	}
+}
+
+type diffSplit struct {
+	i1, i2       int
+	minLo, minHi bool
+}
+
+// split finds where to divide the problem in two, by following the
+// furthest reaching paths forwards from the start and backwards from the
+// end until they meet. If that gets too expensive, a good enough point is
+// picked instead.
+func (differ *lineDiffer) split(lo1, hi1, lo2, hi2 int, needMin bool) diffSplit {
+	const lineMax = int(^uint(0) >> 1)
+	kf := func(d int) *int { return &differ.forward[d+differ.offset] }
+	kb := func(d int) *int { return &differ.backward[d+differ.offset] }
+
+	dmin, dmax := lo1-hi2, hi1-lo2
+	fmid, bmid := lo1-lo2, hi1-hi2
+	odd := (fmid-bmid)&1 != 0
+	fmin, fmax := fmid, fmid
+	bmin, bmax := bmid, bmid
+
+	*kf(fmid) = lo1
+	*kb(bmid) = hi1
+
+	for cost := 1; ; cost++ {
+		gotSnake := false
+
+		if fmin > dmin {
+			fmin--
+			*kf(fmin - 1) = -1
+		} else {
+			fmin++
+		}
+		if fmax < dmax {
+			fmax++
+			*kf(fmax + 1) = -1
+		} else {
+			fmax--
+		}
+
+		for d := fmax; d >= fmin; d -= 2 {
+			var i1 int
+			if *kf(d - 1) >= *kf(d + 1) {
+				i1 = *kf(d - 1) + 1
+			} else {
+				i1 = *kf(d + 1)
+			}
+			prev := i1
+			i2 := i1 - d
+			for i1 < hi1 && i2 < hi2 && differ.idA(i1) == differ.idB(i2) {
+				i1++
+				i2++
+			}
+			if i1-prev > snakeCount {
+				gotSnake = true
+			}
+			*kf(d) = i1
+			if odd && bmin <= d && d <= bmax && *kb(d) <= i1 {
+				return diffSplit{i1, i2, true, true}
+			}
+		}
+
+		if bmin > dmin {
+			bmin--
+			*kb(bmin - 1) = lineMax
+		} else {
+			bmin++
+		}
+		if bmax < dmax {
+			bmax++
+			*kb(bmax + 1) = lineMax
+		} else {
+			bmax--
+		}
+
+		for d := bmax; d >= bmin; d -= 2 {
+			var i1 int
+			if *kb(d - 1) < *kb(d + 1) {
+				i1 = *kb(d - 1)
+			} else {
+				i1 = *kb(d + 1) - 1
+			}
+			prev := i1
+			i2 := i1 - d
+			for i1 > lo1 && i2 > lo2 && differ.idA(i1-1) == differ.idB(i2-1) {
+				i1--
+				i2--
+			}
+			if prev-i1 > snakeCount {
+				gotSnake = true
+			}
+			*kb(d) = i1
+			if !odd && fmin <= d && d <= fmax && i1 <= *kf(d) {
+				return diffSplit{i1, i2, true, true}
+			}
+		}
+
+		if needMin {
+			continue
+		}
+
+		// once the cost is high, settle for a diagonal that has come a
+		// long way along a good run of matching lines
+		if gotSnake && cost > heuristicMinCost {
+			best := 0
+			var split diffSplit
+			for d := fmax; d >= fmin; d -= 2 {
+				dd := d - fmid
+				if dd < 0 {
+					dd = -dd
+				}
+				i1 := *kf(d)
+				i2 := i1 - d
+				v := (i1 - lo1) + (i2 - lo2) - dd
+				if v > heuristicFactor*cost && v > best &&
+					lo1+snakeCount <= i1 && i1 < hi1 &&
+					lo2+snakeCount <= i2 && i2 < hi2 {
+					for k := 1; differ.idA(i1-k) == differ.idB(i2-k); k++ {
+						if k == snakeCount {
+							best = v
+							split = diffSplit{i1, i2, true, false}
+							break
+						}
+					}
+				}
+			}
+			if best > 0 {
+				return split
+			}
+
+			for d := bmax; d >= bmin; d -= 2 {
+				dd := d - bmid
+				if dd < 0 {
+					dd = -dd
+				}
+				i1 := *kb(d)
+				i2 := i1 - d
+				v := (hi1 - i1) + (hi2 - i2) - dd
+				if v > heuristicFactor*cost && v > best &&
+					lo1 < i1 && i1 <= hi1-snakeCount &&
+					lo2 < i2 && i2 <= hi2-snakeCount {
+					for k := 0; differ.idA(i1+k) == differ.idB(i2+k); k++ {
+						if k == snakeCount-1 {
+							best = v
+							split = diffSplit{i1, i2, false, true}
+							break
+						}
+					}
+				}
+			}
+			if best > 0 {
+				return split
+			}
+		}
+
+		// enough is enough: take whichever path has got furthest
+		if cost >= differ.maxCost {
+			fbest, fbest1 := -1, -1
+			for d := fmax; d >= fmin; d -= 2 {
+				i1 := *kf(d)
+				if i1 > hi1 {
+					i1 = hi1
+				}
+				i2 := i1 - d
+				if hi2 < i2 {
+					i1, i2 = hi2+d, hi2
+				}
+				if fbest < i1+i2 {
+					fbest, fbest1 = i1+i2, i1
+				}
+			}
+
+			bbest, bbest1 := lineMax, lineMax
+			for d := bmax; d >= bmin; d -= 2 {
+				i1 := *kb(d)
+				if i1 < lo1 {
+					i1 = lo1
+				}
+				i2 := i1 - d
+				if i2 < lo2 {
+					i1, i2 = lo2+d, lo2
+				}
+				if i1+i2 < bbest {
+					bbest, bbest1 = i1+i2, i1
+				}
+			}
+
+			if (hi1+hi2)-bbest < fbest-(lo1+lo2) {
+				return diffSplit{fbest1, fbest - fbest1, true, false}
+			}
+			return diffSplit{bbest1, bbest - bbest1, false, true}
+		}
+	}
+}
+
+// diffGroup is a run of changed lines in one side, from start up to end. Each
+// side has the same number of groups, some of them empty, separated by the
+// unchanged lines the sides share.
+type diffGroup struct {
+	start, end int
+}
+
+func firstGroup(side *diffSide) diffGroup {
+	g := diffGroup{0, 0}
+	for side.isChanged(g.end) {
+		g.end++
+	}
+	return g
+}
+
+func (g *diffGroup) next(side *diffSide) bool {
+	if g.end >= len(side.changed) {
+		return false
+	}
+	g.start = g.end + 1
+	g.end = g.start
+	for side.isChanged(g.end) {
+		g.end++
+	}
+	return true
+}
+
+func (g *diffGroup) previous(side *diffSide) bool {
+	if g.start == 0 {
+		return false
+	}
+	g.end = g.start - 1
+	g.start = g.end
+	for side.isChanged(g.start - 1) {
+		g.start--
+	}
+	return true
+}
+
+// slideDown moves the group down a line if the line after it is the same as
+// its first, merging it with any group it then touches.
+func (g *diffGroup) slideDown(side *diffSide) bool {
+	if g.end >= len(side.ids) || side.ids[g.start] != side.ids[g.end] {
+		return false
+	}
+	side.changed[g.start] = false
+	side.changed[g.end] = true
+	g.start++
+	g.end++
+	for side.isChanged(g.end) {
+		g.end++
+	}
+	return true
+}
+
+func (g *diffGroup) slideUp(side *diffSide) bool {
+	if g.start == 0 || side.ids[g.start-1] != side.ids[g.end-1] {
+		return false
+	}
+	g.start--
+	g.end--
+	side.changed[g.start] = true
+	side.changed[g.end] = false
+	for side.isChanged(g.start - 1) {
+		g.start--
+	}
+	return true
+}
+
+// maxIndentSliding limits how far the indent heuristic looks for a better
+// place for a group.
+const maxIndentSliding = 100
+
+// compactChanges slides each group of changes in side as git's xdiff does:
+// merging groups where possible, lining them up with a group in other if one
+// is in reach, and otherwise placing them by the indentation around them if
+// indentHeuristic is set, or as far down as they go if not.
+func compactChanges(side *diffSide, other *diffSide, indentHeuristic bool) {
+	g := firstGroup(side)
+	og := firstGroup(other)
+
+	for {
+		if g.end != g.start {
+			var size, earliestEnd int
+			endMatchingOther := -1
+			for {
+				size = g.end - g.start
+				endMatchingOther = -1
+
+				for g.slideUp(side) {
+					og.previous(other)
+				}
+				earliestEnd = g.end
+				if og.end > og.start {
+					endMatchingOther = g.end
+				}
+
+				for g.slideDown(side) {
+					og.next(other)
+					if og.end > og.start {
+						endMatchingOther = g.end
+					}
+				}
+
+				if size == g.end-g.start {
+					break
+				}
+			}
+
+			if g.end == earliestEnd {
+				// the group can not move
+			} else if endMatchingOther != -1 {
+				for og.end == og.start {
+					g.slideUp(side)
+					og.previous(other)
+				}
+			} else if indentHeuristic {
+				shift := earliestEnd
+				if g.end-size-1 > shift {
+					shift = g.end - size - 1
+				}
+				if g.end-maxIndentSliding > shift {
+					shift = g.end - maxIndentSliding
+				}
+
+				bestShift := -1
+				var best splitScore
+				for ; shift <= g.end; shift++ {
+					score := splitScore{}
+					score.add(measureSplit(side, shift))
+					score.add(measureSplit(side, shift-size))
+					if bestShift == -1 || score.compare(best) <= 0 {
+						best = score
+						bestShift = shift
+					}
+				}
+
+				for g.end > bestShift {
+					g.slideUp(side)
+					og.previous(other)
+				}
+			}
+		}
+
+		if !g.next(side) {
+			break
+		}
+		og.next(other)
+	}
+}
+
+// The weights of git's indent heuristic, which places changes so that they
+// start and end at the boundaries of blocks of code or text.
+const (
+	maxIndent                      = 200
+	maxBlanks                      = 20
+	startOfFilePenalty             = 1
+	endOfFilePenalty               = 21
+	totalBlankWeight               = -30
+	postBlankWeight                = 6
+	relativeIndentPenalty          = -4
+	relativeIndentWithBlankPenalty = 10
+	relativeOutdentPenalty         = 24
+	relativeOutdentWithBlank       = 17
+	relativeDedentPenalty          = 23
+	relativeDedentWithBlank        = 17
+	indentWeight                   = 60
+)
+
+// splitMeasurement describes the lines around a boundary between a group
+// of changes and the unchanged lines next to it. Indents are -1 for blank
+// lines.
+type splitMeasurement struct {
+	endOfFile  bool
+	indent     int
+	preBlank   int
+	preIndent  int
+	postBlank  int
+	postIndent int
+}
+
+// lineIndent returns the width of the whitespace a line starts with, with
+// tabs to multiples of 8, or -1 if the line is blank.
+func lineIndent(line string) int {
+	indent := 0
+	for i := 0; i < len(line); i++ {
+		switch line[i] {
+		case ' ':
+			indent++
+		case '\t':
+			indent += 8 - indent%8
+		case '\n', '\r', '\v', '\f':
+		default:
+			return indent
+		}
+		if indent >= maxIndent {
+			return maxIndent
+		}
+	}
+	return -1
+}
+
+func measureSplit(side *diffSide, split int) splitMeasurement {
+	m := splitMeasurement{indent: -1, preIndent: -1, postIndent: -1}
+	if split >= len(side.lines) {
+		m.endOfFile = true
+	} else {
+		m.indent = lineIndent(side.lines[split])
+	}
+
+	for i := split - 1; i >= 0; i-- {
+		m.preIndent = lineIndent(side.lines[i])
+		if m.preIndent != -1 {
+			break
+		}
+		m.preBlank++
+		if m.preBlank == maxBlanks {
+			m.preIndent = 0
+			break
+		}
+	}
+
+	for i := split + 1; i < len(side.lines); i++ {
+		m.postIndent = lineIndent(side.lines[i])
+		if m.postIndent != -1 {
+			break
+		}
+		m.postBlank++
+		if m.postBlank == maxBlanks {
+			m.postIndent = 0
+			break
+		}
+	}
+	return m
+}
+
+type splitScore struct {
+	effectiveIndent int
+	penalty         int
+}
+
+func (s *splitScore) add(m splitMeasurement) {
+	if m.preIndent == -1 && m.preBlank == 0 {
+		s.penalty += startOfFilePenalty
+	}
+	if m.endOfFile {
+		s.penalty += endOfFilePenalty
+	}
+
+	postBlank := 0
+	if m.indent == -1 {
+		postBlank = 1 + m.postBlank
+	}
+	totalBlank := m.preBlank + postBlank
+	s.penalty += totalBlankWeight * totalBlank
+	s.penalty += postBlankWeight * postBlank
+
+	indent := m.indent
+	if indent == -1 {
+		indent = m.postIndent
+	}
+	anyBlanks := totalBlank != 0
+	s.effectiveIndent += indent
+
+	switch {
+	case indent == -1 || m.preIndent == -1 || indent == m.preIndent:
+	case indent > m.preIndent:
+		if anyBlanks {
+			s.penalty += relativeIndentWithBlankPenalty
+		} else {
+			s.penalty += relativeIndentPenalty
+		}
+	case m.postIndent != -1 && m.postIndent > indent:
+		if anyBlanks {
+			s.penalty += relativeOutdentWithBlank
+		} else {
+			s.penalty += relativeOutdentPenalty
+		}
+	default:
+		if anyBlanks {
+			s.penalty += relativeDedentWithBlank
+		} else {
+			s.penalty += relativeDedentPenalty
+		}
+	}
+}
+
+// compare returns a negative number if s is a better place to split than
+// other, and a positive one if it is worse.
+func (s splitScore) compare(other splitScore) int {
+	cmp := 0
+	if s.effectiveIndent > other.effectiveIndent {
+		cmp = 1
+	} else if s.effectiveIndent < other.effectiveIndent {
+		cmp = -1
+	}
+	return indentWeight*cmp + s.penalty - other.penalty
+}
@@ -0,0 +1,176 @@
+package gitpacklib
+
+import (
+	"context"
+	"os"
+	"sort"
+	"strings"
+)
+
+// refKeyPrefix is prepended to a ref name to give the backing store key that
+// holds its value in a LooseRefStore.
+const refKeyPrefix = "ref/"
+
+// LooseRefStore stores each ref under its own key in a BackingStore, so that
+// each can be locked and written on its own. Transactions hold the store
+// shared and lock just the refs they touch, letting pushes to different refs
+// proceed concurrently.
+type LooseRefStore struct {
+	store BackingStore
+}
+
+func NewLooseRefStore(store BackingStore) *LooseRefStore {
+	return &LooseRefStore{store}
+}
+
+func (r *LooseRefStore) Get(ctx context.Context, name string) (*Ref, error) {
+	value, err := r.store.Get(ctx, refKeyPrefix+name)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return parseLooseRef(name, value), nil
+}
+
+func (r *LooseRefStore) Iterate(ctx context.Context, prefix string, fn func(ref *Ref) error) error {
+	keys, err := r.store.List(ctx, refKeyPrefix+prefix)
+	if err != nil {
+		return err
+	}
+
+	for _, key := range keys {
+		ref, err := r.Get(ctx, strings.TrimPrefix(key, refKeyPrefix))
+		if err != nil {
+			return err
+		}
+		// the ref may have been deleted since it was listed
+		if ref == nil {
+			continue
+		}
+		if err = fn(ref); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Update locks the refs being updated in sorted order, so that concurrent
+// transactions cannot deadlock, then compares and swaps each of them. A ref
+// being created also locks the names of its directories, so that it cannot
+// be created alongside a conflicting ref. Reflog entries are appended before
+// the refs are written, as git does, so that a ref never moves without one.
+// If writing fails part way through, refs already written are put back.
+func (r *LooseRefStore) Update(ctx context.Context, updates []*RefUpdate) error {
+	lockCtx, cancel := lockWaitContext(ctx)
+	defer cancel()
+
+	err := r.store.RLock(lockCtx)
+	if err != nil {
+		return err
+	}
+	defer r.store.RUnlock()
+
+	names, err := refUpdateNames(updates)
+	if err != nil {
+		return err
+	}
+	names = refLockNames(updates, names)
+
+	for i, name := range names {
+		err := r.store.LockKey(lockCtx, refKeyPrefix+name)
+		if err != nil {
+			for _, locked := range names[:i] {
+				r.store.UnlockKey(refKeyPrefix + locked)
+			}
+			return err
+		}
+	}
+	defer func() {
+		for _, name := range names {
+			r.store.UnlockKey(refKeyPrefix + name)
+		}
+	}()
+
+	previous := make(map[string]*Ref, len(updates))
+	err = checkRefUpdates(updates, func(name string) (*Ref, error) {
+		ref, err := r.Get(ctx, name)
+		previous[name] = ref
+		return ref, err
+	})
+	if err != nil {
+		return err
+	}
+	err = checkRefNamesAvailable(updates, func(name string) (bool, error) {
+		ref, err := r.Get(ctx, name)
+		return ref != nil, err
+	}, func(prefix string) ([]string, error) {
+		keys, err := r.store.List(ctx, refKeyPrefix+prefix)
+		for i, key := range keys {
+			keys[i] = strings.TrimPrefix(key, refKeyPrefix)
+		}
+		return keys, err
+	})
+	if err != nil {
+		return err
+	}
+	err = appendReflogs(ctx, lockCtx, r.store, updates)
+	if err != nil {
+		return err
+	}
+
+	for i, update := range updates {
+		err = r.set(ctx, update.Name, update.result())
+		if err != nil {
+			update.Err = err
+			for _, applied := range updates[:i] {
+				r.set(ctx, applied.Name, previous[applied.Name])
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// refLockNames adds the directories of each ref being created to the sorted
+// names of the refs being updated, keeping them sorted.
+func refLockNames(updates []*RefUpdate, names []string) []string {
+	locked := map[string]bool{}
+	for _, name := range names {
+		locked[name] = true
+	}
+	for _, update := range updates {
+		if !update.creates() {
+			continue
+		}
+		for _, dir := range refDirectories(update.Name) {
+			if !locked[dir] {
+				locked[dir] = true
+				names = append(names, dir)
+			}
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// set writes ref in the same format as a loose ref in a git repository, or
+// deletes the ref if it is nil.
+func (r *LooseRefStore) set(ctx context.Context, name string, ref *Ref) error {
+	if ref == nil {
+		return r.store.Delete(ctx, refKeyPrefix+name)
+	}
+	if ref.Target != "" {
+		return r.store.Set(ctx, refKeyPrefix+name, []byte("ref: "+ref.Target+"\n"))
+	}
+	return r.store.Set(ctx, refKeyPrefix+name, []byte(ref.Hash+"\n"))
+}
+
+func parseLooseRef(name string, value []byte) *Ref {
+	content := strings.TrimSpace(string(value))
+	if strings.HasPrefix(content, "ref: ") {
+		return &Ref{Name: name, Target: strings.TrimPrefix(content, "ref: ")}
+	}
+	return &Ref{Name: name, Hash: content}
+}
@@ -0,0 +1,221 @@
+package gitpacklib
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"io/ioutil"
+	"mime"
+	"mime/quotedprintable"
+	"net/mail"
+	"strconv"
+	"strings"
+)
+
+// MailPatch is a single patch from a mailbox, such as one written by git
+// format-patch.
+type MailPatch struct {
+	// Author is taken from the From and Date headers, or from the same
+	// headers at the start of the body, which format-patch writes when the
+	// author is not the sender.
+	Author *Signature
+
+	// Message is the commit message: the subject without any "[PATCH]"
+	// prefix, then the body up to the "---" line that separates it from the
+	// diff.
+	Message string
+
+	Files []*FilePatch
+}
+
+// ParseMailbox splits an mbox, or the output of git format-patch, into its
+// patches, as git am does. Input that does not start with an mbox "From "
+// line is taken to be a single message.
+func ParseMailbox(data []byte) ([]*MailPatch, error) {
+	// mail may come with CRLF line endings, which git mailsplit drops
+	data = bytes.Replace(data, []byte("\r\n"), []byte("\n"), -1)
+
+	var patches []*MailPatch
+	for _, message := range splitMailbox(data) {
+		patch, err := parseMailPatch(message)
+		if err != nil {
+			return nil, errors.New("Invalid patch " + strconv.Itoa(len(patches)+1) + ": " + err.Error())
+		}
+		patches = append(patches, patch)
+	}
+	return patches, nil
+}
+
+// splitMailbox splits data at the "From " lines that start each message of
+// an mbox.
+func splitMailbox(data []byte) [][]byte {
+	lines := bytes.SplitAfter(data, []byte("\n"))
+	if len(lines) == 0 || !isMailboxFromLine(lines[0]) {
+		return [][]byte{data}
+	}
+
+	var messages [][]byte
+	var message []byte
+	for _, line := range lines {
+		if isMailboxFromLine(line) {
+			if message != nil {
+				messages = append(messages, message)
+			}
+			message = []byte{}
+			continue
+		}
+		message = append(message, line...)
+	}
+	return append(messages, message)
+}
+
+// isMailboxFromLine reports whether line separates messages in an mbox. Like
+// git mailsplit, it looks for a time and year at the end of the line, so that
+// a line of a message that merely starts with "From " is not mistaken for one.
+func isMailboxFromLine(line []byte) bool {
+	s := strings.TrimRight(string(line), "\r\n")
+	if len(s) < 20 || !strings.HasPrefix(s, "From ") {
+		return false
+	}
+	colon := strings.LastIndexByte(s, ':')
+	if colon < 9 || colon+3 > len(s) {
+		return false
+	}
+	digit := func(c byte) bool { return c >= '0' && c <= '9' }
+	if !digit(s[colon-4]) || !digit(s[colon-2]) || !digit(s[colon-1]) || !digit(s[colon+1]) || !digit(s[colon+2]) {
+		return false
+	}
+	year, _ := strconv.Atoi(strings.Fields(s[colon+3:] + " 0")[0])
+	return year > 90
+}
+
+func parseMailPatch(data []byte) (*MailPatch, error) {
+	msg, err := mail.ReadMessage(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	body, err := ioutil.ReadAll(msg.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	switch strings.ToLower(msg.Header.Get("Content-Transfer-Encoding")) {
+	case "quoted-printable":
+		body, err = ioutil.ReadAll(quotedprintable.NewReader(bytes.NewReader(body)))
+	case "base64":
+		body, err = base64.StdEncoding.DecodeString(string(bytes.Join(bytes.Fields(body), nil)))
+	}
+	if err != nil {
+		return nil, errors.New("Invalid body: " + err.Error())
+	}
+
+	headers := map[string]string{
+		"From":    msg.Header.Get("From"),
+		"Date":    msg.Header.Get("Date"),
+		"Subject": msg.Header.Get("Subject"),
+	}
+
+	// headers at the start of the body override those of the mail
+	lines := splitLines(body)
+	inBody := false
+	for len(lines) > 0 {
+		parts := strings.SplitN(strings.TrimRight(lines[0], "\r\n"), ": ", 2)
+		if _, ok := headers[parts[0]]; !ok || len(parts) != 2 {
+			break
+		}
+		headers[parts[0]] = parts[1]
+		lines = lines[1:]
+		inBody = true
+	}
+	if inBody && len(lines) > 0 && strings.TrimSpace(lines[0]) == "" {
+		lines = lines[1:]
+	}
+
+	// the message ends where the diff starts
+	var message []string
+	for len(lines) > 0 && !isPatchBreak(lines[0]) {
+		message = append(message, strings.TrimRight(lines[0], "\r\n"))
+		lines = lines[1:]
+	}
+
+	patch := &MailPatch{}
+	patch.Author, err = parseMailAuthor(headers["From"], headers["Date"])
+	if err != nil {
+		return nil, err
+	}
+
+	decoder := &mime.WordDecoder{}
+	subject, err := decoder.DecodeHeader(headers["Subject"])
+	if err != nil {
+		subject = headers["Subject"]
+	}
+	patch.Message = cleanSubject(subject) + "\n"
+	if text := strings.Trim(strings.Join(message, "\n"), "\n"); text != "" {
+		patch.Message += "\n" + text + "\n"
+	}
+
+	patch.Files, err = ParsePatch([]byte(strings.Join(lines, "")))
+	if err != nil {
+		return nil, err
+	}
+	return patch, nil
+}
+
+func parseMailAuthor(from string, date string) (*Signature, error) {
+	if from == "" {
+		return nil, errors.New("No author")
+	}
+	addr, err := mail.ParseAddress(from)
+	if err != nil {
+		return nil, errors.New("Invalid author " + from)
+	}
+
+	author := &Signature{Name: addr.Name, Email: addr.Address}
+	if author.Name == "" {
+		author.Name = addr.Address
+	}
+	if date != "" {
+		author.When, err = mail.ParseDate(date)
+		if err != nil {
+			return nil, errors.New("Invalid date " + date)
+		}
+	}
+	return author, nil
+}
+
+// cleanSubject removes the "Re:" and bracketed prefixes, such as
+// "[PATCH 1/2]", that git am leaves out of a commit's subject.
+func cleanSubject(subject string) string {
+	for {
+		subject = strings.TrimSpace(subject)
+		switch {
+		case len(subject) >= 3 && strings.EqualFold(subject[:3], "re:"):
+			subject = subject[3:]
+		case strings.HasPrefix(subject, "["):
+			end := strings.IndexByte(subject, ']')
+			if end < 0 {
+				return subject
+			}
+			subject = subject[end+1:]
+		default:
+			return strings.Join(strings.Fields(subject), " ")
+		}
+	}
+}
+
+// isPatchBreak reports whether line starts the diff of a mail, as in git
+// mailinfo: a "---" line, or the start of a diff.
+func isPatchBreak(line string) bool {
+	line = strings.TrimRight(line, "\r\n")
+	if strings.HasPrefix(line, "diff -") || strings.HasPrefix(line, "Index: ") {
+		return true
+	}
+	if !strings.HasPrefix(line, "---") {
+		return false
+	}
+	rest := line[3:]
+	if len(rest) > 1 && rest[0] == ' ' && rest[1] != ' ' && rest[1] != '\t' {
+		return true
+	}
+	return strings.TrimSpace(rest) == ""
+}
@@ -0,0 +1,474 @@
+package gitpacklib
+
+import (
+	"context"
+	"errors"
+	"sort"
+)
+
+var (
+	ErrMergeConflict   = errors.New("Merge has conflicts")
+	ErrAlreadyUpToDate = errors.New("Already up to date")
+)
+
+// MergeConflictType says why a path could not be merged.
+type MergeConflictType string
+
+const (
+	// ConflictContent is a file changed differently on both sides, or whose
+	// changes could not be merged because it is binary, a symlink or a
+	// submodule.
+	ConflictContent MergeConflictType = "content"
+
+	// ConflictAddAdd is a path added on both sides with different content.
+	ConflictAddAdd MergeConflictType = "add/add"
+
+	// ConflictModifyDelete is a file deleted on one side and changed on the
+	// other.
+	ConflictModifyDelete MergeConflictType = "modify/delete"
+
+	// ConflictFileDirectory is a path that is a directory on one side and
+	// not on the other.
+	ConflictFileDirectory MergeConflictType = "file/directory"
+)
+
+// MergeConflict is a path that could not be merged. Base, Ours and Theirs are
+// its entries in each tree, nil where it does not exist.
+type MergeConflict struct {
+	Path   string
+	Type   MergeConflictType
+	Base   *TreeEntry
+	Ours   *TreeEntry
+	Theirs *TreeEntry
+}
+
+// MergeResult is the outcome of a merge. Tree is the merged tree. Where there
+// are conflicts, conflicting text files hold both versions between conflict
+// markers and other conflicting paths keep our side, if it has one.
+type MergeResult struct {
+	Tree      string
+	Conflicts []*MergeConflict
+
+	// Commit is the commit a ref was moved to by Merge.
+	Commit string
+}
+
+type MergeOptions struct {
+	// OursLabel and TheirsLabel name the sides in conflict markers. They
+	// default to "ours" and "theirs".
+	OursLabel   string
+	TheirsLabel string
+}
+
+// MergeTrees merges the changes made to the tree base in the trees ours and
+// theirs. An empty base is taken to be an empty tree.
+//
+// Renames are not detected, so a file renamed on one side and changed on the
+// other is a modify/delete conflict.
+func (repo *Repository) MergeTrees(ctx context.Context, base string, ours string, theirs string, opts *MergeOptions) (*MergeResult, error) {
+	merger := &treeMerger{repo: repo, oursLabel: "ours", theirsLabel: "theirs"}
+	if opts != nil {
+		if opts.OursLabel != "" {
+			merger.oursLabel = opts.OursLabel
+		}
+		if opts.TheirsLabel != "" {
+			merger.theirsLabel = opts.TheirsLabel
+		}
+	}
+
+	tree, err := merger.mergeTrees(ctx, "", base, ours, theirs)
+	if err != nil {
+		return nil, err
+	}
+	if tree == "" {
+		tree, err = repo.WriteObject(ctx, &Tree{})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &MergeResult{Tree: tree, Conflicts: merger.conflicts}, nil
+}
+
+// MergeCommits merges the trees of the commits ours and theirs, using their
+// merge base as the base. Where there are several merge bases they are first
+// merged into one, as git's default merge strategy does.
+func (repo *Repository) MergeCommits(ctx context.Context, ours string, theirs string, opts *MergeOptions) (*MergeResult, error) {
+	base, err := repo.mergeBaseTree(ctx, ours, []string{theirs})
+	if err != nil {
+		return nil, err
+	}
+	oursCommit, err := repo.ReadCommit(ctx, ours)
+	if err != nil {
+		return nil, err
+	}
+	theirsCommit, err := repo.ReadCommit(ctx, theirs)
+	if err != nil {
+		return nil, err
+	}
+	return repo.MergeTrees(ctx, base, oursCommit.Tree, theirsCommit.Tree, opts)
+}
+
+// mergeBaseTree returns the tree to use as the base for merging one and
+// others: the tree of their merge base, the empty string if they have none,
+// or if they have several, the merge of those, conflicts and all.
+func (repo *Repository) mergeBaseTree(ctx context.Context, one string, others []string) (string, error) {
+	bases, err := repo.MergeBases(ctx, one, others...)
+	if err != nil || len(bases) == 0 {
+		return "", err
+	}
+
+	commit, err := repo.ReadCommit(ctx, bases[0])
+	if err != nil {
+		return "", err
+	}
+	tree := commit.Tree
+	for i := 1; i < len(bases); i++ {
+		base, err := repo.mergeBaseTree(ctx, bases[i], bases[:i])
+		if err != nil {
+			return "", err
+		}
+		commit, err := repo.ReadCommit(ctx, bases[i])
+		if err != nil {
+			return "", err
+		}
+		merged, err := repo.MergeTrees(ctx, base, tree, commit.Tree, &MergeOptions{
+			OursLabel:   "Temporary merge branch 1",
+			TheirsLabel: "Temporary merge branch 2",
+		})
+		if err != nil {
+			return "", err
+		}
+		tree = merged.Tree
+	}
+	return tree, nil
+}
+
+type treeMerger struct {
+	repo        *Repository
+	oursLabel   string
+	theirsLabel string
+	conflicts   []*MergeConflict
+}
+
+// mergeTrees merges the trees with the given shas, any of which may be empty
+// for a missing tree, and stores the result. It returns the sha of the merged
+// tree, or the empty string if it is left empty.
+func (merger *treeMerger) mergeTrees(ctx context.Context, prefix string, base string, ours string, theirs string) (string, error) {
+	sides := make([]map[string]*TreeEntry, 3)
+	names := map[string]bool{}
+	for i, sha := range []string{base, ours, theirs} {
+		entries, err := merger.repo.readTreeEntries(ctx, sha)
+		if err != nil {
+			return "", err
+		}
+		sides[i] = map[string]*TreeEntry{}
+		for j := range entries {
+			sides[i][entries[j].Name] = &entries[j]
+			names[entries[j].Name] = true
+		}
+	}
+
+	sorted := make([]string, 0, len(names))
+	for name := range names {
+		sorted = append(sorted, name)
+	}
+	sort.Strings(sorted)
+
+	tree := &Tree{}
+	for _, name := range sorted {
+		entry, err := merger.mergeEntry(ctx, prefix+name, sides[0][name], sides[1][name], sides[2][name])
+		if err != nil {
+			return "", err
+		}
+		if entry != nil {
+			tree.Entries = append(tree.Entries, TreeEntry{Mode: entry.Mode, Name: name, Hash: entry.Hash})
+		}
+	}
+
+	if len(tree.Entries) == 0 {
+		return "", nil
+	}
+	tree.Sort()
+	return merger.repo.WriteObject(ctx, tree)
+}
+
+// mergeEntry merges a single path, returning its merged entry or nil if it is
+// to be left out.
+func (merger *treeMerger) mergeEntry(ctx context.Context, path string, base *TreeEntry, ours *TreeEntry, theirs *TreeEntry) (*TreeEntry, error) {
+	switch {
+	case sameTreeEntry(ours, theirs), sameTreeEntry(base, theirs):
+		return ours, nil
+	case sameTreeEntry(base, ours):
+		return theirs, nil
+	}
+
+	conflict := &MergeConflict{Path: path, Base: base, Ours: ours, Theirs: theirs}
+
+	if ours == nil || theirs == nil {
+		changed := ours
+		if changed == nil {
+			changed = theirs
+		}
+		// a directory deleted on one side is merged file by file, so that
+		// only the files changed on the other side conflict
+		if changed.IsTree() && base.IsTree() {
+			return merger.mergeSubtrees(ctx, path, base, ours, theirs)
+		}
+		conflict.Type = ConflictModifyDelete
+		merger.conflicts = append(merger.conflicts, conflict)
+		return changed, nil
+	}
+
+	if ours.IsTree() && theirs.IsTree() {
+		return merger.mergeSubtrees(ctx, path, base, ours, theirs)
+	}
+	if ours.IsTree() || theirs.IsTree() {
+		conflict.Type = ConflictFileDirectory
+		merger.conflicts = append(merger.conflicts, conflict)
+		return ours, nil
+	}
+
+	conflict.Type = ConflictContent
+	if base == nil || base.IsTree() {
+		conflict.Type = ConflictAddAdd
+		base = nil
+	}
+
+	if !isRegularFile(ours.Mode) || !isRegularFile(theirs.Mode) ||
+		(base != nil && !isRegularFile(base.Mode)) {
+		merger.conflicts = append(merger.conflicts, conflict)
+		return ours, nil
+	}
+
+	// the executable bit is merged on its own
+	mode := ours.Mode
+	if base != nil && ours.Mode == base.Mode {
+		mode = theirs.Mode
+	}
+	modeConflict := ours.Mode != theirs.Mode && (base == nil || (ours.Mode != base.Mode && theirs.Mode != base.Mode))
+
+	hash, contentConflict, err := merger.mergeBlobs(ctx, base, ours, theirs)
+	if err != nil {
+		return nil, err
+	}
+	if modeConflict || contentConflict {
+		merger.conflicts = append(merger.conflicts, conflict)
+	}
+	return &TreeEntry{Mode: mode, Hash: hash}, nil
+}
+
+// mergeSubtrees merges a path that is a directory on at least one side,
+// returning nil if it is left empty.
+func (merger *treeMerger) mergeSubtrees(ctx context.Context, path string, base *TreeEntry, ours *TreeEntry, theirs *TreeEntry) (*TreeEntry, error) {
+	var shas [3]string
+	for i, entry := range []*TreeEntry{base, ours, theirs} {
+		if entry != nil && entry.IsTree() {
+			shas[i] = entry.Hash
+		}
+	}
+	tree, err := merger.mergeTrees(ctx, path+"/", shas[0], shas[1], shas[2])
+	if err != nil || tree == "" {
+		return nil, err
+	}
+	return &TreeEntry{Mode: ModeTree, Hash: tree}, nil
+}
+
+// mergeBlobs merges the content of regular files, where base may be nil. It
+// returns the sha of the merged blob, which for a binary file that could not
+// be merged is ours.
+func (merger *treeMerger) mergeBlobs(ctx context.Context, base *TreeEntry, ours *TreeEntry, theirs *TreeEntry) (string, bool, error) {
+	baseHash := ""
+	if base != nil {
+		baseHash = base.Hash
+	}
+	switch {
+	case ours.Hash == theirs.Hash, theirs.Hash == baseHash:
+		return ours.Hash, false, nil
+	case ours.Hash == baseHash:
+		return theirs.Hash, false, nil
+	}
+
+	var contents [3][]byte
+	for i, entry := range []*TreeEntry{base, ours, theirs} {
+		if entry == nil {
+			continue
+		}
+		blob, err := merger.repo.ReadBlob(ctx, entry.Hash)
+		if err != nil {
+			return "", false, err
+		}
+		if isBinary(blob.Data) {
+			return ours.Hash, true, nil
+		}
+		contents[i] = blob.Data
+	}
+
+	merged, conflicted := mergeContent(contents[0], contents[1], contents[2], merger.oursLabel, merger.theirsLabel)
+	hash, err := merger.repo.WriteObject(ctx, &Blob{Data: merged})
+	return hash, conflicted, err
+}
+
+func sameTreeEntry(a *TreeEntry, b *TreeEntry) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.Mode == b.Mode && a.Hash == b.Hash
+}
+
+func isRegularFile(mode uint32) bool {
+	return modeKind(mode) == modeKind(ModeBlob)
+}
+
+// MergeRequest describes a merge into a branch to be made by Merge.
+type MergeRequest struct {
+	// Ref is the ref to merge into, such as "refs/heads/main". Symbolic refs
+	// such as HEAD are followed.
+	Ref string
+
+	// Theirs is the revision to merge, such as "refs/heads/feature".
+	Theirs string
+
+	// Parent is the commit Ref must still point at for it to be updated. If
+	// empty, whatever Ref points at is merged into.
+	Parent string
+
+	// Author of the merge commit. If Committer is nil, the author is used.
+	// A zero When is filled in with the current time.
+	Author    *Signature
+	Committer *Signature
+
+	// Message defaults to "Merge commit '<sha>'", naming the merged commit.
+	Message string
+
+	// FastForward moves Ref straight to Theirs, without a merge commit,
+	// when Theirs already contains Ref.
+	FastForward bool
+
+	// Identity is recorded as who updated the ref in its reflog. If empty,
+	// the committer's name and email are used.
+	Identity string
+
+	Options *MergeOptions
+}
+
+// Merge merges req.Theirs into req.Ref and moves the ref to the merge commit,
+// like a "merge pull request" button. If there are conflicts, nothing is
+// changed and ErrMergeConflict is returned along with a result listing them.
+// ErrAlreadyUpToDate is returned if Ref already contains Theirs.
+//
+// The ref is updated with a compare-and-swap, as by CreateCommit.
+func (repo *Repository) Merge(ctx context.Context, req *MergeRequest) (*MergeResult, error) {
+	ref, ours, theirs, err := repo.resolveMerge(ctx, req.Ref, req.Parent, req.Theirs)
+	if err != nil {
+		return nil, err
+	}
+
+	if req.FastForward {
+		fastForward, err := repo.IsAncestor(ctx, ours, theirs)
+		if err != nil {
+			return nil, err
+		}
+		if fastForward {
+			return repo.fastForward(ctx, ref.Name, ours, theirs, req)
+		}
+	}
+
+	opts := mergeLabels(ref.Name, req.Theirs, req.Options)
+	result, err := repo.MergeCommits(ctx, ours, theirs, opts)
+	if err != nil {
+		return nil, err
+	}
+	if len(result.Conflicts) > 0 {
+		return result, ErrMergeConflict
+	}
+
+	message := req.Message
+	if message == "" {
+		message = "Merge commit '" + theirs + "'"
+	}
+	result.Commit, err = repo.commitToRef(ctx, ref.Name, ours, &commitDetails{
+		tree:      result.Tree,
+		parents:   []string{ours, theirs},
+		author:    req.Author,
+		committer: req.Committer,
+		message:   message,
+		identity:  req.Identity,
+		action:    "merge",
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// resolveMerge resolves the ref to merge into and the commits being merged,
+// returning ErrAlreadyUpToDate if there is nothing to merge.
+func (repo *Repository) resolveMerge(ctx context.Context, name string, parent string, rev string) (ref *Ref, ours string, theirs string, err error) {
+	ref, err = repo.resolveCommitRef(ctx, name)
+	if err != nil {
+		return nil, "", "", err
+	}
+	ours = parent
+	if ours == "" {
+		ours = ref.Hash
+	}
+	if ours == "" {
+		return nil, "", "", errors.New("Can not merge into " + ref.Name + ": " + ErrRefNotFound.Error())
+	}
+
+	theirs, err = repo.ResolveRevision(ctx, rev)
+	if err != nil {
+		return nil, "", "", err
+	}
+	theirs, err = repo.peelRevision(ctx, theirs, CommitObject)
+	if err != nil {
+		return nil, "", "", err
+	}
+
+	upToDate, err := repo.IsAncestor(ctx, theirs, ours)
+	if err != nil {
+		return nil, "", "", err
+	}
+	if upToDate {
+		return nil, "", "", ErrAlreadyUpToDate
+	}
+	return ref, ours, theirs, nil
+}
+
+// mergeLabels returns opts with the labels it leaves empty set to the names
+// of the sides.
+func mergeLabels(ours string, theirs string, opts *MergeOptions) *MergeOptions {
+	labels := &MergeOptions{OursLabel: ours, TheirsLabel: theirs}
+	if opts != nil {
+		if opts.OursLabel != "" {
+			labels.OursLabel = opts.OursLabel
+		}
+		if opts.TheirsLabel != "" {
+			labels.TheirsLabel = opts.TheirsLabel
+		}
+	}
+	return labels
+}
+
+func (repo *Repository) fastForward(ctx context.Context, name string, ours string, theirs string, req *MergeRequest) (*MergeResult, error) {
+	commit, err := repo.ReadCommit(ctx, theirs)
+	if err != nil {
+		return nil, err
+	}
+
+	identity := req.Identity
+	if identity == "" {
+		sig := req.Committer
+		if sig == nil {
+			sig = req.Author
+		}
+		if sig != nil {
+			identity = signatureIdentity(sig)
+		}
+	}
+	err = repo.moveRef(ctx, name, ours, theirs, identity, "merge "+req.Theirs+": Fast-forward")
+	if err != nil {
+		return nil, err
+	}
+	return &MergeResult{Tree: commit.Tree, Commit: theirs}, nil
+}
@@ -0,0 +1,280 @@
+package gitpacklib
+
+import (
+	"container/heap"
+	"context"
+	"time"
+)
+
+// flags painted onto commits while looking for merge bases
+const (
+	paintOne = 1 << iota
+	paintTwo
+	paintStale
+	paintResult
+)
+
+// commitQueue is a priority queue of commits, newest committer date first,
+// with ties going to the commit queued first.
+type commitQueue []*queuedCommit
+
+type queuedCommit struct {
+	sha  string
+	when time.Time
+	seq  int
+}
+
+func (queue commitQueue) Len() int { return len(queue) }
+
+func (queue commitQueue) Less(i, j int) bool {
+	if !queue[i].when.Equal(queue[j].when) {
+		return queue[i].when.After(queue[j].when)
+	}
+	return queue[i].seq < queue[j].seq
+}
+
+func (queue commitQueue) Swap(i, j int) { queue[i], queue[j] = queue[j], queue[i] }
+
+func (queue *commitQueue) Push(x interface{}) { *queue = append(*queue, x.(*queuedCommit)) }
+
+func (queue *commitQueue) Pop() interface{} {
+	old := *queue
+	item := old[len(old)-1]
+	*queue = old[:len(old)-1]
+	return item
+}
+
+// commitPainter walks down the history of two sets of commits at once,
+// marking each commit with which of the sets it is reachable from, the way
+// git's merge-base does. The walk stops as soon as everything left to visit
+// is reachable from both sets.
+type commitPainter struct {
+	repo    *Repository
+	commits map[string]*Commit
+	flags   map[string]int
+	queue   commitQueue
+	seq     int
+
+	// queued counts the entries of each commit in the queue, of which
+	// nonStale are for commits not painted stale
+	queued   map[string]int
+	nonStale int
+}
+
+func (repo *Repository) newCommitPainter() *commitPainter {
+	return &commitPainter{
+		repo:    repo,
+		commits: map[string]*Commit{},
+		flags:   map[string]int{},
+		queued:  map[string]int{},
+	}
+}
+
+func (painter *commitPainter) readCommit(ctx context.Context, sha string) (*Commit, error) {
+	if commit, ok := painter.commits[sha]; ok {
+		return commit, nil
+	}
+	commit, err := painter.repo.ReadCommit(ctx, sha)
+	if err != nil {
+		return nil, err
+	}
+	painter.commits[sha] = commit
+	return commit, nil
+}
+
+func (painter *commitPainter) push(ctx context.Context, sha string, flags int) error {
+	commit, err := painter.readCommit(ctx, sha)
+	if err != nil {
+		return err
+	}
+	previous := painter.flags[sha]
+	painter.flags[sha] |= flags
+	if previous&paintStale == 0 && flags&paintStale != 0 {
+		painter.nonStale -= painter.queued[sha]
+	}
+	if painter.flags[sha]&paintStale == 0 {
+		painter.nonStale++
+	}
+	painter.queued[sha]++
+	painter.seq++
+	heap.Push(&painter.queue, &queuedCommit{sha, commit.Committer.When, painter.seq})
+	return nil
+}
+
+func (painter *commitPainter) pop() string {
+	sha := heap.Pop(&painter.queue).(*queuedCommit).sha
+	painter.queued[sha]--
+	if painter.flags[sha]&paintStale == 0 {
+		painter.nonStale--
+	}
+	return sha
+}
+
+// paint marks the history of one and two, returning the commits reachable
+// from both that are not reachable from another such commit it found first.
+func (painter *commitPainter) paint(ctx context.Context, one []string, two []string) ([]string, error) {
+	for _, sha := range one {
+		if err := painter.push(ctx, sha, paintOne); err != nil {
+			return nil, err
+		}
+	}
+	for _, sha := range two {
+		if err := painter.push(ctx, sha, paintTwo); err != nil {
+			return nil, err
+		}
+	}
+
+	var result []string
+	for painter.nonStale > 0 {
+		sha := painter.pop()
+		flags := painter.flags[sha] & (paintOne | paintTwo | paintStale)
+
+		if flags == paintOne|paintTwo {
+			if painter.flags[sha]&paintResult == 0 {
+				painter.flags[sha] |= paintResult
+				result = append(result, sha)
+			}
+			// everything below a common commit is common too
+			flags |= paintStale
+		}
+
+		for _, parent := range painter.commits[sha].Parents {
+			if painter.flags[parent]&flags == flags {
+				continue
+			}
+			if err := painter.push(ctx, parent, flags); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return result, nil
+}
+
+// IsAncestor reports whether the commit ancestor is reachable from the commit
+// descendant. A commit is its own ancestor.
+func (repo *Repository) IsAncestor(ctx context.Context, ancestor string, descendant string) (bool, error) {
+	if ancestor == descendant {
+		return true, nil
+	}
+
+	painter := repo.newCommitPainter()
+	if _, err := painter.paint(ctx, []string{ancestor}, []string{descendant}); err != nil {
+		return false, err
+	}
+	return painter.flags[ancestor]&paintTwo != 0, nil
+}
+
+// MergeBase returns the best common ancestor of the commits one and two for
+// use in a three-way merge, or the empty string if they share no history.
+// Where there is more than one, which is returned is arbitrary but stable.
+func (repo *Repository) MergeBase(ctx context.Context, one string, two string) (string, error) {
+	bases, err := repo.MergeBases(ctx, one, two)
+	if err != nil || len(bases) == 0 {
+		return "", err
+	}
+	return bases[0], nil
+}
+
+// MergeBases returns every best common ancestor of one and a hypothetical
+// merge of others, like git merge-base --all. No base is an ancestor of
+// another, and the newest comes first.
+func (repo *Repository) MergeBases(ctx context.Context, one string, others ...string) ([]string, error) {
+	for _, other := range others {
+		if other == one {
+			return []string{one}, nil
+		}
+	}
+
+	painter := repo.newCommitPainter()
+	candidates, err := painter.paint(ctx, []string{one}, others)
+	if err != nil {
+		return nil, err
+	}
+
+	// a candidate painted stale after it was found is below another one
+	var bases []string
+	for _, sha := range candidates {
+		if painter.flags[sha]&paintStale == 0 {
+			bases = append(bases, sha)
+		}
+	}
+	return repo.removeRedundant(ctx, bases)
+}
+
+// OctopusMergeBases returns the best common ancestors of all the given
+// commits, for merging them all at once, like git merge-base --octopus.
+func (repo *Repository) OctopusMergeBases(ctx context.Context, commits ...string) ([]string, error) {
+	if len(commits) == 0 {
+		return nil, nil
+	}
+
+	bases := []string{commits[0]}
+	for _, sha := range commits[1:] {
+		var next []string
+		seen := map[string]bool{}
+		for _, base := range bases {
+			found, err := repo.MergeBases(ctx, base, sha)
+			if err != nil {
+				return nil, err
+			}
+			for _, found := range found {
+				if !seen[found] {
+					seen[found] = true
+					next = append(next, found)
+				}
+			}
+		}
+		bases = next
+	}
+	return repo.removeRedundant(ctx, bases)
+}
+
+// removeRedundant drops commits that are ancestors of another of the given
+// commits.
+func (repo *Repository) removeRedundant(ctx context.Context, commits []string) ([]string, error) {
+	if len(commits) < 2 {
+		return commits, nil
+	}
+
+	var result []string
+	for i, sha := range commits {
+		redundant := false
+		for j, other := range commits {
+			if i == j {
+				continue
+			}
+			isAncestor, err := repo.IsAncestor(ctx, sha, other)
+			if err != nil {
+				return nil, err
+			}
+			if isAncestor {
+				redundant = true
+				break
+			}
+		}
+		if !redundant {
+			result = append(result, sha)
+		}
+	}
+	return result, nil
+}
+
+// AheadBehind counts the commits reachable from one but not two (ahead), and
+// from two but not one (behind), as shown by git status for a branch and its
+// upstream.
+func (repo *Repository) AheadBehind(ctx context.Context, one string, two string) (ahead int, behind int, err error) {
+	painter := repo.newCommitPainter()
+	if _, err := painter.paint(ctx, []string{one}, []string{two}); err != nil {
+		return 0, 0, err
+	}
+
+	for _, flags := range painter.flags {
+		switch flags & (paintOne | paintTwo | paintStale) {
+		case paintOne:
+			ahead++
+		case paintTwo:
+			behind++
+		}
+	}
+	return ahead, behind, nil
+}
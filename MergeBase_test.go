@@ -0,0 +1,168 @@
+package gitpacklib
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// crissCrossRepository makes a git repository in which branches p and q have
+// two merge bases, m1 and x1, whose own merge conflicts, and main and x have
+// three, m1, x1 and y1. It returns the repository and the shas of the
+// commits by name.
+func crissCrossRepository(t *testing.T) (string, map[string]string) {
+	dir := newGitRepository(t)
+	commits := map[string]string{}
+	commit := func(branch string, name string, files map[string][]byte) {
+		if branch != "" {
+			runGit(t, dir, "checkout", "-q", branch)
+		}
+		writeFiles(t, dir, files)
+		commits[name] = gitCommit(t, dir, name)
+	}
+	merge := func(branch string, name string, other string, resolved map[string][]byte) {
+		runGit(t, dir, "checkout", "-q", branch)
+		cmd := exec.Command("git", "merge", "-q", "--no-ff", "--no-commit", commits[other])
+		cmd.Dir = dir
+		cmd.Env = append(os.Environ(), gitTestEnv...)
+		if out, err := cmd.CombinedOutput(); err != nil && resolved == nil {
+			t.Fatalf("git merge %s: %v\n%s", other, err, out)
+		}
+		writeFiles(t, dir, resolved)
+		commits[name] = gitCommit(t, dir, name)
+	}
+
+	commit("", "c0", map[string][]byte{"a.txt": numberedLines(30, nil), "b.txt": numberedLines(30, nil), "c.txt": numberedLines(30, nil)})
+	runGit(t, dir, "branch", "x")
+	runGit(t, dir, "branch", "y")
+	commit("main", "m1", map[string][]byte{"a.txt": numberedLines(30, map[int]string{1: "m1"}), "c.txt": numberedLines(30, map[int]string{15: "m1"})})
+	commit("x", "x1", map[string][]byte{"a.txt": numberedLines(30, map[int]string{10: "x1"}), "c.txt": numberedLines(30, map[int]string{15: "x1"})})
+	commit("y", "y1", map[string][]byte{"b.txt": numberedLines(30, map[int]string{10: "y1"})})
+
+	// each side resolves the conflict between m1 and x1 its own way
+	merge("main", "M1", "x1", map[string][]byte{"c.txt": numberedLines(30, map[int]string{15: "M1"})})
+	merge("x", "X1", "m1", map[string][]byte{"c.txt": numberedLines(30, map[int]string{15: "X1"})})
+	commit("main", "m2", map[string][]byte{"a.txt": numberedLines(30, map[int]string{1: "m1", 10: "x1", 20: "m2"})})
+	commit("x", "x2", map[string][]byte{"a.txt": numberedLines(30, map[int]string{1: "m1", 10: "x1", 30: "x2"}), "d.txt": []byte("x2\n")})
+	runGit(t, dir, "branch", "p", "main")
+	runGit(t, dir, "branch", "q", "x")
+
+	merge("main", "M2", "y1", nil)
+	merge("x", "X2", "y1", nil)
+	commit("main", "m3", map[string][]byte{"e.txt": []byte("m3\n")})
+
+	runGit(t, dir, "checkout", "-q", "--orphan", "unrelated")
+	commit("", "u1", map[string][]byte{"a.txt": []byte("unrelated\n")})
+	return dir, commits
+}
+
+func TestMergeBasesMatchesGit(t *testing.T) {
+	ctx := context.Background()
+	dir, commits := crissCrossRepository(t)
+	repo := newTestRepository(t)
+	importGitObjects(t, repo, dir)
+
+	for _, names := range [][]string{
+		{"m2", "x2"},
+		{"x2", "m2"},
+		{"m3", "X2"},
+		{"M2", "X2"},
+		{"m1", "x1"},
+		{"M1", "X1"},
+		{"c0", "m3"},
+		{"m3", "c0"},
+		{"y1", "m1", "x1"},
+		{"m1", "x1", "y1"},
+		{"m3", "u1"},
+	} {
+		var shas []string
+		for _, name := range names {
+			shas = append(shas, commits[name])
+		}
+		bases, err := repo.MergeBases(ctx, shas[0], shas[1:]...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cmd := exec.Command("git", append([]string{"merge-base", "--all"}, shas...)...)
+		cmd.Dir = dir
+		// git merge-base exits with 1 when there is no base
+		out, err := cmd.Output()
+		if _, ok := err.(*exec.ExitError); err != nil && !ok {
+			t.Fatal(err)
+		}
+		want := strings.Fields(string(out))
+		sort.Strings(bases)
+		sort.Strings(want)
+		if strings.Join(bases, " ") != strings.Join(want, " ") {
+			t.Errorf("Merge bases of %v are %v, git has %v", names, bases, want)
+		}
+	}
+
+	// the fixture has the criss-crosses it was made for
+	for names, want := range map[[2]string]int{{"m2", "x2"}: 2, {"m3", "X2"}: 3} {
+		if bases, err := repo.MergeBases(ctx, commits[names[0]], commits[names[1]]); err != nil || len(bases) != want {
+			t.Errorf("Merge bases of %v are %v, want %d of them: %v", names, bases, want, err)
+		}
+	}
+
+	octopus, err := repo.OctopusMergeBases(ctx, commits["M1"], commits["X1"], commits["y1"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := strings.Fields(string(runGit(t, dir, "merge-base", "--octopus", commits["M1"], commits["X1"], commits["y1"])))
+	if strings.Join(octopus, " ") != strings.Join(want, " ") {
+		t.Errorf("Octopus merge bases are %v, git has %v", octopus, want)
+	}
+
+	for _, pair := range [][2]string{{"c0", "m3"}, {"m1", "X2"}, {"y1", "m2"}, {"m3", "m3"}, {"m3", "c0"}, {"u1", "m3"}} {
+		isAncestor, err := repo.IsAncestor(ctx, commits[pair[0]], commits[pair[1]])
+		if err != nil {
+			t.Fatal(err)
+		}
+		cmd := exec.Command("git", "merge-base", "--is-ancestor", commits[pair[0]], commits[pair[1]])
+		cmd.Dir = dir
+		err = cmd.Run()
+		if _, ok := err.(*exec.ExitError); err != nil && !ok {
+			t.Fatal(err)
+		}
+		if isAncestor != (err == nil) {
+			t.Errorf("%s is an ancestor of %s is %v, git says %v", pair[0], pair[1], isAncestor, err == nil)
+		}
+	}
+}
+
+func TestMergeCommitsCrissCrossMatchesGit(t *testing.T) {
+	ctx := context.Background()
+	dir, _ := crissCrossRepository(t)
+	repo := newTestRepository(t)
+	importGitObjects(t, repo, dir)
+
+	for _, pair := range [][2]string{{"p", "q"}, {"q", "p"}, {"main", "x"}} {
+		result, err := repo.MergeCommits(ctx, gitRevParse(t, dir, pair[0]), gitRevParse(t, dir, pair[1]), &MergeOptions{OursLabel: pair[0], TheirsLabel: pair[1]})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var conflicts []string
+		for _, conflict := range result.Conflicts {
+			conflicts = append(conflicts, conflict.Path)
+		}
+
+		// git merge-tree exits with 1 when there are conflicts
+		cmd := exec.Command("git", "merge-tree", "--write-tree", "--name-only", "--no-messages", pair[0], pair[1])
+		cmd.Dir = dir
+		out, err := cmd.Output()
+		if _, ok := err.(*exec.ExitError); err != nil && !ok {
+			t.Fatal(err)
+		}
+		lines := strings.Fields(string(out))
+		if result.Tree != lines[0] {
+			t.Errorf("Merge of %s and %s gave tree %s, git merged to %s", pair[0], pair[1], result.Tree, lines[0])
+		}
+		if strings.Join(conflicts, " ") != strings.Join(lines[1:], " ") {
+			t.Errorf("Merge of %s and %s conflicts in %v, git in %v", pair[0], pair[1], conflicts, lines[1:])
+		}
+	}
+}
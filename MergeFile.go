@@ -0,0 +1,193 @@
+package gitpacklib
+
+import (
+	"strings"
+)
+
+// Conflict markers, as written by git.
+const (
+	conflictOursMarker   = "<<<<<<<"
+	conflictSplitMarker  = "======="
+	conflictTheirsMarker = ">>>>>>>"
+)
+
+// maxConflictGap is the most lines that may separate two conflicts before
+// they are written as one, as git does since it takes no more space.
+const maxConflictGap = 3
+
+type mergeResolution int
+
+const (
+	takeOurs mergeResolution = iota
+	takeTheirs
+	conflict
+)
+
+// mergeHunk is a run of lines changed on at least one side, from ours0 up to
+// ours1 in ours and from theirs0 up to theirs1 in theirs.
+type mergeHunk struct {
+	resolution       mergeResolution
+	ours0, ours1     int
+	theirs0, theirs1 int
+}
+
+// mergeContent merges the changes made to base in ours and in theirs, line by
+// line, as git merge does. Where both changed the same lines differently, the
+// result has both versions between conflict markers naming each side by its
+// label, and conflicted is set.
+func mergeContent(base []byte, ours []byte, theirs []byte, oursLabel string, theirsLabel string) (merged []byte, conflicted bool) {
+	baseLines := splitLines(base)
+	oursLines := splitLines(ours)
+	theirsLines := splitLines(theirs)
+
+	hunks := mergeHunks(baseLines, oursLines, theirsLines)
+	hunks = refineConflicts(hunks, oursLines, theirsLines)
+
+	b := &strings.Builder{}
+	pos := 0
+	for _, hunk := range hunks {
+		writeLines(b, oursLines[pos:hunk.ours0])
+		pos = hunk.ours1
+
+		ours := oursLines[hunk.ours0:hunk.ours1]
+		theirs := theirsLines[hunk.theirs0:hunk.theirs1]
+		switch hunk.resolution {
+		case takeOurs:
+			writeLines(b, ours)
+		case takeTheirs:
+			writeLines(b, theirs)
+		default:
+			conflicted = true
+			b.WriteString(conflictOursMarker + " " + oursLabel + "\n")
+			writeLines(b, ours)
+			ensureNewline(b)
+			b.WriteString(conflictSplitMarker + "\n")
+			writeLines(b, theirs)
+			ensureNewline(b)
+			b.WriteString(conflictTheirsMarker + " " + theirsLabel + "\n")
+		}
+	}
+	writeLines(b, oursLines[pos:])
+
+	return []byte(b.String()), conflicted
+}
+
+// mergeHunks finds the runs of lines changed on one side or differently on
+// both, separated by lines of base that neither side changed, and resolves
+// those that only one side changed.
+func mergeHunks(base []string, ours []string, theirs []string) []*mergeHunk {
+	// where each base line is in ours and theirs, or -1 if it was changed
+	unchangedIn := func(lines []string) []int {
+		matches := make([]int, len(base))
+		for i := range matches {
+			matches[i] = -1
+		}
+		for _, edit := range diffLinesHistogram(base, lines) {
+			if edit.op == diffEqual {
+				matches[edit.oldLine] = edit.newLine
+			}
+		}
+		return matches
+	}
+	inOurs := unchangedIn(ours)
+	inTheirs := unchangedIn(theirs)
+
+	var hunks []*mergeHunk
+	i, j, k := 0, 0, 0
+	for i < len(base) || j < len(ours) || k < len(theirs) {
+		if i < len(base) && inOurs[i] == j && inTheirs[i] == k {
+			i++
+			j++
+			k++
+			continue
+		}
+
+		// the changes run up to the next line neither side changed
+		nextI := i
+		for nextI < len(base) && (inOurs[nextI] < 0 || inTheirs[nextI] < 0) {
+			nextI++
+		}
+		nextJ, nextK := len(ours), len(theirs)
+		if nextI < len(base) {
+			nextJ, nextK = inOurs[nextI], inTheirs[nextI]
+		}
+
+		hunk := &mergeHunk{ours0: j, ours1: nextJ, theirs0: k, theirs1: nextK}
+		baseChunk := base[i:nextI]
+		i, j, k = nextI, nextJ, nextK
+		switch {
+		case equalStrings(ours[hunk.ours0:j], theirs[hunk.theirs0:k]):
+			// the same change on both sides is left as it is in ours
+			continue
+		case equalStrings(ours[hunk.ours0:j], baseChunk):
+			hunk.resolution = takeTheirs
+		case equalStrings(theirs[hunk.theirs0:k], baseChunk):
+			hunk.resolution = takeOurs
+		default:
+			hunk.resolution = conflict
+		}
+		hunks = append(hunks, hunk)
+	}
+	return hunks
+}
+
+// refineConflicts narrows each conflict down to the lines the two sides do
+// not have in common, splitting it where they do. Conflicts that end up at
+// most maxConflictGap lines apart are then joined back together.
+func refineConflicts(hunks []*mergeHunk, ours []string, theirs []string) []*mergeHunk {
+	var refined []*mergeHunk
+	for _, hunk := range hunks {
+		if hunk.resolution != conflict || hunk.ours0 == hunk.ours1 || hunk.theirs0 == hunk.theirs1 {
+			refined = append(refined, hunk)
+			continue
+		}
+
+		edits := diffLinesHistogram(ours[hunk.ours0:hunk.ours1], theirs[hunk.theirs0:hunk.theirs1])
+		for n := 0; n < len(edits); {
+			if edits[n].op == diffEqual {
+				n++
+				continue
+			}
+			start := edits[n]
+			for n < len(edits) && edits[n].op != diffEqual {
+				n++
+			}
+			end := lineEdit{oldLine: hunk.ours1 - hunk.ours0, newLine: hunk.theirs1 - hunk.theirs0}
+			if n < len(edits) {
+				end = edits[n]
+			}
+			refined = append(refined, &mergeHunk{
+				resolution: conflict,
+				ours0:      hunk.ours0 + start.oldLine,
+				ours1:      hunk.ours0 + end.oldLine,
+				theirs0:    hunk.theirs0 + start.newLine,
+				theirs1:    hunk.theirs0 + end.newLine,
+			})
+		}
+	}
+
+	var joined []*mergeHunk
+	for _, hunk := range refined {
+		if n := len(joined); n > 0 && hunk.resolution == conflict && joined[n-1].resolution == conflict &&
+			hunk.ours0-joined[n-1].ours1 <= maxConflictGap {
+			joined[n-1].ours1 = hunk.ours1
+			joined[n-1].theirs1 = hunk.theirs1
+			continue
+		}
+		joined = append(joined, hunk)
+	}
+	return joined
+}
+
+func writeLines(b *strings.Builder, lines []string) {
+	for _, line := range lines {
+		b.WriteString(line)
+	}
+}
+
+func ensureNewline(b *strings.Builder) {
+	s := b.String()
+	if len(s) > 0 && !strings.HasSuffix(s, "\n") {
+		b.WriteString("\n")
+	}
+}
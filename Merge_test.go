@@ -0,0 +1,151 @@
+package gitpacklib
+
+import (
+	"context"
+	"io/ioutil"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// mergeTestRepository makes a git repository with a base commit and commits
+// ours and theirs on top of it, made by the given changes, and returns it
+// with the shas of the three commits.
+func mergeTestRepository(t *testing.T, base, ours, theirs map[string][]byte) (string, string, string, string) {
+	dir := newGitRepository(t)
+	writeFiles(t, dir, base)
+	baseCommit := gitCommit(t, dir, "base")
+	runGit(t, dir, "checkout", "-q", "-b", "theirs")
+	writeFiles(t, dir, theirs)
+	theirsCommit := gitCommit(t, dir, "theirs")
+	runGit(t, dir, "checkout", "-q", "main")
+	writeFiles(t, dir, ours)
+	oursCommit := gitCommit(t, dir, "ours")
+	return dir, baseCommit, oursCommit, theirsCommit
+}
+
+// numberedLines returns the lines "1" to "n", with the given lines replaced.
+func numberedLines(n int, replace map[int]string) []byte {
+	b := &strings.Builder{}
+	for i := 1; i <= n; i++ {
+		line, ok := replace[i]
+		if !ok {
+			line = strconv.Itoa(i)
+		}
+		b.WriteString(line + "\n")
+	}
+	return []byte(b.String())
+}
+
+func TestMergeCommitsMatchesGit(t *testing.T) {
+	ctx := context.Background()
+	dir, _, ours, theirs := mergeTestRepository(t,
+		map[string][]byte{
+			"both.txt":      numberedLines(30, nil),
+			"same.txt":      []byte("same\n"),
+			"ours-only.txt": []byte("a\n"),
+			"removed.txt":   []byte("removed\n"),
+			"dir/kept.txt":  []byte("kept\n"),
+		},
+		map[string][]byte{
+			"both.txt":      numberedLines(30, map[int]string{2: "ours"}),
+			"same.txt":      []byte("changed alike\n"),
+			"ours-only.txt": []byte("b\n"),
+			"dir/new.txt":   []byte("ours\n"),
+		},
+		map[string][]byte{
+			"both.txt":       numberedLines(30, map[int]string{28: "theirs"}),
+			"same.txt":       []byte("changed alike\n"),
+			"removed.txt":    nil,
+			"newdir/new.txt": []byte("theirs\n"),
+		})
+	repo := newTestRepository(t)
+	importGitObjects(t, repo, dir)
+
+	result, err := repo.MergeCommits(ctx, ours, theirs, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Conflicts) != 0 {
+		t.Fatalf("Unexpected conflicts %v", result.Conflicts)
+	}
+	want := strings.SplitN(string(runGit(t, dir, "merge-tree", "--write-tree", ours, theirs)), "\n", 2)[0]
+	if result.Tree != want {
+		t.Errorf("Merged tree is %s, git merged to %s", result.Tree, want)
+	}
+}
+
+func TestMergeCommitsConflicts(t *testing.T) {
+	ctx := context.Background()
+	base := numberedLines(20, nil)
+	ours := numberedLines(20, map[int]string{5: "five", 6: "six", 15: "ours"})
+	theirs := numberedLines(20, map[int]string{5: "five", 6: "SIX", 7: "SEVEN"})
+	dir, _, oursCommit, theirsCommit := mergeTestRepository(t,
+		map[string][]byte{
+			"content.txt":  base,
+			"modified.txt": []byte("base\n"),
+			"path":         []byte("file\n"),
+		},
+		map[string][]byte{
+			"content.txt":  ours,
+			"added.txt":    []byte("ours\n"),
+			"modified.txt": []byte("ours\n"),
+			"path":         []byte("ours\n"),
+		},
+		map[string][]byte{
+			"content.txt":  theirs,
+			"added.txt":    []byte("theirs\n"),
+			"modified.txt": nil,
+			"path":         nil,
+			"path/file":    []byte("theirs\n"),
+		})
+	repo := newTestRepository(t)
+	importGitObjects(t, repo, dir)
+
+	result, err := repo.MergeCommits(ctx, oursCommit, theirsCommit, &MergeOptions{OursLabel: "main", TheirsLabel: "topic"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var conflicts []string
+	for _, conflict := range result.Conflicts {
+		conflicts = append(conflicts, conflict.Path+" "+string(conflict.Type))
+	}
+	want := []string{
+		"added.txt add/add",
+		"content.txt content",
+		"modified.txt modify/delete",
+		"path file/directory",
+	}
+	if strings.Join(conflicts, "\n") != strings.Join(want, "\n") {
+		t.Errorf("Conflicts are %q, want %q", conflicts, want)
+	}
+
+	// the conflicting file is merged as git merge-file does
+	scratch := t.TempDir()
+	for name, data := range map[string][]byte{"base": base, "ours": ours, "theirs": theirs} {
+		if err := ioutil.WriteFile(filepath.Join(scratch, name), data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// git merge-file exits with the number of conflicts
+	cmd := exec.Command("git", "merge-file", "-p", "-L", "main", "-L", "base", "-L", "topic", "ours", "base", "theirs")
+	cmd.Dir = scratch
+	wantContent, err := cmd.Output()
+	if _, ok := err.(*exec.ExitError); err != nil && !ok {
+		t.Fatal(err)
+	}
+	entry, err := repo.ReadTreeEntry(ctx, result.Tree, "content.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	blob, err := repo.ReadBlob(ctx, entry.Hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(blob.Data) != string(wantContent) {
+		t.Errorf("Merged content is:\n%s\nwant:\n%s", blob.Data, wantContent)
+	}
+}
@@ -0,0 +1,340 @@
+package gitpacklib
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// multiPackIndexMagic starts a multi-pack index.
+var multiPackIndexMagic = []byte{'M', 'I', 'D', 'X'}
+
+// multiPackIndexVersion is the version of the multi-pack indexes written by
+// WriteMultiPackIndex.
+const multiPackIndexVersion = 1
+
+// The chunks of a multi-pack index. The reverse index chunk shares its id
+// with the magic of a reverse index file.
+var (
+	packNamesChunk    = []byte{'P', 'N', 'A', 'M'}
+	oidFanoutChunk    = []byte{'O', 'I', 'D', 'F'}
+	oidLookupChunk    = []byte{'O', 'I', 'D', 'L'}
+	objectOffsetChunk = []byte{'O', 'O', 'F', 'F'}
+	largeOffsetChunk  = []byte{'L', 'O', 'F', 'F'}
+)
+
+// multiPackLargeOffset marks an object offset in a multi-pack index as the
+// position of the offset in the chunk of large offsets.
+const multiPackLargeOffset = 0x80000000
+
+// MultiPackIndexEntry is where an object is found in the packs of a
+// multi-pack index.
+type MultiPackIndexEntry struct {
+	Hash string
+
+	// Pack is the position of the pack holding the object in PackNames.
+	Pack   int
+	Offset int64
+}
+
+// WriteMultiPackIndex writes a multi-pack index to out, as git
+// multi-pack-index write does, for the packs with the given indexes. Packs are
+// named by the names of their index files, such as "pack-<checksum>.idx". An
+// object in more than one of the packs is found in whichever of them comes
+// first by name. The index includes a reverse index of the objects, ordered by
+// pack and then by where they are in the pack.
+func WriteMultiPackIndex(out io.Writer, packs []string, indexes []*PackIndex) error {
+	if len(packs) != len(indexes) {
+		return errors.New("Multi-pack index needs an index for each pack")
+	}
+	order := make([]int, len(packs))
+	for i := range order {
+		order[i] = i
+	}
+	sort.Slice(order, func(i, j int) bool {
+		return packs[order[i]] < packs[order[j]]
+	})
+
+	var names []string
+	var entries []*MultiPackIndexEntry
+	for id, i := range order {
+		if strings.ContainsRune(packs[i], 0) || id > 0 && packs[i] == names[id-1] {
+			return errors.New("Invalid pack name " + packs[i])
+		}
+		names = append(names, packs[i])
+		index := indexes[i]
+		for n := 0; n < index.NumObjects(); n++ {
+			entry := index.Entry(n)
+			entries = append(entries, &MultiPackIndexEntry{Hash: entry.Hash, Pack: id, Offset: entry.Offset})
+		}
+	}
+
+	// keep the first pack's entry for each object
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].Hash < entries[j].Hash
+	})
+	unique := entries[:0]
+	for _, entry := range entries {
+		if len(unique) == 0 || unique[len(unique)-1].Hash != entry.Hash {
+			unique = append(unique, entry)
+		}
+	}
+	entries = unique
+
+	packNames := &bytes.Buffer{}
+	for _, name := range names {
+		packNames.WriteString(name)
+		packNames.WriteByte(0)
+	}
+	for packNames.Len()%4 != 0 {
+		packNames.WriteByte(0)
+	}
+
+	shas := make([]string, len(entries))
+	for i, entry := range entries {
+		shas[i] = entry.Hash
+	}
+	fanout, lookup, err := shaTableData(shas)
+	if err != nil {
+		return err
+	}
+
+	// as git does, offsets that fit in four bytes are stored there unless
+	// some offset does not, in which case all those with the top bit set
+	// are stored as large offsets
+	needLarge := false
+	for _, entry := range entries {
+		if entry.Offset > 0xffffffff {
+			needLarge = true
+		}
+	}
+	offsets := &bytes.Buffer{}
+	largeOffsets := &bytes.Buffer{}
+	for _, entry := range entries {
+		binary.Write(offsets, binary.BigEndian, uint32(entry.Pack))
+		if needLarge && entry.Offset > maxSmallOffset {
+			binary.Write(offsets, binary.BigEndian, uint32(multiPackLargeOffset|largeOffsets.Len()/8))
+			binary.Write(largeOffsets, binary.BigEndian, uint64(entry.Offset))
+		} else {
+			binary.Write(offsets, binary.BigEndian, uint32(entry.Offset))
+		}
+	}
+
+	positions := make([]int, len(entries))
+	for i := range positions {
+		positions[i] = i
+	}
+	sort.Slice(positions, func(i, j int) bool {
+		a, b := entries[positions[i]], entries[positions[j]]
+		if a.Pack != b.Pack {
+			return a.Pack < b.Pack
+		}
+		return a.Offset < b.Offset
+	})
+	reverse := &bytes.Buffer{}
+	for _, position := range positions {
+		binary.Write(reverse, binary.BigEndian, uint32(position))
+	}
+
+	type chunk struct {
+		id   []byte
+		data []byte
+	}
+	chunks := []chunk{
+		{packNamesChunk, packNames.Bytes()},
+		{oidFanoutChunk, fanout},
+		{oidLookupChunk, lookup},
+		{objectOffsetChunk, offsets.Bytes()},
+	}
+	if needLarge {
+		chunks = append(chunks, chunk{largeOffsetChunk, largeOffsets.Bytes()})
+	}
+	chunks = append(chunks, chunk{reverseIndexMagic, reverse.Bytes()})
+
+	midx := &bytes.Buffer{}
+	midx.Write(multiPackIndexMagic)
+	midx.Write([]byte{multiPackIndexVersion, sha1HashVersion, byte(len(chunks)), 0})
+	binary.Write(midx, binary.BigEndian, uint32(len(names)))
+
+	offset := uint64(midx.Len() + (len(chunks)+1)*12)
+	for _, c := range chunks {
+		midx.Write(c.id)
+		binary.Write(midx, binary.BigEndian, offset)
+		offset += uint64(len(c.data))
+	}
+	midx.Write([]byte{0, 0, 0, 0})
+	binary.Write(midx, binary.BigEndian, offset)
+	for _, c := range chunks {
+		midx.Write(c.data)
+	}
+	sum := sha1.Sum(midx.Bytes())
+	midx.Write(sum[:])
+
+	if _, err := out.Write(midx.Bytes()); err != nil {
+		return errors.New("Error writing multi-pack index: " + err.Error())
+	}
+	return nil
+}
+
+// MultiPackIndex finds objects by their sha across many packs at once, and by
+// where they are in those packs if it has a reverse index.
+type MultiPackIndex struct {
+	shaTable
+	packs        []string
+	offsets      []byte
+	largeOffsets []byte
+	reverse      []byte
+}
+
+// ParseMultiPackIndex reads a multi-pack index, checking its checksum and that
+// its chunks are the size its fanout says.
+func ParseMultiPackIndex(data []byte) (*MultiPackIndex, error) {
+	if len(data) < 12+12+sha1.Size || !bytes.Equal(data[:4], multiPackIndexMagic) {
+		return nil, errors.New("Invalid multi-pack index header")
+	}
+	if version := data[4]; version != multiPackIndexVersion {
+		return nil, errors.New("Unsupported multi-pack index version " + strconv.Itoa(int(version)))
+	}
+	if hashVersion := data[5]; hashVersion != sha1HashVersion {
+		return nil, errors.New("Unsupported multi-pack index hash version " + strconv.Itoa(int(hashVersion)))
+	}
+	if data[7] != 0 {
+		return nil, errors.New("Incremental multi-pack indexes are not supported")
+	}
+	numChunks := int(data[6])
+	numPacks := int(binary.BigEndian.Uint32(data[8:]))
+
+	sum := sha1.Sum(data[:len(data)-sha1.Size])
+	if !bytes.Equal(sum[:], data[len(data)-sha1.Size:]) {
+		return nil, errors.New("Multi-pack index checksum mismatch")
+	}
+
+	end := uint64(len(data) - sha1.Size)
+	if uint64(12+(numChunks+1)*12) > end {
+		return nil, errors.New("Multi-pack index is too short")
+	}
+	chunks := map[string][]byte{}
+	for i := 0; i < numChunks; i++ {
+		row := data[12+i*12:]
+		start := binary.BigEndian.Uint64(row[4:])
+		next := binary.BigEndian.Uint64(row[16:])
+		if start > next || next > end {
+			return nil, errors.New("Multi-pack index has an invalid chunk offset")
+		}
+		chunks[string(row[:4])] = data[start:next]
+	}
+
+	names := chunks[string(packNamesChunk)]
+	fanout := chunks[string(oidFanoutChunk)]
+	if names == nil || len(fanout) != 256*4 {
+		return nil, errors.New("Multi-pack index is missing a chunk")
+	}
+	numObjects, err := fanoutObjects(fanout)
+	if err != nil {
+		return nil, err
+	}
+
+	index := &MultiPackIndex{
+		shaTable:     shaTable{fanout, chunks[string(oidLookupChunk)], numObjects},
+		offsets:      chunks[string(objectOffsetChunk)],
+		largeOffsets: chunks[string(largeOffsetChunk)],
+		reverse:      chunks[string(reverseIndexMagic)],
+	}
+	if len(index.shas) != numObjects*sha1.Size || len(index.offsets) != numObjects*8 ||
+		len(index.largeOffsets)%8 != 0 || index.reverse != nil && len(index.reverse) != numObjects*4 {
+		return nil, errors.New("Multi-pack index has the wrong size for its objects")
+	}
+
+	for _, name := range strings.Split(string(names), "\x00") {
+		if name != "" {
+			index.packs = append(index.packs, name)
+		}
+	}
+	if len(index.packs) != numPacks {
+		return nil, errors.New("Multi-pack index has the wrong number of packs")
+	}
+	for i := 0; i < numObjects; i++ {
+		pack := binary.BigEndian.Uint32(index.offsets[i*8:])
+		offset := binary.BigEndian.Uint32(index.offsets[i*8+4:])
+		if int(pack) >= numPacks {
+			return nil, errors.New("Multi-pack index has an invalid pack")
+		}
+		if index.largeOffsets != nil && offset&multiPackLargeOffset != 0 && int(offset&^multiPackLargeOffset) >= len(index.largeOffsets)/8 {
+			return nil, errors.New("Multi-pack index has an invalid offset")
+		}
+	}
+	for i := 0; index.reverse != nil && i < numObjects; i++ {
+		if int(binary.BigEndian.Uint32(index.reverse[i*4:])) >= numObjects {
+			return nil, errors.New("Multi-pack index has an invalid reverse index")
+		}
+	}
+	return index, nil
+}
+
+// NumObjects returns how many objects are in the packs, counting objects in
+// more than one pack once.
+func (index *MultiPackIndex) NumObjects() int {
+	return index.numObjects
+}
+
+// PackNames returns the names of the index files of the packs, in order.
+func (index *MultiPackIndex) PackNames() []string {
+	return append([]string{}, index.packs...)
+}
+
+// Entry returns the i'th object of the index, in order of sha.
+func (index *MultiPackIndex) Entry(i int) *MultiPackIndexEntry {
+	pack, offset := index.location(i)
+	return &MultiPackIndexEntry{Hash: hex.EncodeToString(index.sha(i)), Pack: pack, Offset: offset}
+}
+
+// Lookup returns the pack holding the object with the given sha and where it
+// is in the pack, and whether it is in any of the packs.
+func (index *MultiPackIndex) Lookup(sha string) (int, int64, bool) {
+	i, ok := index.find(sha)
+	if !ok {
+		return 0, 0, false
+	}
+	pack, offset := index.location(i)
+	return pack, offset, true
+}
+
+// ObjectAt returns the sha of the object whose entry starts at offset in the
+// given pack, and whether there is one. It needs the reverse index, which
+// indexes written by git include only when asked to.
+func (index *MultiPackIndex) ObjectAt(pack int, offset int64) (string, bool) {
+	if index.reverse == nil {
+		return "", false
+	}
+	position := func(i int) int {
+		return int(binary.BigEndian.Uint32(index.reverse[i*4:]))
+	}
+	i := sort.Search(index.numObjects, func(i int) bool {
+		p, o := index.location(position(i))
+		return p > pack || p == pack && o >= offset
+	})
+	if i == index.numObjects {
+		return "", false
+	}
+	if p, o := index.location(position(i)); p != pack || o != offset {
+		return "", false
+	}
+	return hex.EncodeToString(index.sha(position(i))), true
+}
+
+// location returns the pack and offset of the i'th object.
+func (index *MultiPackIndex) location(i int) (int, int64) {
+	pack := int(binary.BigEndian.Uint32(index.offsets[i*8:]))
+	offset := binary.BigEndian.Uint32(index.offsets[i*8+4:])
+	if index.largeOffsets == nil || offset&multiPackLargeOffset == 0 {
+		return pack, int64(offset)
+	}
+	large := int(offset&^multiPackLargeOffset) * 8
+	return pack, int64(binary.BigEndian.Uint64(index.largeOffsets[large:]))
+}
@@ -0,0 +1,124 @@
+package gitpacklib
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// multiPackTestRepository makes a git repository whose objects are in
+// several packs, some holding the same objects, and returns it with the
+// paths of the packs' indexes.
+func multiPackTestRepository(t *testing.T) (string, []string) {
+	dir := packTestRepository(t)
+	runGit(t, dir, "repack", "-adq")
+	for i := 0; i < 3; i++ {
+		writeFiles(t, dir, map[string][]byte{"more.txt": numberedLines(100+i, nil)})
+		gitCommit(t, dir, "more "+strconv.Itoa(i))
+		runGit(t, dir, "repack", "-q")
+	}
+	// a pack of everything, leaving the other packs in place
+	runGit(t, dir, "repack", "-aq")
+	indexes, err := filepath.Glob(filepath.Join(dir, ".git", "objects", "pack", "pack-*.idx"))
+	if err != nil || len(indexes) != 5 {
+		t.Fatalf("Repository has packs %v: %v", indexes, err)
+	}
+	return dir, indexes
+}
+
+func TestWriteMultiPackIndexVerifiesWithGit(t *testing.T) {
+	dir, paths := multiPackTestRepository(t)
+	var names []string
+	var indexes []*PackIndex
+	for _, path := range paths {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		index, err := ParsePackIndex(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, filepath.Base(path))
+		indexes = append(indexes, index)
+	}
+
+	data := &bytes.Buffer{}
+	if err := WriteMultiPackIndex(data, names, indexes); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, ".git", "objects", "pack", "multi-pack-index")
+	if err := ioutil.WriteFile(path, data.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	runGit(t, dir, "multi-pack-index", "verify")
+
+	// and git's own multi-pack index is read the same way
+	runGit(t, dir, "multi-pack-index", "write")
+	gitData, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, data := range [][]byte{data.Bytes(), gitData} {
+		midx, err := ParseMultiPackIndex(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.Join(midx.PackNames(), " ") != strings.Join(names, " ") {
+			t.Errorf("Multi-pack index has packs %v, want %v", midx.PackNames(), names)
+		}
+		objects := 0
+		for i, index := range indexes {
+			for j := 0; j < index.NumObjects(); j++ {
+				entry := index.Entry(j)
+				pack, offset, ok := midx.Lookup(entry.Hash)
+				if !ok {
+					t.Errorf("Object %s is missing", entry.Hash)
+					continue
+				}
+				if pack == i && offset != entry.Offset {
+					t.Errorf("Object %s found at %d, want %d", entry.Hash, offset, entry.Offset)
+				}
+				if pack == i {
+					objects++
+				}
+			}
+		}
+		if objects != midx.NumObjects() {
+			t.Errorf("Multi-pack index has %d objects, found %d", midx.NumObjects(), objects)
+		}
+		if _, _, ok := midx.Lookup("0000000000000000000000000000000000000001"); ok {
+			t.Error("Missing object found")
+		}
+	}
+}
+
+func TestRepositoryMultiPackIndex(t *testing.T) {
+	ctx := context.Background()
+	dir, paths := multiPackTestRepository(t)
+	repo := newTestRepository(t)
+	for _, path := range paths {
+		storeGitPack(t, repo, strings.TrimSuffix(path, packIndexSuffix)+packSuffix, path)
+	}
+	if err := repo.WriteMultiPackIndex(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := repo.store.Get(ctx, multiPackIndexKey); err != nil {
+		t.Fatal(err)
+	}
+
+	// a fresh repository finds every object through the multi-pack index
+	repo = NewRepository(repo.store, nil)
+	for _, sha := range gitObjects(t, dir) {
+		objType, data, err := repo.ReadRawObject(ctx, sha)
+		if err != nil {
+			t.Errorf("Error reading %s: %v", sha, err)
+		} else if HashObject(objType, data) != sha {
+			t.Errorf("Object %s has the wrong content", sha)
+		}
+	}
+}
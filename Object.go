@@ -0,0 +1,115 @@
+package gitpacklib
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Object types, as they appear in the header of a stored object.
+const (
+	CommitObject = "commit"
+	TreeObject   = "tree"
+	BlobObject   = "blob"
+	TagObject    = "tag"
+)
+
+// Object is a parsed git object: a *Commit, *Tree, *Tag or *Blob.
+type Object interface {
+	Type() string
+	Serialize() []byte
+}
+
+// ObjectHeader is a header line of a commit or tag that has no field of its
+// own, such as mergetag. Values spanning several lines are joined with "\n".
+type ObjectHeader struct {
+	Key   string
+	Value string
+}
+
+// ParseObject parses the content of an object of the given type.
+func ParseObject(objType string, data []byte) (Object, error) {
+	switch objType {
+	case CommitObject:
+		return ParseCommit(data)
+	case TreeObject:
+		return ParseTree(data)
+	case BlobObject:
+		return ParseBlob(data)
+	case TagObject:
+		return ParseTag(data)
+	}
+	return nil, errors.New("Unknown object type: " + objType)
+}
+
+// HashObject returns the sha an object of the given type and content is
+// stored under.
+func HashObject(objType string, data []byte) string {
+	h := sha1.New()
+	fmt.Fprintf(h, "%s %d\x00", objType, len(data))
+	h.Write(data)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// isObjectSha reports whether s is a full, lowercase hex sha.
+func isObjectSha(s string) bool {
+	return len(s) == 40 && isHex(s)
+}
+
+// isHex reports whether s consists only of lowercase hex digits.
+func isHex(s string) bool {
+	for _, c := range []byte(s) {
+		if !(c >= '0' && c <= '9' || c >= 'a' && c <= 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// parseObjectHeaders splits a commit or tag into its header lines and message.
+// Continuation lines, which start with a space, are joined onto the value of
+// the header before them with "\n".
+func parseObjectHeaders(data []byte) (headers []ObjectHeader, message string, err error) {
+	rest := data
+	for len(rest) > 0 {
+		end := bytes.IndexByte(rest, '\n')
+		if end < 0 {
+			return nil, "", errors.New("Header line is not terminated")
+		}
+		line := string(rest[:end])
+		rest = rest[end+1:]
+
+		if line == "" {
+			return headers, string(rest), nil
+		}
+
+		if line[0] == ' ' {
+			if len(headers) == 0 {
+				return nil, "", errors.New("Continuation line without a header")
+			}
+			headers[len(headers)-1].Value += "\n" + line[1:]
+			continue
+		}
+
+		parts := strings.SplitN(line, " ", 2)
+		if len(parts) != 2 {
+			return nil, "", errors.New("Invalid header line: " + line)
+		}
+		headers = append(headers, ObjectHeader{parts[0], parts[1]})
+	}
+
+	// no message at all, not even the blank line separating it
+	return headers, "", nil
+}
+
+// writeObjectHeader writes a header, continuing values that span several
+// lines on lines starting with a space.
+func writeObjectHeader(b *bytes.Buffer, key string, value string) {
+	b.WriteString(key)
+	b.WriteByte(' ')
+	b.WriteString(strings.Replace(value, "\n", "\n ", -1))
+	b.WriteByte('\n')
+}
@@ -0,0 +1,72 @@
+package gitpacklib
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// objectKeyPrefix is prepended to an object's sha to give the backing store
+// key holding it, in the same format as a loose object in a git repository
+// but without compression.
+const objectKeyPrefix = "object/"
+
+func saveObject(ctx context.Context, store BackingStore, packs *packCache, objType string, data []byte) (sha string, err error) {
+	h := sha1.New()
+	b := new(bytes.Buffer)
+
+	both := io.MultiWriter(h, b)
+	both.Write([]byte(fmt.Sprintf("%s %d", objType, len(data))))
+	both.Write([]byte("\x00"))
+	both.Write(data)
+
+	sha = hex.EncodeToString(h.Sum(nil))
+
+	err = store.Set(ctx, objectKeyPrefix+sha, b.Bytes())
+	if err != nil {
+		return sha, err
+	}
+
+	if objType == TagObject {
+		err = cachePeeledTag(ctx, store, packs, sha, data)
+	}
+
+	return sha, err
+}
+
+// loadCachedObject reads the object with the given sha, whether stored loose
+// by saveObject or in one of the packs in the store, reading packs through
+// packs so that their indexes are read once for many objects. If there is no
+// such object, the error is the one the store gave for the loose object.
+func loadCachedObject(ctx context.Context, store BackingStore, packs *packCache, sha string) (objType string, data []byte, err error) {
+	allContent, err := store.Get(ctx, objectKeyPrefix+sha)
+	if os.IsNotExist(err) {
+		objType, data, found, packErr := packs.readObject(ctx, store, sha)
+		if packErr != nil {
+			return "", nil, packErr
+		}
+		if found {
+			return objType, data, nil
+		}
+	}
+	if err != nil {
+		return "", nil, err
+	}
+
+	parts := bytes.SplitN(allContent, []byte{0}, 2)
+	if len(parts) != 2 {
+		return "", nil, errors.New("Expected null byte separating content and header")
+	}
+
+	var dataSize int
+	fmt.Sscanf(string(parts[0]), "%s %d", &objType, &dataSize)
+
+	data = parts[1]
+
+	return objType, data, nil
+}
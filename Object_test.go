@@ -0,0 +1,188 @@
+package gitpacklib
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"io/ioutil"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// gitHashObject writes data to the git repository in dir as an object of the
+// given type, without git checking it, and returns its sha.
+func gitHashObject(t *testing.T, dir string, objType string, data []byte) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "object")
+	if err := ioutil.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return strings.TrimSpace(string(runGit(t, dir, "hash-object", "--literally", "-w", "-t", objType, path)))
+}
+
+// treeData builds the content of a tree from entries given as "<mode> <name>",
+// each pointing at hash.
+func treeData(hash string, entries ...string) []byte {
+	raw, _ := hex.DecodeString(hash)
+	b := &bytes.Buffer{}
+	for _, entry := range entries {
+		b.WriteString(entry)
+		b.WriteByte(0)
+		b.Write(raw)
+	}
+	return b.Bytes()
+}
+
+func TestParseObjectsRoundTrip(t *testing.T) {
+	dir := packTestRepository(t)
+	runGit(t, dir, "checkout", "-q", "-b", "topic", "HEAD~3")
+	writeFiles(t, dir, map[string][]byte{"topic.txt": []byte("topic\n"), "src/deep/er/file": []byte("deep\n")})
+	gitCommit(t, dir, "topic\n\nwith a body\nof several lines")
+	runGit(t, dir, "checkout", "-q", "main")
+	runGit(t, dir, "merge", "-q", "--no-ff", "-m", "merge topic", "topic")
+	writeFiles(t, dir, map[string][]byte{"script.sh": []byte("#!/bin/sh\n")})
+	runGit(t, dir, "update-index", "--add", "--chmod=+x", "script.sh")
+	runGit(t, dir, "-c", "i18n.commitEncoding=ISO-8859-1", "commit", "-q", "--allow-empty-message", "-m", "")
+	runGit(t, dir, "tag", "-a", "-m", "nested", "v1-nested", "v1")
+	runGit(t, dir, "tag", "-a", "-m", "of a tree", "tree-tag", "HEAD^{tree}")
+
+	out := runGit(t, dir, "cat-file", "--batch-all-objects", "--batch")
+	for len(out) > 0 {
+		end := bytes.IndexByte(out, '\n')
+		fields := strings.Fields(string(out[:end]))
+		size, err := strconv.Atoi(fields[2])
+		if err != nil {
+			t.Fatal(err)
+		}
+		data := out[end+1 : end+1+size]
+		out = out[end+1+size+1:]
+
+		obj, err := ParseObject(fields[1], data)
+		if err != nil {
+			t.Errorf("Error parsing %s %s: %v", fields[1], fields[0], err)
+			continue
+		}
+		if !bytes.Equal(obj.Serialize(), data) {
+			t.Errorf("%s %s serializes differently:\n%s\nwant\n%s", fields[1], fields[0], obj.Serialize(), data)
+		}
+	}
+}
+
+func TestParseObjectsMatchesGitFsck(t *testing.T) {
+	dir := newGitRepository(t)
+	blob := gitHashObject(t, dir, BlobObject, []byte("content\n"))
+	emptyTree := gitHashObject(t, dir, TreeObject, nil)
+	tree := gitHashObject(t, dir, TreeObject, treeData(blob, "100644 file"))
+	commit := gitHashObject(t, dir, CommitObject, []byte("tree "+tree+"\nauthor A <a@example.com> 1700000000 +0000\ncommitter C <c@example.com> 1700000000 +0000\n\nmessage\n"))
+	author := "author A U Thor <author@example.com> 1700000000 +0000\n"
+	committer := "committer C O Mitter <committer@example.com> 1700000000 +0000\n"
+	tagger := "tagger C O Mitter <committer@example.com> 1700000000 +0000\n"
+
+	for _, test := range []struct {
+		objType string
+		data    string
+		// whether git fsck accepts the object, perhaps with a warning
+		valid bool
+	}{
+		// problems git fsck only warns about
+		{TreeObject, string(treeData(emptyTree, "040000 dir")), true},
+		{TreeObject, string(treeData(blob, "100644 .git")), true},
+		{TreeObject, string(treeData(blob, "100644 .")), true},
+		{TreeObject, string(treeData(blob, "100644 ..")), true},
+		{TreeObject, string(treeData(blob, "100644 a/b")), true},
+		{TreeObject, string(treeData(blob, "100600 file")), true},
+		{TreeObject, string(treeData(blob, "100664 file")), true},
+		{CommitObject, "tree " + tree + "\n" + author + committer + "\nmessage with a \x00\n", true},
+		{TagObject, "object " + commit + "\ntype commit\ntag v1\n\nno tagger\n", true},
+		{TagObject, "object " + commit + "\ntype commit\ntag bad..name\n" + tagger + "\nmessage\n", true},
+
+		{TreeObject, "100644", false},
+		{TreeObject, string(treeData(blob, "10x644 file")), false},
+		{TreeObject, string(treeData(blob, "100644 file")[:30]), false},
+		{TreeObject, string(treeData(blob, "100644 file", "100644 file")), false},
+		{TreeObject, string(treeData(blob, "100644 b", "100644 a")), false},
+		{TreeObject, string(treeData(blob, "100644 a", "100644 a.b", "40000 a")), false},
+
+		{CommitObject, author + committer + "\nmessage\n", false},
+		{CommitObject, "tree 1234\n" + author + committer + "\nmessage\n", false},
+		{CommitObject, "tree " + tree + "\nparent 1234\n" + author + committer + "\nmessage\n", false},
+		{CommitObject, "tree " + tree + "\n" + committer + "\nmessage\n", false},
+		{CommitObject, "tree " + tree + "\n" + author + "\nmessage\n", false},
+		{CommitObject, "tree " + tree + "\n" + committer + author + "\nmessage\n", false},
+		{CommitObject, "tree " + tree + "\nauthor A U Thor author@example.com 1700000000 +0000\n" + committer + "\nmessage\n", false},
+		{CommitObject, "tree " + tree + "\nauthor A U Thor <author@example.com> 1700000000\n" + committer + "\nmessage\n", false},
+		{CommitObject, "tree " + tree + "\nauthor A U Thor <author@example.com> 1700000000 +00\n" + committer + "\nmessage\n", false},
+		{CommitObject, "tree " + tree + "\nauthor A U Thor <author@example.com> soon +0000\n" + committer + "\nmessage\n", false},
+		{CommitObject, "tree " + tree + "\n" + author + committer[:len(committer)-1], false},
+
+		{TagObject, "type commit\ntag v1\n" + tagger + "\nmessage\n", false},
+		{TagObject, "object 1234\ntype commit\ntag v1\n" + tagger + "\nmessage\n", false},
+		{TagObject, "object " + commit + "\ntype thing\ntag v1\n" + tagger + "\nmessage\n", false},
+		{TagObject, "object " + commit + "\ntype commit\n" + tagger + "\nmessage\n", false},
+		{TagObject, "object " + commit + "\ntag v1\ntype commit\n" + tagger + "\nmessage\n", false},
+		{TagObject, "object " + commit + "\ntype commit\ntag v1\ntagger C O Mitter <committer@example.com>\n\nmessage\n", false},
+	} {
+		sha := gitHashObject(t, dir, test.objType, []byte(test.data))
+		cmd := exec.Command("git", "fsck", "--no-dangling", sha)
+		cmd.Dir = dir
+		output, err := cmd.CombinedOutput()
+		if _, ok := err.(*exec.ExitError); err != nil && !ok {
+			t.Fatal(err)
+		}
+		if (err == nil) != test.valid {
+			t.Fatalf("git fsck of %s %q gave %v:\n%s", test.objType, test.data, err, output)
+		}
+
+		_, err = ParseObject(test.objType, []byte(test.data))
+		if test.valid && err != nil {
+			t.Errorf("Error parsing %s %q: %v", test.objType, test.data, err)
+		}
+		if !test.valid && err == nil {
+			t.Errorf("Invalid %s %q parsed", test.objType, test.data)
+		}
+	}
+}
+
+func TestWriteObjectChecksTrees(t *testing.T) {
+	ctx := context.Background()
+	repo := newTestRepository(t)
+	blob, err := repo.WriteObject(ctx, &Blob{Data: []byte("content\n")})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		data string
+		ok   bool
+	}{
+		// zero-padded modes are written without the padding
+		{string(treeData(blob, "040000 dir")), true},
+		{string(treeData(blob, "100664 file")), true},
+		{string(treeData(blob, "100644 .git")), false},
+		{string(treeData(blob, "100644 .")), false},
+		{string(treeData(blob, "100644 ..")), false},
+		{string(treeData(blob, "100644 a/b")), false},
+		{string(treeData(blob, "100600 file")), false},
+	} {
+		tree, err := ParseTree([]byte(test.data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		sha, err := repo.WriteObject(ctx, tree)
+		if test.ok && err != nil {
+			t.Errorf("Error writing tree %q: %v", test.data, err)
+		}
+		if !test.ok && err == nil {
+			t.Errorf("Tree %q was written", test.data)
+		}
+		if test.ok && err == nil && strings.HasPrefix(test.data, "0") {
+			_, data, err := repo.ReadRawObject(ctx, sha)
+			if err != nil || !bytes.HasPrefix(data, []byte("40000 dir\x00")) {
+				t.Errorf("Tree was written as %q: %v", data, err)
+			}
+		}
+	}
+}
@@ -0,0 +1,283 @@
+package gitpacklib
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// packIndexMagic starts an index of version 2 or later, which would be an
+// unlikely first fanout entry of a version 1 index.
+var packIndexMagic = []byte{0xff, 't', 'O', 'c'}
+
+// packIndexVersion is the version of the indexes written by WritePackIndex.
+const packIndexVersion = 2
+
+// maxSmallOffset is the largest offset an index stores in its table of four
+// byte offsets; larger ones go in a table of eight byte offsets.
+const maxSmallOffset = 0x7fffffff
+
+// PackIndexEntry is where an object is found in a pack.
+type PackIndexEntry struct {
+	Hash   string
+	Offset int64
+	CRC32  uint32
+}
+
+// WritePackIndex writes an index of version 2 for the pack with the given
+// checksum to out, as git index-pack does, with an entry for each object in
+// the pack.
+func WritePackIndex(out io.Writer, packChecksum string, entries []*PackIndexEntry) error {
+	checksum, err := hex.DecodeString(packChecksum)
+	if err != nil || len(checksum) != sha1.Size {
+		return errors.New("Invalid PACK checksum " + packChecksum)
+	}
+
+	sorted := append([]*PackIndexEntry{}, entries...)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].Hash < sorted[j].Hash
+	})
+
+	index := &bytes.Buffer{}
+	index.Write(packIndexMagic)
+	binary.Write(index, binary.BigEndian, uint32(packIndexVersion))
+
+	shas := make([]string, len(sorted))
+	for i, entry := range sorted {
+		shas[i] = entry.Hash
+	}
+	fanout, table, err := shaTableData(shas)
+	if err != nil {
+		return err
+	}
+	index.Write(fanout)
+	index.Write(table)
+	for _, entry := range sorted {
+		binary.Write(index, binary.BigEndian, entry.CRC32)
+	}
+	var largeOffsets []int64
+	for _, entry := range sorted {
+		if entry.Offset > maxSmallOffset {
+			binary.Write(index, binary.BigEndian, uint32(0x80000000|len(largeOffsets)))
+			largeOffsets = append(largeOffsets, entry.Offset)
+		} else {
+			binary.Write(index, binary.BigEndian, uint32(entry.Offset))
+		}
+	}
+	for _, offset := range largeOffsets {
+		binary.Write(index, binary.BigEndian, uint64(offset))
+	}
+
+	index.Write(checksum)
+	sum := sha1.Sum(index.Bytes())
+	index.Write(sum[:])
+
+	if _, err := out.Write(index.Bytes()); err != nil {
+		return errors.New("Error writing pack index: " + err.Error())
+	}
+	return nil
+}
+
+// PackIndex is a pack index of version 2, which finds objects in a pack by
+// their sha.
+type PackIndex struct {
+	shaTable
+	data []byte
+
+	// where each table after the shas starts in data
+	crcs         int
+	offsets      int
+	largeOffsets int
+	numLarge     int
+}
+
+// ParsePackIndex reads a pack index, checking its checksum and that its
+// tables are the size its fanout says.
+func ParsePackIndex(data []byte) (*PackIndex, error) {
+	if len(data) < 8+256*4+2*sha1.Size {
+		return nil, errors.New("Pack index is too short")
+	}
+	if !bytes.Equal(data[:4], packIndexMagic) {
+		return nil, errors.New("Unsupported pack index version 1")
+	}
+	if version := binary.BigEndian.Uint32(data[4:]); version != packIndexVersion {
+		return nil, errors.New("Unsupported pack index version " + strconv.Itoa(int(version)))
+	}
+
+	sum := sha1.Sum(data[:len(data)-sha1.Size])
+	if !bytes.Equal(sum[:], data[len(data)-sha1.Size:]) {
+		return nil, errors.New("Pack index checksum mismatch")
+	}
+
+	fanout := data[8 : 8+256*4]
+	numObjects, err := fanoutObjects(fanout)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < 8+len(fanout)+numObjects*(sha1.Size+8)+2*sha1.Size {
+		return nil, errors.New("Pack index has the wrong size for its objects")
+	}
+	shas := data[8+len(fanout) : 8+len(fanout)+numObjects*sha1.Size]
+
+	index := &PackIndex{shaTable: shaTable{fanout, shas, numObjects}, data: data}
+	index.crcs = 8 + len(fanout) + len(shas)
+	index.offsets = index.crcs + index.numObjects*4
+	index.largeOffsets = index.offsets + index.numObjects*4
+	largeSize := len(data) - 2*sha1.Size - index.largeOffsets
+	if largeSize < 0 || largeSize%8 != 0 {
+		return nil, errors.New("Pack index has the wrong size for its objects")
+	}
+	index.numLarge = largeSize / 8
+
+	for i := 0; i < index.numObjects; i++ {
+		offset := binary.BigEndian.Uint32(data[index.offsets+i*4:])
+		if offset&0x80000000 != 0 && int(offset&0x7fffffff) >= index.numLarge {
+			return nil, errors.New("Pack index has an invalid offset")
+		}
+	}
+	return index, nil
+}
+
+// NumObjects returns how many objects are in the pack.
+func (index *PackIndex) NumObjects() int {
+	return index.numObjects
+}
+
+// PackChecksum returns the checksum of the pack the index is for.
+func (index *PackIndex) PackChecksum() string {
+	start := len(index.data) - 2*sha1.Size
+	return hex.EncodeToString(index.data[start : start+sha1.Size])
+}
+
+// Entry returns the i'th object of the index, in order of sha.
+func (index *PackIndex) Entry(i int) *PackIndexEntry {
+	return &PackIndexEntry{
+		Hash:   hex.EncodeToString(index.sha(i)),
+		Offset: index.offset(i),
+		CRC32:  binary.BigEndian.Uint32(index.data[index.crcs+i*4:]),
+	}
+}
+
+// Lookup returns the offset of the object with the given sha in the pack, and
+// whether it is there.
+func (index *PackIndex) Lookup(sha string) (int64, bool) {
+	i, ok := index.find(sha)
+	if !ok {
+		return 0, false
+	}
+	return index.offset(i), true
+}
+
+func (index *PackIndex) offset(i int) int64 {
+	offset := binary.BigEndian.Uint32(index.data[index.offsets+i*4:])
+	if offset&0x80000000 == 0 {
+		return int64(offset)
+	}
+	large := index.largeOffsets + int(offset&0x7fffffff)*8
+	return int64(binary.BigEndian.Uint64(index.data[large:]))
+}
+
+// shaTable is the sorted shas of the objects in an index, and the fanout
+// table that says how many of them start with each byte or a lower one.
+type shaTable struct {
+	fanout     []byte
+	shas       []byte
+	numObjects int
+}
+
+// shaTableData returns the fanout table and table of shas for sorted shas.
+func shaTableData(shas []string) ([]byte, []byte, error) {
+	var counts [256]uint32
+	table := make([]byte, 0, len(shas)*sha1.Size)
+	for i, sha := range shas {
+		raw, err := hex.DecodeString(sha)
+		if err != nil || len(raw) != sha1.Size {
+			return nil, nil, errors.New("Invalid object sha " + sha)
+		}
+		if i > 0 && sha == shas[i-1] {
+			return nil, nil, errors.New("Object " + sha + " is in the index twice")
+		}
+		table = append(table, raw...)
+		counts[raw[0]]++
+	}
+
+	fanout := make([]byte, 0, 256*4)
+	var total uint32
+	for _, count := range counts {
+		total += count
+		fanout = append(fanout, byte(total>>24), byte(total>>16), byte(total>>8), byte(total))
+	}
+	return fanout, table, nil
+}
+
+// fanoutObjects returns how many objects a fanout table says there are,
+// checking that it never decreases.
+func fanoutObjects(fanout []byte) (int, error) {
+	var last uint32
+	for i := 0; i < 256; i++ {
+		count := binary.BigEndian.Uint32(fanout[i*4:])
+		if count < last {
+			return 0, errors.New("Fanout table is not sorted")
+		}
+		last = count
+	}
+	return int(last), nil
+}
+
+// find returns the position of the object with the given sha in the table,
+// and whether it is there.
+func (table *shaTable) find(sha string) (int, bool) {
+	raw, err := hex.DecodeString(sha)
+	if err != nil || len(raw) != sha1.Size {
+		return 0, false
+	}
+	i := table.search(raw)
+	return i, i < table.numObjects && bytes.Equal(table.sha(i), raw)
+}
+
+// withPrefix returns the shas of the objects in the table that start with
+// prefix, stopping after limit of them.
+func (table *shaTable) withPrefix(prefix string, limit int) []string {
+	if len(prefix) == 0 || len(prefix) > 2*sha1.Size {
+		return nil
+	}
+	// the first sha that could start with the prefix, which may be of an
+	// odd length
+	raw, err := hex.DecodeString(prefix + strings.Repeat("0", 2*sha1.Size-len(prefix)))
+	if err != nil {
+		return nil
+	}
+
+	var shas []string
+	for i := table.search(raw); i < table.numObjects && len(shas) < limit; i++ {
+		sha := hex.EncodeToString(table.sha(i))
+		if !strings.HasPrefix(sha, prefix) {
+			break
+		}
+		shas = append(shas, sha)
+	}
+	return shas
+}
+
+// search returns the position of the first sha not less than raw, using the
+// fanout to narrow down where it is.
+func (table *shaTable) search(raw []byte) int {
+	low := 0
+	if raw[0] > 0 {
+		low = int(binary.BigEndian.Uint32(table.fanout[int(raw[0]-1)*4:]))
+	}
+	high := int(binary.BigEndian.Uint32(table.fanout[int(raw[0])*4:]))
+	return low + sort.Search(high-low, func(i int) bool {
+		return bytes.Compare(table.sha(low+i), raw) >= 0
+	})
+}
+
+func (table *shaTable) sha(i int) []byte {
+	return table.shas[i*sha1.Size : (i+1)*sha1.Size]
+}
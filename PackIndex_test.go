@@ -0,0 +1,145 @@
+package gitpacklib
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"testing"
+)
+
+// storeGitPack stores the pack git wrote at packPath, with its index, in
+// repo, as a received pack is stored.
+func storeGitPack(t *testing.T, repo *Repository, packPath string, indexPath string) *PackIndex {
+	t.Helper()
+	pack, err := ioutil.ReadFile(packPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(indexPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	index, err := ParsePackIndex(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reverse := &bytes.Buffer{}
+	if err := WriteReverseIndex(reverse, index); err != nil {
+		t.Fatal(err)
+	}
+	if err := savePack(context.Background(), repo.store, index.PackChecksum(), pack, index, reverse.Bytes(), nil); err != nil {
+		t.Fatal(err)
+	}
+	return index
+}
+
+func TestWritePackIndexMatchesGit(t *testing.T) {
+	ctx := context.Background()
+	dir := packTestRepository(t)
+	packPath, indexPath := gitPack(t, dir)
+	want, err := ioutil.ReadFile(indexPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(packPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reader, err := NewPackReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var entries []*PackIndexEntry
+	for {
+		obj, err := reader.Next(ctx)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		entries = append(entries, &PackIndexEntry{Hash: obj.Hash, Offset: obj.Offset, CRC32: obj.CRC32})
+	}
+	got := &bytes.Buffer{}
+	if err := WritePackIndex(got, reader.Checksum(), entries); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got.Bytes(), want) {
+		t.Error("Index differs from the one git index-pack wrote")
+	}
+
+	index, err := ParsePackIndex(want)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range entries {
+		if offset, ok := index.Lookup(entry.Hash); !ok || offset != entry.Offset {
+			t.Errorf("Object %s found at %d, %v, want %d", entry.Hash, offset, ok, entry.Offset)
+		}
+	}
+	if _, ok := index.Lookup("0000000000000000000000000000000000000001"); ok {
+		t.Error("Missing object found")
+	}
+}
+
+func TestPackIndexLargeOffsets(t *testing.T) {
+	var entries []*PackIndexEntry
+	for i := 0; i < 300; i++ {
+		sha := fmt.Sprintf("%040x", i*7919*104729)
+		entries = append(entries, &PackIndexEntry{Hash: sha, Offset: int64(i) * 0x1234567, CRC32: uint32(i)})
+	}
+	data := &bytes.Buffer{}
+	if err := WritePackIndex(data, fmt.Sprintf("%040x", 42), entries); err != nil {
+		t.Fatal(err)
+	}
+	index, err := ParsePackIndex(data.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if index.NumObjects() != len(entries) {
+		t.Errorf("Index has %d objects, want %d", index.NumObjects(), len(entries))
+	}
+	for _, entry := range entries {
+		if offset, ok := index.Lookup(entry.Hash); !ok || offset != entry.Offset {
+			t.Errorf("Object %s found at %d, %v, want %d", entry.Hash, offset, ok, entry.Offset)
+		}
+	}
+}
+
+func TestPeelRefThroughPacks(t *testing.T) {
+	ctx := context.Background()
+	dir := packTestRepository(t)
+	runGit(t, dir, "tag", "-a", "-m", "nested", "v1-nested", "v1")
+	runGit(t, dir, "tag", "lightweight")
+	repo := newTestRepository(t)
+	packPath, indexPath := gitPack(t, dir)
+	storeGitPack(t, repo, packPath, indexPath)
+
+	head := gitRevParse(t, dir, "HEAD")
+	var updates []*RefUpdate
+	for _, name := range []string{"refs/heads/main", "refs/tags/v1", "refs/tags/v1-nested", "refs/tags/lightweight"} {
+		updates = append(updates, &RefUpdate{Name: name, NewHash: gitRevParse(t, dir, name)})
+	}
+	if err := repo.RefStore().Update(ctx, updates); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, update := range updates {
+		peeled, err := repo.PeelRef(ctx, update.Name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if peeled != head {
+			t.Errorf("%s peeled to %s, want %s", update.Name, peeled, head)
+		}
+
+		// tags and the commits they point at are cached alike
+		cached, err := repo.store.Get(ctx, peeledKeyPrefix+update.NewHash)
+		if err != nil || string(cached) != head {
+			t.Errorf("%s is cached as peeling to %q, %v", update.Name, cached, err)
+		}
+	}
+}
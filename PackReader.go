@@ -0,0 +1,356 @@
+package gitpacklib
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"context"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"hash"
+	"hash/crc32"
+	"io"
+	"strconv"
+)
+
+// PackObject is an object read from a pack by PackReader.
+type PackObject struct {
+	// Offset is where the object's entry starts in the pack, and CRC32 the
+	// checksum of the entry's bytes, as recorded in a pack index.
+	Offset int64
+	CRC32  uint32
+
+	Type string
+	Hash string
+	Data []byte
+
+	// DeltaBase is the sha of the object this one was stored as a delta
+	// of, or empty if it was stored whole. BaseOffset is where the base's
+	// entry starts if the delta named it by offset, and zero otherwise.
+	DeltaBase  string
+	BaseOffset int64
+
+	// DeltaSize is the size of the delta the object was stored as.
+	DeltaSize int
+}
+
+// PackReader reads the objects of a pack in the order they are stored,
+// resolving deltas as it goes, without needing to seek.
+type PackReader struct {
+	// LoadObject, if set, returns the type and content of the object with
+	// the given sha, for the delta bases of objects. It must find the
+	// objects already read from the pack, such as by having them stored as
+	// they are read, as well as any a thin pack leaves out. If nil, the
+	// reader keeps every object it reads in memory instead.
+	LoadObject func(ctx context.Context, sha string) (string, []byte, error)
+
+	stream     *packStream
+	version    uint32
+	numObjects uint32
+	read       uint32
+	checksum   string
+
+	// shas of the objects read by their offsets, and their content if
+	// LoadObject is nil
+	offsets map[int64]string
+	objects map[string]*PackObject
+}
+
+// NewPackReader reads the header of the pack in r, ready for its objects to
+// be read with Next.
+func NewPackReader(r io.Reader) (*PackReader, error) {
+	return newPackReader(r, nil)
+}
+
+// newPackReader returns a PackReader that also copies the bytes of the pack
+// to copy as they are read, if it is not nil.
+func newPackReader(r io.Reader, copy io.Writer) (*PackReader, error) {
+	reader := &PackReader{
+		stream:  newPackStream(r, copy),
+		offsets: map[int64]string{},
+		objects: map[string]*PackObject{},
+	}
+
+	header := make([]byte, 12)
+	if _, err := io.ReadFull(reader.stream, header); err != nil {
+		return nil, errors.New("Error reading PACK header: " + err.Error())
+	}
+	if string(header[:4]) != "PACK" {
+		return nil, errors.New("Invalid PACK header")
+	}
+	reader.version = binary.BigEndian.Uint32(header[4:])
+	reader.numObjects = binary.BigEndian.Uint32(header[8:])
+	if reader.version != 2 && reader.version != 3 {
+		return nil, errors.New("Unsupported PACK version " + strconv.Itoa(int(reader.version)))
+	}
+	return reader, nil
+}
+
+// Version returns the version of the pack format.
+func (reader *PackReader) Version() uint32 {
+	return reader.version
+}
+
+// NumObjects returns the number of objects the pack's header says it holds.
+func (reader *PackReader) NumObjects() uint32 {
+	return reader.numObjects
+}
+
+// Checksum returns the sha1 of the pack, which ends it, once every object has
+// been read.
+func (reader *PackReader) Checksum() string {
+	return reader.checksum
+}
+
+// Next reads the next object of the pack. After the last object, it checks
+// the checksum at the end of the pack and returns io.EOF.
+func (reader *PackReader) Next(ctx context.Context) (*PackObject, error) {
+	if reader.read == reader.numObjects {
+		if reader.checksum == "" {
+			if err := reader.readChecksum(); err != nil {
+				return nil, err
+			}
+		}
+		return nil, io.EOF
+	}
+
+	obj, err := reader.readEntry(ctx)
+	if err != nil {
+		return nil, errors.New("Error reading object " + strconv.Itoa(int(reader.read)+1) + ": " + err.Error())
+	}
+	reader.read++
+
+	reader.offsets[obj.Offset] = obj.Hash
+	if reader.LoadObject == nil {
+		reader.objects[obj.Hash] = obj
+	}
+	return obj, nil
+}
+
+func (reader *PackReader) readEntry(ctx context.Context) (*PackObject, error) {
+	stream := reader.stream
+	stream.startEntry()
+	obj := &PackObject{Offset: stream.offset}
+
+	header, err := readPackEntryHeader(stream, obj.Offset)
+	if err != nil {
+		return nil, err
+	}
+	obj.Type = packTypeName(header.packType)
+	obj.BaseOffset = header.baseOffset
+	obj.DeltaBase = header.baseHash
+	if header.packType == packOfsDelta {
+		base, ok := reader.offsets[obj.BaseOffset]
+		if !ok {
+			return nil, errors.New("No delta base at offset " + strconv.FormatInt(obj.BaseOffset, 10))
+		}
+		obj.DeltaBase = base
+	}
+
+	data, err := readPackData(stream, header.size)
+	if err != nil {
+		return nil, err
+	}
+	obj.CRC32 = stream.crc.Sum32()
+
+	if obj.DeltaBase != "" {
+		obj.DeltaSize = len(data)
+		baseType, base, err := reader.loadBase(ctx, obj.DeltaBase)
+		if err != nil {
+			return nil, errors.New("Error loading delta base " + obj.DeltaBase + ": " + err.Error())
+		}
+		obj.Type = baseType
+		data, err = applyDelta(base, data)
+		if err != nil {
+			return nil, errors.New("Error applying delta: " + err.Error())
+		}
+	}
+
+	obj.Data = data
+	obj.Hash = HashObject(obj.Type, data)
+	return obj, nil
+}
+
+func (reader *PackReader) loadBase(ctx context.Context, sha string) (string, []byte, error) {
+	if reader.LoadObject != nil {
+		return reader.LoadObject(ctx, sha)
+	}
+	if obj, ok := reader.objects[sha]; ok {
+		return obj.Type, obj.Data, nil
+	}
+	return "", nil, ErrObjectNotFound
+}
+
+func (reader *PackReader) readChecksum() error {
+	computed := reader.stream.hash.Sum(nil)
+	received := make([]byte, sha1.Size)
+	if _, err := io.ReadFull(reader.stream, received); err != nil {
+		return errors.New("Error reading PACK checksum: " + err.Error())
+	}
+	if !bytes.Equal(computed, received) {
+		return errors.New("PACK checksum mismatch: " + hex.EncodeToString(computed) + " != " + hex.EncodeToString(received))
+	}
+	reader.checksum = hex.EncodeToString(received)
+	return nil
+}
+
+// packHeader is the start of an entry in a pack, up to its compressed
+// data.
+type packHeader struct {
+	packType byte
+	size     int64
+
+	// the base of a delta, which is named by offset for OFS_DELTA entries
+	// and by sha for REF_DELTA entries
+	baseOffset int64
+	baseHash   string
+}
+
+// readPackEntryHeader reads the header of the entry at offset in a pack.
+func readPackEntryHeader(r packByteReader, offset int64) (*packHeader, error) {
+	c, err := r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	header := &packHeader{packType: (c >> 4) & 0x7, size: int64(c & 0x0f)}
+	for shift := uint(4); c&0x80 != 0; shift += 7 {
+		if shift > 56 {
+			return nil, errors.New("Invalid object size")
+		}
+		if c, err = r.ReadByte(); err != nil {
+			return nil, err
+		}
+		header.size |= int64(c&0x7f) << shift
+	}
+
+	switch header.packType {
+	case packCommit, packTree, packBlob, packTag:
+	case packOfsDelta:
+		distance, err := readOffsetDelta(r)
+		if err != nil {
+			return nil, err
+		}
+		if distance <= 0 || distance > offset {
+			return nil, errors.New("Invalid delta base offset")
+		}
+		header.baseOffset = offset - distance
+	case packRefDelta:
+		base := make([]byte, sha1.Size)
+		if _, err := io.ReadFull(r, base); err != nil {
+			return nil, err
+		}
+		header.baseHash = hex.EncodeToString(base)
+	default:
+		return nil, errors.New("Unknown object type " + strconv.Itoa(int(header.packType)))
+	}
+	return header, nil
+}
+
+// packByteReader is what the entries of a pack are read from.
+type packByteReader interface {
+	io.Reader
+	io.ByteReader
+}
+
+// readOffsetDelta reads how far back the base of an OFS_DELTA entry is, as
+// written by packOffsetDelta.
+func readOffsetDelta(r io.ByteReader) (int64, error) {
+	c, err := r.ReadByte()
+	if err != nil {
+		return 0, err
+	}
+	distance := int64(c & 0x7f)
+	for c&0x80 != 0 {
+		if distance >= 1<<56 {
+			return 0, errors.New("Invalid delta base offset")
+		}
+		if c, err = r.ReadByte(); err != nil {
+			return 0, err
+		}
+		distance = (distance+1)<<7 | int64(c&0x7f)
+	}
+	return distance, nil
+}
+
+// readPackData inflates size bytes of an entry's data, making sure that the
+// compressed data ends there. The data is read before its size is trusted.
+func readPackData(r packByteReader, size int64) ([]byte, error) {
+	inflated, err := zlib.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	// reading to the end also checks the data's checksum
+	data := &bytes.Buffer{}
+	if _, err := io.Copy(data, io.LimitReader(inflated, size+1)); err != nil {
+		return nil, errors.New("Error reading object data: " + err.Error())
+	}
+	if int64(data.Len()) > size {
+		return nil, errors.New("Object data is longer than its size")
+	}
+	if int64(data.Len()) < size {
+		return nil, errors.New("Error reading object data: " + io.ErrUnexpectedEOF.Error())
+	}
+	return data.Bytes(), inflated.Close()
+}
+
+func packTypeName(packType byte) string {
+	switch packType {
+	case packCommit:
+		return CommitObject
+	case packTree:
+		return TreeObject
+	case packBlob:
+		return BlobObject
+	case packTag:
+		return TagObject
+	}
+	return ""
+}
+
+// packStream reads a pack a byte at a time as needed, so that zlib does not
+// read past the end of an entry, while keeping track of the offset, the
+// checksum of the pack and the CRC32 of the current entry.
+type packStream struct {
+	r      *bufio.Reader
+	offset int64
+	hash   hash.Hash
+	crc    hash.Hash32
+	copy   io.Writer
+}
+
+func newPackStream(r io.Reader, copy io.Writer) *packStream {
+	buffered, ok := r.(*bufio.Reader)
+	if !ok {
+		buffered = bufio.NewReader(r)
+	}
+	return &packStream{r: buffered, hash: sha1.New(), crc: crc32.NewIEEE(), copy: copy}
+}
+
+func (stream *packStream) startEntry() {
+	stream.crc.Reset()
+}
+
+func (stream *packStream) Read(p []byte) (int, error) {
+	n, err := stream.r.Read(p)
+	stream.consumed(p[:n])
+	return n, err
+}
+
+func (stream *packStream) ReadByte() (byte, error) {
+	c, err := stream.r.ReadByte()
+	if err == nil {
+		stream.consumed([]byte{c})
+	}
+	return c, err
+}
+
+func (stream *packStream) consumed(p []byte) {
+	if stream.copy != nil {
+		stream.copy.Write(p)
+	}
+	stream.hash.Write(p)
+	stream.crc.Write(p)
+	stream.offset += int64(len(p))
+}
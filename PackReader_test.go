@@ -0,0 +1,129 @@
+package gitpacklib
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// gitPack repacks the git repository in dir into a single pack, with any
+// config given as "name=value", and returns the paths of the pack and its
+// index.
+func gitPack(t *testing.T, dir string, config ...string) (string, string) {
+	t.Helper()
+	var args []string
+	for _, c := range config {
+		args = append(args, "-c", c)
+	}
+	runGit(t, dir, append(args, "repack", "-adfq")...)
+	packs, err := filepath.Glob(filepath.Join(dir, ".git", "objects", "pack", "pack-*.pack"))
+	if err != nil || len(packs) != 1 {
+		t.Fatalf("Repacking made packs %v: %v", packs, err)
+	}
+	return packs[0], strings.TrimSuffix(packs[0], packSuffix) + packIndexSuffix
+}
+
+func TestPackReaderReadsGitPacks(t *testing.T) {
+	ctx := context.Background()
+	dir := packTestRepository(t)
+	objects := gitObjects(t, dir)
+
+	for _, refDeltas := range []bool{false, true} {
+		packPath, indexPath := gitPack(t, dir, "repack.useDeltaBaseOffset="+strconv.FormatBool(!refDeltas))
+		data, err := ioutil.ReadFile(packPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		indexData, err := ioutil.ReadFile(indexPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		index, err := ParsePackIndex(indexData)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		reader, err := NewPackReader(bytes.NewReader(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if int(reader.NumObjects()) != len(objects) {
+			t.Errorf("Pack has %d objects, want %d", reader.NumObjects(), len(objects))
+		}
+		deltas := 0
+		for {
+			obj, err := reader.Next(ctx)
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if sha := HashObject(obj.Type, obj.Data); sha != obj.Hash {
+				t.Errorf("Object %s has content hashing to %s", obj.Hash, sha)
+			}
+			for i := 0; i < index.NumObjects(); i++ {
+				if entry := index.Entry(i); entry.Hash == obj.Hash && (entry.Offset != obj.Offset || entry.CRC32 != obj.CRC32) {
+					t.Errorf("Object %s at offset %d with CRC32 %08x, git has %d and %08x", obj.Hash, obj.Offset, obj.CRC32, entry.Offset, entry.CRC32)
+				}
+			}
+			if obj.DeltaBase != "" {
+				deltas++
+				if (obj.BaseOffset != 0) == refDeltas {
+					t.Errorf("Delta %s has base offset %d with ref deltas %v", obj.Hash, obj.BaseOffset, refDeltas)
+				}
+			}
+		}
+		if deltas == 0 {
+			t.Error("Pack has no deltas")
+		}
+		if name := "pack-" + reader.Checksum() + packSuffix; name != filepath.Base(packPath) {
+			t.Errorf("Pack checksum gives %s, git wrote %s", name, filepath.Base(packPath))
+		}
+	}
+}
+
+func TestPackReaderChecksEntrySizes(t *testing.T) {
+	ctx := context.Background()
+	content := []byte("some content\n")
+
+	for _, test := range []struct {
+		size int
+		err  string
+	}{
+		{len(content), ""},
+		{len(content) - 1, "Object data is longer than its size"},
+		{len(content) + 1, "Error reading object data: unexpected EOF"},
+		{1 << 40, "Error reading object data: unexpected EOF"},
+	} {
+		pack := &bytes.Buffer{}
+		pack.WriteString("PACK")
+		binary.Write(pack, binary.BigEndian, uint32(packVersion))
+		binary.Write(pack, binary.BigEndian, uint32(1))
+		pack.Write(packEntryHeader(packBlob, test.size))
+		pack.Write(compressPackData(content))
+		sum := sha1.Sum(pack.Bytes())
+		pack.Write(sum[:])
+
+		reader, err := NewPackReader(pack)
+		if err != nil {
+			t.Fatal(err)
+		}
+		obj, err := reader.Next(ctx)
+		switch {
+		case test.err == "" && err != nil:
+			t.Errorf("Entry of size %d: %v", test.size, err)
+		case test.err == "" && !bytes.Equal(obj.Data, content):
+			t.Errorf("Entry of size %d read as %q", test.size, obj.Data)
+		case test.err != "" && (err == nil || !strings.HasSuffix(err.Error(), ": "+test.err)):
+			t.Errorf("Entry of size %d gave error %v, want %q", test.size, err, test.err)
+		}
+	}
+}
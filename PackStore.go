@@ -0,0 +1,542 @@
+package gitpacklib
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// packKeyPrefix is prepended to the names of the packs kept intact in the
+// backing store, each stored as "pack-<checksum>.pack" next to its index
+// "pack-<checksum>.idx", as in a git repository's objects/pack directory.
+const packKeyPrefix = "pack/"
+
+// A pack is stored before its reverse index, the mtimes of a cruft pack and
+// then its index, so a pack is only used once its index is there.
+const (
+	packSuffix         = ".pack"
+	packIndexSuffix    = ".idx"
+	reverseIndexSuffix = ".rev"
+	packMtimesSuffix   = ".mtimes"
+)
+
+// multiPackIndexKey holds a multi-pack index of the packs in the store, which
+// need not cover packs stored since it was written.
+const multiPackIndexKey = packKeyPrefix + "multi-pack-index"
+
+// maxUnindexedPacks is how many packs may be left out of the multi-pack index
+// before a push writes it again.
+const maxUnindexedPacks = 8
+
+// maxPackDeltaDepth bounds how long a chain of deltas is followed when
+// reading an object from a pack.
+const maxPackDeltaDepth = 10000
+
+// maxPackCacheBytes bounds how much of the objects read from a pack are kept
+// to be used again as delta bases.
+const maxPackCacheBytes = 32 << 20
+
+func packKey(checksum string, suffix string) string {
+	return packKeyPrefix + "pack-" + checksum + suffix
+}
+
+// indexPack returns the index and reverse index of the pack with the given
+// checksum, given entries for its objects.
+func indexPack(checksum string, entries []*PackIndexEntry) (*PackIndex, []byte, error) {
+	data := &bytes.Buffer{}
+	if err := WritePackIndex(data, checksum, entries); err != nil {
+		return nil, nil, err
+	}
+	index, err := ParsePackIndex(data.Bytes())
+	if err != nil {
+		return nil, nil, err
+	}
+	reverse := &bytes.Buffer{}
+	if err := WriteReverseIndex(reverse, index); err != nil {
+		return nil, nil, err
+	}
+	return index, reverse.Bytes(), nil
+}
+
+// savePack stores a pack and its indexes, making its objects available to
+// loadCachedObject. mtimes is only given for a cruft pack.
+func savePack(ctx context.Context, store BackingStore, checksum string, pack []byte, index *PackIndex, reverse []byte, mtimes []byte) error {
+	if err := store.Set(ctx, packKey(checksum, packSuffix), pack); err != nil {
+		return err
+	}
+	if err := store.Set(ctx, packKey(checksum, reverseIndexSuffix), reverse); err != nil {
+		return err
+	}
+	if mtimes != nil {
+		if err := store.Set(ctx, packKey(checksum, packMtimesSuffix), mtimes); err != nil {
+			return err
+		}
+	}
+	return store.Set(ctx, packKey(checksum, packIndexSuffix), index.data)
+}
+
+// removePack deletes a pack and its indexes, starting with its index so that
+// it is no longer found before the rest goes.
+func removePack(ctx context.Context, store BackingStore, name string) error {
+	for _, suffix := range []string{packIndexSuffix, packMtimesSuffix, reverseIndexSuffix, packSuffix} {
+		if err := store.Delete(ctx, name+suffix); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WriteMultiPackIndex writes a multi-pack index of every pack in the store,
+// so that an object is found with a single lookup however many packs there
+// are. Packs stored afterwards are searched separately until it is written
+// again, which pushes do once there are a few of them.
+func (repo *Repository) WriteMultiPackIndex(ctx context.Context) error {
+	return repo.packs.writeMultiPackIndex(ctx, repo.store, nil)
+}
+
+// completeThinPack appends the objects that the deltas of a thin pack are
+// based on but that it leaves out, as git index-pack --fix-thin does, so that
+// the pack can be read on its own. It returns the new pack along with entries
+// for the objects added.
+func completeThinPack(ctx context.Context, repo *Repository, pack []byte, bases []string) ([]byte, []*PackIndexEntry, error) {
+	pack = append([]byte{}, pack[:len(pack)-sha1.Size]...)
+	count := binary.BigEndian.Uint32(pack[8:])
+
+	var entries []*PackIndexEntry
+	for _, sha := range bases {
+		objType, data, err := repo.ReadRawObject(ctx, sha)
+		if err != nil {
+			return nil, nil, errors.New("Error reading delta base " + sha + ": " + err.Error())
+		}
+		entry := packEntryHeader(packTypeCode(objType), len(data))
+		entry = append(entry, compressPackData(data)...)
+		entries = append(entries, &PackIndexEntry{Hash: sha, Offset: int64(len(pack)), CRC32: crc32.ChecksumIEEE(entry)})
+		pack = append(pack, entry...)
+		count++
+	}
+
+	binary.BigEndian.PutUint32(pack[8:], count)
+	sum := sha1.Sum(pack)
+	return append(pack, sum[:]...), entries, nil
+}
+
+// packCache holds the indexes of the packs in a store, and the packs
+// themselves once objects have been read from them, so that they are read
+// from the store once. Objects are looked for using the multi-pack index, if
+// there is one, and then the index of each pack it does not cover.
+type packCache struct {
+	mu   sync.Mutex
+	keys []string
+
+	packs      map[string]*storedPack
+	multi      *MultiPackIndex
+	multiPacks []*storedPack
+	unindexed  []*storedPack
+}
+
+func newPackCache() *packCache {
+	return &packCache{packs: map[string]*storedPack{}}
+}
+
+// readObject reads the object with the given sha from whichever pack holds
+// it, returning false if none does.
+func (cache *packCache) readObject(ctx context.Context, store BackingStore, sha string) (string, []byte, bool, error) {
+	for attempt := 0; attempt < 2; attempt++ {
+		if pack, offset := cache.find(sha); pack != nil {
+			objType, data, err := pack.readObject(ctx, store, offset)
+			if os.IsNotExist(err) && attempt == 0 {
+				// the pack was removed since its index was read, such
+				// as by a repack that put its objects in a new pack
+				if err := cache.refresh(ctx, store); err != nil {
+					return "", nil, false, err
+				}
+				continue
+			}
+			return objType, data, err == nil, err
+		}
+		if attempt == 0 {
+			if err := cache.refresh(ctx, store); err != nil {
+				return "", nil, false, err
+			}
+		}
+	}
+	return "", nil, false, nil
+}
+
+// find returns the pack holding the object with the given sha and where it
+// is in the pack, or nil if none of the packs known so far does.
+func (cache *packCache) find(sha string) (*storedPack, int64) {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	if cache.multi != nil {
+		if pack, offset, ok := cache.multi.Lookup(sha); ok {
+			return cache.multiPacks[pack], offset
+		}
+	}
+	for _, pack := range cache.unindexed {
+		if offset, ok := pack.index.Lookup(sha); ok {
+			return pack, offset
+		}
+	}
+	return nil, 0
+}
+
+// withPrefix returns the shas of the objects in the packs that start with
+// prefix, stopping after limit from any one index.
+func (cache *packCache) withPrefix(ctx context.Context, store BackingStore, prefix string, limit int) ([]string, error) {
+	if err := cache.refresh(ctx, store); err != nil {
+		return nil, err
+	}
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	var shas []string
+	if cache.multi != nil {
+		shas = cache.multi.withPrefix(prefix, limit)
+	}
+	for _, pack := range cache.unindexed {
+		shas = append(shas, pack.index.withPrefix(prefix, limit)...)
+	}
+	return shas, nil
+}
+
+// numUnindexed returns how many packs the multi-pack index does not cover.
+func (cache *packCache) numUnindexed(ctx context.Context, store BackingStore) (int, error) {
+	if err := cache.refresh(ctx, store); err != nil {
+		return 0, err
+	}
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	return len(cache.unindexed), nil
+}
+
+// refresh lists the packs in the store, and if they have changed reads the
+// multi-pack index and the indexes of new packs it does not cover, and
+// forgets packs that have been removed.
+func (cache *packCache) refresh(ctx context.Context, store BackingStore) error {
+	keys, err := store.List(ctx, packKeyPrefix)
+	if err != nil {
+		return err
+	}
+	cache.mu.Lock()
+	unchanged := equalStrings(keys, cache.keys)
+	previous := cache.packs
+	cache.mu.Unlock()
+	if unchanged {
+		return nil
+	}
+
+	var names []string
+	packs := map[string]*storedPack{}
+	hasMulti := false
+	for _, key := range keys {
+		if key == multiPackIndexKey {
+			hasMulti = true
+		}
+		if !strings.HasSuffix(key, packIndexSuffix) {
+			continue
+		}
+		name := strings.TrimSuffix(key, packIndexSuffix)
+		pack := previous[name]
+		if pack == nil {
+			pack = &storedPack{name: name}
+		}
+		names = append(names, name)
+		packs[name] = pack
+	}
+
+	var multi *MultiPackIndex
+	var multiPacks []*storedPack
+	if hasMulti {
+		data, err := store.Get(ctx, multiPackIndexKey)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		if err == nil {
+			multi, err = ParseMultiPackIndex(data)
+			if err != nil {
+				return errors.New("Error reading multi-pack index: " + err.Error())
+			}
+		}
+	}
+	if multi != nil {
+		for _, name := range multi.PackNames() {
+			pack := packs[packKeyPrefix+strings.TrimSuffix(name, packIndexSuffix)]
+			if pack == nil {
+				// a pack has been removed since the index was written
+				multi, multiPacks = nil, nil
+				break
+			}
+			multiPacks = append(multiPacks, pack)
+		}
+	}
+
+	covered := map[*storedPack]bool{}
+	for _, pack := range multiPacks {
+		covered[pack] = true
+	}
+	var unindexed []*storedPack
+	for _, name := range names {
+		pack := packs[name]
+		if covered[pack] {
+			continue
+		}
+		if _, err := pack.loadIndex(ctx, store); err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return err
+		}
+		unindexed = append(unindexed, pack)
+	}
+
+	cache.mu.Lock()
+	cache.keys, cache.packs = keys, packs
+	cache.multi, cache.multiPacks, cache.unindexed = multi, multiPacks, unindexed
+	cache.mu.Unlock()
+	return nil
+}
+
+// indexedPacks returns every pack in the store along with its index.
+func (cache *packCache) indexedPacks(ctx context.Context, store BackingStore) ([]*storedPack, error) {
+	if err := cache.refresh(ctx, store); err != nil {
+		return nil, err
+	}
+	cache.mu.Lock()
+	all := append(append([]*storedPack{}, cache.multiPacks...), cache.unindexed...)
+	cache.mu.Unlock()
+
+	var packs []*storedPack
+	for _, pack := range all {
+		_, err := pack.loadIndex(ctx, store)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		packs = append(packs, pack)
+	}
+	return packs, nil
+}
+
+// writeMultiPackIndex writes a multi-pack index covering every pack but those
+// named in skip, which are about to be removed.
+func (cache *packCache) writeMultiPackIndex(ctx context.Context, store BackingStore, skip map[string]bool) error {
+	packs, err := cache.indexedPacks(ctx, store)
+	if err != nil {
+		return err
+	}
+
+	var names []string
+	var indexes []*PackIndex
+	for _, pack := range packs {
+		if skip[pack.name] {
+			continue
+		}
+		names = append(names, strings.TrimPrefix(pack.name, packKeyPrefix)+packIndexSuffix)
+		indexes = append(indexes, pack.index)
+	}
+
+	midx := &bytes.Buffer{}
+	if err := WriteMultiPackIndex(midx, names, indexes); err != nil {
+		return err
+	}
+	return store.Set(ctx, multiPackIndexKey, midx.Bytes())
+}
+
+// storedPack is a pack in the store. Its index is read when it is not
+// covered by the multi-pack index or an object is read from it, and the pack
+// itself when an object is first read from it.
+type storedPack struct {
+	name string
+
+	mu    sync.Mutex
+	index *PackIndex
+	file  *packFile
+}
+
+func (pack *storedPack) loadIndex(ctx context.Context, store BackingStore) (*PackIndex, error) {
+	pack.mu.Lock()
+	defer pack.mu.Unlock()
+	return pack.loadIndexLocked(ctx, store)
+}
+
+func (pack *storedPack) loadIndexLocked(ctx context.Context, store BackingStore) (*PackIndex, error) {
+	if pack.index == nil {
+		data, err := store.Get(ctx, pack.name+packIndexSuffix)
+		if err != nil {
+			return nil, err
+		}
+		index, err := ParsePackIndex(data)
+		if err != nil {
+			return nil, errors.New("Error reading pack index " + pack.name + packIndexSuffix + ": " + err.Error())
+		}
+		pack.index = index
+	}
+	return pack.index, nil
+}
+
+func (pack *storedPack) readObject(ctx context.Context, store BackingStore, offset int64) (string, []byte, error) {
+	pack.mu.Lock()
+	defer pack.mu.Unlock()
+	if pack.file == nil {
+		index, err := pack.loadIndexLocked(ctx, store)
+		if err != nil {
+			return "", nil, err
+		}
+		data, err := store.Get(ctx, pack.name+packSuffix)
+		if err != nil {
+			return "", nil, err
+		}
+		rev, err := pack.loadReverseIndex(ctx, store, index)
+		if err != nil {
+			return "", nil, err
+		}
+		pack.file = newPackFile(data, index.Lookup)
+		if rev != nil {
+			pack.file.startsObject = func(offset int64) bool {
+				_, ok := rev.ObjectAt(offset)
+				return ok
+			}
+		}
+	}
+	return pack.file.readObject(offset)
+}
+
+// loadReverseIndex reads the reverse index of the pack, or returns nil if it
+// was stored before reverse indexes were.
+func (pack *storedPack) loadReverseIndex(ctx context.Context, store BackingStore, index *PackIndex) (*ReverseIndex, error) {
+	data, err := store.Get(ctx, pack.name+reverseIndexSuffix)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	rev, err := ParseReverseIndex(data, index)
+	if err != nil {
+		return nil, errors.New("Error reading reverse index " + pack.name + reverseIndexSuffix + ": " + err.Error())
+	}
+	return rev, nil
+}
+
+// packFile reads objects from the bytes of a pack by where their entries
+// start, keeping recently read objects as delta bases for the next.
+type packFile struct {
+	data []byte
+
+	// lookup finds the entry of a REF_DELTA entry's base in the pack, and
+	// loadBase, if set, reads bases that are not in the pack, as those of a
+	// thin pack are not
+	lookup   func(sha string) (int64, bool)
+	loadBase func(sha string) (string, []byte, error)
+
+	// startsObject, if set, reports whether an entry starts at an offset,
+	// so that an OFS_DELTA entry can not name a base part way through one
+	startsObject func(offset int64) bool
+
+	cache      map[int64]*packedObject
+	cacheBytes int
+}
+
+// packedObject is an object read from a pack.
+type packedObject struct {
+	objType string
+	data    []byte
+}
+
+func newPackFile(data []byte, lookup func(sha string) (int64, bool)) *packFile {
+	return &packFile{data: data, lookup: lookup, cache: map[int64]*packedObject{}}
+}
+
+// readObject reads the object whose entry starts at offset, following the
+// chain of deltas down to a whole object and then applying them in turn.
+func (pack *packFile) readObject(offset int64) (string, []byte, error) {
+	type pendingDelta struct {
+		offset int64
+		delta  []byte
+	}
+	var deltas []pendingDelta
+
+	var base *packedObject
+	for base == nil {
+		if len(deltas) > maxPackDeltaDepth {
+			return "", nil, errors.New("Chain of deltas is too deep")
+		}
+		if cached, ok := pack.cache[offset]; ok {
+			base = cached
+			break
+		}
+		if offset < 0 || offset >= int64(len(pack.data)) {
+			return "", nil, errors.New("No pack entry at offset " + strconv.FormatInt(offset, 10))
+		}
+
+		r := bytes.NewReader(pack.data[offset:])
+		header, err := readPackEntryHeader(r, offset)
+		if err != nil {
+			return "", nil, errors.New("Error reading pack entry at offset " + strconv.FormatInt(offset, 10) + ": " + err.Error())
+		}
+		data, err := readPackData(r, header.size)
+		if err != nil {
+			return "", nil, errors.New("Error reading pack entry at offset " + strconv.FormatInt(offset, 10) + ": " + err.Error())
+		}
+
+		switch header.packType {
+		case packOfsDelta:
+			if pack.startsObject != nil && !pack.startsObject(header.baseOffset) {
+				return "", nil, errors.New("Delta base at offset " + strconv.FormatInt(header.baseOffset, 10) + " is not the start of an object")
+			}
+			deltas = append(deltas, pendingDelta{offset, data})
+			offset = header.baseOffset
+		case packRefDelta:
+			deltas = append(deltas, pendingDelta{offset, data})
+			baseOffset, ok := pack.lookup(header.baseHash)
+			if ok {
+				offset = baseOffset
+				continue
+			}
+			if pack.loadBase == nil {
+				return "", nil, errors.New("Delta base " + header.baseHash + " is not in the pack")
+			}
+			objType, data, err := pack.loadBase(header.baseHash)
+			if err != nil {
+				return "", nil, errors.New("Error loading delta base " + header.baseHash + ": " + err.Error())
+			}
+			base = &packedObject{objType: objType, data: data}
+		default:
+			base = &packedObject{objType: packTypeName(header.packType), data: data}
+			pack.cacheObject(offset, base)
+		}
+	}
+
+	for i := len(deltas) - 1; i >= 0; i-- {
+		data, err := applyDelta(base.data, deltas[i].delta)
+		if err != nil {
+			return "", nil, errors.New("Error applying delta at offset " + strconv.FormatInt(deltas[i].offset, 10) + ": " + err.Error())
+		}
+		base = &packedObject{objType: base.objType, data: data}
+		pack.cacheObject(deltas[i].offset, base)
+	}
+	return base.objType, base.data, nil
+}
+
+// cacheObject keeps an object read from the pack, starting the cache afresh
+// once it gets too large.
+func (pack *packFile) cacheObject(offset int64, obj *packedObject) {
+	if len(obj.data) > maxPackCacheBytes/4 {
+		return
+	}
+	if pack.cacheBytes+len(obj.data) > maxPackCacheBytes {
+		pack.cache = map[int64]*packedObject{}
+		pack.cacheBytes = 0
+	}
+	pack.cache[offset] = obj
+	pack.cacheBytes += len(obj.data)
+}
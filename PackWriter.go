@@ -0,0 +1,359 @@
+package gitpacklib
+
+import (
+	"bytes"
+	"compress/zlib"
+	"context"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"hash"
+	"hash/crc32"
+	"io"
+	"sort"
+)
+
+// Object types as numbered in a pack.
+const (
+	packCommit   = 1
+	packTree     = 2
+	packBlob     = 3
+	packTag      = 4
+	packOfsDelta = 6
+	packRefDelta = 7
+)
+
+// packVersion is the version of the packs written by WritePack.
+const packVersion = 2
+
+// The defaults of git pack-objects for how hard it looks for deltas.
+const (
+	DefaultPackWindow = 10
+	DefaultPackDepth  = 50
+)
+
+// PackOptions controls how WritePack compresses objects.
+type PackOptions struct {
+	// Window is how many similar objects are tried as the delta base of
+	// each object, as in git pack-objects --window. Zero uses
+	// DefaultPackWindow, and a negative window writes no deltas.
+	Window int
+
+	// Depth limits how long chains of deltas may get. Zero uses
+	// DefaultPackDepth.
+	Depth int
+
+	// RefDeltas names delta bases by sha rather than by their offset in the
+	// pack, for clients that lack the ofs-delta capability.
+	RefDeltas bool
+}
+
+// packEntry is an object to be written to a pack.
+type packEntry struct {
+	sha      string
+	objType  string
+	size     int
+	nameHash uint32
+
+	// base is the entry the object is stored as a delta of, if any
+	base  *packEntry
+	delta []byte
+	depth int
+
+	offset  int64
+	crc     uint32
+	written bool
+}
+
+// WritePack writes the objects with the given shas to out as a pack, as used
+// by upload-pack, bundles and repacking, and returns the pack's checksum.
+// Each object is stored as a delta of another object in the pack where that
+// is smaller. Like git, likely bases are found among objects of the same type
+// whose names, taken from the trees in the pack, end the same way, and which
+// are of a similar size.
+func (repo *Repository) WritePack(ctx context.Context, out io.Writer, objects []string, opts *PackOptions) (string, error) {
+	checksum, _, err := repo.writePack(ctx, out, objects, opts)
+	return checksum, err
+}
+
+// writePack is WritePack, also returning entries for the pack's index.
+func (repo *Repository) writePack(ctx context.Context, out io.Writer, objects []string, opts *PackOptions) (string, []*PackIndexEntry, error) {
+	if opts == nil {
+		opts = &PackOptions{}
+	}
+	window := opts.Window
+	if window == 0 {
+		window = DefaultPackWindow
+	}
+	depth := opts.Depth
+	if depth == 0 {
+		depth = DefaultPackDepth
+	}
+
+	entries, err := repo.packEntries(ctx, objects)
+	if err != nil {
+		return "", nil, err
+	}
+	if window > 0 {
+		if err := repo.findDeltas(ctx, entries, window, depth); err != nil {
+			return "", nil, err
+		}
+	}
+
+	writer := &packWriter{repo: repo, out: out, hash: sha1.New(), refDeltas: opts.RefDeltas}
+	header := make([]byte, 12)
+	copy(header, "PACK")
+	binary.BigEndian.PutUint32(header[4:], packVersion)
+	binary.BigEndian.PutUint32(header[8:], uint32(len(entries)))
+	if err := writer.write(header); err != nil {
+		return "", nil, err
+	}
+	for _, entry := range entries {
+		if err := writer.writeEntry(ctx, entry); err != nil {
+			return "", nil, err
+		}
+	}
+
+	sum := writer.hash.Sum(nil)
+	if _, err := out.Write(sum); err != nil {
+		return "", nil, errors.New("Error writing pack: " + err.Error())
+	}
+
+	indexEntries := make([]*PackIndexEntry, len(entries))
+	for i, entry := range entries {
+		indexEntries[i] = &PackIndexEntry{Hash: entry.sha, Offset: entry.offset, CRC32: entry.crc}
+	}
+	return hex.EncodeToString(sum), indexEntries, nil
+}
+
+// packEntries reads the type and size of each object, and names each object
+// after an entry for it in one of the trees.
+func (repo *Repository) packEntries(ctx context.Context, objects []string) ([]*packEntry, error) {
+	var entries []*packEntry
+	seen := map[string]bool{}
+	names := map[string]string{}
+	for _, sha := range objects {
+		if seen[sha] {
+			continue
+		}
+		seen[sha] = true
+
+		objType, data, err := repo.ReadRawObject(ctx, sha)
+		if err != nil {
+			return nil, errors.New("Error reading object " + sha + ": " + err.Error())
+		}
+		if packTypeCode(objType) == 0 {
+			return nil, errors.New("Object " + sha + " has unknown type " + objType)
+		}
+		entries = append(entries, &packEntry{sha: sha, objType: objType, size: len(data)})
+
+		if objType == TreeObject {
+			tree, err := ParseTree(data)
+			if err != nil {
+				return nil, errors.New("Error reading tree " + sha + ": " + err.Error())
+			}
+			for _, entry := range tree.Entries {
+				if _, ok := names[entry.Hash]; !ok {
+					names[entry.Hash] = entry.Name
+				}
+			}
+		}
+	}
+
+	for _, entry := range entries {
+		entry.nameHash = packNameHash(names[entry.sha])
+	}
+	return entries, nil
+}
+
+// packNameHash is git's hash of an object's name for sorting objects to be
+// deltified, which keeps names with the same ending together.
+func packNameHash(name string) uint32 {
+	var hash uint32
+	for _, c := range []byte(name) {
+		switch c {
+		case ' ', '\t', '\n', '\v', '\f', '\r':
+			continue
+		}
+		hash = hash>>2 + uint32(c)<<24
+	}
+	return hash
+}
+
+// deltaCandidate is an object in the window of findDeltas.
+type deltaCandidate struct {
+	entry *packEntry
+	data  []byte
+	index *deltaIndex
+}
+
+// findDeltas sorts objects of the same type and similar names together,
+// largest first, and deltifies each against whichever of the window objects
+// before it gives the smallest delta.
+func (repo *Repository) findDeltas(ctx context.Context, entries []*packEntry, window int, depth int) error {
+	sorted := append([]*packEntry{}, entries...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		a, b := sorted[i], sorted[j]
+		if a.objType != b.objType {
+			return packTypeCode(a.objType) < packTypeCode(b.objType)
+		}
+		if a.nameHash != b.nameHash {
+			return a.nameHash < b.nameHash
+		}
+		return a.size > b.size
+	})
+
+	var candidates []*deltaCandidate
+	for _, entry := range sorted {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		_, data, err := repo.ReadRawObject(ctx, entry.sha)
+		if err != nil {
+			return err
+		}
+
+		for i := len(candidates) - 1; i >= 0; i-- {
+			candidate := candidates[i]
+			if candidate.entry.objType != entry.objType || candidate.entry.depth >= depth {
+				continue
+			}
+
+			// the delta must save at least half the object, and beat the
+			// best found so far, and like git an object much smaller than
+			// the base is not worth trying
+			maxSize := entry.size/2 - sha1.Size
+			if entry.delta != nil {
+				maxSize = len(entry.delta) - 1
+			}
+			if maxSize <= 0 || entry.size < candidate.entry.size/32 || entry.size-candidate.entry.size >= maxSize {
+				continue
+			}
+
+			if candidate.index == nil {
+				candidate.index = newDeltaIndex(candidate.data)
+			}
+			if delta := candidate.index.createDelta(data, maxSize); delta != nil {
+				entry.base, entry.delta, entry.depth = candidate.entry, delta, candidate.entry.depth+1
+			}
+		}
+
+		candidates = append(candidates, &deltaCandidate{entry: entry, data: data})
+		if len(candidates) > window {
+			candidates = candidates[1:]
+		}
+	}
+	return nil
+}
+
+// packWriter writes the entries of a pack, keeping track of where each one
+// starts and the checksum of the whole pack.
+type packWriter struct {
+	repo      *Repository
+	out       io.Writer
+	hash      hash.Hash
+	offset    int64
+	refDeltas bool
+}
+
+func (writer *packWriter) write(data []byte) error {
+	if _, err := writer.out.Write(data); err != nil {
+		return errors.New("Error writing pack: " + err.Error())
+	}
+	writer.hash.Write(data)
+	writer.offset += int64(len(data))
+	return nil
+}
+
+// writeEntry writes an entry, after writing its delta base if it has not
+// been written yet, since a delta must come after its base.
+func (writer *packWriter) writeEntry(ctx context.Context, entry *packEntry) error {
+	if entry.written {
+		return nil
+	}
+	if entry.base != nil {
+		if err := writer.writeEntry(ctx, entry.base); err != nil {
+			return err
+		}
+	}
+	entry.offset = writer.offset
+	entry.written = true
+
+	var header, data []byte
+	switch {
+	case entry.base != nil && writer.refDeltas:
+		header = packEntryHeader(packRefDelta, len(entry.delta))
+		base, _ := hex.DecodeString(entry.base.sha)
+		header = append(header, base...)
+		data = entry.delta
+	case entry.base != nil:
+		header = packEntryHeader(packOfsDelta, len(entry.delta))
+		header = append(header, packOffsetDelta(entry.offset-entry.base.offset)...)
+		data = entry.delta
+	default:
+		var err error
+		_, data, err = writer.repo.ReadRawObject(ctx, entry.sha)
+		if err != nil {
+			return errors.New("Error reading object " + entry.sha + ": " + err.Error())
+		}
+		header = packEntryHeader(packTypeCode(entry.objType), len(data))
+	}
+
+	compressed := compressPackData(data)
+	entry.crc = crc32.Update(crc32.ChecksumIEEE(header), crc32.IEEETable, compressed)
+	if err := writer.write(header); err != nil {
+		return err
+	}
+	return writer.write(compressed)
+}
+
+// compressPackData compresses the data of a pack entry.
+func compressPackData(data []byte) []byte {
+	compressed := &bytes.Buffer{}
+	z := zlib.NewWriter(compressed)
+	z.Write(data)
+	z.Close()
+	return compressed.Bytes()
+}
+
+// packEntryHeader encodes the type and size that start each pack entry: the
+// type and low four bits of the size, then seven bits of the size at a time.
+func packEntryHeader(packType byte, size int) []byte {
+	header := []byte{packType<<4 | byte(size&0x0f)}
+	size >>= 4
+	for size > 0 {
+		header[len(header)-1] |= 0x80
+		header = append(header, byte(size&0x7f))
+		size >>= 7
+	}
+	return header
+}
+
+// packOffsetDelta encodes how far back the base of an OFS_DELTA entry is,
+// most significant bits first, with one added to each byte but the last so
+// that no offset has two encodings.
+func packOffsetDelta(offset int64) []byte {
+	encoded := []byte{byte(offset & 0x7f)}
+	for offset >>= 7; offset > 0; offset >>= 7 {
+		offset--
+		encoded = append([]byte{0x80 | byte(offset&0x7f)}, encoded...)
+	}
+	return encoded
+}
+
+// packTypeCode returns the number of an object type in a pack, or zero if
+// the type is unknown.
+func packTypeCode(objType string) byte {
+	switch objType {
+	case CommitObject:
+		return packCommit
+	case TreeObject:
+		return packTree
+	case BlobObject:
+		return packBlob
+	case TagObject:
+		return packTag
+	}
+	return 0
+}
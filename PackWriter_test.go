@@ -0,0 +1,103 @@
+package gitpacklib
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// packTestRepository makes a git repository whose history has many similar
+// versions of its files, so that packs of it have deltas, and an annotated
+// tag.
+func packTestRepository(t *testing.T) string {
+	dir := newGitRepository(t)
+	for i := 0; i < 12; i++ {
+		writeFiles(t, dir, map[string][]byte{
+			"big.txt":                      numberedLines(500, map[int]string{i*40 + 1: "changed " + strconv.Itoa(i)}),
+			"src/file" + strconv.Itoa(i%3): numberedLines(50+i, nil),
+		})
+		gitCommit(t, dir, "commit "+strconv.Itoa(i))
+	}
+	runGit(t, dir, "tag", "-a", "-m", "release", "v1")
+	return dir
+}
+
+// gitObjects returns the shas of every object in the git repository in dir.
+func gitObjects(t *testing.T, dir string) []string {
+	return strings.Fields(string(runGit(t, dir, "cat-file", "--batch-all-objects", "--batch-check=%(objectname)")))
+}
+
+// verifyPack indexes the pack in data with git index-pack, checking that its
+// checksum is as given, and returns what git verify-pack lists of each
+// object in it by sha.
+func verifyPack(t *testing.T, data []byte, checksum string) map[string][]string {
+	t.Helper()
+	dir := newGitRepository(t)
+	path := filepath.Join(dir, "test.pack")
+	if err := ioutil.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if sum := strings.TrimSpace(string(runGit(t, dir, "index-pack", path))); sum != checksum {
+		t.Errorf("git index-pack found checksum %s, want %s", sum, checksum)
+	}
+
+	objects := map[string][]string{}
+	for _, line := range strings.Split(string(runGit(t, dir, "verify-pack", "-v", path)), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) >= 5 && isObjectSha(fields[0]) {
+			objects[fields[0]] = fields[1:]
+		}
+	}
+	return objects
+}
+
+func TestWritePackVerifiesWithGit(t *testing.T) {
+	ctx := context.Background()
+	dir := packTestRepository(t)
+	repo := newTestRepository(t)
+	importGitObjects(t, repo, dir)
+	objects := gitObjects(t, dir)
+
+	for _, opts := range []*PackOptions{nil, {RefDeltas: true}, {Window: -1}, {Depth: 1}} {
+		data := &bytes.Buffer{}
+		checksum, err := repo.WritePack(ctx, data, objects, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		listed := verifyPack(t, data.Bytes(), checksum)
+
+		deltas, maxDepth := 0, 0
+		for _, sha := range objects {
+			fields, ok := listed[sha]
+			if !ok {
+				t.Errorf("Object %s is missing from the pack", sha)
+				continue
+			}
+			// deltas are listed with their depth and base
+			if len(fields) == 6 {
+				deltas++
+				if depth, _ := strconv.Atoi(fields[4]); depth > maxDepth {
+					maxDepth = depth
+				}
+			}
+		}
+		if len(listed) != len(objects) {
+			t.Errorf("Pack has %d objects, want %d", len(listed), len(objects))
+		}
+
+		switch {
+		case opts != nil && opts.Window < 0:
+			if deltas != 0 {
+				t.Errorf("Pack without deltas has %d deltas", deltas)
+			}
+		case deltas == 0:
+			t.Errorf("Pack with options %+v has no deltas", opts)
+		case opts != nil && opts.Depth > 0 && maxDepth > opts.Depth:
+			t.Errorf("Pack has deltas %d deep, more than %d", maxDepth, opts.Depth)
+		}
+	}
+}
@@ -0,0 +1,198 @@
+package gitpacklib
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"sort"
+	"strings"
+)
+
+// PackedRefsKey is the backing store key holding the refs of a
+// PackedRefStore.
+const PackedRefsKey = "packed-refs"
+
+// PackedRefStore keeps every ref in a single snapshot in git's packed-refs
+// format. Reads see a consistent view of all refs at once and prefix
+// iteration is a binary search, at the cost of each transaction rewriting
+// the snapshot while holding its key locked.
+//
+// Symbolic refs, which git never packs, are kept in the same snapshot as
+// "ref: <target> <name>" lines so that they take part in transactions.
+type PackedRefStore struct {
+	store BackingStore
+}
+
+func NewPackedRefStore(store BackingStore) *PackedRefStore {
+	return &PackedRefStore{store}
+}
+
+func (r *PackedRefStore) Get(ctx context.Context, name string) (*Ref, error) {
+	refs, err := r.load(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	i := sort.Search(len(refs), func(i int) bool { return refs[i].Name >= name })
+	if i < len(refs) && refs[i].Name == name {
+		return refs[i], nil
+	}
+	return nil, nil
+}
+
+func (r *PackedRefStore) Iterate(ctx context.Context, prefix string, fn func(ref *Ref) error) error {
+	refs, err := r.load(ctx)
+	if err != nil {
+		return err
+	}
+
+	i := sort.Search(len(refs), func(i int) bool { return refs[i].Name >= prefix })
+	for ; i < len(refs) && strings.HasPrefix(refs[i].Name, prefix); i++ {
+		if err = fn(refs[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *PackedRefStore) Update(ctx context.Context, updates []*RefUpdate) error {
+	_, err := refUpdateNames(updates)
+	if err != nil {
+		return err
+	}
+
+	lockCtx, cancel := lockWaitContext(ctx)
+	defer cancel()
+
+	err = r.store.RLock(lockCtx)
+	if err != nil {
+		return err
+	}
+	defer r.store.RUnlock()
+
+	err = r.store.LockKey(lockCtx, PackedRefsKey)
+	if err != nil {
+		return err
+	}
+	defer r.store.UnlockKey(PackedRefsKey)
+
+	refs, err := r.load(ctx)
+	if err != nil {
+		return err
+	}
+
+	byName := make(map[string]*Ref, len(refs))
+	for _, ref := range refs {
+		byName[ref.Name] = ref
+	}
+
+	err = checkRefUpdates(updates, func(name string) (*Ref, error) {
+		return byName[name], nil
+	})
+	if err != nil {
+		return err
+	}
+	err = checkRefNamesAvailable(updates, func(name string) (bool, error) {
+		return byName[name] != nil, nil
+	}, func(prefix string) ([]string, error) {
+		var names []string
+		for name := range byName {
+			if strings.HasPrefix(name, prefix) {
+				names = append(names, name)
+			}
+		}
+		return names, nil
+	})
+	if err != nil {
+		return err
+	}
+	err = appendReflogs(ctx, lockCtx, r.store, updates)
+	if err != nil {
+		return err
+	}
+
+	for _, update := range updates {
+		if ref := update.result(); ref != nil {
+			byName[update.Name] = ref
+		} else {
+			delete(byName, update.Name)
+		}
+	}
+
+	refs = refs[:0]
+	for _, ref := range byName {
+		refs = append(refs, ref)
+	}
+	sort.Slice(refs, func(i, j int) bool { return refs[i].Name < refs[j].Name })
+
+	err = r.store.Set(ctx, PackedRefsKey, serializePackedRefs(refs))
+	if err != nil {
+		for _, update := range updates {
+			update.Err = err
+		}
+	}
+	return err
+}
+
+// load reads the snapshot, returning its refs sorted by name.
+func (r *PackedRefStore) load(ctx context.Context) ([]*Ref, error) {
+	data, err := r.store.Get(ctx, PackedRefsKey)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return parsePackedRefs(data)
+}
+
+func parsePackedRefs(data []byte) ([]*Ref, error) {
+	var refs []*Ref
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" || line[0] == '#' || line[0] == '^' {
+			continue
+		}
+
+		if strings.HasPrefix(line, "ref: ") {
+			parts := strings.SplitN(strings.TrimPrefix(line, "ref: "), " ", 2)
+			if len(parts) != 2 {
+				return nil, errors.New("Invalid packed-refs line: " + line)
+			}
+			refs = append(refs, &Ref{Name: parts[1], Target: parts[0]})
+			continue
+		}
+
+		parts := strings.SplitN(line, " ", 2)
+		if len(parts) != 2 {
+			return nil, errors.New("Invalid packed-refs line: " + line)
+		}
+		refs = append(refs, &Ref{Name: parts[1], Hash: parts[0]})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	// snapshots written by other tools need not be sorted
+	if !sort.SliceIsSorted(refs, func(i, j int) bool { return refs[i].Name < refs[j].Name }) {
+		sort.Slice(refs, func(i, j int) bool { return refs[i].Name < refs[j].Name })
+	}
+	return refs, nil
+}
+
+func serializePackedRefs(refs []*Ref) []byte {
+	b := &bytes.Buffer{}
+	b.WriteString("# pack-refs with: sorted \n")
+	for _, ref := range refs {
+		if ref.Target != "" {
+			b.WriteString("ref: " + ref.Target + " " + ref.Name + "\n")
+		} else {
+			b.WriteString(ref.Hash + " " + ref.Name + "\n")
+		}
+	}
+	return b.Bytes()
+}
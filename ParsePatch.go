@@ -0,0 +1,419 @@
+package gitpacklib
+
+import (
+	"bytes"
+	"compress/zlib"
+	"errors"
+	"io/ioutil"
+	"strconv"
+	"strings"
+)
+
+// base85Alphabet is the alphabet of the base85 encoding used by git for
+// binary patches.
+const base85Alphabet = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz!#$%&()*+-;<=>?@^_`{|}~"
+
+// binaryHunk is the forward half of a "GIT binary patch": either the new
+// content itself, or a delta from the old content.
+type binaryHunk struct {
+	delta bool
+	data  []byte
+}
+
+// ParsePatch parses a patch in the format of git diff, such as the diffs of
+// a mail written by git format-patch. Anything before the first "diff --git"
+// line and after the last hunk is ignored.
+//
+// The hashes of the changes are as given on the patch's index lines, which
+// are usually abbreviated, and are empty if there are none. Copies are not
+// supported.
+func ParsePatch(data []byte) ([]*FilePatch, error) {
+	lines := splitLines(data)
+
+	var patches []*FilePatch
+	for len(lines) > 0 {
+		if !strings.HasPrefix(lines[0], "diff --git ") {
+			lines = lines[1:]
+			continue
+		}
+		patch, rest, err := parseFilePatch(lines)
+		if err != nil {
+			return nil, err
+		}
+		patches = append(patches, patch)
+		lines = rest
+	}
+	return patches, nil
+}
+
+// parseFilePatch parses the patch for a single file at the start of lines,
+// returning the lines that follow it.
+func parseFilePatch(lines []string) (*FilePatch, []string, error) {
+	header := strings.TrimRight(lines[0], "\n")
+	patch := &FilePatch{Change: &Change{Type: ChangeModified}}
+	oldPath, newPath := parseDiffGitNames(strings.TrimPrefix(header, "diff --git "))
+	lines = lines[1:]
+
+	var err error
+	parseMode := func(s string) uint32 {
+		mode, parseErr := strconv.ParseUint(s, 8, 32)
+		if parseErr != nil && err == nil {
+			err = errors.New("Invalid mode " + s + " in " + header)
+		}
+		return uint32(mode)
+	}
+
+	// the extended header lines, up to the content of the patch
+headers:
+	for len(lines) > 0 {
+		line := strings.TrimRight(lines[0], "\n")
+		switch {
+		case strings.HasPrefix(line, "old mode "):
+			patch.OldMode = parseMode(line[len("old mode "):])
+		case strings.HasPrefix(line, "new mode "):
+			patch.NewMode = parseMode(line[len("new mode "):])
+		case strings.HasPrefix(line, "deleted file mode "):
+			patch.Type = ChangeDeleted
+			patch.OldMode = parseMode(line[len("deleted file mode "):])
+		case strings.HasPrefix(line, "new file mode "):
+			patch.Type = ChangeAdded
+			patch.NewMode = parseMode(line[len("new file mode "):])
+		case strings.HasPrefix(line, "rename from "):
+			patch.Type = ChangeRenamed
+			oldPath = unquotePatchPath(line[len("rename from "):])
+		case strings.HasPrefix(line, "rename to "):
+			patch.Type = ChangeRenamed
+			newPath = unquotePatchPath(line[len("rename to "):])
+		case strings.HasPrefix(line, "similarity index "):
+			patch.Similarity, _ = strconv.Atoi(strings.TrimSuffix(line[len("similarity index "):], "%"))
+		case strings.HasPrefix(line, "dissimilarity index "):
+		case strings.HasPrefix(line, "copy from "), strings.HasPrefix(line, "copy to "):
+			return nil, nil, errors.New("Copied files are not supported: " + header)
+		case strings.HasPrefix(line, "index "):
+			fields := strings.Fields(line[len("index "):])
+			hashes := strings.SplitN(fields[0], "..", 2)
+			if len(hashes) != 2 {
+				return nil, nil, errors.New("Invalid index line in " + header)
+			}
+			patch.OldHash, patch.NewHash = hashes[0], hashes[1]
+			if len(fields) > 1 {
+				patch.OldMode = parseMode(fields[1])
+				patch.NewMode = patch.OldMode
+			}
+		case strings.HasPrefix(line, "--- "):
+			if name := parsePatchName(line[len("--- "):]); name != "" {
+				oldPath = name
+			}
+		case strings.HasPrefix(line, "+++ "):
+			if name := parsePatchName(line[len("+++ "):]); name != "" {
+				newPath = name
+			}
+		case strings.HasPrefix(line, "Binary files ") && strings.HasSuffix(line, " differ"):
+			patch.Binary = true
+		default:
+			break headers
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		lines = lines[1:]
+	}
+
+	switch patch.Type {
+	case ChangeAdded:
+		patch.NewPath = newPath
+	case ChangeDeleted:
+		patch.OldPath = oldPath
+	default:
+		patch.OldPath, patch.NewPath = oldPath, newPath
+	}
+	if patch.Type != ChangeAdded && patch.OldPath == "" || patch.Type != ChangeDeleted && patch.NewPath == "" {
+		return nil, nil, errors.New("No file name in " + header)
+	}
+
+	// the missing side of an added or deleted file is shown as zeros
+	switch patch.Type {
+	case ChangeAdded:
+		patch.OldHash = ""
+	case ChangeDeleted:
+		patch.NewHash = ""
+	}
+
+	if len(lines) > 0 && lines[0] == "GIT binary patch\n" {
+		patch.Binary = true
+		patch.binary, lines, err = parseBinaryHunk(lines[1:])
+		if err != nil {
+			return nil, nil, errors.New("Invalid binary patch for " + patch.Path() + ": " + err.Error())
+		}
+		return patch, lines, nil
+	}
+
+	for len(lines) > 0 && strings.HasPrefix(lines[0], "@@ -") {
+		var hunk *Hunk
+		hunk, lines, err = parseHunk(lines)
+		if err != nil {
+			return nil, nil, errors.New("Invalid patch for " + patch.Path() + ": " + err.Error())
+		}
+		patch.Hunks = append(patch.Hunks, hunk)
+	}
+	return patch, lines, nil
+}
+
+// parseHunk parses the hunk at the start of lines, returning the lines that
+// follow it.
+func parseHunk(lines []string) (*Hunk, []string, error) {
+	header := strings.TrimRight(lines[0], "\n")
+	parts := strings.SplitN(header, " @@", 2)
+	ranges := strings.Fields(strings.TrimPrefix(parts[0], "@@ "))
+	if len(parts) != 2 || len(ranges) != 2 || !strings.HasPrefix(ranges[0], "-") || !strings.HasPrefix(ranges[1], "+") {
+		return nil, nil, errors.New("Invalid hunk header " + header)
+	}
+
+	hunk := &Hunk{Header: strings.TrimPrefix(parts[1], " ")}
+	var err error
+	hunk.OldStart, hunk.OldLines, err = parseHunkRange(ranges[0][1:])
+	if err == nil {
+		hunk.NewStart, hunk.NewLines, err = parseHunkRange(ranges[1][1:])
+	}
+	if err != nil {
+		return nil, nil, errors.New("Invalid hunk header " + header)
+	}
+	lines = lines[1:]
+
+	oldLeft, newLeft := hunk.OldLines, hunk.NewLines
+	for oldLeft > 0 || newLeft > 0 {
+		if len(lines) == 0 {
+			return nil, nil, errors.New("Truncated hunk " + header)
+		}
+		line := lines[0]
+		op := line[0]
+		text := line[1:]
+		if line == "\n" {
+			// mail can lose the space of an empty context line
+			op, text = ' ', "\n"
+		}
+
+		switch op {
+		case ' ':
+			oldLeft--
+			newLeft--
+		case '-':
+			oldLeft--
+		case '+':
+			newLeft--
+		case '\\':
+			if err := stripLastNewline(hunk); err != nil {
+				return nil, nil, err
+			}
+			lines = lines[1:]
+			continue
+		default:
+			return nil, nil, errors.New("Truncated hunk " + header)
+		}
+		if oldLeft < 0 || newLeft < 0 {
+			return nil, nil, errors.New("Truncated hunk " + header)
+		}
+		hunk.Lines = append(hunk.Lines, DiffLine{Op: op, Text: text})
+		lines = lines[1:]
+	}
+
+	if len(lines) > 0 && strings.HasPrefix(lines[0], "\\") {
+		if err := stripLastNewline(hunk); err != nil {
+			return nil, nil, err
+		}
+		lines = lines[1:]
+	}
+	return hunk, lines, nil
+}
+
+// stripLastNewline handles a "\ No newline at end of file" line, which says
+// that the line before it has no newline.
+func stripLastNewline(hunk *Hunk) error {
+	if len(hunk.Lines) == 0 {
+		return errors.New("Misplaced \"No newline at end of file\" line")
+	}
+	last := &hunk.Lines[len(hunk.Lines)-1]
+	last.Text = strings.TrimSuffix(last.Text, "\n")
+	return nil
+}
+
+// parseHunkRange parses one side of a hunk header, where the number of lines
+// is left out if it is one.
+func parseHunkRange(s string) (int, int, error) {
+	parts := strings.SplitN(s, ",", 2)
+	start, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return 0, 0, err
+	}
+	count := 1
+	if len(parts) == 2 {
+		count, err = strconv.Atoi(parts[1])
+		if err != nil {
+			return 0, 0, err
+		}
+	}
+	if start < 0 || count < 0 {
+		return 0, 0, errors.New("Negative hunk range")
+	}
+	return start, count, nil
+}
+
+// parseBinaryHunk parses the "literal" or "delta" hunks of a binary patch,
+// keeping only the first, which applies the patch forwards.
+func parseBinaryHunk(lines []string) (*binaryHunk, []string, error) {
+	var hunks []*binaryHunk
+	for len(hunks) < 2 && len(lines) > 0 {
+		header := strings.TrimRight(lines[0], "\n")
+		hunk := &binaryHunk{}
+		var sizeText string
+		switch {
+		case strings.HasPrefix(header, "literal "):
+			sizeText = header[len("literal "):]
+		case strings.HasPrefix(header, "delta "):
+			hunk.delta = true
+			sizeText = header[len("delta "):]
+		}
+		size, err := strconv.Atoi(sizeText)
+		if err != nil {
+			if len(hunks) == 0 {
+				return nil, nil, errors.New("Invalid header " + header)
+			}
+			break
+		}
+		lines = lines[1:]
+
+		var compressed []byte
+		for len(lines) > 0 && lines[0] != "\n" {
+			data, err := decodeBase85Line(strings.TrimRight(lines[0], "\n"))
+			if err != nil {
+				return nil, nil, err
+			}
+			compressed = append(compressed, data...)
+			lines = lines[1:]
+		}
+		if len(lines) > 0 {
+			lines = lines[1:]
+		}
+
+		r, err := zlib.NewReader(bytes.NewReader(compressed))
+		if err != nil {
+			return nil, nil, err
+		}
+		hunk.data, err = ioutil.ReadAll(r)
+		if err != nil {
+			return nil, nil, err
+		}
+		if len(hunk.data) != size {
+			return nil, nil, errors.New("Wrong size of " + header)
+		}
+		hunks = append(hunks, hunk)
+	}
+	if len(hunks) == 0 {
+		return nil, nil, errors.New("No content")
+	}
+	return hunks[0], lines, nil
+}
+
+// decodeBase85Line decodes a line of a binary patch, whose first character
+// gives the number of bytes it holds: 'A' to 'Z' for 1 to 26, and 'a' to 'z'
+// for 27 to 52.
+func decodeBase85Line(line string) ([]byte, error) {
+	if line == "" {
+		return nil, errors.New("Empty line")
+	}
+	var size int
+	switch c := line[0]; {
+	case c >= 'A' && c <= 'Z':
+		size = int(c-'A') + 1
+	case c >= 'a' && c <= 'z':
+		size = int(c-'a') + 27
+	default:
+		return nil, errors.New("Invalid line length")
+	}
+	encoded := line[1:]
+	if len(encoded) != (size+3)/4*5 {
+		return nil, errors.New("Invalid line length")
+	}
+
+	data := make([]byte, 0, len(encoded)/5*4)
+	for i := 0; i < len(encoded); i += 5 {
+		var value uint64
+		for _, c := range []byte(encoded[i : i+5]) {
+			digit := strings.IndexByte(base85Alphabet, c)
+			if digit < 0 {
+				return nil, errors.New("Invalid base85 character")
+			}
+			value = value*85 + uint64(digit)
+		}
+		if value > 0xffffffff {
+			return nil, errors.New("Invalid base85 data")
+		}
+		data = append(data, byte(value>>24), byte(value>>16), byte(value>>8), byte(value))
+	}
+	return data[:size], nil
+}
+
+// parseDiffGitNames finds the old and new paths in the rest of a
+// "diff --git" line. Unquoted paths that contain spaces can only be told
+// apart when both are the same, which is enough since renames also have
+// "rename from" and "rename to" lines.
+func parseDiffGitNames(names string) (string, string) {
+	if strings.HasPrefix(names, "\"") {
+		quoted, err := strconv.QuotedPrefix(names)
+		if err != nil {
+			return "", ""
+		}
+		return stripPatchPrefix(unquotePatchPath(quoted)), stripPatchPrefix(unquotePatchPath(strings.TrimSpace(names[len(quoted):])))
+	}
+	if n := strings.Index(names, " \""); n >= 0 {
+		return stripPatchPrefix(names[:n]), stripPatchPrefix(unquotePatchPath(names[n+1:]))
+	}
+
+	// "a/<name> b/<name>"
+	if len(names)%2 == 1 {
+		half := len(names) / 2
+		oldPath, newPath := stripPatchPrefix(names[:half]), stripPatchPrefix(names[half+1:])
+		if names[half] == ' ' && oldPath == newPath {
+			return oldPath, newPath
+		}
+	}
+	if parts := strings.Fields(names); len(parts) == 2 {
+		return stripPatchPrefix(parts[0]), stripPatchPrefix(parts[1])
+	}
+	return "", ""
+}
+
+// parsePatchName parses the name on a "---" or "+++" line, which is empty for
+// /dev/null.
+func parsePatchName(name string) string {
+	if !strings.HasPrefix(name, "\"") {
+		// some diff programs put a timestamp after a tab
+		name = strings.SplitN(name, "\t", 2)[0]
+	}
+	name = unquotePatchPath(strings.TrimSpace(name))
+	if name == "/dev/null" {
+		return ""
+	}
+	return stripPatchPrefix(name)
+}
+
+// unquotePatchPath undoes quotePath.
+func unquotePatchPath(name string) string {
+	if !strings.HasPrefix(name, "\"") {
+		return name
+	}
+	unquoted, err := strconv.Unquote(name)
+	if err != nil {
+		return name
+	}
+	return unquoted
+}
+
+// stripPatchPrefix removes the "a/" or "b/" git puts in front of the paths of
+// a patch.
+func stripPatchPrefix(name string) string {
+	if n := strings.IndexByte(name, '/'); n >= 0 {
+		return name[n+1:]
+	}
+	return name
+}
@@ -0,0 +1,354 @@
+package gitpacklib
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// DefaultContextLines is the number of unchanged lines git shows around each
+// change in a patch.
+const DefaultContextLines = 3
+
+// binaryCheckSize is how much of a file is searched for a NUL byte to decide
+// whether it is binary, as in git.
+const binaryCheckSize = 8000
+
+// maxHunkHeaderLength limits the function name shown after a hunk's line
+// numbers.
+const maxHunkHeaderLength = 80
+
+// FilePatch is the content diff for a single Change.
+type FilePatch struct {
+	*Change
+
+	// Binary is set if either side of the change is binary, in which case
+	// there are no Hunks.
+	Binary bool
+	Hunks  []*Hunk
+
+	// binary is the content of a binary patch parsed by ParsePatch, if it
+	// had any.
+	binary *binaryHunk
+}
+
+// Hunk is a run of changed lines along with their surrounding context.
+// Starts are 1-based line numbers, as in a unified diff.
+type Hunk struct {
+	OldStart int
+	OldLines int
+	NewStart int
+	NewLines int
+
+	// Header is the nearest line before the hunk that looks like the start
+	// of a function, shown after the line numbers.
+	Header string
+	Lines  []DiffLine
+}
+
+// DiffLine is a single line of a hunk. Op is ' ' for context, '-' for a
+// removed line and '+' for an added one. Text includes the line's newline,
+// unless it is the last line of a file without one.
+type DiffLine struct {
+	Op   byte
+	Text string
+}
+
+// DiffFile computes the line changes for change, with contextLines lines of
+// context around each hunk.
+func (repo *Repository) DiffFile(ctx context.Context, change *Change, contextLines int) (*FilePatch, error) {
+	patch := &FilePatch{Change: change}
+
+	oldData, err := repo.readDiffContent(ctx, change.OldHash, change.OldMode)
+	if err != nil {
+		return nil, err
+	}
+	newData, err := repo.readDiffContent(ctx, change.NewHash, change.NewMode)
+	if err != nil {
+		return nil, err
+	}
+
+	if isBinary(oldData) || isBinary(newData) {
+		patch.Binary = !bytes.Equal(oldData, newData)
+		return patch, nil
+	}
+
+	oldLines := splitLines(oldData)
+	newLines := splitLines(newData)
+	patch.Hunks = makeHunks(oldLines, newLines, diffLines(oldLines, newLines), contextLines)
+	return patch, nil
+}
+
+// readDiffContent returns the content shown for one side of a change. A
+// submodule is shown as the commit it points at.
+func (repo *Repository) readDiffContent(ctx context.Context, sha string, mode uint32) ([]byte, error) {
+	if sha == "" {
+		return nil, nil
+	}
+	if modeKind(mode) == modeKind(ModeSubmodule) {
+		return []byte("Subproject commit " + sha + "\n"), nil
+	}
+	_, data, err := repo.ReadRawObject(ctx, sha)
+	return data, err
+}
+
+func isBinary(data []byte) bool {
+	if len(data) > binaryCheckSize {
+		data = data[:binaryCheckSize]
+	}
+	return bytes.IndexByte(data, 0) >= 0
+}
+
+// makeHunks groups edits into hunks, merging changes that are close enough
+// for their context to touch.
+func makeHunks(oldLines []string, newLines []string, edits []lineEdit, contextLines int) []*Hunk {
+	if contextLines < 0 {
+		contextLines = 0
+	}
+
+	var hunks []*Hunk
+	for i := 0; i < len(edits); {
+		for i < len(edits) && edits[i].op == diffEqual {
+			i++
+		}
+		if i == len(edits) {
+			break
+		}
+
+		start := i - contextLines
+		if start < 0 {
+			start = 0
+		}
+		end := i
+		for {
+			for end < len(edits) && edits[end].op != diffEqual {
+				end++
+			}
+			next := end
+			for next < len(edits) && edits[next].op == diffEqual {
+				next++
+			}
+			if next == len(edits) || next-end > 2*contextLines {
+				break
+			}
+			end = next
+		}
+		stop := end + contextLines
+		if stop > len(edits) {
+			stop = len(edits)
+		}
+
+		hunk := &Hunk{}
+		for _, edit := range edits[start:stop] {
+			switch edit.op {
+			case diffEqual:
+				hunk.Lines = append(hunk.Lines, DiffLine{' ', oldLines[edit.oldLine]})
+				hunk.OldLines++
+				hunk.NewLines++
+			case diffDelete:
+				hunk.Lines = append(hunk.Lines, DiffLine{'-', oldLines[edit.oldLine]})
+				hunk.OldLines++
+			case diffInsert:
+				hunk.Lines = append(hunk.Lines, DiffLine{'+', newLines[edit.newLine]})
+				hunk.NewLines++
+			}
+		}
+
+		// an empty side is numbered by the line before it, as in git
+		first := edits[start]
+		hunk.OldStart, hunk.NewStart = first.oldLine, first.newLine
+		if hunk.OldLines > 0 {
+			hunk.OldStart++
+		}
+		if hunk.NewLines > 0 {
+			hunk.NewStart++
+		}
+		hunk.Header = hunkHeader(oldLines, first.oldLine-1)
+
+		hunks = append(hunks, hunk)
+		i = stop
+	}
+	return hunks
+}
+
+// hunkHeader looks back from line for one that starts with a letter, '_' or
+// '$', which is git's default guess at a function definition.
+func hunkHeader(lines []string, line int) string {
+	for ; line >= 0; line-- {
+		text := lines[line]
+		if text == "" {
+			continue
+		}
+		c := text[0]
+		if c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c == '_' || c == '$' {
+			if len(text) > maxHunkHeaderLength {
+				text = text[:maxHunkHeaderLength]
+			}
+			return strings.TrimRight(text, " \t\r\n")
+		}
+	}
+	return ""
+}
+
+// WritePatch writes changes as a patch in the format of git diff, which git
+// apply accepts.
+func (repo *Repository) WritePatch(ctx context.Context, out io.Writer, changes []*Change, contextLines int) error {
+	for _, change := range changes {
+		// git shows a change of type as a deletion followed by an addition
+		parts := []*Change{change}
+		if change.Type == ChangeTypeChanged {
+			parts = []*Change{
+				{Type: ChangeDeleted, OldPath: change.OldPath, OldMode: change.OldMode, OldHash: change.OldHash},
+				{Type: ChangeAdded, NewPath: change.NewPath, NewMode: change.NewMode, NewHash: change.NewHash},
+			}
+		}
+
+		for _, part := range parts {
+			patch, err := repo.DiffFile(ctx, part, contextLines)
+			if err != nil {
+				return err
+			}
+			if _, err := out.Write(patch.Format()); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Format returns the patch in the format of git diff.
+func (patch *FilePatch) Format() []byte {
+	b := &bytes.Buffer{}
+
+	oldPath, newPath := patch.OldPath, patch.NewPath
+	if oldPath == "" {
+		oldPath = newPath
+	}
+	if newPath == "" {
+		newPath = oldPath
+	}
+	fmt.Fprintf(b, "diff --git %s %s\n", quotePath("a/"+oldPath), quotePath("b/"+newPath))
+
+	switch patch.Type {
+	case ChangeAdded:
+		fmt.Fprintf(b, "new file mode %06o\n", patch.NewMode)
+	case ChangeDeleted:
+		fmt.Fprintf(b, "deleted file mode %06o\n", patch.OldMode)
+	default:
+		if patch.OldMode != patch.NewMode {
+			fmt.Fprintf(b, "old mode %06o\nnew mode %06o\n", patch.OldMode, patch.NewMode)
+		}
+	}
+	if patch.Type == ChangeRenamed {
+		fmt.Fprintf(b, "similarity index %d%%\n", patch.Similarity)
+		fmt.Fprintf(b, "rename from %s\nrename to %s\n", quotePath(patch.OldPath), quotePath(patch.NewPath))
+	}
+
+	if patch.OldHash != patch.NewHash {
+		fmt.Fprintf(b, "index %s..%s", abbrevSha(patch.OldHash), abbrevSha(patch.NewHash))
+		if patch.OldMode == patch.NewMode {
+			fmt.Fprintf(b, " %06o", patch.OldMode)
+		}
+		b.WriteString("\n")
+	}
+
+	if !patch.Binary && len(patch.Hunks) == 0 {
+		return b.Bytes()
+	}
+
+	oldName, newName := quotePath("a/"+oldPath), quotePath("b/"+newPath)
+	if patch.Type == ChangeAdded {
+		oldName = "/dev/null"
+	}
+	if patch.Type == ChangeDeleted {
+		newName = "/dev/null"
+	}
+
+	if patch.Binary {
+		fmt.Fprintf(b, "Binary files %s and %s differ\n", oldName, newName)
+		return b.Bytes()
+	}
+
+	fmt.Fprintf(b, "--- %s\n+++ %s\n", oldName, newName)
+	for _, hunk := range patch.Hunks {
+		fmt.Fprintf(b, "@@ -%s +%s @@", hunkRange(hunk.OldStart, hunk.OldLines), hunkRange(hunk.NewStart, hunk.NewLines))
+		if hunk.Header != "" {
+			b.WriteString(" " + hunk.Header)
+		}
+		b.WriteString("\n")
+
+		for _, line := range hunk.Lines {
+			b.WriteByte(line.Op)
+			b.WriteString(line.Text)
+			if !strings.HasSuffix(line.Text, "\n") {
+				b.WriteString("\n\\ No newline at end of file\n")
+			}
+		}
+	}
+	return b.Bytes()
+}
+
+func hunkRange(start int, lines int) string {
+	if lines == 1 {
+		return fmt.Sprint(start)
+	}
+	return fmt.Sprintf("%d,%d", start, lines)
+}
+
+// abbrevSha shortens a sha for display, showing a missing object as zeros.
+func abbrevSha(sha string) string {
+	if sha == "" {
+		sha = zeroSha
+	}
+	return sha[:7]
+}
+
+// quotePath quotes a path the way git does if it contains characters that
+// are special or not printable ASCII.
+func quotePath(name string) string {
+	needsQuote := false
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		if c < 0x20 || c >= 0x7f || c == '"' || c == '\\' {
+			needsQuote = true
+			break
+		}
+	}
+	if !needsQuote {
+		return name
+	}
+
+	b := &strings.Builder{}
+	b.WriteByte('"')
+	for i := 0; i < len(name); i++ {
+		switch c := name[i]; c {
+		case '"', '\\':
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		case '\a':
+			b.WriteString(`\a`)
+		case '\b':
+			b.WriteString(`\b`)
+		case '\t':
+			b.WriteString(`\t`)
+		case '\n':
+			b.WriteString(`\n`)
+		case '\v':
+			b.WriteString(`\v`)
+		case '\f':
+			b.WriteString(`\f`)
+		case '\r':
+			b.WriteString(`\r`)
+		default:
+			if c < 0x20 || c >= 0x7f {
+				fmt.Fprintf(b, "\\%03o", c)
+			} else {
+				b.WriteByte(c)
+			}
+		}
+	}
+	b.WriteByte('"')
+	return b.String()
+}
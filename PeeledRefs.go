@@ -0,0 +1,95 @@
+package gitpacklib
+
+import (
+	"context"
+	"errors"
+	"os"
+)
+
+// peeledKeyPrefix is prepended to the sha of an annotated tag to give the
+// backing store key caching the sha of the object it ultimately points at.
+// Objects found not to be tags, such as those of lightweight tags, are cached
+// as peeling to themselves.
+const peeledKeyPrefix = "peeled/"
+
+// maxTagDepth bounds how many tags pointing at tags are followed when peeling.
+const maxTagDepth = 32
+
+// cachePeeledTag records what the tag with the given sha and content peels
+// to. Tags pointing at other tags are followed if those are stored already,
+// and are otherwise left to be peeled when first asked for.
+func cachePeeledTag(ctx context.Context, store BackingStore, packs *packCache, sha string, data []byte) error {
+	tag, err := ParseTag(data)
+	if err != nil {
+		return err
+	}
+
+	target := tag.Object
+	if tag.ObjectType == TagObject {
+		target, err = peelObject(ctx, store, packs, target)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return store.Set(ctx, peeledKeyPrefix+sha, []byte(target))
+}
+
+// peelObject returns the sha of the first object that is not an annotated
+// tag, following the chain of tags starting at sha. An object that is not a
+// tag peels to itself. Objects are read through packs.
+func peelObject(ctx context.Context, store BackingStore, packs *packCache, sha string) (string, error) {
+	peeled, cached, err := followTags(ctx, store, packs, sha)
+	if err != nil {
+		return "", err
+	}
+
+	if !cached {
+		// cache objects that were peeled the long way for next time
+		store.Set(ctx, peeledKeyPrefix+sha, []byte(peeled))
+	}
+	return peeled, nil
+}
+
+// followTags peels sha, reporting whether it was already cached.
+func followTags(ctx context.Context, store BackingStore, packs *packCache, sha string) (string, bool, error) {
+	for depth := 0; depth < maxTagDepth; depth++ {
+		peeled, err := store.Get(ctx, peeledKeyPrefix+sha)
+		if err == nil {
+			return string(peeled), depth == 0, nil
+		}
+		if !os.IsNotExist(err) {
+			return "", false, err
+		}
+
+		objType, data, err := loadCachedObject(ctx, store, packs, sha)
+		if err != nil {
+			return "", false, err
+		}
+		if objType != TagObject {
+			return sha, false, nil
+		}
+
+		tag, err := ParseTag(data)
+		if err != nil {
+			return "", false, err
+		}
+		sha = tag.Object
+	}
+	return "", false, errors.New("Chain of tags is too deep")
+}
+
+// PeelRef returns the sha of the object the named ref ultimately points at,
+// following symbolic refs and then annotated tags, so that a tag ref gives
+// the commit it was made from. It returns the empty string if the ref does
+// not exist.
+func PeelRef(ctx context.Context, store BackingStore, refs RefStore, name string) (string, error) {
+	ref, err := ResolveRef(ctx, refs, name)
+	if err != nil || ref.Hash == "" {
+		return "", err
+	}
+	return peelObject(ctx, store, newPackCache(), ref.Hash)
+}
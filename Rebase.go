@@ -0,0 +1,414 @@
+package gitpacklib
+
+import (
+	"context"
+	"errors"
+	"strings"
+)
+
+// ReplayResult is the outcome of copying commits onto a new base with
+// CherryPick or Rebase.
+type ReplayResult struct {
+	// Commit is the commit the ref was moved to.
+	Commit string
+
+	// Commits maps each commit replayed to its copy, or to the empty string
+	// if it was left out because its changes were already there.
+	Commits map[string]string
+
+	// Failed is the commit that could not be replayed because of Conflicts,
+	// in which case nothing is changed.
+	Failed    string
+	Conflicts []*MergeConflict
+}
+
+// CherryPickRequest describes commits to be copied onto a branch by
+// CherryPick.
+type CherryPickRequest struct {
+	// Ref is the ref to copy the commits onto, such as "refs/heads/main".
+	// Symbolic refs such as HEAD are followed.
+	Ref string
+
+	// Parent is the commit Ref must still point at for it to be updated. If
+	// empty, the commits are copied onto whatever Ref points at.
+	Parent string
+
+	// Revisions are the commits to copy, as given to git cherry-pick. Named
+	// commits are copied in the order given, but if any of the revisions is
+	// a range, such as "refs/heads/main..refs/heads/feature", every commit in
+	// it is copied, oldest first.
+	Revisions []string
+
+	// Committer of the copies, which keep the author of each commit. A zero
+	// When is filled in with the current time.
+	Committer *Signature
+
+	// Identity is recorded as who updated the ref in its reflog. If empty,
+	// the committer's name and email are used.
+	Identity string
+}
+
+// CherryPick copies the changes made by each of req.Revisions onto req.Ref
+// as new commits, and moves the ref to the last of them. This is also how a
+// "rebase and merge" is made. Merge commits can not be copied.
+//
+// If a commit conflicts, nothing is changed and ErrMergeConflict is returned
+// along with a result saying which commit failed. Commits whose changes are
+// already on the branch are left out. The ref is updated with a
+// compare-and-swap, as by CreateCommit.
+func (repo *Repository) CherryPick(ctx context.Context, req *CherryPickRequest) (*ReplayResult, error) {
+	ref, err := repo.resolveCommitRef(ctx, req.Ref)
+	if err != nil {
+		return nil, err
+	}
+	onto := req.Parent
+	if onto == "" {
+		onto = ref.Hash
+	}
+	if onto == "" {
+		return nil, errors.New("Can not cherry-pick onto " + ref.Name + ": " + ErrRefNotFound.Error())
+	}
+
+	commits, err := repo.cherryPickCommits(ctx, req.Revisions)
+	if err != nil {
+		return nil, err
+	}
+
+	result, err := repo.replay(ctx, onto, commits, req.Committer, ref.Name, false)
+	if err != nil || result.Commit == onto {
+		return result, err
+	}
+
+	identity := req.Identity
+	if identity == "" {
+		identity = signatureIdentity(req.Committer)
+	}
+	message := "cherry-pick: " + ref.Name
+	if len(commits) == 1 {
+		commit, err := repo.ReadCommit(ctx, commits[0])
+		if err != nil {
+			return nil, err
+		}
+		message = "cherry-pick: " + commit.Subject()
+	}
+	err = repo.moveRef(ctx, ref.Name, onto, result.Commit, identity, message)
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// cherryPickCommits lists the commits named by revs, oldest first.
+func (repo *Repository) cherryPickCommits(ctx context.Context, revs []string) ([]string, error) {
+	isRange := false
+	for _, rev := range revs {
+		if strings.Contains(rev, "..") || strings.HasPrefix(rev, "^") || rev == "--not" {
+			isRange = true
+		}
+	}
+
+	if !isRange {
+		var commits []string
+		for _, rev := range revs {
+			sha, err := repo.ResolveRevision(ctx, rev)
+			if err != nil {
+				return nil, err
+			}
+			sha, err = repo.peelRevision(ctx, sha, CommitObject)
+			if err != nil {
+				return nil, err
+			}
+			commits = append(commits, sha)
+		}
+		return commits, nil
+	}
+
+	walk := repo.NewRevWalk()
+	walk.Order = WalkOrderTopo
+	if err := walk.AddRevisions(ctx, revs...); err != nil {
+		return nil, err
+	}
+	return walkOldestFirst(ctx, walk)
+}
+
+// RebaseRequest describes a branch to be rebased by Rebase.
+type RebaseRequest struct {
+	// Ref is the branch to rebase, such as "refs/heads/feature". Symbolic
+	// refs such as HEAD are followed.
+	Ref string
+
+	// Onto is the revision to copy the commits of the branch onto, such as
+	// "refs/heads/main".
+	Onto string
+
+	// Upstream limits the commits copied to those not in it, and defaults
+	// to Onto.
+	Upstream string
+
+	// Parent is the commit Ref must still point at for it to be updated. If
+	// empty, whatever Ref points at is rebased.
+	Parent string
+
+	// Committer of the copies, which keep the author of each commit. A zero
+	// When is filled in with the current time.
+	Committer *Signature
+
+	// Identity is recorded as who updated the ref in its reflog. If empty,
+	// the committer's name and email are used.
+	Identity string
+}
+
+// Rebase copies the commits of req.Ref that are not in req.Upstream onto
+// req.Onto, and moves the ref to the copy of the last of them, like git
+// rebase. Merge commits are left out, as are commits whose changes are
+// already in Onto. Commits that would be copied unchanged, because they are
+// already on top of Onto, are kept as they are.
+//
+// Conflicts are reported as by CherryPick, and the ref is updated with a
+// compare-and-swap, as by CreateCommit.
+func (repo *Repository) Rebase(ctx context.Context, req *RebaseRequest) (*ReplayResult, error) {
+	ref, err := repo.resolveCommitRef(ctx, req.Ref)
+	if err != nil {
+		return nil, err
+	}
+	head := req.Parent
+	if head == "" {
+		head = ref.Hash
+	}
+	if head == "" {
+		return nil, errors.New("Can not rebase " + ref.Name + ": " + ErrRefNotFound.Error())
+	}
+
+	onto, err := repo.ResolveRevision(ctx, req.Onto)
+	if err != nil {
+		return nil, err
+	}
+	onto, err = repo.peelRevision(ctx, onto, CommitObject)
+	if err != nil {
+		return nil, err
+	}
+
+	upstream := req.Upstream
+	if upstream == "" {
+		upstream = onto
+	}
+	walk := repo.NewRevWalk()
+	walk.Order = WalkOrderTopo
+	if err := walk.Include(ctx, head); err != nil {
+		return nil, err
+	}
+	if err := walk.Exclude(ctx, upstream); err != nil {
+		return nil, err
+	}
+	commits, err := walkOldestFirst(ctx, walk)
+	if err != nil {
+		return nil, err
+	}
+
+	result, err := repo.replay(ctx, onto, commits, req.Committer, req.Onto, true)
+	if err != nil || result.Commit == head {
+		return result, err
+	}
+
+	identity := req.Identity
+	if identity == "" {
+		identity = signatureIdentity(req.Committer)
+	}
+	err = repo.moveRef(ctx, ref.Name, head, result.Commit, identity, "rebase (finish): "+ref.Name+" onto "+onto)
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// SquashRequest describes a "squash and merge" to be made by Squash.
+type SquashRequest struct {
+	// Ref is the ref to merge into, such as "refs/heads/main". Symbolic refs
+	// such as HEAD are followed.
+	Ref string
+
+	// Theirs is the revision whose changes are squashed into Ref, such as
+	// "refs/heads/feature".
+	Theirs string
+
+	// Parent is the commit Ref must still point at for it to be updated. If
+	// empty, whatever Ref points at is merged into.
+	Parent string
+
+	// Author of the commit. If Committer is nil, the author is used. A zero
+	// When is filled in with the current time.
+	Author    *Signature
+	Committer *Signature
+
+	// Message defaults to the messages of the squashed commits, oldest
+	// first.
+	Message string
+
+	// Identity is recorded as who updated the ref in its reflog. If empty,
+	// the committer's name and email are used.
+	Identity string
+
+	Options *MergeOptions
+}
+
+// Squash merges the changes of req.Theirs into req.Ref as a single commit
+// whose only parent is the commit Ref pointed at, like git merge --squash.
+// Conflicts and errors are reported as by Merge, and if the changes are
+// already in Ref, ErrNothingToCommit is returned.
+func (repo *Repository) Squash(ctx context.Context, req *SquashRequest) (*MergeResult, error) {
+	ref, ours, theirs, err := repo.resolveMerge(ctx, req.Ref, req.Parent, req.Theirs)
+	if err != nil {
+		return nil, err
+	}
+
+	result, err := repo.MergeCommits(ctx, ours, theirs, mergeLabels(ref.Name, req.Theirs, req.Options))
+	if err != nil {
+		return nil, err
+	}
+	if len(result.Conflicts) > 0 {
+		return result, ErrMergeConflict
+	}
+	oursCommit, err := repo.ReadCommit(ctx, ours)
+	if err != nil {
+		return nil, err
+	}
+	if result.Tree == oursCommit.Tree {
+		return nil, ErrNothingToCommit
+	}
+
+	message := req.Message
+	if message == "" {
+		message, err = repo.squashMessage(ctx, ours, theirs)
+		if err != nil {
+			return nil, err
+		}
+	}
+	result.Commit, err = repo.commitToRef(ctx, ref.Name, ours, &commitDetails{
+		tree:      result.Tree,
+		parents:   []string{ours},
+		author:    req.Author,
+		committer: req.Committer,
+		message:   message,
+		identity:  req.Identity,
+		action:    "squash",
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// squashMessage joins the messages of the commits in theirs but not ours,
+// oldest first.
+func (repo *Repository) squashMessage(ctx context.Context, ours string, theirs string) (string, error) {
+	walk := repo.NewRevWalk()
+	walk.Order = WalkOrderTopo
+	if err := walk.Include(ctx, theirs); err != nil {
+		return "", err
+	}
+	if err := walk.Exclude(ctx, ours); err != nil {
+		return "", err
+	}
+
+	var messages []string
+	err := walk.Walk(ctx, func(sha string, commit *Commit) error {
+		messages = append([]string{commit.Message}, messages...)
+		return nil
+	})
+	return strings.Join(messages, "\n"), err
+}
+
+// walkOldestFirst lists the commits of a walk, oldest first.
+func walkOldestFirst(ctx context.Context, walk *RevWalk) ([]string, error) {
+	var commits []string
+	err := walk.Walk(ctx, func(sha string, commit *Commit) error {
+		commits = append(commits, sha)
+		return nil
+	})
+	for i, j := 0, len(commits)-1; i < j; i, j = i+1, j-1 {
+		commits[i], commits[j] = commits[j], commits[i]
+	}
+	return commits, err
+}
+
+// replay copies the changes of each commit onto onto in turn, storing the new
+// commits. Merge commits are skipped if skipMerges is set, and otherwise are
+// an error. ontoLabel names onto in conflict markers.
+func (repo *Repository) replay(ctx context.Context, onto string, commits []string, committer *Signature, ontoLabel string, skipMerges bool) (*ReplayResult, error) {
+	if committer == nil {
+		return nil, errors.New("Copied commits need a committer")
+	}
+
+	head := onto
+	headCommit, err := repo.ReadCommit(ctx, onto)
+	if err != nil {
+		return nil, err
+	}
+	headTree := headCommit.Tree
+
+	result := &ReplayResult{Commits: map[string]string{}}
+	for _, sha := range commits {
+		commit, err := repo.ReadCommit(ctx, sha)
+		if err != nil {
+			return nil, err
+		}
+		if len(commit.Parents) > 1 {
+			if skipMerges {
+				continue
+			}
+			return nil, errors.New("Commit " + sha + " is a merge")
+		}
+
+		// a commit already on top of what it would be copied onto is kept
+		if len(commit.Parents) == 1 && commit.Parents[0] == head {
+			result.Commits[sha] = sha
+			head, headTree = sha, commit.Tree
+			continue
+		}
+
+		baseTree := ""
+		if len(commit.Parents) == 1 {
+			parent, err := repo.ReadCommit(ctx, commit.Parents[0])
+			if err != nil {
+				return nil, err
+			}
+			baseTree = parent.Tree
+		}
+
+		merged, err := repo.MergeTrees(ctx, baseTree, headTree, commit.Tree, &MergeOptions{
+			OursLabel:   ontoLabel,
+			TheirsLabel: abbrevSha(sha) + " (" + commit.Subject() + ")",
+		})
+		if err != nil {
+			return nil, err
+		}
+		if len(merged.Conflicts) > 0 {
+			result.Failed = sha
+			result.Conflicts = merged.Conflicts
+			return result, ErrMergeConflict
+		}
+
+		// leave out commits whose changes are already there, but not those
+		// that never changed anything
+		if merged.Tree == headTree && commit.Tree != baseTree {
+			result.Commits[sha] = ""
+			continue
+		}
+
+		copied, _, err := repo.writeCommit(ctx, &commitDetails{
+			tree:      merged.Tree,
+			parents:   []string{head},
+			author:    commit.Author,
+			committer: committer,
+			message:   commit.Message,
+		})
+		if err != nil {
+			return nil, err
+		}
+		result.Commits[sha] = copied
+		head, headTree = copied, merged.Tree
+	}
+
+	result.Commit = head
+	return result, nil
+}
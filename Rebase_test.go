@@ -0,0 +1,326 @@
+package gitpacklib
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+// rebaseTestRepository makes a git repository with a branch feature made of
+// a change, a commit already made on main, a merge of side and another
+// change, and a branch conflict whose change conflicts with main. It copies
+// its objects and branches into a repository, and returns both with the
+// shas of the commits by name.
+func rebaseTestRepository(t *testing.T) (*Repository, string, map[string]string) {
+	ctx := context.Background()
+	dir := newGitRepository(t)
+	commits := map[string]string{}
+	commit := func(branch string, name string, files map[string][]byte) {
+		runGit(t, dir, "checkout", "-q", branch)
+		writeFiles(t, dir, files)
+		commits[name] = gitCommit(t, dir, name)
+	}
+
+	writeFiles(t, dir, map[string][]byte{"a.txt": numberedLines(30, nil), "b.txt": []byte("b\n")})
+	commits["base"] = gitCommit(t, dir, "base")
+	for _, branch := range []string{"feature", "side", "conflict"} {
+		runGit(t, dir, "branch", branch)
+	}
+	commit("main", "m1", map[string][]byte{"a.txt": numberedLines(30, map[int]string{15: "m1"}), "c.txt": []byte("c\n")})
+	commit("feature", "f1", map[string][]byte{"a.txt": numberedLines(30, map[int]string{5: "f1"})})
+	commit("feature", "f2", map[string][]byte{"c.txt": []byte("c\n")})
+	commit("side", "s1", map[string][]byte{"b.txt": []byte("side\n")})
+	runGit(t, dir, "checkout", "-q", "feature")
+	runGit(t, dir, "merge", "-q", "--no-ff", "-m", "merge side", "side")
+	commits["merge"] = gitRevParse(t, dir, "HEAD")
+	commit("feature", "f3", map[string][]byte{"a.txt": numberedLines(30, map[int]string{5: "f1", 25: "f3"})})
+	commit("conflict", "k1", map[string][]byte{"a.txt": numberedLines(30, map[int]string{15: "k1"})})
+	runGit(t, dir, "checkout", "-q", "main")
+
+	repo := newTestRepository(t)
+	importGitObjects(t, repo, dir)
+	var updates []*RefUpdate
+	for _, line := range strings.Split(strings.TrimSpace(string(runGit(t, dir, "for-each-ref", "--format=%(objectname) %(refname)"))), "\n") {
+		fields := strings.Fields(line)
+		updates = append(updates, &RefUpdate{Name: fields[1], NewHash: fields[0]})
+	}
+	if err := repo.RefStore().Update(ctx, updates); err != nil {
+		t.Fatal(err)
+	}
+	return repo, dir, commits
+}
+
+var replayCommitter = &Signature{Name: "C O Mitter", Email: "committer@example.com", When: time.Unix(1700000000, 0).UTC()}
+
+// lastReflogEntry describes the newest reflog entry of the named ref.
+func lastReflogEntry(t *testing.T, repo *Repository, name string) string {
+	entries, err := ReadReflog(context.Background(), repo.store, name)
+	if err != nil || len(entries) == 0 {
+		t.Fatalf("Reflog of %s is %v: %v", name, entries, err)
+	}
+	return entries[0].OldHash + ".." + entries[0].NewHash + " " + entries[0].Identity + " " + entries[0].Message
+}
+
+// subjects lists the subjects of the commits in head but not base, oldest
+// first.
+func subjects(t *testing.T, repo *Repository, base string, head string) []string {
+	ctx := context.Background()
+	walk := repo.NewRevWalk()
+	walk.Order = WalkOrderTopo
+	if err := walk.AddRevisions(ctx, head, "^"+base); err != nil {
+		t.Fatal(err)
+	}
+	var subjects []string
+	err := walk.Walk(ctx, func(sha string, commit *Commit) error {
+		subjects = append([]string{commit.Subject()}, subjects...)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return subjects
+}
+
+func TestRebaseMatchesGit(t *testing.T) {
+	ctx := context.Background()
+	repo, dir, commits := rebaseTestRepository(t)
+	main := commits["m1"]
+
+	result, err := repo.Rebase(ctx, &RebaseRequest{Ref: "refs/heads/feature", Onto: "refs/heads/main", Committer: replayCommitter, Identity: "tester"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	runGit(t, dir, "rebase", "-q", "main", "feature")
+
+	// git also leaves out the merge and f2, whose change is already on main
+	tree, err := repo.ResolveRevision(ctx, result.Commit+"^{tree}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := gitRevParse(t, dir, "feature^{tree}"); tree != want {
+		t.Errorf("Rebase gave tree %s, git has %s", tree, want)
+	}
+	want := strings.Fields(string(runGit(t, dir, "log", "--reverse", "--format=%s", "main..feature")))
+	if got := subjects(t, repo, main, result.Commit); strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Errorf("Rebase copied %v, git copied %v", got, want)
+	}
+	if _, ok := result.Commits[commits["merge"]]; ok {
+		t.Errorf("Rebase replayed the merge")
+	}
+	if copied, ok := result.Commits[commits["f2"]]; !ok || copied != "" {
+		t.Errorf("f2 was copied to %q, want it left out", copied)
+	}
+	copied, err := repo.ReadCommit(ctx, result.Commits[commits["f3"]])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if copied.Author.Name != "A U Thor" || copied.Committer.Name != replayCommitter.Name {
+		t.Errorf("Copy of f3 is by %s, committed by %s", copied.Author.Name, copied.Committer.Name)
+	}
+
+	if sha, err := repo.ResolveRef(ctx, "refs/heads/feature"); err != nil || sha != result.Commit {
+		t.Errorf("feature is at %s, want %s: %v", sha, result.Commit, err)
+	}
+	if entry, want := lastReflogEntry(t, repo, "refs/heads/feature"), commits["f3"]+".."+result.Commit+" tester rebase (finish): refs/heads/feature onto "+main; entry != want {
+		t.Errorf("Reflog entry is %q, want %q", entry, want)
+	}
+
+	// a branch already on top of onto is kept as it is
+	again, err := repo.Rebase(ctx, &RebaseRequest{Ref: "refs/heads/feature", Onto: "refs/heads/main", Committer: replayCommitter})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again.Commit != result.Commit {
+		t.Errorf("Rebasing again moved feature to %s", again.Commit)
+	}
+	for sha, copied := range again.Commits {
+		if sha != copied {
+			t.Errorf("Rebasing again copied %s to %s", sha, copied)
+		}
+	}
+
+	// a branch that moved since it was read is left alone
+	_, err = repo.Rebase(ctx, &RebaseRequest{Ref: "refs/heads/feature", Onto: "refs/heads/main", Parent: commits["f3"], Committer: replayCommitter})
+	if err != ErrStaleRef {
+		t.Errorf("Rebase of a stale branch gave %v", err)
+	}
+	if sha, err := repo.ResolveRef(ctx, "refs/heads/feature"); err != nil || sha != result.Commit {
+		t.Errorf("Stale rebase moved feature to %s: %v", sha, err)
+	}
+}
+
+func TestRebaseConflicts(t *testing.T) {
+	ctx := context.Background()
+	repo, _, commits := rebaseTestRepository(t)
+
+	result, err := repo.Rebase(ctx, &RebaseRequest{Ref: "refs/heads/conflict", Onto: "refs/heads/main", Committer: replayCommitter})
+	if err != ErrMergeConflict {
+		t.Fatalf("Conflicting rebase gave %v", err)
+	}
+	if result.Failed != commits["k1"] || len(result.Conflicts) != 1 || result.Conflicts[0].Path != "a.txt" {
+		t.Errorf("Rebase failed at %s with %v", result.Failed, result.Conflicts)
+	}
+	if sha, err := repo.ResolveRef(ctx, "refs/heads/conflict"); err != nil || sha != commits["k1"] {
+		t.Errorf("Failed rebase moved conflict to %s: %v", sha, err)
+	}
+}
+
+func TestCherryPickMatchesGit(t *testing.T) {
+	ctx := context.Background()
+	repo, dir, commits := rebaseTestRepository(t)
+	main := commits["m1"]
+
+	result, err := repo.CherryPick(ctx, &CherryPickRequest{Ref: "refs/heads/main", Revisions: []string{"feature~1^2", commits["f3"]}, Committer: replayCommitter, Identity: "tester"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	runGit(t, dir, "checkout", "-q", "-b", "picked", "main")
+	runGit(t, dir, "cherry-pick", commits["s1"], commits["f3"])
+
+	tree, err := repo.ResolveRevision(ctx, result.Commit+"^{tree}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := gitRevParse(t, dir, "picked^{tree}"); tree != want {
+		t.Errorf("Cherry-pick gave tree %s, git has %s", tree, want)
+	}
+	if got := subjects(t, repo, main, result.Commit); strings.Join(got, " ") != "s1 f3" {
+		t.Errorf("Cherry-pick copied %v", got)
+	}
+	if sha, err := repo.ResolveRef(ctx, "refs/heads/main"); err != nil || sha != result.Commit {
+		t.Errorf("main is at %s, want %s: %v", sha, result.Commit, err)
+	}
+	if entry, want := lastReflogEntry(t, repo, "refs/heads/main"), main+".."+result.Commit+" tester cherry-pick: refs/heads/main"; entry != want {
+		t.Errorf("Reflog entry is %q, want %q", entry, want)
+	}
+
+	// a single commit is named by its subject in the reflog
+	picked := result.Commit
+	result, err = repo.CherryPick(ctx, &CherryPickRequest{Ref: "refs/heads/main", Revisions: []string{"feature~3"}, Committer: replayCommitter, Identity: "tester"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Commits[commits["f1"]] != result.Commit {
+		t.Errorf("Cherry-pick of f1 gave %s, %v", result.Commit, result.Commits)
+	}
+	if entry, want := lastReflogEntry(t, repo, "refs/heads/main"), picked+".."+result.Commit+" tester cherry-pick: f1"; entry != want {
+		t.Errorf("Reflog entry is %q, want %q", entry, want)
+	}
+
+	// and one whose changes are already there is left out
+	picked = result.Commit
+	result, err = repo.CherryPick(ctx, &CherryPickRequest{Ref: "refs/heads/main", Revisions: []string{commits["f2"]}, Committer: replayCommitter})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if copied, ok := result.Commits[commits["f2"]]; !ok || copied != "" || result.Commit != picked {
+		t.Errorf("f2 was copied to %q, want it left out", copied)
+	}
+	if sha, err := repo.ResolveRef(ctx, "refs/heads/main"); err != nil || sha != picked {
+		t.Errorf("main is at %s, want %s: %v", sha, picked, err)
+	}
+}
+
+func TestCherryPickRejections(t *testing.T) {
+	ctx := context.Background()
+	repo, _, commits := rebaseTestRepository(t)
+	main := commits["m1"]
+
+	// a conflict in the second commit leaves the first unreferenced
+	result, err := repo.CherryPick(ctx, &CherryPickRequest{Ref: "refs/heads/main", Revisions: []string{commits["f1"], "conflict"}, Committer: replayCommitter})
+	if err != ErrMergeConflict {
+		t.Fatalf("Conflicting cherry-pick gave %v", err)
+	}
+	if result.Failed != commits["k1"] || len(result.Conflicts) != 1 || result.Conflicts[0].Path != "a.txt" || result.Commits[commits["f1"]] == "" {
+		t.Errorf("Cherry-pick failed at %s with %v, after %v", result.Failed, result.Conflicts, result.Commits)
+	}
+
+	// merge commits can not be picked, even as part of a range
+	for _, revs := range [][]string{{commits["merge"]}, {"main..feature"}} {
+		if _, err := repo.CherryPick(ctx, &CherryPickRequest{Ref: "refs/heads/main", Revisions: revs, Committer: replayCommitter}); err == nil || err.Error() != "Commit "+commits["merge"]+" is a merge" {
+			t.Errorf("Cherry-pick of %v gave %v", revs, err)
+		}
+	}
+
+	// nor onto a branch that moved since it was read
+	_, err = repo.CherryPick(ctx, &CherryPickRequest{Ref: "refs/heads/main", Parent: commits["base"], Revisions: []string{commits["f1"]}, Committer: replayCommitter})
+	if err != ErrStaleRef {
+		t.Errorf("Cherry-pick onto a stale branch gave %v", err)
+	}
+
+	if sha, err := repo.ResolveRef(ctx, "refs/heads/main"); err != nil || sha != main {
+		t.Errorf("Failed cherry-picks moved main to %s: %v", sha, err)
+	}
+}
+
+func TestSquashMatchesGit(t *testing.T) {
+	ctx := context.Background()
+	repo, dir, commits := rebaseTestRepository(t)
+	main := commits["m1"]
+	author := &Signature{Name: "A U Thor", Email: "author@example.com"}
+
+	result, err := repo.Squash(ctx, &SquashRequest{Ref: "refs/heads/main", Theirs: "refs/heads/feature", Author: author, Message: "squash feature", Identity: "tester"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	runGit(t, dir, "checkout", "-q", "-b", "squashed", "main")
+	runGit(t, dir, "merge", "-q", "--squash", "feature")
+	if want := strings.TrimSpace(string(runGit(t, dir, "write-tree"))); result.Tree != want {
+		t.Errorf("Squash gave tree %s, git has %s", result.Tree, want)
+	}
+	commit, err := repo.ReadCommit(ctx, result.Commit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if commit.Tree != result.Tree || len(commit.Parents) != 1 || commit.Parents[0] != main {
+		t.Errorf("Squash commit has tree %s and parents %v", commit.Tree, commit.Parents)
+	}
+	if sha, err := repo.ResolveRef(ctx, "refs/heads/main"); err != nil || sha != result.Commit {
+		t.Errorf("main is at %s, want %s: %v", sha, result.Commit, err)
+	}
+	if entry, want := lastReflogEntry(t, repo, "refs/heads/main"), main+".."+result.Commit+" tester squash: squash feature"; entry != want {
+		t.Errorf("Reflog entry is %q, want %q", entry, want)
+	}
+
+	// the default message is the squashed messages, oldest first
+	message, err := repo.squashMessage(ctx, main, commits["f3"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(message, "f1\n") && !strings.HasPrefix(message, "s1\n") || !strings.HasSuffix(message, "merge side\n\nf3\n") {
+		t.Errorf("Squash message is %q", message)
+	}
+
+	// the changes are in main now, though feature is not
+	if _, err := repo.Squash(ctx, &SquashRequest{Ref: "refs/heads/main", Theirs: "refs/heads/feature", Author: author}); err != ErrNothingToCommit {
+		t.Errorf("Squashing again gave %v", err)
+	}
+	if _, err := repo.Squash(ctx, &SquashRequest{Ref: "refs/heads/main", Theirs: "refs/heads/main~1", Author: author}); err != ErrAlreadyUpToDate {
+		t.Errorf("Squashing an ancestor gave %v", err)
+	}
+}
+
+func TestSquashRejections(t *testing.T) {
+	ctx := context.Background()
+	repo, _, commits := rebaseTestRepository(t)
+	main := commits["m1"]
+	author := &Signature{Name: "A U Thor", Email: "author@example.com"}
+
+	result, err := repo.Squash(ctx, &SquashRequest{Ref: "refs/heads/main", Theirs: "refs/heads/conflict", Author: author})
+	if err != ErrMergeConflict {
+		t.Fatalf("Conflicting squash gave %v", err)
+	}
+	if len(result.Conflicts) != 1 || result.Conflicts[0].Path != "a.txt" || result.Commit != "" {
+		t.Errorf("Squash made %s with conflicts %v", result.Commit, result.Conflicts)
+	}
+
+	_, err = repo.Squash(ctx, &SquashRequest{Ref: "refs/heads/main", Parent: commits["base"], Theirs: "refs/heads/feature", Author: author})
+	if err != ErrStaleRef {
+		t.Errorf("Squash into a stale branch gave %v", err)
+	}
+
+	if sha, err := repo.ResolveRef(ctx, "refs/heads/main"); err != nil || sha != main {
+		t.Errorf("Failed squashes moved main to %s: %v", sha, err)
+	}
+}
@@ -0,0 +1,89 @@
+package gitpacklib
+
+import (
+	"context"
+	"io"
+	"os"
+	"strings"
+)
+
+// readAdvertisedRefs returns the refs to advertise to a client at the start
+// of receive-pack or upload-pack, with HEAD first and symbolic refs resolved
+// to the hash of the ref they point at. Symbolic refs that do not resolve,
+// such as HEAD in an empty repository, are left out. Each ref pointing at an
+// annotated tag, wherever it is, is followed by a "<name>^{}" entry giving the
+// object it peels to, so clients can follow tags without fetching them first.
+//
+// Only refs for which visible returns true are advertised. Objects are read
+// through packs, which should outlive a single advertisement.
+//
+// The capabilities returned describe HEAD with "symref=HEAD:<target>" when it
+// is advertised, so that clients learn the default branch.
+func readAdvertisedRefs(ctx context.Context, store BackingStore, packs *packCache, refs RefStore, visible func(name string) bool) (advertised []*Ref, capabilities []string, err error) {
+	var head *Ref
+	err = refs.Iterate(ctx, "", func(ref *Ref) error {
+		if !visible(ref.Name) {
+			return nil
+		}
+
+		if ref.Target != "" {
+			resolved, err := ResolveRef(ctx, refs, ref.Name)
+			if err == ErrSymbolicRefLoop {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			if resolved.Hash == "" || !visible(resolved.Name) {
+				return nil
+			}
+			if ref.Name == HeadRef {
+				capabilities = append(capabilities, "symref="+HeadRef+":"+resolved.Name)
+			}
+			ref = &Ref{Name: ref.Name, Hash: resolved.Hash, Target: ref.Target}
+		}
+
+		if ref.Name == HeadRef {
+			head = ref
+			return nil
+		}
+
+		advertised = append(advertised, ref)
+		peeled, err := peelObject(ctx, store, packs, ref.Hash)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if peeled != ref.Hash {
+			advertised = append(advertised, &Ref{Name: ref.Name + "^{}", Hash: peeled})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if head != nil {
+		advertised = append([]*Ref{head}, advertised...)
+	}
+	return advertised, capabilities, nil
+}
+
+// writeRefAdvertisement writes refs as pkt-lines, with capabilities attached
+// to the first line. If there are no refs, a placeholder line carries the
+// capabilities instead.
+func writeRefAdvertisement(out io.Writer, refs []*Ref, capabilities []string) {
+	capabilitySuffix := "\x00" + strings.Join(capabilities, " ")
+
+	if len(refs) == 0 {
+		writeGitMessage(out, zeroSha+" capabilities^{}"+capabilitySuffix)
+	} else {
+		for _, ref := range refs {
+			writeGitMessage(out, ref.Hash+" "+ref.Name+capabilitySuffix)
+			capabilitySuffix = ""
+		}
+	}
+	terminateGitMessages(out)
+}
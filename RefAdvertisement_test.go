@@ -0,0 +1,43 @@
+package gitpacklib
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestReadAdvertisedRefsMatchesGit(t *testing.T) {
+	ctx := context.Background()
+	dir := packTestRepository(t)
+	runGit(t, dir, "tag", "-a", "-m", "nested", "v1-nested", "v1")
+	runGit(t, dir, "tag", "lightweight")
+	runGit(t, dir, "update-ref", "refs/pull/1/head", "refs/tags/v1")
+	runGit(t, dir, "update-ref", "refs/notes/tagged", "refs/tags/v1-nested")
+	repo := newTestRepository(t)
+	importGitObjects(t, repo, dir)
+
+	updates := []*RefUpdate{{Name: HeadRef, NewTarget: "refs/heads/main"}}
+	for _, line := range strings.Split(strings.TrimSpace(string(runGit(t, dir, "for-each-ref", "--format=%(objectname) %(refname)"))), "\n") {
+		fields := strings.Fields(line)
+		updates = append(updates, &RefUpdate{Name: fields[1], NewHash: fields[0]})
+	}
+	if err := repo.RefStore().Update(ctx, updates); err != nil {
+		t.Fatal(err)
+	}
+
+	advertised, capabilities, err := readAdvertisedRefs(ctx, repo.store, repo.packs, repo.RefStore(), func(string) bool { return true })
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, ref := range advertised {
+		got = append(got, ref.Hash+"\t"+ref.Name)
+	}
+	want := strings.TrimSpace(string(runGit(t, dir, "ls-remote", ".")))
+	if strings.Join(got, "\n") != want {
+		t.Errorf("Advertised\n%s\nwant\n%s", strings.Join(got, "\n"), want)
+	}
+	if strings.Join(capabilities, " ") != "symref=HEAD:refs/heads/main" {
+		t.Errorf("Advertised capabilities %v", capabilities)
+	}
+}
@@ -0,0 +1,106 @@
+package gitpacklib
+
+import (
+	"context"
+	"errors"
+	"strings"
+)
+
+// CheckRefFormat reports whether name is a valid ref name, following the
+// same rules as git check-ref-format. As without --allow-onelevel, the name
+// must contain at least one '/'.
+func CheckRefFormat(name string) error {
+	if name == "" {
+		return errors.New("Ref name cannot be empty")
+	}
+	if name == "@" {
+		return errors.New("Ref name cannot be '@'")
+	}
+	if strings.HasPrefix(name, "/") || strings.HasSuffix(name, "/") {
+		return errors.New("Ref name cannot begin or end with '/'")
+	}
+	if strings.HasSuffix(name, ".") {
+		return errors.New("Ref name cannot end with '.'")
+	}
+	if strings.Contains(name, "..") {
+		return errors.New("Ref name cannot contain '..'")
+	}
+	if strings.Contains(name, "@{") {
+		return errors.New("Ref name cannot contain '@{'")
+	}
+
+	for _, c := range []byte(name) {
+		if c < 0x20 || c == 0x7f {
+			return errors.New("Ref name cannot contain control characters")
+		}
+		if strings.IndexByte(" ~^:?*[\\", c) >= 0 {
+			return errors.New("Ref name cannot contain '" + string(c) + "'")
+		}
+	}
+
+	components := strings.Split(name, "/")
+	if len(components) < 2 {
+		return errors.New("Ref name must contain at least one '/'")
+	}
+	for _, component := range components {
+		if component == "" {
+			return errors.New("Ref name cannot contain '//'")
+		}
+		if strings.HasPrefix(component, ".") {
+			return errors.New("Ref name component cannot begin with '.'")
+		}
+		if strings.HasSuffix(component, ".lock") {
+			return errors.New("Ref name component cannot end with '.lock'")
+		}
+	}
+
+	return nil
+}
+
+// checkPushedRefName reports whether a client may push to name, which must be
+// a valid ref name under refs/.
+func checkPushedRefName(name string) error {
+	if !strings.HasPrefix(name, "refs/") {
+		return errors.New("Ref name must begin with 'refs/'")
+	}
+	return CheckRefFormat(name)
+}
+
+// findCaseCollision returns an existing ref that name would collide with on a
+// case-insensitive filesystem, such as those of macOS and Windows clients, or
+// the empty string if there is none. Refs collide if they differ only in case,
+// or if a directory leading to one differs only in case from a directory of,
+// or the name of, the other, as refs/heads/Foo does with refs/heads/foo/bar.
+func findCaseCollision(ctx context.Context, refs RefStore, name string, extra []string) (string, error) {
+	var collision string
+	check := func(existing string) {
+		if collision != "" || existing == name {
+			return
+		}
+		if strings.EqualFold(existing, name) {
+			collision = existing
+			return
+		}
+
+		a := strings.Split(existing, "/")
+		b := strings.Split(name, "/")
+		for i := 0; i < len(a) && i < len(b); i++ {
+			if a[i] == b[i] {
+				continue
+			}
+			if strings.EqualFold(a[i], b[i]) {
+				collision = existing
+			}
+			return
+		}
+	}
+
+	for _, existing := range extra {
+		check(existing)
+	}
+	err := refs.Iterate(ctx, "", func(ref *Ref) error {
+		check(ref.Name)
+		return nil
+	})
+	return collision, err
+}
@@ -0,0 +1,92 @@
+package gitpacklib
+
+import (
+	"context"
+	"os/exec"
+	"testing"
+)
+
+func TestCheckRefFormatMatchesGit(t *testing.T) {
+	requireGit(t)
+	for _, name := range []string{
+		"refs/heads/main",
+		"refs/heads/feature/x",
+		"refs/tags/v1.0",
+		"refs/heads/a-b_c+d=e,f",
+		"refs/heads/été",
+		"refs/heads/@",
+		"refs/heads/a@b",
+		"main",
+		"",
+		"@",
+		"/refs/heads/a",
+		"refs/heads/a/",
+		"refs/heads/a.",
+		"refs/heads/a..b",
+		"refs/heads/a@{b",
+		"refs/heads/.a",
+		"refs/heads/a/.b",
+		"refs/heads/a.lock",
+		"refs/heads/a.lock/b",
+		"refs/heads/a.locked",
+		"refs//heads/a",
+		"refs/heads/a b",
+		"refs/heads/a~b",
+		"refs/heads/a^b",
+		"refs/heads/a:b",
+		"refs/heads/a?b",
+		"refs/heads/a*b",
+		"refs/heads/a[b",
+		"refs/heads/a\\b",
+		"refs/heads/a\tb",
+		"refs/heads/a\x7fb",
+		"refs/heads/a\x01b",
+	} {
+		err := CheckRefFormat(name)
+		// git check-ref-format exits with 1 for invalid names
+		gitErr := exec.Command("git", "check-ref-format", name).Run()
+		if _, ok := gitErr.(*exec.ExitError); gitErr != nil && !ok {
+			t.Fatal(gitErr)
+		}
+		if (err == nil) != (gitErr == nil) {
+			t.Errorf("%q: CheckRefFormat gave %v, git check-ref-format %v", name, err, gitErr)
+		}
+	}
+}
+
+func TestFindCaseCollision(t *testing.T) {
+	ctx := context.Background()
+	repo := newTestRepository(t)
+	var updates []*RefUpdate
+	for _, name := range []string{"refs/heads/main", "refs/heads/Feature/a", "refs/tags/v1"} {
+		updates = append(updates, &RefUpdate{Name: name, NewHash: "1111111111111111111111111111111111111111"})
+	}
+	if err := repo.RefStore().Update(ctx, updates); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		name  string
+		extra []string
+		want  string
+	}{
+		{"refs/heads/main", nil, ""},
+		{"refs/heads/other", nil, ""},
+		{"refs/heads/MAIN", nil, "refs/heads/main"},
+		{"refs/heads/feature/b", nil, "refs/heads/Feature/a"},
+		{"refs/heads/Feature/b", nil, ""},
+		{"refs/heads/feature", nil, "refs/heads/Feature/a"},
+		{"refs/heads/Main/x", nil, "refs/heads/main"},
+		{"refs/Tags/x", nil, "refs/tags/v1"},
+		{"refs/tags/V1", nil, "refs/tags/v1"},
+		{"refs/heads/new", []string{"refs/heads/NEW"}, "refs/heads/NEW"},
+	} {
+		got, err := findCaseCollision(ctx, repo.RefStore(), test.name, test.extra)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != test.want {
+			t.Errorf("%s collides with %q, want %q", test.name, got, test.want)
+		}
+	}
+}
@@ -1,9 +1,14 @@
 package gitpacklib
 
 import (
+	"context"
 	"encoding/json"
+	"os"
 )
 
+// RefMap is the format refs were stored in by older versions, as a single
+// JSON document under RefsKey. Refs are now kept in a RefStore, and a RefMap
+// found in a store is migrated by MigrateRefMap when a session first opens it.
 type RefMap struct {
 	Refs map[string]string
 }
@@ -34,3 +39,46 @@ func (r *RefMap) Set(name string, value string) {
 func (r *RefMap) Length() int {
 	return len(r.Refs)
 }
+
+// MigrateRefMap moves refs from the single JSON RefMap document used by older
+// versions into refs, removing the document once done. Refs that already
+// exist in refs are left alone. It does nothing if there is no document to
+// migrate, so is cheap to call whenever a repository is opened.
+func MigrateRefMap(ctx context.Context, store BackingStore, refs RefStore) error {
+	_, err := store.Get(ctx, RefsKey)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	err = store.LockKey(ctx, RefsKey)
+	if err != nil {
+		return err
+	}
+	defer store.UnlockKey(RefsKey)
+
+	// another session may have migrated while we waited for the lock
+	refMapBytes, err := store.Get(ctx, RefsKey)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	refMap := NewRefMap()
+	refMap.Deserialize(refMapBytes)
+	for name, hash := range refMap.Refs {
+		if hash == zeroSha {
+			continue
+		}
+		err = refs.Update(ctx, []*RefUpdate{{Name: name, NewHash: hash}})
+		if err != nil && err != ErrStaleRef {
+			return err
+		}
+	}
+
+	return store.Delete(ctx, RefsKey)
+}
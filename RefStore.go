@@ -0,0 +1,219 @@
+package gitpacklib
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"strings"
+)
+
+// ErrStaleRef is set on a RefUpdate whose ref no longer has the value the
+// update expected it to have.
+var ErrStaleRef = errors.New("Ref has changed since it was read")
+
+// ErrTransactionAborted is set on a RefUpdate that was valid by itself but was
+// not applied because another update in the same transaction failed.
+var ErrTransactionAborted = errors.New("Ref transaction aborted")
+
+// ErrRefNameConflict is set on a RefUpdate creating a ref whose name has
+// another ref's name as a directory, or is itself a directory of another
+// ref's name. git keeps refs as files, so it can not hold both.
+var ErrRefNameConflict = errors.New("Ref name conflicts with an existing ref")
+
+// Ref is a single named ref and the object it points at. A symbolic ref,
+// such as HEAD, instead has the name of another ref as its Target and no Hash.
+type Ref struct {
+	Name   string
+	Hash   string
+	Target string
+}
+
+// RefUpdate is a compare-and-swap of a single ref.
+//
+// OldHash is the value the ref is expected to have, with the empty string
+// meaning it must not exist, unless OldTarget is set, in which case the ref is
+// expected to be symbolic and point at OldTarget. Likewise NewHash is the
+// value to give the ref, with the empty string deleting it, unless NewTarget
+// is set, in which case the ref is made to point at NewTarget. Updating a
+// symbolic ref replaces it rather than the ref it points at.
+//
+// Reflog, if set, is appended to the reflog of the ref, with its hashes
+// filled in from the update, while the ref is locked for the update. Entries
+// are then logged in the order the ref changed.
+//
+// Err is set by RefStore.Update if this update could not be applied.
+type RefUpdate struct {
+	Name      string
+	OldHash   string
+	OldTarget string
+	NewHash   string
+	NewTarget string
+	Reflog    *ReflogEntry
+
+	Err error
+}
+
+// matches reports whether ref, which is nil if it does not exist, has the
+// value the update expects.
+func (update *RefUpdate) matches(ref *Ref) bool {
+	if ref == nil {
+		return update.OldHash == "" && update.OldTarget == ""
+	}
+	if update.OldTarget != "" {
+		return ref.Target == update.OldTarget
+	}
+	return ref.Target == "" && ref.Hash == update.OldHash
+}
+
+// result returns the ref as it is after the update, or nil if it is deleted.
+func (update *RefUpdate) result() *Ref {
+	if update.NewTarget != "" {
+		return &Ref{Name: update.Name, Target: update.NewTarget}
+	}
+	if update.NewHash != "" {
+		return &Ref{Name: update.Name, Hash: update.NewHash}
+	}
+	return nil
+}
+
+// RefStore holds the refs of a repository.
+//
+// Get returns nil if the ref does not exist. Iterate calls fn for each ref
+// whose name starts with prefix, in sorted order, stopping at the first error.
+//
+// Update applies updates as a single transaction: either every update is
+// applied or none are, in which case an error is returned and the Err of the
+// offending updates is set. A ref may appear at most once in a transaction,
+// and may not be created where it would conflict with another ref, as with
+// refs/heads/foo and refs/heads/foo/bar. Waits for locks are bounded by any
+// timeout given with WithLockTimeout.
+type RefStore interface {
+	Get(ctx context.Context, name string) (*Ref, error)
+	Iterate(ctx context.Context, prefix string, fn func(ref *Ref) error) error
+	Update(ctx context.Context, updates []*RefUpdate) error
+}
+
+// refUpdateNames returns the sorted names of the refs in a transaction, or an
+// error if a ref appears more than once.
+func refUpdateNames(updates []*RefUpdate) ([]string, error) {
+	names := make([]string, 0, len(updates))
+	for _, update := range updates {
+		names = append(names, update.Name)
+	}
+	sort.Strings(names)
+
+	for i := 1; i < len(names); i++ {
+		if names[i] == names[i-1] {
+			return nil, errors.New("Ref " + names[i] + " updated more than once")
+		}
+	}
+	return names, nil
+}
+
+// checkRefUpdates compares updates against the current values of their refs,
+// setting Err on each that fails and on the rest if any did. current is
+// called with each ref name in turn, and returns nil if it does not exist.
+func checkRefUpdates(updates []*RefUpdate, current func(name string) (*Ref, error)) error {
+	var failed error
+	for _, update := range updates {
+		ref, err := current(update.Name)
+		if err != nil {
+			update.Err = err
+		} else if !update.matches(ref) {
+			update.Err = ErrStaleRef
+		}
+		if update.Err != nil && failed == nil {
+			failed = update.Err
+		}
+	}
+
+	if failed != nil {
+		for _, update := range updates {
+			if update.Err == nil {
+				update.Err = ErrTransactionAborted
+			}
+		}
+	}
+	return failed
+}
+
+// creates reports whether the update creates a ref that did not exist, once
+// checkRefUpdates has passed.
+func (update *RefUpdate) creates() bool {
+	return update.OldHash == "" && update.OldTarget == "" && update.result() != nil
+}
+
+// refDirectories returns the names that are directories of a ref name, such
+// as refs and refs/heads for refs/heads/main.
+func refDirectories(name string) []string {
+	var dirs []string
+	for i := 0; i < len(name); i++ {
+		if name[i] == '/' {
+			dirs = append(dirs, name[:i])
+		}
+	}
+	return dirs
+}
+
+// checkRefNamesAvailable sets ErrRefNameConflict on each update creating a ref
+// that would conflict with another ref once the transaction is applied, as
+// git's refs_verify_refname_available does, and aborts the rest if any does.
+// exists reports whether a ref exists before the transaction, and under
+// returns the names of those starting with a prefix.
+func checkRefNamesAvailable(updates []*RefUpdate, exists func(name string) (bool, error), under func(prefix string) ([]string, error)) error {
+	results := map[string]bool{}
+	for _, update := range updates {
+		results[update.Name] = update.result() != nil
+	}
+	// whether a ref exists once the transaction is applied
+	existsAfter := func(name string) (bool, error) {
+		if result, ok := results[name]; ok {
+			return result, nil
+		}
+		return exists(name)
+	}
+
+	var failed error
+	for _, update := range updates {
+		if !update.creates() {
+			continue
+		}
+		conflict := false
+		for _, dir := range refDirectories(update.Name) {
+			found, err := existsAfter(dir)
+			if err != nil {
+				return err
+			}
+			conflict = conflict || found
+		}
+		names, err := under(update.Name + "/")
+		if err != nil {
+			return err
+		}
+		for name := range results {
+			if strings.HasPrefix(name, update.Name+"/") {
+				names = append(names, name)
+			}
+		}
+		for _, name := range names {
+			found, err := existsAfter(name)
+			if err != nil {
+				return err
+			}
+			conflict = conflict || found
+		}
+		if conflict {
+			update.Err = ErrRefNameConflict
+			failed = update.Err
+		}
+	}
+
+	if failed != nil {
+		for _, update := range updates {
+			if update.Err == nil {
+				update.Err = ErrTransactionAborted
+			}
+		}
+	}
+	return failed
+}
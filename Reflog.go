@@ -0,0 +1,249 @@
+package gitpacklib
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// reflogKeyPrefix is prepended to a ref name to give the backing store key
+// holding its reflog, in the same format as a reflog in a git repository.
+const reflogKeyPrefix = "reflog/"
+
+// ReflogEntry records a single update of a ref. OldHash is empty if the ref
+// was created and NewHash is empty if it was deleted.
+type ReflogEntry struct {
+	OldHash  string
+	NewHash  string
+	Identity string
+	Time     time.Time
+	Message  string
+}
+
+// PusherIdentity describes the owner of an authenticated key for reflogs, by
+// its type and SHA256 fingerprint as shown by ssh-keygen -l.
+func PusherIdentity(key ssh.PublicKey) string {
+	return key.Type() + " " + ssh.FingerprintSHA256(key)
+}
+
+// AppendReflog adds entry to the end of the reflog for the named ref. Refs
+// updated through a RefStore are better logged with RefUpdate.Reflog, which
+// keeps the entries in the order the ref changed.
+func AppendReflog(ctx context.Context, store BackingStore, name string, entry *ReflogEntry) error {
+	lockCtx, cancel := lockWaitContext(ctx)
+	defer cancel()
+
+	err := store.RLock(lockCtx)
+	if err != nil {
+		return err
+	}
+	defer store.RUnlock()
+
+	return appendReflog(ctx, lockCtx, store, name, entry)
+}
+
+// appendReflogs appends the Reflog entry of each update that has one. It is
+// called by RefStore.Update holding the store shared and the refs locked.
+func appendReflogs(ctx context.Context, lockCtx context.Context, store BackingStore, updates []*RefUpdate) error {
+	for _, update := range updates {
+		if update.Reflog == nil {
+			continue
+		}
+		entry := *update.Reflog
+		entry.OldHash, entry.NewHash = update.OldHash, update.NewHash
+
+		err := appendReflog(ctx, lockCtx, store, update.Name, &entry)
+		if err != nil {
+			update.Err = err
+			return err
+		}
+	}
+	return nil
+}
+
+// appendReflog adds entry to the reflog for the named ref, with the store
+// already held shared.
+func appendReflog(ctx context.Context, lockCtx context.Context, store BackingStore, name string, entry *ReflogEntry) error {
+	key := reflogKeyPrefix + name
+	err := store.LockKey(lockCtx, key)
+	if err != nil {
+		return err
+	}
+	defer store.UnlockKey(key)
+
+	log, err := store.Get(ctx, key)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	log = append(log, serializeReflogEntry(entry)...)
+	return store.Set(ctx, key, log)
+}
+
+// rewriteReflog replaces the reflog of the named ref with the entries rewrite
+// returns when given its entries newest first, deleting the reflog if none
+// are left. The reflog is locked so that no entries are appended meanwhile.
+func rewriteReflog(ctx context.Context, store BackingStore, name string, rewrite func(entries []*ReflogEntry) ([]*ReflogEntry, error)) error {
+	lockCtx, cancel := lockWaitContext(ctx)
+	defer cancel()
+
+	err := store.RLock(lockCtx)
+	if err != nil {
+		return err
+	}
+	defer store.RUnlock()
+
+	key := reflogKeyPrefix + name
+	err = store.LockKey(lockCtx, key)
+	if err != nil {
+		return err
+	}
+	defer store.UnlockKey(key)
+
+	entries, err := ReadReflog(ctx, store, name)
+	if err != nil {
+		return err
+	}
+	kept, err := rewrite(entries)
+	if err != nil || len(kept) == len(entries) {
+		return err
+	}
+	if len(kept) == 0 {
+		return store.Delete(ctx, key)
+	}
+
+	var log []byte
+	for i := len(kept) - 1; i >= 0; i-- {
+		log = append(log, serializeReflogEntry(kept[i])...)
+	}
+	return store.Set(ctx, key, log)
+}
+
+// ReadReflog returns the reflog of the named ref, newest entry first, so that
+// the entry at index n describes name@{n} in git's notation. A ref that was
+// never updated has an empty reflog.
+func ReadReflog(ctx context.Context, store BackingStore, name string) ([]*ReflogEntry, error) {
+	log, err := store.Get(ctx, reflogKeyPrefix+name)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []*ReflogEntry
+	for _, line := range bytes.Split(log, []byte("\n")) {
+		if len(line) == 0 {
+			continue
+		}
+		entry, err := parseReflogEntry(string(line))
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+
+	for i, j := 0, len(entries)-1; i < j; i, j = i+1, j-1 {
+		entries[i], entries[j] = entries[j], entries[i]
+	}
+	return entries, nil
+}
+
+// RestoreRef moves the named ref back to the value it was given by the reflog
+// entry at index, as returned by ReadReflog, for example to undo an
+// accidental force push. The restore is itself logged against identity.
+func RestoreRef(ctx context.Context, store BackingStore, refs RefStore, name string, index int, identity string) error {
+	entries, err := ReadReflog(ctx, store, name)
+	if err != nil {
+		return err
+	}
+	if index < 0 || index >= len(entries) {
+		return fmt.Errorf("Reflog of %s has no entry %d", name, index)
+	}
+	hash := entries[index].NewHash
+	if hash == "" {
+		return fmt.Errorf("Reflog entry %d of %s is a deletion", index, name)
+	}
+
+	current, err := refs.Get(ctx, name)
+	if err != nil {
+		return err
+	}
+	update := &RefUpdate{Name: name, NewHash: hash, Reflog: &ReflogEntry{
+		Identity: identity,
+		Time:     time.Now(),
+		Message:  fmt.Sprintf("restore: %s@{%d}", name, index),
+	}}
+	if current != nil {
+		if current.Target != "" {
+			return errors.New("Cannot restore symbolic ref " + name)
+		}
+		update.OldHash = current.Hash
+	}
+
+	return refs.Update(ctx, []*RefUpdate{update})
+}
+
+// serializeReflogEntry formats entry as a line of a git reflog, with the
+// identity standing in for the committer.
+func serializeReflogEntry(entry *ReflogEntry) []byte {
+	oldHash, newHash := entry.OldHash, entry.NewHash
+	if oldHash == "" {
+		oldHash = zeroSha
+	}
+	if newHash == "" {
+		newHash = zeroSha
+	}
+
+	// identities and messages are free text, but must not break the line up
+	clean := strings.NewReplacer("\n", " ", "\t", " ").Replace
+
+	return []byte(fmt.Sprintf("%s %s %s %d %s\t%s\n",
+		oldHash, newHash, clean(entry.Identity),
+		entry.Time.Unix(), entry.Time.Format("-0700"),
+		clean(entry.Message)))
+}
+
+func parseReflogEntry(line string) (*ReflogEntry, error) {
+	invalid := errors.New("Invalid reflog line: " + line)
+
+	parts := strings.SplitN(line, "\t", 2)
+	header := parts[0]
+	entry := &ReflogEntry{}
+	if len(parts) == 2 {
+		entry.Message = parts[1]
+	}
+
+	if len(header) < 82 || header[40] != ' ' || header[81] != ' ' {
+		return nil, invalid
+	}
+	entry.OldHash = refHash(header[:40])
+	entry.NewHash = refHash(header[41:81])
+
+	// the identity may contain spaces, so the timestamp and zone are found
+	// from the end
+	fields := strings.Split(header[82:], " ")
+	if len(fields) < 2 {
+		return nil, invalid
+	}
+	entry.Identity = strings.Join(fields[:len(fields)-2], " ")
+
+	timestamp, err := strconv.ParseInt(fields[len(fields)-2], 10, 64)
+	if err != nil {
+		return nil, invalid
+	}
+	zone, err := time.Parse("-0700", fields[len(fields)-1])
+	if err != nil {
+		return nil, invalid
+	}
+	entry.Time = time.Unix(timestamp, 0).In(zone.Location())
+
+	return entry, nil
+}
@@ -0,0 +1,83 @@
+package gitpacklib
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRefUpdatesLogInOrder(t *testing.T) {
+	ctx := context.Background()
+	const name = "refs/heads/main"
+
+	for _, newRefs := range []func(store BackingStore) RefStore{
+		func(store BackingStore) RefStore { return NewLooseRefStore(store) },
+		func(store BackingStore) RefStore { return NewPackedRefStore(store) },
+	} {
+		repo := newTestRepository(t)
+		refs := newRefs(repo.store)
+
+		// concurrent compare-and-swaps of one ref, each retrying until it
+		// lands, must log a chain of updates in the order they were made
+		var wg sync.WaitGroup
+		for i := 0; i < 8; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				for j := 0; j < 5; j++ {
+					for {
+						ref, err := refs.Get(ctx, name)
+						if err != nil {
+							t.Error(err)
+							return
+						}
+						update := &RefUpdate{Name: name, NewHash: fmt.Sprintf("%040x", i*100+j+1), Reflog: &ReflogEntry{Time: time.Now(), Message: "test"}}
+						if ref != nil {
+							update.OldHash = ref.Hash
+						}
+						err = refs.Update(ctx, []*RefUpdate{update})
+						if err == nil {
+							break
+						}
+						if err != ErrStaleRef {
+							t.Error(err)
+							return
+						}
+					}
+				}
+			}(i)
+		}
+		wg.Wait()
+
+		entries, err := ReadReflog(ctx, repo.store, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(entries) != 40 {
+			t.Fatalf("Reflog has %d entries, want 40", len(entries))
+		}
+		ref, err := refs.Get(ctx, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if entries[0].NewHash != ref.Hash || entries[len(entries)-1].OldHash != "" {
+			t.Errorf("Reflog runs from %q to %s, ref is at %s", entries[len(entries)-1].OldHash, entries[0].NewHash, ref.Hash)
+		}
+		for i := 1; i < len(entries); i++ {
+			if entries[i].NewHash != entries[i-1].OldHash {
+				t.Errorf("Entry %d moves to %s, but entry %d moves from %s", i, entries[i].NewHash, i-1, entries[i-1].OldHash)
+			}
+		}
+
+		// a failed update logs nothing
+		err = refs.Update(ctx, []*RefUpdate{{Name: name, NewHash: fmt.Sprintf("%040x", 1), Reflog: &ReflogEntry{Time: time.Now()}}})
+		if err != ErrStaleRef {
+			t.Errorf("Stale update gave %v", err)
+		}
+		if entries, err := ReadReflog(ctx, repo.store, name); err != nil || len(entries) != 40 {
+			t.Errorf("Reflog has %d entries after a stale update: %v", len(entries), err)
+		}
+	}
+}
@@ -0,0 +1,203 @@
+package gitpacklib
+
+import (
+	"context"
+	"errors"
+	"os"
+	"strings"
+)
+
+var ErrObjectNotFound = errors.New("Object not found")
+var ErrRefNotFound = errors.New("Ref not found")
+var ErrPathNotFound = errors.New("Path not found in tree")
+
+// Repository reads the objects and refs of a repository from the same
+// BackingStore the SSH server writes pushes to.
+type Repository struct {
+	store BackingStore
+	refs  RefStore
+	packs *packCache
+}
+
+// NewRepository returns a Repository over store, with refs held in refs. If
+// refs is nil, a LooseRefStore over store is used, as GitReceiveSession does.
+func NewRepository(store BackingStore, refs RefStore) *Repository {
+	if refs == nil {
+		refs = NewLooseRefStore(store)
+	}
+	return &Repository{store, refs, newPackCache()}
+}
+
+func (repo *Repository) BackingStore() BackingStore {
+	return repo.store
+}
+
+func (repo *Repository) RefStore() RefStore {
+	return repo.refs
+}
+
+// Refs returns every ref in the repository, sorted by name. Symbolic refs
+// are returned as they are, without being resolved.
+func (repo *Repository) Refs(ctx context.Context) ([]*Ref, error) {
+	var refs []*Ref
+	err := repo.refs.Iterate(ctx, "", func(ref *Ref) error {
+		refs = append(refs, ref)
+		return nil
+	})
+	return refs, err
+}
+
+// ResolveRef returns the sha a ref points at, following symbolic refs. Like
+// git, a short name such as "main" or "v1.0" is looked up as given and then
+// under refs/, refs/tags/, refs/heads/ and refs/remotes/, in that order.
+func (repo *Repository) ResolveRef(ctx context.Context, name string) (string, error) {
+	ref, err := repo.findRef(ctx, name)
+	if err != nil {
+		return "", err
+	}
+	return ref.Hash, nil
+}
+
+// findRef looks up name as ResolveRef does, returning the ref it resolves to.
+func (repo *Repository) findRef(ctx context.Context, name string) (*Ref, error) {
+	candidates := []string{name}
+	if !strings.HasPrefix(name, "refs/") {
+		candidates = append(candidates,
+			"refs/"+name,
+			"refs/tags/"+name,
+			"refs/heads/"+name,
+			"refs/remotes/"+name,
+			"refs/remotes/"+name+"/"+HeadRef,
+		)
+	}
+
+	for _, candidate := range candidates {
+		ref, err := ResolveRef(ctx, repo.refs, candidate)
+		if err != nil {
+			return nil, err
+		}
+		if ref.Hash != "" {
+			return ref, nil
+		}
+	}
+	return nil, ErrRefNotFound
+}
+
+// PeelRef returns the sha of the object the named ref ultimately points at,
+// following symbolic refs and then annotated tags.
+func (repo *Repository) PeelRef(ctx context.Context, name string) (string, error) {
+	sha, err := repo.ResolveRef(ctx, name)
+	if err != nil {
+		return "", err
+	}
+	return peelObject(ctx, repo.store, repo.packs, sha)
+}
+
+// ReadRawObject returns the type and content of the object with the given
+// sha, without parsing it.
+func (repo *Repository) ReadRawObject(ctx context.Context, sha string) (objType string, data []byte, err error) {
+	objType, data, err = loadCachedObject(ctx, repo.store, repo.packs, sha)
+	if os.IsNotExist(err) {
+		return "", nil, ErrObjectNotFound
+	}
+	return objType, data, err
+}
+
+// HasObject reports whether the object with the given sha is stored.
+func (repo *Repository) HasObject(ctx context.Context, sha string) (bool, error) {
+	_, _, err := repo.ReadRawObject(ctx, sha)
+	if err == ErrObjectNotFound {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// ReadObject returns the parsed object with the given sha.
+func (repo *Repository) ReadObject(ctx context.Context, sha string) (Object, error) {
+	objType, data, err := repo.ReadRawObject(ctx, sha)
+	if err != nil {
+		return nil, err
+	}
+	return ParseObject(objType, data)
+}
+
+// WriteObject stores obj, returning its sha. Trees are checked first, so
+// that a tree read leniently is not written back with the same problems.
+func (repo *Repository) WriteObject(ctx context.Context, obj Object) (string, error) {
+	if tree, ok := obj.(*Tree); ok {
+		if err := tree.check(); err != nil {
+			return "", err
+		}
+	}
+	return saveObject(ctx, repo.store, repo.packs, obj.Type(), obj.Serialize())
+}
+
+func (repo *Repository) ReadCommit(ctx context.Context, sha string) (*Commit, error) {
+	data, err := repo.readObjectOfType(ctx, sha, CommitObject)
+	if err != nil {
+		return nil, err
+	}
+	return ParseCommit(data)
+}
+
+func (repo *Repository) ReadTree(ctx context.Context, sha string) (*Tree, error) {
+	data, err := repo.readObjectOfType(ctx, sha, TreeObject)
+	if err != nil {
+		return nil, err
+	}
+	return ParseTree(data)
+}
+
+func (repo *Repository) ReadTag(ctx context.Context, sha string) (*Tag, error) {
+	data, err := repo.readObjectOfType(ctx, sha, TagObject)
+	if err != nil {
+		return nil, err
+	}
+	return ParseTag(data)
+}
+
+func (repo *Repository) ReadBlob(ctx context.Context, sha string) (*Blob, error) {
+	data, err := repo.readObjectOfType(ctx, sha, BlobObject)
+	if err != nil {
+		return nil, err
+	}
+	return ParseBlob(data)
+}
+
+func (repo *Repository) readObjectOfType(ctx context.Context, sha string, want string) ([]byte, error) {
+	objType, data, err := repo.ReadRawObject(ctx, sha)
+	if err != nil {
+		return nil, err
+	}
+	if objType != want {
+		return nil, errors.New("Object " + sha + " is a " + objType + ", not a " + want)
+	}
+	return data, nil
+}
+
+// ReadTreeEntry returns the entry at path, such as "docs/README.md", within
+// the tree with the given sha. The empty path gives an entry for the tree
+// itself.
+func (repo *Repository) ReadTreeEntry(ctx context.Context, treeSha string, path string) (*TreeEntry, error) {
+	entry := &TreeEntry{Mode: ModeTree, Hash: treeSha}
+
+	for _, name := range strings.Split(strings.Trim(path, "/"), "/") {
+		if name == "" {
+			continue
+		}
+		if !entry.IsTree() {
+			return nil, ErrPathNotFound
+		}
+
+		tree, err := repo.ReadTree(ctx, entry.Hash)
+		if err != nil {
+			return nil, err
+		}
+		entry = tree.Entry(name)
+		if entry == nil {
+			return nil, ErrPathNotFound
+		}
+	}
+
+	return entry, nil
+}
@@ -0,0 +1,448 @@
+package gitpacklib
+
+import (
+	"container/heap"
+	"context"
+	"errors"
+	"strings"
+)
+
+type WalkOrder int
+
+const (
+	// WalkOrderDate shows commits newest committer date first, like git log.
+	WalkOrderDate WalkOrder = iota
+	// WalkOrderTopo never shows a commit before all of its children, like
+	// git log --topo-order.
+	WalkOrderTopo
+)
+
+// flags marked on commits during a walk
+const (
+	walkSeen = 1 << iota
+	walkAdded
+	walkHidden
+)
+
+// ErrStopWalk may be returned by the function passed to RevWalk.Walk to stop
+// the walk early without Walk returning an error.
+var ErrStopWalk = errors.New("Walk stopped")
+
+// RevWalk iterates over the commits reachable from a set of included commits
+// but not from any excluded commit, like git rev-list.
+//
+// If Paths is set, only commits that change something at or below one of
+// the paths are shown, and merges that took those paths unchanged from one
+// parent are only followed down that parent, as git log does by default.
+type RevWalk struct {
+	Order       WalkOrder
+	FirstParent bool
+	Paths       []string
+	Limit       int
+
+	repo    *Repository
+	include []string
+	exclude []string
+	commits map[string]*Commit
+	paths   map[string][]string
+
+	// queue holds commits seen but not yet added to the walk, of which
+	// interesting are not hidden
+	flags       map[string]int
+	queue       commitQueue
+	seq         int
+	interesting int
+}
+
+func (repo *Repository) NewRevWalk() *RevWalk {
+	return &RevWalk{
+		repo:    repo,
+		commits: map[string]*Commit{},
+		paths:   map[string][]string{},
+	}
+}
+
+// Include adds the commits named by revs, and their history, to the walk.
+func (walk *RevWalk) Include(ctx context.Context, revs ...string) error {
+	for _, rev := range revs {
+		sha, err := walk.resolveCommit(ctx, rev)
+		if err != nil {
+			return err
+		}
+		walk.include = append(walk.include, sha)
+	}
+	return nil
+}
+
+// Exclude removes the commits named by revs, and their history, from the
+// walk.
+func (walk *RevWalk) Exclude(ctx context.Context, revs ...string) error {
+	for _, rev := range revs {
+		sha, err := walk.resolveCommit(ctx, rev)
+		if err != nil {
+			return err
+		}
+		walk.exclude = append(walk.exclude, sha)
+	}
+	return nil
+}
+
+// AddRevisions includes and excludes commits using the arguments git
+// rev-list takes: "A..B" includes B and excludes A, "^A" excludes A, and
+// "--not" flips the meaning of the arguments that follow it.
+func (walk *RevWalk) AddRevisions(ctx context.Context, args ...string) error {
+	not := false
+	for _, arg := range args {
+		var err error
+		switch {
+		case arg == "--not":
+			not = !not
+		case strings.Contains(arg, "..."):
+			err = errors.New("Symmetric difference " + arg + " is not supported")
+		case strings.Contains(arg, ".."):
+			parts := strings.SplitN(arg, "..", 2)
+			for i := range parts {
+				if parts[i] == "" {
+					parts[i] = HeadRef
+				}
+			}
+			if not {
+				err = walk.Exclude(ctx, parts[1])
+				if err == nil {
+					err = walk.Include(ctx, parts[0])
+				}
+			} else {
+				err = walk.Exclude(ctx, parts[0])
+				if err == nil {
+					err = walk.Include(ctx, parts[1])
+				}
+			}
+		case strings.HasPrefix(arg, "^") != not:
+			err = walk.Exclude(ctx, strings.TrimPrefix(arg, "^"))
+		default:
+			err = walk.Include(ctx, strings.TrimPrefix(arg, "^"))
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Walk calls fn for each commit in the walk, in the order set by Order.
+//
+// Like git rev-list, commits are taken newest first from the included and
+// excluded commits, marking everything below an excluded commit as hidden,
+// until only hidden commits are left. Without excluded commits, commits in
+// date order are passed to fn as they are found, so Limit bounds the walk.
+func (walk *RevWalk) Walk(ctx context.Context, fn func(sha string, commit *Commit) error) error {
+	walk.flags = map[string]int{}
+	walk.queue = nil
+	walk.interesting = 0
+	for _, sha := range walk.exclude {
+		walk.markHidden(sha)
+	}
+	for _, sha := range append(append([]string{}, walk.exclude...), walk.include...) {
+		if err := walk.push(ctx, sha); err != nil {
+			return err
+		}
+	}
+
+	count := 0
+	emit := func(sha string) error {
+		if err := fn(sha, walk.commits[sha]); err != nil {
+			return err
+		}
+		count++
+		if walk.Limit > 0 && count >= walk.Limit {
+			return ErrStopWalk
+		}
+		return nil
+	}
+
+	if len(walk.exclude) == 0 && walk.Order == WalkOrderDate {
+		for walk.interesting > 0 {
+			sha, _, shown, err := walk.next(ctx)
+			if err != nil {
+				return err
+			}
+			if !shown {
+				continue
+			}
+			if err := emit(sha); err != nil {
+				return nilIfStopped(err)
+			}
+		}
+		return nil
+	}
+
+	// find every commit in the walk along with the parents we follow from
+	// it, in date order
+	var found []string
+	follow := map[string][]string{}
+	show := map[string]bool{}
+	for walk.interesting > 0 {
+		sha, parents, shown, err := walk.next(ctx)
+		if err != nil {
+			return err
+		}
+		if parents != nil {
+			found = append(found, sha)
+			follow[sha] = parents
+			show[sha] = shown
+		}
+	}
+
+	// with clock skew, a commit may be found to be hidden after it was
+	// added to the walk
+	kept := found[:0]
+	for _, sha := range found {
+		if walk.flags[sha]&walkHidden == 0 {
+			kept = append(kept, sha)
+		}
+	}
+	found = kept
+	if walk.Order == WalkOrderTopo {
+		for sha, parents := range follow {
+			var visible []string
+			for _, parent := range parents {
+				if walk.flags[parent]&(walkAdded|walkHidden) == walkAdded {
+					visible = append(visible, parent)
+				}
+			}
+			follow[sha] = visible
+		}
+		found = topoSort(found, follow)
+	}
+
+	for _, sha := range found {
+		if !show[sha] {
+			continue
+		}
+		if err := emit(sha); err != nil {
+			return nilIfStopped(err)
+		}
+	}
+	return nil
+}
+
+// nilIfStopped returns err, unless it stopped the walk early.
+func nilIfStopped(err error) error {
+	if err == ErrStopWalk {
+		return nil
+	}
+	return err
+}
+
+// push queues a commit to be added to the walk, unless it has been already.
+func (walk *RevWalk) push(ctx context.Context, sha string) error {
+	flags := walk.flags[sha]
+	if flags&walkSeen != 0 {
+		return nil
+	}
+	commit, err := walk.readCommit(ctx, sha)
+	if err != nil {
+		return err
+	}
+	walk.flags[sha] = flags | walkSeen
+	if flags&walkHidden == 0 {
+		walk.interesting++
+	}
+	walk.seq++
+	heap.Push(&walk.queue, &queuedCommit{sha, commit.Committer.When, walk.seq})
+	return nil
+}
+
+// next adds the newest queued commit to the walk and queues its parents,
+// returning whether it is shown and which parents the walk follows from it.
+// The parents of a hidden commit are all hidden, and nil is returned.
+func (walk *RevWalk) next(ctx context.Context) (string, []string, bool, error) {
+	if err := ctx.Err(); err != nil {
+		return "", nil, false, err
+	}
+	sha := heap.Pop(&walk.queue).(*queuedCommit).sha
+	flags := walk.flags[sha]
+	walk.flags[sha] = flags | walkAdded
+	commit := walk.commits[sha]
+
+	if flags&walkHidden != 0 {
+		for _, parent := range commit.Parents {
+			walk.markHidden(parent)
+			if err := walk.push(ctx, parent); err != nil {
+				return "", nil, false, err
+			}
+		}
+		return sha, nil, false, nil
+	}
+	walk.interesting--
+
+	parents := commit.Parents
+	if walk.FirstParent && len(parents) > 1 {
+		parents = parents[:1]
+	}
+	shown, parents, err := walk.simplify(ctx, commit, parents)
+	if err != nil {
+		return "", nil, false, err
+	}
+	follow := []string{}
+	for _, parent := range parents {
+		if walk.flags[parent]&walkHidden != 0 {
+			continue
+		}
+		follow = append(follow, parent)
+		if err := walk.push(ctx, parent); err != nil {
+			return "", nil, false, err
+		}
+	}
+	return sha, follow, shown, nil
+}
+
+// markHidden marks a commit as reachable from an excluded commit, along with
+// the history below it that has already been added to the walk.
+func (walk *RevWalk) markHidden(sha string) {
+	stack := []string{sha}
+	for len(stack) > 0 {
+		sha := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		flags := walk.flags[sha]
+		if flags&walkHidden != 0 {
+			continue
+		}
+		walk.flags[sha] = flags | walkHidden
+		if flags&(walkSeen|walkAdded) == walkSeen {
+			walk.interesting--
+		}
+		if flags&walkAdded != 0 {
+			stack = append(stack, walk.commits[sha].Parents...)
+		}
+	}
+}
+
+// topoSort reorders commits, which are sorted newest first, so that no
+// commit comes before any of its children. Each line of history is kept
+// together rather than being interleaved by date.
+func topoSort(commits []string, parents map[string][]string) []string {
+	children := map[string]int{}
+	for _, sha := range commits {
+		for _, parent := range parents[sha] {
+			children[parent]++
+		}
+	}
+
+	// tips are pushed oldest first, so the newest is popped first
+	var stack []string
+	for i := len(commits) - 1; i >= 0; i-- {
+		if children[commits[i]] == 0 {
+			stack = append(stack, commits[i])
+		}
+	}
+
+	sorted := make([]string, 0, len(commits))
+	for len(stack) > 0 {
+		sha := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		sorted = append(sorted, sha)
+
+		// like git, the merged-in side of a merge is shown before the
+		// line it was merged into
+		for _, parent := range parents[sha] {
+			children[parent]--
+			if children[parent] == 0 {
+				stack = append(stack, parent)
+			}
+		}
+	}
+	return sorted
+}
+
+// simplify decides whether commit is shown when filtering by Paths, and
+// which of its parents the walk continues down.
+func (walk *RevWalk) simplify(ctx context.Context, commit *Commit, parents []string) (bool, []string, error) {
+	if len(walk.Paths) == 0 {
+		return true, parents, nil
+	}
+
+	own, err := walk.pathHashes(ctx, commit.Tree)
+	if err != nil {
+		return false, nil, err
+	}
+
+	if len(parents) == 0 {
+		for _, hash := range own {
+			if hash != "" {
+				return true, parents, nil
+			}
+		}
+		return false, parents, nil
+	}
+
+	for _, parent := range parents {
+		parentCommit, err := walk.readCommit(ctx, parent)
+		if err != nil {
+			return false, nil, err
+		}
+		theirs, err := walk.pathHashes(ctx, parentCommit.Tree)
+		if err != nil {
+			return false, nil, err
+		}
+		if equalStrings(own, theirs) {
+			return false, []string{parent}, nil
+		}
+	}
+	return true, parents, nil
+}
+
+// pathHashes returns the hash of each of the walk's Paths in the given tree,
+// or the empty string for paths that do not exist.
+func (walk *RevWalk) pathHashes(ctx context.Context, treeSha string) ([]string, error) {
+	if hashes, ok := walk.paths[treeSha]; ok {
+		return hashes, nil
+	}
+
+	hashes := make([]string, len(walk.Paths))
+	for i, path := range walk.Paths {
+		entry, err := walk.repo.ReadTreeEntry(ctx, treeSha, path)
+		if err == ErrPathNotFound {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		hashes[i] = entry.Hash
+	}
+
+	walk.paths[treeSha] = hashes
+	return hashes, nil
+}
+
+func (walk *RevWalk) resolveCommit(ctx context.Context, rev string) (string, error) {
+	sha, err := walk.repo.ResolveRevision(ctx, rev)
+	if err != nil {
+		return "", err
+	}
+	return walk.repo.peelRevision(ctx, sha, CommitObject)
+}
+
+func (walk *RevWalk) readCommit(ctx context.Context, sha string) (*Commit, error) {
+	if commit, ok := walk.commits[sha]; ok {
+		return commit, nil
+	}
+	commit, err := walk.repo.ReadCommit(ctx, sha)
+	if err != nil {
+		return nil, err
+	}
+	walk.commits[sha] = commit
+	return commit, nil
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
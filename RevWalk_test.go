@@ -0,0 +1,139 @@
+package gitpacklib
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// gitCommitAt commits all changes in the git repository in dir with the
+// given committer timestamp, and returns the commit's sha.
+func gitCommitAt(t *testing.T, dir string, message string, timestamp int) string {
+	t.Helper()
+	runGit(t, dir, "add", "-A")
+	cmd := exec.Command("git", "commit", "-q", "--allow-empty", "-m", message)
+	cmd.Dir = dir
+	cmd.Env = append(append(os.Environ(), gitTestEnv...), "GIT_COMMITTER_DATE="+strconv.Itoa(timestamp)+" +0000")
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("git commit: %v\n%s", err, out)
+	}
+	return gitRevParse(t, dir, "HEAD")
+}
+
+// walkTestRepository makes a git repository whose history has several
+// merges, including one of a long-lived branch and one with a commit dated
+// before its parent, and copies its objects and branches into a repository.
+func walkTestRepository(t *testing.T) (*Repository, string) {
+	ctx := context.Background()
+	dir := newGitRepository(t)
+	now := 1700000000
+	commit := func(branch string, message string) {
+		now += 100
+		if branch != "" {
+			runGit(t, dir, "checkout", "-q", branch)
+		}
+		writeFiles(t, dir, map[string][]byte{message + ".txt": []byte(message + "\n")})
+		gitCommitAt(t, dir, message, now)
+	}
+	merge := func(into string, branch string) {
+		now += 100
+		runGit(t, dir, "checkout", "-q", into)
+		runGit(t, dir, "merge", "-q", "--no-ff", "--no-commit", branch)
+		gitCommitAt(t, dir, "merge "+branch, now)
+	}
+
+	commit("", "c1")
+	commit("", "c2")
+	runGit(t, dir, "branch", "a")
+	runGit(t, dir, "branch", "old")
+	commit("", "c3")
+	commit("a", "a1")
+	commit("a", "a2")
+	commit("main", "c4")
+	merge("main", "a")
+	runGit(t, dir, "branch", "b")
+	commit("old", "old1")
+	commit("b", "b1")
+	commit("main", "c5")
+	commit("a", "a3")
+	merge("main", "b")
+	// a commit dated before its parent, as a skewed clock makes
+	now -= 1000
+	commit("old", "old2")
+	now += 1000
+	merge("main", "old")
+	merge("b", "a")
+	commit("main", "c6")
+
+	repo := newTestRepository(t)
+	importGitObjects(t, repo, dir)
+	var updates []*RefUpdate
+	for _, line := range strings.Split(strings.TrimSpace(string(runGit(t, dir, "for-each-ref", "--format=%(objectname) %(refname)"))), "\n") {
+		fields := strings.Fields(line)
+		updates = append(updates, &RefUpdate{Name: fields[1], NewHash: fields[0]})
+	}
+	if err := repo.RefStore().Update(ctx, updates); err != nil {
+		t.Fatal(err)
+	}
+	return repo, dir
+}
+
+func TestRevWalkMatchesGit(t *testing.T) {
+	ctx := context.Background()
+	repo, dir := walkTestRepository(t)
+
+	for _, args := range [][]string{
+		{"main"},
+		{"main", "b"},
+		{"--topo-order", "main"},
+		{"--topo-order", "main", "b"},
+		{"--first-parent", "main"},
+		{"--first-parent", "--topo-order", "main"},
+		{"main", "^a"},
+		{"a..main"},
+		{"b..main"},
+		{"main..b"},
+		{"--topo-order", "main", "^old"},
+		{"--topo-order", "a..b"},
+		{"--first-parent", "main", "^a"},
+		{"main", "--not", "b", "old"},
+		{"main", "^main"},
+		{"-n", "3", "main"},
+		{"-n", "4", "--topo-order", "main", "^a"},
+	} {
+		walk := repo.NewRevWalk()
+		var revs []string
+		for i := 0; i < len(args); i++ {
+			switch args[i] {
+			case "--topo-order":
+				walk.Order = WalkOrderTopo
+			case "--first-parent":
+				walk.FirstParent = true
+			case "-n":
+				i++
+				walk.Limit, _ = strconv.Atoi(args[i])
+			default:
+				revs = append(revs, args[i])
+			}
+		}
+		if err := walk.AddRevisions(ctx, revs...); err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		err := walk.Walk(ctx, func(sha string, commit *Commit) error {
+			got = append(got, sha)
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		want := strings.Fields(string(runGit(t, dir, append([]string{"rev-list"}, args...)...)))
+		if strings.Join(got, " ") != strings.Join(want, " ") {
+			t.Errorf("Walk of %v gave\n%v\nwant\n%v", args, got, want)
+		}
+	}
+}
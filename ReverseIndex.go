@@ -0,0 +1,125 @@
+package gitpacklib
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"io"
+	"sort"
+	"strconv"
+)
+
+// reverseIndexMagic starts a reverse index, which is also the id of the
+// chunk of a multi-pack index holding one.
+var reverseIndexMagic = []byte{'R', 'I', 'D', 'X'}
+
+// reverseIndexVersion is the version of the reverse indexes written by
+// WriteReverseIndex.
+const reverseIndexVersion = 1
+
+// sha1HashVersion identifies sha1 as the hash of the objects in a reverse
+// index or multi-pack index.
+const sha1HashVersion = 1
+
+// WriteReverseIndex writes the reverse index of the pack that index is for,
+// as git index-pack --rev-index does, which lists the objects of the pack in
+// the order they are stored.
+func WriteReverseIndex(out io.Writer, index *PackIndex) error {
+	rev := &bytes.Buffer{}
+	rev.Write(reverseIndexMagic)
+	binary.Write(rev, binary.BigEndian, uint32(reverseIndexVersion))
+	binary.Write(rev, binary.BigEndian, uint32(sha1HashVersion))
+	for _, i := range packOrder(index) {
+		binary.Write(rev, binary.BigEndian, uint32(i))
+	}
+
+	checksum, _ := hex.DecodeString(index.PackChecksum())
+	rev.Write(checksum)
+	sum := sha1.Sum(rev.Bytes())
+	rev.Write(sum[:])
+
+	if _, err := out.Write(rev.Bytes()); err != nil {
+		return errors.New("Error writing reverse index: " + err.Error())
+	}
+	return nil
+}
+
+// packOrder returns the positions in index of the objects in the pack, in
+// the order they are stored in the pack.
+func packOrder(index *PackIndex) []int {
+	order := make([]int, index.NumObjects())
+	for i := range order {
+		order[i] = i
+	}
+	sort.Slice(order, func(i, j int) bool {
+		return index.offset(order[i]) < index.offset(order[j])
+	})
+	return order
+}
+
+// ReverseIndex finds the objects of a pack by where they are stored in it,
+// alongside the PackIndex that finds them by sha.
+type ReverseIndex struct {
+	index     *PackIndex
+	positions []byte
+}
+
+// ParseReverseIndex reads the reverse index of the pack that index is for.
+func ParseReverseIndex(data []byte, index *PackIndex) (*ReverseIndex, error) {
+	if len(data) < 12+2*sha1.Size || !bytes.Equal(data[:4], reverseIndexMagic) {
+		return nil, errors.New("Invalid reverse index header")
+	}
+	if version := binary.BigEndian.Uint32(data[4:]); version != reverseIndexVersion {
+		return nil, errors.New("Unsupported reverse index version " + strconv.Itoa(int(version)))
+	}
+	if hashVersion := binary.BigEndian.Uint32(data[8:]); hashVersion != sha1HashVersion {
+		return nil, errors.New("Unsupported reverse index hash version " + strconv.Itoa(int(hashVersion)))
+	}
+
+	sum := sha1.Sum(data[:len(data)-sha1.Size])
+	if !bytes.Equal(sum[:], data[len(data)-sha1.Size:]) {
+		return nil, errors.New("Reverse index checksum mismatch")
+	}
+	checksum := data[len(data)-2*sha1.Size : len(data)-sha1.Size]
+	if hex.EncodeToString(checksum) != index.PackChecksum() {
+		return nil, errors.New("Reverse index is for a different pack")
+	}
+
+	positions := data[12 : len(data)-2*sha1.Size]
+	if len(positions) != index.NumObjects()*4 {
+		return nil, errors.New("Reverse index has the wrong size for its objects")
+	}
+	var last int64 = -1
+	for i := 0; i < index.NumObjects(); i++ {
+		position := int(binary.BigEndian.Uint32(positions[i*4:]))
+		if position >= index.NumObjects() || index.offset(position) <= last {
+			return nil, errors.New("Reverse index is not in pack order")
+		}
+		last = index.offset(position)
+	}
+	return &ReverseIndex{index: index, positions: positions}, nil
+}
+
+// Entry returns the i'th object stored in the pack.
+func (rev *ReverseIndex) Entry(i int) *PackIndexEntry {
+	return rev.index.Entry(rev.position(i))
+}
+
+// ObjectAt returns the object whose entry starts at offset in the pack, and
+// whether there is one.
+func (rev *ReverseIndex) ObjectAt(offset int64) (*PackIndexEntry, bool) {
+	n := rev.index.NumObjects()
+	i := sort.Search(n, func(i int) bool {
+		return rev.index.offset(rev.position(i)) >= offset
+	})
+	if i == n || rev.index.offset(rev.position(i)) != offset {
+		return nil, false
+	}
+	return rev.Entry(i), true
+}
+
+func (rev *ReverseIndex) position(i int) int {
+	return int(binary.BigEndian.Uint32(rev.positions[i*4:]))
+}
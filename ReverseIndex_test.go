@@ -0,0 +1,116 @@
+package gitpacklib
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestWriteReverseIndexMatchesGit(t *testing.T) {
+	dir := packTestRepository(t)
+	packPath, _ := gitPack(t, dir)
+	data, err := ioutil.ReadFile(packPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	scratch := newGitRepository(t)
+	packPath = filepath.Join(scratch, "test.pack")
+	if err := ioutil.WriteFile(packPath, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	runGit(t, scratch, "index-pack", "--rev-index", packPath)
+	want, err := ioutil.ReadFile(filepath.Join(scratch, "test.rev"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	indexData, err := ioutil.ReadFile(filepath.Join(scratch, "test.idx"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	index, err := ParsePackIndex(indexData)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := &bytes.Buffer{}
+	if err := WriteReverseIndex(got, index); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got.Bytes(), want) {
+		t.Error("Reverse index differs from the one git index-pack --rev-index wrote")
+	}
+
+	rev, err := ParseReverseIndex(want, index)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < index.NumObjects(); i++ {
+		entry := rev.Entry(i)
+		if i > 0 && entry.Offset <= rev.Entry(i-1).Offset {
+			t.Errorf("Object %d at %d is not after the one before", i, entry.Offset)
+		}
+		if found, ok := rev.ObjectAt(entry.Offset); !ok || found.Hash != entry.Hash {
+			t.Errorf("Object at %d is not %s", entry.Offset, entry.Hash)
+		}
+		if _, ok := rev.ObjectAt(entry.Offset + 1); ok {
+			t.Errorf("Object found part way through %s", entry.Hash)
+		}
+	}
+}
+
+func TestReadObjectChecksDeltaBaseOffsets(t *testing.T) {
+	ctx := context.Background()
+	base := numberedLines(20, nil)
+	target := numberedLines(20, map[int]string{10: "ten"})
+	delta := newDeltaIndex(base).createDelta(target, len(target))
+
+	for _, test := range []struct {
+		distance int64
+		err      string
+	}{
+		{0, ""},
+		{-1, "Delta base at offset 13 is not the start of an object"},
+	} {
+		// a pack of the base and a delta naming it by offset, which the
+		// test moves part way into the base's entry
+		pack := &bytes.Buffer{}
+		pack.WriteString("PACK")
+		binary.Write(pack, binary.BigEndian, uint32(packVersion))
+		binary.Write(pack, binary.BigEndian, uint32(2))
+		baseEntry := &PackIndexEntry{Hash: HashObject(BlobObject, base), Offset: int64(pack.Len())}
+		pack.Write(packEntryHeader(packBlob, len(base)))
+		pack.Write(compressPackData(base))
+		deltaEntry := &PackIndexEntry{Hash: HashObject(BlobObject, target), Offset: int64(pack.Len())}
+		pack.Write(packEntryHeader(packOfsDelta, len(delta)))
+		pack.Write(packOffsetDelta(deltaEntry.Offset - baseEntry.Offset + test.distance))
+		pack.Write(compressPackData(delta))
+		sum := sha1.Sum(pack.Bytes())
+		pack.Write(sum[:])
+
+		checksum := hex.EncodeToString(sum[:])
+		index, reverse, err := indexPack(checksum, []*PackIndexEntry{baseEntry, deltaEntry})
+		if err != nil {
+			t.Fatal(err)
+		}
+		repo := newTestRepository(t)
+		if err := savePack(ctx, repo.store, checksum, pack.Bytes(), index, reverse, nil); err != nil {
+			t.Fatal(err)
+		}
+
+		_, data, err := repo.ReadRawObject(ctx, deltaEntry.Hash)
+		switch {
+		case test.err == "" && err != nil:
+			t.Error(err)
+		case test.err == "" && !bytes.Equal(data, target):
+			t.Errorf("Delta read as %q", data)
+		case test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)):
+			t.Errorf("Delta with its base moved by %d gave error %v, want %q", test.distance, err, test.err)
+		}
+	}
+}
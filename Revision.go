@@ -0,0 +1,223 @@
+package gitpacklib
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"strings"
+)
+
+// minAbbrevLength is the shortest abbreviated sha ResolveRevision accepts.
+const minAbbrevLength = 4
+
+// ResolveRevision returns the sha of the object named by rev, using a subset
+// of the syntax described in gitrevisions(7):
+//
+//	<sha>, <abbreviated sha>, <refname>, @
+//	<refname>@{<n>}, @{<n>}
+//	<rev>^, <rev>^<n>, <rev>~, <rev>~<n>
+//	<rev>^{}, <rev>^{commit}, <rev>^{tree}, <rev>^{tag}, <rev>^{blob}
+//	<rev>:<path>
+//
+// As HEAD has no reflog of its own, HEAD@{<n>} and @{<n>} read the reflog of
+// the branch HEAD points at.
+func (repo *Repository) ResolveRevision(ctx context.Context, rev string) (string, error) {
+	path := ""
+	hasPath := false
+	if i := strings.IndexByte(rev, ':'); i >= 0 {
+		rev, path, hasPath = rev[:i], rev[i+1:], true
+		if rev == "" {
+			return "", errors.New("Revision with a path must name a tree-ish before the ':'")
+		}
+	}
+
+	end := strings.IndexAny(rev, "^~")
+	if end < 0 {
+		end = len(rev)
+	}
+	sha, err := repo.resolveRevisionBase(ctx, rev[:end])
+	if err != nil {
+		return "", err
+	}
+
+	for suffix := rev[end:]; suffix != ""; {
+		op := suffix[0]
+		suffix = suffix[1:]
+
+		if op == '^' && strings.HasPrefix(suffix, "{") {
+			brace := strings.IndexByte(suffix, '}')
+			if brace < 0 {
+				return "", errors.New("Unterminated ^{ in revision " + rev)
+			}
+			sha, err = repo.peelRevision(ctx, sha, suffix[1:brace])
+			if err != nil {
+				return "", err
+			}
+			suffix = suffix[brace+1:]
+			continue
+		}
+
+		digits := len(suffix) - len(strings.TrimLeft(suffix, "0123456789"))
+		n := 1
+		if digits > 0 {
+			n, err = strconv.Atoi(suffix[:digits])
+			if err != nil {
+				return "", errors.New("Invalid number in revision " + rev)
+			}
+		}
+		suffix = suffix[digits:]
+
+		if op == '^' {
+			sha, err = repo.nthParent(ctx, sha, n)
+		} else {
+			for i := 0; i < n && err == nil; i++ {
+				sha, err = repo.nthParent(ctx, sha, 1)
+			}
+		}
+		if err != nil {
+			return "", err
+		}
+	}
+
+	if !hasPath {
+		return sha, nil
+	}
+
+	treeSha, err := repo.peelRevision(ctx, sha, TreeObject)
+	if err != nil {
+		return "", err
+	}
+	entry, err := repo.ReadTreeEntry(ctx, treeSha, path)
+	if err != nil {
+		return "", err
+	}
+	return entry.Hash, nil
+}
+
+func (repo *Repository) resolveRevisionBase(ctx context.Context, name string) (string, error) {
+	// a full sha is taken as one even if a ref has the same name, as git does
+	if isObjectSha(name) {
+		return name, nil
+	}
+	if i := strings.Index(name, "@{"); i >= 0 && strings.HasSuffix(name, "}") {
+		n, err := strconv.Atoi(name[i+2 : len(name)-1])
+		if err != nil || n < 0 {
+			return "", errors.New("Unsupported reflog revision " + name)
+		}
+		return repo.resolveReflogEntry(ctx, name[:i], n)
+	}
+	if name == "" || name == "@" {
+		name = HeadRef
+	}
+
+	sha, err := repo.ResolveRef(ctx, name)
+	if err != ErrRefNotFound {
+		return sha, err
+	}
+
+	if len(name) >= minAbbrevLength && isHex(name) {
+		return repo.expandAbbrevSha(ctx, name)
+	}
+	return "", errors.New("Unknown revision " + name)
+}
+
+// resolveReflogEntry returns the value the named ref was given n updates ago,
+// according to its reflog.
+func (repo *Repository) resolveReflogEntry(ctx context.Context, name string, n int) (string, error) {
+	if name == "" || name == "@" {
+		name = HeadRef
+	}
+	ref, err := repo.findRef(ctx, name)
+	if err != nil {
+		return "", err
+	}
+	entries, err := ReadReflog(ctx, repo.store, ref.Name)
+	if err != nil {
+		return "", err
+	}
+	if n >= len(entries) {
+		return "", errors.New("Log for " + name + " only has " + strconv.Itoa(len(entries)) + " entries")
+	}
+	if entries[n].NewHash == "" {
+		return "", errors.New("Log entry " + strconv.Itoa(n) + " of " + name + " deletes the ref")
+	}
+	return entries[n].NewHash, nil
+}
+
+func (repo *Repository) expandAbbrevSha(ctx context.Context, abbrev string) (string, error) {
+	keys, err := repo.store.List(ctx, objectKeyPrefix+abbrev)
+	if err != nil {
+		return "", err
+	}
+	packed, err := repo.packs.withPrefix(ctx, repo.store, abbrev, 2)
+	if err != nil {
+		return "", err
+	}
+
+	// an object may be both loose and in a pack, or in several packs
+	match := ""
+	for _, sha := range append(packed, keys...) {
+		sha = strings.TrimPrefix(sha, objectKeyPrefix)
+		if match != "" && sha != match {
+			return "", errors.New("Short object sha " + abbrev + " is ambiguous")
+		}
+		match = sha
+	}
+	if match == "" {
+		return "", errors.New("Unknown revision " + abbrev)
+	}
+	return match, nil
+}
+
+// nthParent returns the nth parent of the commit sha peels to. The 0th
+// parent is the commit itself.
+func (repo *Repository) nthParent(ctx context.Context, sha string, n int) (string, error) {
+	sha, err := repo.peelRevision(ctx, sha, CommitObject)
+	if err != nil {
+		return "", err
+	}
+	if n == 0 {
+		return sha, nil
+	}
+
+	commit, err := repo.ReadCommit(ctx, sha)
+	if err != nil {
+		return "", err
+	}
+	if n > len(commit.Parents) {
+		return "", errors.New("Commit " + sha + " has no parent " + strconv.Itoa(n))
+	}
+	return commit.Parents[n-1], nil
+}
+
+// peelRevision peels tags starting at sha until it reaches an object of type
+// want, or any non-tag object if want is empty. Commits peel to their tree.
+func (repo *Repository) peelRevision(ctx context.Context, sha string, want string) (string, error) {
+	for depth := 0; depth < maxTagDepth; depth++ {
+		objType, data, err := repo.ReadRawObject(ctx, sha)
+		if err != nil {
+			return "", err
+		}
+		if objType == want || (want == "" && objType != TagObject) {
+			return sha, nil
+		}
+
+		switch {
+		case objType == TagObject:
+			tag, err := ParseTag(data)
+			if err != nil {
+				return "", err
+			}
+			sha = tag.Object
+		case objType == CommitObject && want == TreeObject:
+			commit, err := ParseCommit(data)
+			if err != nil {
+				return "", err
+			}
+			sha = commit.Tree
+		default:
+			return "", errors.New("Object " + sha + " is a " + objType + ", not a " + want)
+		}
+	}
+	return "", errors.New("Chain of tags is too deep")
+}
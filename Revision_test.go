@@ -0,0 +1,95 @@
+package gitpacklib
+
+import (
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// revisionTestRepository makes a git repository with a merge, tags and a
+// reflog that moves back and forth, and copies its objects, refs and the
+// reflog of main into a repository.
+func revisionTestRepository(t *testing.T) (*Repository, string) {
+	ctx := context.Background()
+	dir := packTestRepository(t)
+	runGit(t, dir, "checkout", "-q", "-b", "topic", "HEAD~3")
+	writeFiles(t, dir, map[string][]byte{"topic.txt": []byte("topic\n")})
+	gitCommit(t, dir, "topic 1")
+	writeFiles(t, dir, map[string][]byte{"topic.txt": []byte("topic 2\n")})
+	gitCommit(t, dir, "topic 2")
+	runGit(t, dir, "checkout", "-q", "main")
+	runGit(t, dir, "merge", "-q", "--no-ff", "-m", "merge topic", "topic")
+	runGit(t, dir, "reset", "-q", "--hard", "HEAD~2")
+	runGit(t, dir, "reset", "-q", "--hard", "ORIG_HEAD")
+	runGit(t, dir, "tag", "light", "HEAD~1")
+
+	repo := newTestRepository(t)
+	importGitObjects(t, repo, dir)
+	updates := []*RefUpdate{{Name: HeadRef, NewTarget: "refs/heads/main"}}
+	for _, line := range strings.Split(strings.TrimSpace(string(runGit(t, dir, "for-each-ref", "--format=%(objectname) %(refname)"))), "\n") {
+		fields := strings.Fields(line)
+		updates = append(updates, &RefUpdate{Name: fields[1], NewHash: fields[0]})
+	}
+	if err := repo.RefStore().Update(ctx, updates); err != nil {
+		t.Fatal(err)
+	}
+	log, err := ioutil.ReadFile(filepath.Join(dir, ".git", "logs", "refs", "heads", "main"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.store.Set(ctx, reflogKeyPrefix+"refs/heads/main", log); err != nil {
+		t.Fatal(err)
+	}
+	return repo, dir
+}
+
+func TestResolveRevisionMatchesGit(t *testing.T) {
+	ctx := context.Background()
+	repo, dir := revisionTestRepository(t)
+	head := gitRevParse(t, dir, "HEAD")
+
+	for _, rev := range []string{
+		"HEAD", "@", "main", "refs/heads/main", "heads/main", "topic", "v1", "light",
+		head, head[:7], head[:4] + "~2", gitRevParse(t, dir, "HEAD^{tree}")[:10],
+		"HEAD^", "HEAD^1", "HEAD^2", "HEAD^0", "HEAD~", "HEAD~0", "HEAD~4", "HEAD^^", "HEAD~2^", "HEAD^2~1", "HEAD^2^",
+		"v1^{}", "v1^{commit}", "v1^{tree}", "v1^{tag}", "v1~2", "light^{}", "HEAD^{}", "HEAD^{tree}",
+		"main@{0}", "main@{1}", "main@{2}", "main@{3}~1", "@{1}", "@{2}^2", "refs/heads/main@{5}",
+		"HEAD:big.txt", "main~3:src/file1", "v1:src", "topic:topic.txt",
+	} {
+		want := gitRevParse(t, dir, rev)
+		got, err := repo.ResolveRevision(ctx, rev)
+		if err != nil {
+			t.Errorf("Error resolving %s: %v", rev, err)
+		} else if got != want {
+			t.Errorf("%s resolved to %s, git has %s", rev, got, want)
+		}
+	}
+
+	for _, rev := range []string{"missing", "HEAD^3", "HEAD~100", "v1^{blob}", "main@{100}", "HEAD:missing", "abc"} {
+		if sha, err := repo.ResolveRevision(ctx, rev); err == nil {
+			t.Errorf("%s resolved to %s", rev, sha)
+		}
+	}
+}
+
+func TestResolveRevisionPrefersFullShas(t *testing.T) {
+	ctx := context.Background()
+	repo, dir := revisionTestRepository(t)
+	head := gitRevParse(t, dir, "HEAD")
+	base := gitRevParse(t, dir, "HEAD~5")
+	runGit(t, dir, "branch", head, base)
+	runGit(t, dir, "branch", head[:8], base)
+	if err := repo.RefStore().Update(ctx, []*RefUpdate{{Name: "refs/heads/" + head, NewHash: base}, {Name: "refs/heads/" + head[:8], NewHash: base}}); err != nil {
+		t.Fatal(err)
+	}
+
+	// a full sha names the object, but an abbreviated one is a ref first
+	for _, rev := range []string{head, head[:8], head + "~1"} {
+		want := gitRevParse(t, dir, rev)
+		if got, err := repo.ResolveRevision(ctx, rev); err != nil || got != want {
+			t.Errorf("%s resolved to %s, git has %s: %v", rev, got, want, err)
+		}
+	}
+}
@@ -1,6 +1,8 @@
 package gitpacklib
 
 import (
+	"time"
+
 	"golang.org/x/crypto/ssh"
 )
 
@@ -9,4 +11,52 @@ type ServerConfig struct {
 	SSHConfig ssh.ServerConfig
 
 	ClientHandler ClientHandler
+
+	// LockTimeout is how long a push may wait for the repository lock before
+	// it is rejected with an error. Zero waits until the client disconnects.
+	LockTimeout time.Duration
+
+	// NewRefStore returns the RefStore for a repository's BackingStore. If
+	// nil, each ref is stored under its own key with a LooseRefStore.
+	NewRefStore func(store BackingStore) RefStore
+
+	// DefaultBranch is the branch HEAD points at in a new repository. If
+	// empty, the package DefaultBranch is used. Use SetDefaultBranch to
+	// change it for an existing repository.
+	DefaultBranch string
+
+	// RejectCaseCollisions rejects pushes creating refs whose names differ
+	// only in case from an existing ref, for the benefit of clients on
+	// case-insensitive filesystems such as those of macOS and Windows.
+	RejectCaseCollisions bool
+
+	// DenyNonFastForwards rejects pushes that would move a branch to a commit
+	// that does not contain its current one, like git's
+	// receive.denyNonFastForwards.
+	DenyNonFastForwards bool
+
+	// TrashRetention is how long refs deleted by a push are kept in the trash,
+	// from where an AdminClient can restore them. Zero uses
+	// DefaultTrashRetention, and a negative value deletes refs outright.
+	TrashRetention time.Duration
+
+	// HideRefs hides refs from clients, who can neither see nor push to them,
+	// using the same patterns as git's transfer.hideRefs. Clients implementing
+	// RefVisibilityClient have the final say.
+	HideRefs []string
+
+	// MaxPackSize bounds the size of the pack a push may send, like git's
+	// receive.maxInputSize. Zero uses DefaultMaxPackSize, and a negative
+	// value means no limit.
+	MaxPackSize int64
+
+	// GC controls how garbage is collected by the gitpacklib-gc command of
+	// an AdminClient, and after pushes if AutoGC is set. If nil, the
+	// defaults of GCOptions are used.
+	GC *GCOptions
+
+	// AutoGC collects garbage and repacks in the background after a push
+	// leaves a repository with too many loose objects or packs, like git's
+	// receive.autogc.
+	AutoGC bool
 }
@@ -0,0 +1,90 @@
+package gitpacklib
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Signature identifies the author or committer of a commit, or the tagger of
+// a tag. When is in the timezone recorded in the object, which is named by
+// the zone as written, so that zones such as -0000 are written back as read.
+type Signature struct {
+	Name  string
+	Email string
+	When  time.Time
+}
+
+// ParseSignature parses a signature as it appears in a commit or tag, like
+// "A U Thor <author@example.com> 1136239445 -0700".
+func ParseSignature(s string) (*Signature, error) {
+	invalid := errors.New("Invalid signature: " + s)
+
+	lt := strings.IndexByte(s, '<')
+	if lt < 0 {
+		return nil, invalid
+	}
+	gt := strings.IndexByte(s[lt:], '>')
+	if gt < 0 {
+		return nil, invalid
+	}
+	gt += lt
+
+	sig := &Signature{
+		Name:  strings.TrimSuffix(s[:lt], " "),
+		Email: s[lt+1 : gt],
+	}
+
+	fields := strings.Fields(s[gt+1:])
+	if len(fields) != 2 {
+		return nil, invalid
+	}
+
+	timestamp, err := strconv.ParseInt(fields[0], 10, 64)
+	if err != nil {
+		return nil, invalid
+	}
+	offset, ok := parseSignatureZone(fields[1])
+	if !ok {
+		return nil, invalid
+	}
+
+	sig.When = time.Unix(timestamp, 0).In(time.FixedZone(fields[1], offset))
+	return sig, nil
+}
+
+// parseSignatureZone returns the offset in seconds of a zone like -0700.
+func parseSignatureZone(zone string) (int, bool) {
+	if len(zone) != 5 || (zone[0] != '+' && zone[0] != '-') {
+		return 0, false
+	}
+	hours, err := strconv.Atoi(zone[1:3])
+	if err != nil {
+		return 0, false
+	}
+	minutes, err := strconv.Atoi(zone[3:5])
+	if err != nil {
+		return 0, false
+	}
+	offset := hours*3600 + minutes*60
+	if zone[0] == '-' {
+		offset = -offset
+	}
+	return offset, true
+}
+
+func (sig *Signature) String() string {
+	return fmt.Sprintf("%s <%s> %d %s", sig.Name, sig.Email, sig.When.Unix(), signatureZone(sig.When))
+}
+
+// signatureZone formats the timezone of when as in a signature, keeping the
+// zone as ParseSignature read it, such as -0000, if it has the same offset.
+func signatureZone(when time.Time) string {
+	name, offset := when.Zone()
+	if parsed, ok := parseSignatureZone(name); ok && parsed == offset {
+		return name
+	}
+	return when.Format("-0700")
+}
@@ -0,0 +1,75 @@
+package gitpacklib
+
+import (
+	"context"
+	"errors"
+	"strings"
+)
+
+// HeadRef is the symbolic ref pointing at the default branch of a repository,
+// which clients check out after cloning.
+const HeadRef = "HEAD"
+
+// DefaultBranch is the branch HEAD points at in a new repository, unless
+// configured otherwise.
+const DefaultBranch = "main"
+
+// maxSymbolicRefDepth matches the limit git places on chains of symbolic refs.
+const maxSymbolicRefDepth = 5
+
+var ErrSymbolicRefLoop = errors.New("Symbolic ref chain is too deep or loops")
+
+// ResolveRef follows name through any symbolic refs to the ref holding a
+// hash. If the chain ends at a ref that does not exist, such as an unborn
+// branch, the returned Ref has its name but no Hash.
+func ResolveRef(ctx context.Context, refs RefStore, name string) (*Ref, error) {
+	for depth := 0; depth <= maxSymbolicRefDepth; depth++ {
+		ref, err := refs.Get(ctx, name)
+		if err != nil {
+			return nil, err
+		}
+		if ref == nil {
+			return &Ref{Name: name}, nil
+		}
+		if ref.Target == "" {
+			return ref, nil
+		}
+		name = ref.Target
+	}
+	return nil, ErrSymbolicRefLoop
+}
+
+// SetDefaultBranch points HEAD at branch, which may be given either as a
+// short name like "main" or in full as "refs/heads/main".
+func SetDefaultBranch(ctx context.Context, refs RefStore, branch string) error {
+	if !strings.HasPrefix(branch, "refs/") {
+		branch = "refs/heads/" + branch
+	}
+
+	head, err := refs.Get(ctx, HeadRef)
+	if err != nil {
+		return err
+	}
+
+	update := &RefUpdate{Name: HeadRef, NewTarget: branch}
+	if head != nil {
+		update.OldHash = head.Hash
+		update.OldTarget = head.Target
+	}
+	return refs.Update(ctx, []*RefUpdate{update})
+}
+
+// ensureHead points HEAD at branch if the repository has no HEAD yet.
+func ensureHead(ctx context.Context, refs RefStore, branch string) error {
+	head, err := refs.Get(ctx, HeadRef)
+	if err != nil || head != nil {
+		return err
+	}
+
+	err = refs.Update(ctx, []*RefUpdate{{Name: HeadRef, NewTarget: "refs/heads/" + branch}})
+	if err == ErrStaleRef {
+		// created concurrently by another session
+		return nil
+	}
+	return err
+}
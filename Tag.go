@@ -0,0 +1,84 @@
+package gitpacklib
+
+import (
+	"bytes"
+	"errors"
+)
+
+// Tag is a parsed annotated tag object. Tagger is nil for old tags made
+// before git recorded one. A signature on the tag is part of its Message.
+type Tag struct {
+	Object       string
+	ObjectType   string
+	Name         string
+	Tagger       *Signature
+	ExtraHeaders []ObjectHeader
+	Message      string
+}
+
+// ParseTag parses the content of a tag object, failing if required headers
+// are missing, out of order or malformed.
+func ParseTag(data []byte) (*Tag, error) {
+	headers, message, err := parseObjectHeaders(data)
+	if err != nil {
+		return nil, errors.New("Invalid tag: " + err.Error())
+	}
+
+	tag := &Tag{Message: message}
+
+	// object, type and tag must come first and in that order
+	if len(headers) < 3 || headers[0].Key != "object" || headers[1].Key != "type" || headers[2].Key != "tag" {
+		return nil, errors.New("Invalid tag: missing object, type or tag header")
+	}
+	tag.Object = headers[0].Value
+	tag.ObjectType = headers[1].Value
+	tag.Name = headers[2].Value
+
+	if !isObjectSha(tag.Object) {
+		return nil, errors.New("Invalid tag: invalid object " + tag.Object)
+	}
+	switch tag.ObjectType {
+	case CommitObject, TreeObject, BlobObject, TagObject:
+	default:
+		return nil, errors.New("Invalid tag: invalid type " + tag.ObjectType)
+	}
+
+	rest := headers[3:]
+	if len(rest) > 0 && rest[0].Key == "tagger" {
+		tag.Tagger, err = ParseSignature(rest[0].Value)
+		if err != nil {
+			return nil, errors.New("Invalid tag: " + err.Error())
+		}
+		rest = rest[1:]
+	}
+
+	for _, header := range rest {
+		switch header.Key {
+		case "object", "type", "tag", "tagger":
+			return nil, errors.New("Invalid tag: unexpected " + header.Key + " header")
+		}
+		tag.ExtraHeaders = append(tag.ExtraHeaders, header)
+	}
+
+	return tag, nil
+}
+
+func (tag *Tag) Type() string {
+	return TagObject
+}
+
+func (tag *Tag) Serialize() []byte {
+	b := &bytes.Buffer{}
+	writeObjectHeader(b, "object", tag.Object)
+	writeObjectHeader(b, "type", tag.ObjectType)
+	writeObjectHeader(b, "tag", tag.Name)
+	if tag.Tagger != nil {
+		writeObjectHeader(b, "tagger", tag.Tagger.String())
+	}
+	for _, header := range tag.ExtraHeaders {
+		writeObjectHeader(b, header.Key, header.Value)
+	}
+	b.WriteByte('\n')
+	b.WriteString(tag.Message)
+	return b.Bytes()
+}
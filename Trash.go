@@ -0,0 +1,159 @@
+package gitpacklib
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// trashKeyPrefix is prepended to the ID of a deleted ref to give the backing
+// store key holding its TrashEntry.
+const trashKeyPrefix = "trash/"
+
+// DefaultTrashRetention is how long deleted refs are kept in the trash unless
+// configured otherwise.
+const DefaultTrashRetention = 30 * 24 * time.Hour
+
+var ErrTrashEntryNotFound = errors.New("No such deleted ref in the trash")
+
+// TrashEntry is a deleted ref kept so that it can be restored. Until it
+// expires, the objects it points at are treated as reachable.
+type TrashEntry struct {
+	ID        string `json:"-"`
+	Name      string
+	Hash      string
+	DeletedBy string
+	DeletedAt time.Time
+	ExpiresAt time.Time
+}
+
+// TrashRef keeps the last value of a deleted ref in the trash for retention,
+// and purges any entries that have expired.
+func TrashRef(ctx context.Context, store BackingStore, name string, hash string, deletedBy string, retention time.Duration) error {
+	now := time.Now()
+	entry := &TrashEntry{
+		Name:      name,
+		Hash:      hash,
+		DeletedBy: deletedBy,
+		DeletedAt: now,
+		ExpiresAt: now.Add(retention),
+	}
+
+	value, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	// IDs start with a fixed width timestamp so that listing the trash gives
+	// entries in the order they were deleted
+	id := fmt.Sprintf("%020d/%s", now.UnixNano(), name)
+	err = store.Set(ctx, trashKeyPrefix+id, value)
+	if err != nil {
+		return err
+	}
+
+	return PurgeTrash(ctx, store, now)
+}
+
+// ListTrash returns the deleted refs in the trash that have not yet expired,
+// most recently deleted first.
+func ListTrash(ctx context.Context, store BackingStore) ([]*TrashEntry, error) {
+	keys, err := store.List(ctx, trashKeyPrefix)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	var entries []*TrashEntry
+	for i := len(keys) - 1; i >= 0; i-- {
+		entry, err := readTrashEntry(ctx, store, strings.TrimPrefix(keys[i], trashKeyPrefix))
+		if err == ErrTrashEntryNotFound {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if now.Before(entry.ExpiresAt) {
+			entries = append(entries, entry)
+		}
+	}
+	return entries, nil
+}
+
+// PurgeTrash removes entries that expired before now from the trash.
+func PurgeTrash(ctx context.Context, store BackingStore, now time.Time) error {
+	keys, err := store.List(ctx, trashKeyPrefix)
+	if err != nil {
+		return err
+	}
+
+	for _, key := range keys {
+		entry, err := readTrashEntry(ctx, store, strings.TrimPrefix(key, trashKeyPrefix))
+		if err == ErrTrashEntryNotFound {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if !now.Before(entry.ExpiresAt) {
+			err = store.Delete(ctx, key)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// RestoreTrashedRef recreates the deleted ref with the given trash ID and
+// removes it from the trash. The ref must not have been recreated since it
+// was deleted. The restore is logged in the ref's reflog against identity.
+func RestoreTrashedRef(ctx context.Context, store BackingStore, refs RefStore, id string, identity string) (*TrashEntry, error) {
+	entry, err := readTrashEntry(ctx, store, id)
+	if err != nil {
+		return nil, err
+	}
+	if !time.Now().Before(entry.ExpiresAt) {
+		return nil, ErrTrashEntryNotFound
+	}
+
+	err = refs.Update(ctx, []*RefUpdate{{Name: entry.Name, NewHash: entry.Hash, Reflog: &ReflogEntry{
+		Identity: identity,
+		Time:     time.Now(),
+		Message:  "restore: from trash " + id,
+	}}})
+	if err == ErrStaleRef {
+		return nil, errors.New("Ref " + entry.Name + " has been recreated since it was deleted")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	err = store.Delete(ctx, trashKeyPrefix+id)
+	if err != nil {
+		return nil, err
+	}
+	return entry, nil
+}
+
+func readTrashEntry(ctx context.Context, store BackingStore, id string) (*TrashEntry, error) {
+	value, err := store.Get(ctx, trashKeyPrefix+id)
+	if os.IsNotExist(err) {
+		return nil, ErrTrashEntryNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	entry := &TrashEntry{}
+	err = json.Unmarshal(value, entry)
+	if err != nil {
+		return nil, err
+	}
+	entry.ID = id
+	return entry, nil
+}
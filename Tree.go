@@ -0,0 +1,169 @@
+package gitpacklib
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// File modes of tree entries.
+const (
+	ModeTree       uint32 = 0040000
+	ModeBlob       uint32 = 0100644
+	ModeExecutable uint32 = 0100755
+	ModeSymlink    uint32 = 0120000
+	ModeSubmodule  uint32 = 0160000
+
+	// modeGroupWritable is written by very old versions of git, and is
+	// treated as ModeBlob.
+	modeGroupWritable uint32 = 0100664
+)
+
+// TreeEntry is a single file, directory, symlink or submodule in a Tree.
+type TreeEntry struct {
+	Mode uint32
+	Name string
+	Hash string
+}
+
+// IsTree reports whether the entry is a subdirectory.
+func (entry *TreeEntry) IsTree() bool {
+	return entry.Mode == ModeTree
+}
+
+// Tree is a parsed tree object. Entries are in git's order, which is by name
+// but with subdirectories sorted as if their name ended in '/'.
+type Tree struct {
+	Entries []TreeEntry
+}
+
+// ParseTree parses the content of a tree object, failing on malformed
+// entries and on entries that are duplicated or out of order, as git fsck
+// does. What fsck only warns about, such as zero-padded modes and entries
+// named .git, is accepted, since older tools wrote trees like that. Trees
+// being written are held to the stricter rules of check.
+func ParseTree(data []byte) (*Tree, error) {
+	tree := &Tree{}
+	seen := make(map[string]bool)
+
+	for len(data) > 0 {
+		space := bytes.IndexByte(data, ' ')
+		if space < 0 {
+			return nil, errors.New("Invalid tree: entry has no mode")
+		}
+		modeStr := string(data[:space])
+		mode, err := strconv.ParseUint(modeStr, 8, 32)
+		if err != nil {
+			return nil, errors.New("Invalid tree: invalid mode " + modeStr)
+		}
+		data = data[space+1:]
+
+		nul := bytes.IndexByte(data, 0)
+		if nul < 0 || len(data) < nul+1+20 {
+			return nil, errors.New("Invalid tree: entry is truncated")
+		}
+		entry := TreeEntry{
+			Mode: uint32(mode),
+			Name: string(data[:nul]),
+			Hash: hex.EncodeToString(data[nul+1 : nul+1+20]),
+		}
+		data = data[nul+1+20:]
+
+		if seen[entry.Name] {
+			return nil, errors.New("Invalid tree: duplicate entry " + entry.Name)
+		}
+		seen[entry.Name] = true
+		if n := len(tree.Entries); n > 0 && !treeEntryLess(&tree.Entries[n-1], &entry) {
+			return nil, errors.New("Invalid tree: entries are not sorted")
+		}
+
+		tree.Entries = append(tree.Entries, entry)
+	}
+
+	return tree, nil
+}
+
+// check fails on unknown modes, invalid names, and entries that are
+// duplicated or out of order, so that no tree git fsck would warn about is
+// written.
+func (tree *Tree) check() error {
+	seen := make(map[string]bool)
+	for i := range tree.Entries {
+		entry := &tree.Entries[i]
+		switch entry.Mode {
+		case ModeTree, ModeBlob, ModeExecutable, ModeSymlink, ModeSubmodule, modeGroupWritable:
+		default:
+			return fmt.Errorf("Invalid tree: invalid mode %o", entry.Mode)
+		}
+		if err := checkTreeEntryName(entry.Name); err != nil {
+			return err
+		}
+		if seen[entry.Name] {
+			return errors.New("Invalid tree: duplicate entry " + entry.Name)
+		}
+		seen[entry.Name] = true
+		if i > 0 && !treeEntryLess(&tree.Entries[i-1], entry) {
+			return errors.New("Invalid tree: entries are not sorted")
+		}
+	}
+	return nil
+}
+
+func checkTreeEntryName(name string) error {
+	if name == "" || name == "." || name == ".." || name == ".git" {
+		return fmt.Errorf("Invalid tree: invalid entry name %q", name)
+	}
+	if strings.ContainsAny(name, "/\x00") {
+		return fmt.Errorf("Invalid tree: invalid entry name %q", name)
+	}
+	return nil
+}
+
+// treeEntryLess orders entries as git does, comparing subdirectories as if
+// their name ended in '/'.
+func treeEntryLess(a, b *TreeEntry) bool {
+	nameA, nameB := a.Name, b.Name
+	if a.IsTree() {
+		nameA += "/"
+	}
+	if b.IsTree() {
+		nameB += "/"
+	}
+	return nameA < nameB
+}
+
+// Sort puts the entries into git's order, which trees must be in when they
+// are stored.
+func (tree *Tree) Sort() {
+	sort.Slice(tree.Entries, func(i, j int) bool {
+		return treeEntryLess(&tree.Entries[i], &tree.Entries[j])
+	})
+}
+
+// Entry returns the entry with the given name, or nil if there is none.
+func (tree *Tree) Entry(name string) *TreeEntry {
+	for i := range tree.Entries {
+		if tree.Entries[i].Name == name {
+			return &tree.Entries[i]
+		}
+	}
+	return nil
+}
+
+func (tree *Tree) Type() string {
+	return TreeObject
+}
+
+func (tree *Tree) Serialize() []byte {
+	b := &bytes.Buffer{}
+	for _, entry := range tree.Entries {
+		hash, _ := hex.DecodeString(entry.Hash)
+		fmt.Fprintf(b, "%o %s\x00", entry.Mode, entry.Name)
+		b.Write(hash)
+	}
+	return b.Bytes()
+}
@@ -0,0 +1,372 @@
+package gitpacklib
+
+import (
+	"context"
+	"hash/fnv"
+	"path"
+	"sort"
+)
+
+// ChangeType says how a path differs between two trees, using the status
+// letters of git diff --name-status.
+type ChangeType byte
+
+const (
+	ChangeAdded       ChangeType = 'A'
+	ChangeDeleted     ChangeType = 'D'
+	ChangeModified    ChangeType = 'M'
+	ChangeRenamed     ChangeType = 'R'
+	ChangeTypeChanged ChangeType = 'T'
+)
+
+// DefaultRenameThreshold is the similarity, in percent, at which a deleted
+// and an added file are taken to be a rename, as in git.
+const DefaultRenameThreshold = 50
+
+// maxRenameCandidates limits inexact rename detection to diffs with at most
+// this many deleted and added files, like git's diff.renameLimit.
+const maxRenameCandidates = 1000
+
+// Change is a single path that differs between two trees. Only files,
+// symlinks and submodules are reported, never directories. Added files have
+// an empty OldPath and OldHash, and deleted files an empty NewPath and
+// NewHash.
+type Change struct {
+	Type    ChangeType
+	OldPath string
+	NewPath string
+	OldMode uint32
+	NewMode uint32
+	OldHash string
+	NewHash string
+
+	// Similarity is how alike the old and new content of a rename are, in
+	// percent.
+	Similarity int
+}
+
+// Path returns the path of the change in the new tree, or for deletions the
+// old tree.
+func (change *Change) Path() string {
+	if change.NewPath != "" {
+		return change.NewPath
+	}
+	return change.OldPath
+}
+
+type DiffOptions struct {
+	// DetectRenames pairs up deleted and added files with similar content
+	// as renames.
+	DetectRenames bool
+
+	// RenameThreshold is the similarity, in percent, a pair needs to be
+	// reported as a rename. Zero uses DefaultRenameThreshold.
+	RenameThreshold int
+}
+
+// DiffTrees returns the paths that differ between two trees, in tree order.
+// Either tree may be the empty string to diff against an empty tree.
+func (repo *Repository) DiffTrees(ctx context.Context, oldTree string, newTree string, opts *DiffOptions) ([]*Change, error) {
+	var changes []*Change
+	if err := repo.diffTrees(ctx, oldTree, newTree, "", &changes); err != nil {
+		return nil, err
+	}
+
+	if opts != nil && opts.DetectRenames {
+		threshold := opts.RenameThreshold
+		if threshold == 0 {
+			threshold = DefaultRenameThreshold
+		}
+		return repo.detectRenames(ctx, changes, threshold)
+	}
+	return changes, nil
+}
+
+// DiffCommits returns the paths that differ between the trees of two
+// commits. oldCommit may be the empty string to show everything in newCommit
+// as added, as for a root commit.
+func (repo *Repository) DiffCommits(ctx context.Context, oldCommit string, newCommit string, opts *DiffOptions) ([]*Change, error) {
+	var oldTree string
+	if oldCommit != "" {
+		commit, err := repo.ReadCommit(ctx, oldCommit)
+		if err != nil {
+			return nil, err
+		}
+		oldTree = commit.Tree
+	}
+
+	commit, err := repo.ReadCommit(ctx, newCommit)
+	if err != nil {
+		return nil, err
+	}
+	return repo.DiffTrees(ctx, oldTree, commit.Tree, opts)
+}
+
+func (repo *Repository) diffTrees(ctx context.Context, oldTree string, newTree string, prefix string, changes *[]*Change) error {
+	if oldTree == newTree {
+		return nil
+	}
+
+	oldEntries, err := repo.readTreeEntries(ctx, oldTree)
+	if err != nil {
+		return err
+	}
+	newEntries, err := repo.readTreeEntries(ctx, newTree)
+	if err != nil {
+		return err
+	}
+
+	// a file and a directory can share a name, so match entries up by name
+	// and kind rather than walking both trees in step
+	type entryPair struct {
+		old, new *TreeEntry
+	}
+	var pairs []*entryPair
+	byName := map[string]*entryPair{}
+	add := func(entry *TreeEntry, isOld bool) {
+		key := entry.Name
+		if entry.IsTree() {
+			key += "/"
+		}
+		pair := byName[key]
+		if pair == nil {
+			pair = &entryPair{}
+			byName[key] = pair
+			pairs = append(pairs, pair)
+		}
+		if isOld {
+			pair.old = entry
+		} else {
+			pair.new = entry
+		}
+	}
+	for i := range oldEntries {
+		add(&oldEntries[i], true)
+	}
+	for i := range newEntries {
+		add(&newEntries[i], false)
+	}
+	sort.SliceStable(pairs, func(i, j int) bool {
+		a, b := pairs[i].old, pairs[j].old
+		if a == nil {
+			a = pairs[i].new
+		}
+		if b == nil {
+			b = pairs[j].new
+		}
+		return treeEntryLess(a, b)
+	})
+
+	for _, pair := range pairs {
+		var name string
+		var oldSub, newSub string
+		if pair.old != nil {
+			name = prefix + pair.old.Name
+			oldSub = pair.old.Hash
+		} else {
+			name = prefix + pair.new.Name
+		}
+		if pair.new != nil {
+			newSub = pair.new.Hash
+		}
+
+		isTree := (pair.old != nil && pair.old.IsTree()) || (pair.new != nil && pair.new.IsTree())
+		if isTree {
+			if err := repo.diffTrees(ctx, oldSub, newSub, name+"/", changes); err != nil {
+				return err
+			}
+			continue
+		}
+
+		switch {
+		case pair.new == nil:
+			*changes = append(*changes, &Change{Type: ChangeDeleted, OldPath: name, OldMode: pair.old.Mode, OldHash: pair.old.Hash})
+		case pair.old == nil:
+			*changes = append(*changes, &Change{Type: ChangeAdded, NewPath: name, NewMode: pair.new.Mode, NewHash: pair.new.Hash})
+		case pair.old.Hash != pair.new.Hash || pair.old.Mode != pair.new.Mode:
+			change := &Change{
+				Type:    ChangeModified,
+				OldPath: name, NewPath: name,
+				OldMode: pair.old.Mode, NewMode: pair.new.Mode,
+				OldHash: pair.old.Hash, NewHash: pair.new.Hash,
+			}
+			if modeKind(change.OldMode) != modeKind(change.NewMode) {
+				change.Type = ChangeTypeChanged
+			}
+			*changes = append(*changes, change)
+		}
+	}
+	return nil
+}
+
+func (repo *Repository) readTreeEntries(ctx context.Context, sha string) ([]TreeEntry, error) {
+	if sha == "" {
+		return nil, nil
+	}
+	tree, err := repo.ReadTree(ctx, sha)
+	if err != nil {
+		return nil, err
+	}
+	return tree.Entries, nil
+}
+
+// modeKind returns the file type bits of a mode, so that a change between
+// ModeBlob and ModeExecutable is a modification but one from ModeBlob to
+// ModeSymlink changes the type.
+func modeKind(mode uint32) uint32 {
+	return mode & 0170000
+}
+
+// detectRenames replaces deleted and added files that are alike with
+// renames, placed where the added file was. Identical content is paired
+// first, then content at least threshold percent similar.
+func (repo *Repository) detectRenames(ctx context.Context, changes []*Change, threshold int) ([]*Change, error) {
+	var deleted, added []int
+	for i, change := range changes {
+		if change.Type == ChangeDeleted && modeKind(change.OldMode) != modeKind(ModeSubmodule) {
+			deleted = append(deleted, i)
+		}
+		if change.Type == ChangeAdded && modeKind(change.NewMode) != modeKind(ModeSubmodule) {
+			added = append(added, i)
+		}
+	}
+	if len(deleted) == 0 || len(added) == 0 {
+		return changes, nil
+	}
+
+	// each file is split into chunks once, however many it is compared with
+	blobs := map[string]*fileChunks{}
+	readChunks := func(sha string) (*fileChunks, error) {
+		if chunks, ok := blobs[sha]; ok {
+			return chunks, nil
+		}
+		_, data, err := repo.ReadRawObject(ctx, sha)
+		if err != nil {
+			return nil, err
+		}
+		blobs[sha] = contentChunks(data)
+		return blobs[sha], nil
+	}
+
+	type renamePair struct {
+		del, add   int
+		similarity int
+		sameName   bool
+	}
+	var candidates []renamePair
+	inexact := len(deleted) <= maxRenameCandidates && len(added) <= maxRenameCandidates
+	for _, a := range added {
+		for _, d := range deleted {
+			from, to := changes[d], changes[a]
+			if modeKind(from.OldMode) != modeKind(to.NewMode) {
+				continue
+			}
+			pair := renamePair{d, a, 100, path.Base(from.OldPath) == path.Base(to.NewPath)}
+
+			if from.OldHash != to.NewHash {
+				if !inexact {
+					continue
+				}
+				fromChunks, err := readChunks(from.OldHash)
+				if err != nil {
+					return nil, err
+				}
+				toChunks, err := readChunks(to.NewHash)
+				if err != nil {
+					return nil, err
+				}
+				pair.similarity = contentSimilarity(fromChunks, toChunks)
+				if pair.similarity >= 100 {
+					pair.similarity = 99
+				}
+			}
+			if pair.similarity >= threshold {
+				candidates = append(candidates, pair)
+			}
+		}
+	}
+
+	// best matches first, preferring files that kept their name
+	sort.SliceStable(candidates, func(i, j int) bool {
+		if candidates[i].similarity != candidates[j].similarity {
+			return candidates[i].similarity > candidates[j].similarity
+		}
+		return candidates[i].sameName && !candidates[j].sameName
+	})
+
+	used := map[int]bool{}
+	for _, pair := range candidates {
+		if used[pair.del] || used[pair.add] {
+			continue
+		}
+		used[pair.del] = true
+		used[pair.add] = true
+
+		from, to := changes[pair.del], changes[pair.add]
+		changes[pair.add] = &Change{
+			Type:    ChangeRenamed,
+			OldPath: from.OldPath, NewPath: to.NewPath,
+			OldMode: from.OldMode, NewMode: to.NewMode,
+			OldHash: from.OldHash, NewHash: to.NewHash,
+			Similarity: pair.similarity,
+		}
+		changes[pair.del] = nil
+	}
+
+	result := changes[:0]
+	for _, change := range changes {
+		if change != nil {
+			result = append(result, change)
+		}
+	}
+	return result, nil
+}
+
+// fileChunks is the content of a file as a bag of chunks, giving the number
+// of bytes of content in each distinct chunk.
+type fileChunks struct {
+	size   int
+	chunks map[uint64]int
+}
+
+// contentSimilarity estimates how much of the larger of two files is shared
+// with the other, in percent. Like git, it compares the files as bags of
+// lines, with long lines split into 64 byte chunks.
+func contentSimilarity(a *fileChunks, b *fileChunks) int {
+	larger := a.size
+	if b.size > larger {
+		larger = b.size
+	}
+	if larger == 0 {
+		return 100
+	}
+
+	shared := 0
+	for chunk, size := range b.chunks {
+		if other := a.chunks[chunk]; other < size {
+			shared += other
+		} else {
+			shared += size
+		}
+	}
+	return shared * 100 / larger
+}
+
+// contentChunks splits data into the chunks compared by contentSimilarity.
+func contentChunks(data []byte) *fileChunks {
+	chunks := &fileChunks{size: len(data), chunks: map[uint64]int{}}
+	for len(data) > 0 {
+		n := 0
+		for n < len(data) && n < 64 {
+			n++
+			if data[n-1] == '\n' {
+				break
+			}
+		}
+		hash := fnv.New64a()
+		hash.Write(data[:n])
+		chunks.chunks[hash.Sum64()] += n
+		data = data[n:]
+	}
+	return chunks
+}
@@ -0,0 +1,130 @@
+package gitpacklib
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// diffTestRepository makes a git repository with two commits between which
+// files are changed, added, deleted, renamed and change mode and type, and
+// returns it with the shas of the commits.
+func diffTestRepository(t *testing.T) (string, string, string) {
+	dir := newGitRepository(t)
+	var lines, numbers strings.Builder
+	for i := 1; i <= 200; i++ {
+		lines.WriteString("line " + strconv.Itoa(i) + "\n")
+		if i <= 100 {
+			numbers.WriteString(strconv.Itoa(i) + "\n")
+		}
+	}
+	writeFiles(t, dir, map[string][]byte{
+		"src/big.txt":  []byte(lines.String()),
+		"src/main.go":  []byte("package main\n\nfunc main() {\n\tx := 1\n\ty := 2\n\tprintln(x + y)\n}\n"),
+		"nonl":         []byte("no newline"),
+		"bin.dat":      []byte("bin\x00ary"),
+		"mode.sh":      []byte("keep\n"),
+		"linkme":       []byte("tofile\n"),
+		"exact1":       []byte("same\n"),
+		"movable":      []byte(numbers.String()),
+		"deleted.txt":  []byte("gone\n"),
+		"docs/readme":  []byte("hello\n"),
+		"dir/file.txt": []byte("x\n"),
+	})
+	one := gitCommit(t, dir, "one")
+
+	big := strings.Replace(lines.String(), "line 5\n", "LINE FIVE\n", 1)
+	big = strings.Replace(big, "line 100\n", "changed\n", 1)
+	big = strings.Replace(big, "line 150\n", "", 1)
+	moved := strings.Replace(numbers.String(), "\n50\n", "\nfifty\n", 1)
+	writeFiles(t, dir, map[string][]byte{
+		"src/big.txt":  []byte(big + "line 201\n"),
+		"src/main.go":  []byte("package main\n\nfunc main() {\n\tx := 1\n\ty := 3\n\tprintln(x + y)\n}\n"),
+		"nonl":         []byte("no newline either"),
+		"bin.dat":      []byte("bin\x00ary2"),
+		"linkme":       nil,
+		"exact1":       nil,
+		"exact2":       []byte("same\n"),
+		"movable":      nil,
+		"moved":        []byte(moved),
+		"deleted.txt":  nil,
+		"dir/file.txt": nil,
+		"dir":          []byte("file\n"),
+		"docs/added":   []byte("new\n"),
+		"empty":        []byte{},
+	})
+	if err := os.Chmod(filepath.Join(dir, "mode.sh"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("target", filepath.Join(dir, "linkme")); err != nil {
+		t.Fatal(err)
+	}
+	two := gitCommit(t, dir, "two")
+	return dir, one, two
+}
+
+func TestWritePatchMatchesGit(t *testing.T) {
+	ctx := context.Background()
+	dir, one, two := diffTestRepository(t)
+	repo := newTestRepository(t)
+	importGitObjects(t, repo, dir)
+
+	for _, test := range []struct {
+		renames bool
+		context int
+	}{
+		{false, DefaultContextLines},
+		{true, DefaultContextLines},
+		{false, 0},
+		{true, 1},
+		{false, 10},
+	} {
+		args := []string{"-c", "core.abbrev=7", "-c", "diff.renames=false", "diff", "--no-color", "--no-ext-diff", "-U" + strconv.Itoa(test.context)}
+		if test.renames {
+			args = append(args, "-M")
+		}
+		want := runGit(t, dir, append(args, one, two)...)
+
+		changes, err := repo.DiffCommits(ctx, one, two, &DiffOptions{DetectRenames: test.renames})
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := &bytes.Buffer{}
+		if err := repo.WritePatch(ctx, got, changes, test.context); err != nil {
+			t.Fatal(err)
+		}
+		if got.String() != string(want) {
+			t.Errorf("Patch with renames %v and %d lines of context differs from git's:\n%s\nwant:\n%s", test.renames, test.context, got, want)
+		}
+	}
+}
+
+func TestDiffTreesRenamesMatchGit(t *testing.T) {
+	ctx := context.Background()
+	dir, one, two := diffTestRepository(t)
+	repo := newTestRepository(t)
+	importGitObjects(t, repo, dir)
+
+	want := strings.Replace(string(runGit(t, dir, "diff", "--name-status", "-M", "-z", one, two)), "\x00", "\n", -1)
+
+	changes, err := repo.DiffCommits(ctx, one, two, &DiffOptions{DetectRenames: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := &strings.Builder{}
+	for _, change := range changes {
+		if change.Type == ChangeRenamed {
+			fmt.Fprintf(got, "R%03d\n%s\n%s\n", change.Similarity, change.OldPath, change.NewPath)
+		} else {
+			fmt.Fprintf(got, "%c\n%s\n", change.Type, change.Path())
+		}
+	}
+	if got.String() != want {
+		t.Errorf("Changes differ from git's:\n%s\nwant:\n%s", got, want)
+	}
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"log"
+	"time"
 
 	"github.com/theojulienne/gitpacklib"
 	"golang.org/x/crypto/ssh"
@@ -28,6 +29,11 @@ func (h *DummyClient) PublicKeyChosen(key ssh.PublicKey) {
 	h.key = key
 }
 
+func (c *DummyClient) IsRepositoryAdmin(repoPath string) bool {
+	log.Println("Allowing administration of repo:", c, repoPath)
+	return true
+}
+
 func (c *DummyClient) GetRepositoryBackingStore(repoPath string) (gitpacklib.BackingStore, error) {
 	log.Println("Authenticating client against repo and providing backing store:", c, repoPath)
 	store, err := gitpacklib.NewFileBackingStore("_gitdata")
@@ -42,6 +48,7 @@ func main() {
 			NoClientAuth: false,
 		},
 		ClientHandler: &clientHandler,
+		LockTimeout:   30 * time.Second,
 	}
 
 	gitpacklib.ParseKeysFromFile(&config.SSHConfig, "server.key")
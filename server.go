@@ -2,6 +2,7 @@ package gitpacklib
 
 import (
 	"bytes"
+	"context"
 	"encoding/base64"
 	"encoding/binary"
 	"errors"
@@ -16,6 +17,13 @@ import (
 const authenticatedPublicKeyExt = "gitpacklib.publickey"
 
 func RunServer(conf *ServerConfig) error {
+	return RunServerContext(context.Background(), conf)
+}
+
+// RunServerContext is like RunServer, but stops accepting connections once
+// ctx is done and cancels any pushes still in progress, including those
+// waiting on a repository lock.
+func RunServerContext(ctx context.Context, conf *ServerConfig) error {
 	port := 22
 	if conf.SSHPort != 0 {
 		port = conf.SSHPort
@@ -26,39 +34,56 @@ func RunServer(conf *ServerConfig) error {
 		return err
 	}
 
+	go func() {
+		<-ctx.Done()
+		listener.Close()
+	}()
+
 	for {
 		conn, err := listener.Accept()
 		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
 			log.Println(err)
 			continue
 		}
 
-		go handleSSHConnection(conn, conf)
+		go handleSSHConnection(ctx, conn, conf)
 	}
-
-	return nil
 }
 
 type ClientSession struct {
 	conn     net.Conn
 	confCopy ssh.ServerConfig
 
+	conf   *ServerConfig
 	client Client
 	pubKey ssh.PublicKey
 }
 
-func handleSSHConnection(conn net.Conn, conf *ServerConfig) {
+func handleSSHConnection(ctx context.Context, conn net.Conn, conf *ServerConfig) {
 	session := &ClientSession{}
 	session.conn = conn
 	session.confCopy = conf.SSHConfig
+	session.conf = conf
 
 	session.client = conf.ClientHandler.NewClient()
 
 	defer session.conn.Close()
-	session.handle()
+	session.handle(ctx)
 }
 
-func (session *ClientSession) handle() {
+func (session *ClientSession) handle(ctx context.Context) {
+	// sessions on this connection are cancelled once it goes away, either
+	// because the client disconnected or because the server is shutting down
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		<-ctx.Done()
+		session.conn.Close()
+	}()
+
 	// prepare our copy of the config
 	if session.confCopy.PublicKeyCallback != nil {
 		log.Fatalln("PublicKeyCallback must be nil")
@@ -110,12 +135,12 @@ func (session *ClientSession) handle() {
 			ch.Reject(ssh.UnknownChannelType, "unknown channel type")
 			continue
 		}
-		go session.handleSSHSessionChannel(sshConn, ch)
+		go session.handleSSHSessionChannel(ctx, sshConn, ch)
 	}
 
 }
 
-func (session *ClientSession) handleSSHSessionChannel(conn *ssh.ServerConn, newChan ssh.NewChannel) {
+func (session *ClientSession) handleSSHSessionChannel(ctx context.Context, conn *ssh.ServerConn, newChan ssh.NewChannel) {
 	ch, reqs, err := newChan.Accept()
 	if err != nil {
 		log.Println("newChan.Accept failed:", err)
@@ -126,7 +151,7 @@ func (session *ClientSession) handleSSHSessionChannel(conn *ssh.ServerConn, newC
 	for req := range reqs {
 		switch req.Type {
 		case "exec":
-			session.handleSSHExec(conn, ch, req)
+			session.handleSSHExec(ctx, conn, ch, req)
 			return
 		case "env":
 			if req.WantReply {
@@ -140,11 +165,27 @@ func (session *ClientSession) handleSSHSessionChannel(conn *ssh.ServerConn, newC
 	}
 }
 
-func (session *ClientSession) handleSSHExec(conn *ssh.ServerConn, ch ssh.Channel, req *ssh.Request) {
-	packSession, err := session.setupPackSessionFromReq(req)
+func (session *ClientSession) handleSSHExec(ctx context.Context, conn *ssh.ServerConn, ch ssh.Channel, req *ssh.Request) {
+	var run func() uint32
+
+	execCmd, err := parseExecPayload(req.Payload)
+	if err == nil {
+		if strings.HasPrefix(execCmd, trashCommand+" ") {
+			run, err = session.setupTrashCommand(ctx, ch, execCmd)
+		} else if strings.HasPrefix(execCmd, gcCommand+" ") {
+			run, err = session.setupGCCommand(ctx, ch, execCmd)
+		} else {
+			var packSession *GitReceiveSession
+			packSession, err = session.setupPackSession(execCmd)
+			run = func() uint32 {
+				packSession.HandleGitReceivePack(ctx, ch, ch)
+				return 0
+			}
+		}
+	}
 
 	if err != nil {
-		log.Println("Error setting up pack session from request: ", err)
+		log.Println("Error setting up session from request: ", err)
 		ch.Stderr().Write([]byte("Invalid request.\n"))
 
 		if req.WantReply {
@@ -158,9 +199,7 @@ func (session *ClientSession) handleSSHExec(conn *ssh.ServerConn, ch ssh.Channel
 		req.Reply(true, nil)
 	}
 
-	packSession.HandleGitReceivePack(ch, ch)
-
-	status := struct{ Status uint32 }{0}
+	status := struct{ Status uint32 }{run()}
 	_, err = ch.SendRequest("exit-status", false, ssh.Marshal(&status))
 	if err != nil {
 		log.Println("ch.SendRequest failed:", err)
@@ -168,21 +207,23 @@ func (session *ClientSession) handleSSHExec(conn *ssh.ServerConn, ch ssh.Channel
 	}
 }
 
-func (session *ClientSession) setupPackSessionFromReq(req *ssh.Request) (*GitReceiveSession, error) {
-	if len(req.Payload) < 4 {
-		return nil, errors.New("Payload too short")
+func parseExecPayload(payload []byte) (string, error) {
+	if len(payload) < 4 {
+		return "", errors.New("Payload too short")
 	}
 
-	execLen, err := parseInt32(req.Payload[:4])
+	execLen, err := parseInt32(payload[:4])
 	if err != nil {
-		return nil, fmt.Errorf("Could not parse payload: %s", err.Error())
+		return "", fmt.Errorf("Could not parse payload: %s", err.Error())
 	}
-	if len(req.Payload) != 4+int(execLen) {
-		return nil, errors.New("Payload size does not match length field")
+	if len(payload) != 4+int(execLen) {
+		return "", errors.New("Payload size does not match length field")
 	}
 
-	execCmd := string(req.Payload[4:])
+	return string(payload[4:]), nil
+}
 
+func (session *ClientSession) setupPackSession(execCmd string) (*GitReceiveSession, error) {
 	cmdParts := strings.SplitN(execCmd, " ", 2)
 	if len(cmdParts) != 2 {
 		return nil, errors.New("Expected execution of a git command with a repository as argument")
@@ -195,15 +236,51 @@ func (session *ClientSession) setupPackSessionFromReq(req *ssh.Request) (*GitRec
 		return nil, errors.New("Expected 'git-receive-pack' as the command to execute.")
 	}
 
-	packSession := NewGitReceiveSession()
-	packSession.BackingStore, err = session.client.GetRepositoryBackingStore(repoPath)
+	store, refs, err := session.openRepository(repoPath)
 	if err != nil {
-		return nil, errors.New("Error creating internal backing store")
+		return nil, err
+	}
+
+	packSession := NewGitReceiveSession()
+	packSession.BackingStore = store
+	packSession.RefStore = refs
+	packSession.LockTimeout = session.conf.LockTimeout
+	packSession.DefaultBranch = session.conf.DefaultBranch
+	packSession.RejectCaseCollisions = session.conf.RejectCaseCollisions
+	packSession.DenyNonFastForwards = session.conf.DenyNonFastForwards
+	packSession.TrashRetention = session.conf.TrashRetention
+	packSession.MaxPackSize = session.conf.MaxPackSize
+	packSession.Pusher = PusherIdentity(session.pubKey)
+	packSession.HideRefs = session.conf.HideRefs
+	if session.conf.AutoGC {
+		packSession.AutoGC = session.conf.GC
+		if packSession.AutoGC == nil {
+			packSession.AutoGC = &GCOptions{}
+		}
+	}
+	if filter, ok := session.client.(RefVisibilityClient); ok {
+		packSession.RefFilter = func(ref string, hidden bool) bool {
+			return filter.IsRefVisible(repoPath, ref, hidden)
+		}
 	}
 
 	return packSession, nil
 }
 
+// openRepository returns the backing store the client provides for repoPath,
+// along with the ref store configured for it.
+func (session *ClientSession) openRepository(repoPath string) (BackingStore, RefStore, error) {
+	store, err := session.client.GetRepositoryBackingStore(repoPath)
+	if err != nil {
+		return nil, nil, errors.New("Error creating internal backing store")
+	}
+
+	if session.conf.NewRefStore != nil {
+		return store, session.conf.NewRefStore(store), nil
+	}
+	return store, NewLooseRefStore(store), nil
+}
+
 func parseInt32(data []byte) (int32, error) {
 	var val int32
 	buf := bytes.NewReader(data)
@@ -0,0 +1,140 @@
+package gitpacklib
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// gitTestEnv keeps the git run by tests from reading the user's config, and
+// fixes who makes commits and when, so that their shas do not change.
+var gitTestEnv = []string{
+	"GIT_CONFIG_GLOBAL=/dev/null",
+	"GIT_CONFIG_NOSYSTEM=1",
+	"GIT_AUTHOR_NAME=A U Thor",
+	"GIT_AUTHOR_EMAIL=author@example.com",
+	"GIT_AUTHOR_DATE=1700000000 +0000",
+	"GIT_COMMITTER_NAME=C O Mitter",
+	"GIT_COMMITTER_EMAIL=committer@example.com",
+	"GIT_COMMITTER_DATE=1700000000 +0000",
+}
+
+// requireGit skips a test that checks its results against git when git is
+// not installed.
+func requireGit(t *testing.T) {
+	t.Helper()
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+}
+
+// runGit runs git in dir and returns its output, failing the test if git
+// fails.
+func runGit(t *testing.T, dir string, args ...string) []byte {
+	t.Helper()
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), gitTestEnv...)
+	stderr := &bytes.Buffer{}
+	cmd.Stderr = stderr
+	out, err := cmd.Output()
+	if err != nil {
+		t.Fatalf("git %s: %v\n%s", strings.Join(args, " "), err, stderr)
+	}
+	return out
+}
+
+// newGitRepository creates an empty git repository with a main branch.
+func newGitRepository(t *testing.T) string {
+	t.Helper()
+	requireGit(t)
+	dir := t.TempDir()
+	runGit(t, dir, "init", "-q", "-b", "main")
+	return dir
+}
+
+// writeFiles writes files under dir by path, after deleting those whose
+// content is nil along with the directories left empty, so that a file can
+// replace a directory.
+func writeFiles(t *testing.T, dir string, files map[string][]byte) {
+	t.Helper()
+	for name, data := range files {
+		if data != nil {
+			continue
+		}
+		path := filepath.Join(dir, name)
+		if err := os.Remove(path); err != nil {
+			t.Fatal(err)
+		}
+		for parent := filepath.Dir(path); parent != dir && os.Remove(parent) == nil; parent = filepath.Dir(parent) {
+		}
+	}
+	for name, data := range files {
+		path := filepath.Join(dir, name)
+		if data == nil {
+			continue
+		}
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// gitCommit commits all changes in the git repository in dir and returns the
+// commit's sha.
+func gitCommit(t *testing.T, dir string, message string) string {
+	t.Helper()
+	runGit(t, dir, "add", "-A")
+	runGit(t, dir, "commit", "-q", "--allow-empty", "-m", message)
+	return gitRevParse(t, dir, "HEAD")
+}
+
+func gitRevParse(t *testing.T, dir string, rev string) string {
+	t.Helper()
+	return strings.TrimSpace(string(runGit(t, dir, "rev-parse", rev)))
+}
+
+// newTestRepository returns an empty repository kept in a temporary
+// directory.
+func newTestRepository(t *testing.T) *Repository {
+	t.Helper()
+	store, err := NewFileBackingStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewRepository(store, nil)
+}
+
+// importGitObjects stores every object of the git repository in dir in repo.
+func importGitObjects(t *testing.T, repo *Repository, dir string) {
+	t.Helper()
+	ctx := context.Background()
+	out := runGit(t, dir, "cat-file", "--batch-all-objects", "--batch")
+	for len(out) > 0 {
+		end := bytes.IndexByte(out, '\n')
+		fields := strings.Fields(string(out[:end]))
+		size, err := strconv.Atoi(fields[2])
+		if err != nil {
+			t.Fatal(err)
+		}
+		data := out[end+1 : end+1+size]
+		out = out[end+1+size+1:]
+
+		sha, err := saveObject(ctx, repo.store, repo.packs, fields[1], data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if sha != fields[0] {
+			t.Fatalf("Object %s was stored as %s", fields[0], sha)
+		}
+	}
+}